@@ -0,0 +1,337 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// adminAuth requires the admin credentials. Valid upload credentials get
+// 403 instead of 401 so clients can tell "wrong account" from "not logged in".
+func (s *Server) adminAuth(w http.ResponseWriter, r *http.Request) bool {
+	err := s.checkCredentials(r, s.cfg.AdminUsername, s.cfg.AdminPassword)
+	if err == nil {
+		return true
+	}
+	if s.matchesAccount(r) {
+		s.auditLog.authFailed(r, "not the admin account")
+		writeError(w, r, http.StatusForbidden, "")
+		return false
+	}
+	s.writeAuthError(w, r, err)
+	return false
+}
+
+// adminRoutes that write are refused in read-only mode.
+var adminRoutes = []struct {
+	path    string
+	method  string
+	writes  bool
+	handler func(*Server, http.ResponseWriter, *http.Request)
+}{
+	{"/admin/delete", http.MethodPost, true, (*Server).adminDeleteHandler},
+	{"/admin/purge", http.MethodPost, true, (*Server).adminPurgeHandler},
+	{"/admin/stats", http.MethodGet, false, (*Server).adminStatsHandler},
+	{"/admin/lookup", http.MethodGet, false, (*Server).adminLookupHandler},
+	{"/admin/export", http.MethodGet, false, (*Server).adminExportHandler},
+	{"/admin/blocklist", http.MethodPost, true, (*Server).adminBlockHandler},
+	{"/admin/readonly", http.MethodPost, false, (*Server).adminReadOnlyHandler},
+}
+
+// registerAdminRoutes adds the /admin/ group, only when admin credentials
+// are configured.
+func (s *Server) registerAdminRoutes(r *mux.Router) {
+	if len(s.cfg.AdminUsername) == 0 {
+		return
+	}
+	for _, route := range adminRoutes {
+		handler := func(w http.ResponseWriter, r *http.Request) { route.handler(s, w, r) }
+		if route.writes {
+			handler = s.writable(handler)
+		}
+		path := s.cfg.route(route.path)
+		r.HandleFunc(path, func(w http.ResponseWriter, r *http.Request) {
+			if s.adminAuth(w, r) {
+				recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+				handler(recorder, r)
+				s.auditLog.admin(r, recorder.status)
+			}
+		}).Methods(route.method)
+		handleOptions(r, path)
+	}
+}
+
+type deleteResult struct {
+	Files int   `json:"files"`
+	Bytes int64 `json:"bytes"`
+	// removed are the paths of the deleted files, for the audit log.
+	removed []string
+}
+
+// deleteDays removes every file of the matching days, into the trash with
+// trash_retention, and then the emptied directories.
+func (s *Server) deleteDays(match func(day time.Time) bool) (deleteResult, error) {
+	cfg := s.cfg
+	var result deleteResult
+	var matched []storedEntry
+	err := walkStored(cfg, func(entry storedEntry) error {
+		if match(entry.Day) {
+			matched = append(matched, entry)
+		}
+		return nil
+	})
+	if err != nil {
+		return result, err
+	}
+	for _, entry := range matched {
+		dir := filepath.Dir(entry.Path)
+		size := logicalSize(cfg, dir, entry.Info)
+		err := s.removeStored(entry.Rel, entry.Path)
+		if err != nil {
+			return result, err
+		}
+		s.indexRemoved(entry.Rel)
+		s.replicateRemoved(entry.Rel)
+		s.storageStats.removed(entry.Rel, size, entry.Info.Size())
+		s.hotFiles.remove(entry.Rel)
+		result.removed = append(result.removed, entry.Rel)
+		result.Files++
+		result.Bytes += entry.Info.Size()
+		// fails until the last file of the directory is gone
+		os.Remove(dir)
+	}
+	return result, nil
+}
+
+// deleteFiles removes stored files by their path relative to UploadDir,
+// into the trash with trash_retention, and their day directory once it is
+// empty.
+func (s *Server) deleteFiles(rels []string) (deleteResult, error) {
+	cfg := s.cfg
+	var result deleteResult
+	for _, rel := range rels {
+		filePath, ok := storedRelPath(cfg, rel)
+		if !ok {
+			continue
+		}
+		diskPath, _, err := findStored(filePath)
+		var info os.FileInfo
+		var size int64
+		if err == nil {
+			info, err = os.Stat(diskPath)
+		}
+		if err == nil {
+			size = logicalSize(cfg, filepath.Dir(filePath), info)
+			err = s.removeStored(rel, diskPath)
+		}
+		if err != nil && !os.IsNotExist(err) {
+			return result, err
+		}
+		if err == nil {
+			result.Files++
+			result.Bytes += info.Size()
+			s.storageStats.removed(rel, size, info.Size())
+			result.removed = append(result.removed, rel)
+		}
+		s.hotFiles.remove(rel)
+		s.indexRemoved(rel)
+		s.replicateRemoved(rel)
+		os.Remove(filepath.Dir(filePath))
+	}
+	return result, nil
+}
+
+// adminDeleteHandler deletes every file uploaded between from and to
+// (inclusive, YYYY-MM-DD) and, with the database, carrying every given tag.
+// Without tags both bounds are required.
+func (s *Server) adminDeleteHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	tags := query["tag"]
+	if len(tags) == 0 && (len(query.Get("from")) == 0 || len(query.Get("to")) == 0) {
+		writeError(w, r, http.StatusBadRequest, "from and to, or tag, are required")
+		return
+	}
+	from, to, err := parseDayRange(query.Get("from"), query.Get("to"))
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, "Dates must be YYYY-MM-DD")
+		return
+	}
+	var result deleteResult
+	if len(tags) != 0 {
+		if s.metaIndex == nil {
+			writeError(w, r, http.StatusBadRequest, "Tags need the database")
+			return
+		}
+		var paths []string
+		paths, err = s.metaIndex.searchPaths(searchQuery{From: from, To: to, Tags: tags})
+		if err == nil {
+			result, err = s.deleteFiles(paths)
+		}
+	} else {
+		result, err = s.deleteDays(func(day time.Time) bool {
+			return dayInRange(day, from, to)
+		})
+	}
+	s.auditLog.deleted(r, result.removed)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "fail to delete files", "err", err)
+		writeError(w, r, http.StatusInternalServerError, "")
+		return
+	}
+	writeJSON(w, http.StatusOK, result)
+}
+
+// adminPurgeHandler deletes every day older than older_than, like 30d.
+func (s *Server) adminPurgeHandler(w http.ResponseWriter, r *http.Request) {
+	age, err := parseDuration(r.URL.Query().Get("older_than"))
+	if err != nil || age <= 0 {
+		writeError(w, r, http.StatusBadRequest, "older_than must be a duration like 30d")
+		return
+	}
+	now := s.cfg.now().Add(-age)
+	cutoff := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	result, err := s.deleteDays(func(day time.Time) bool {
+		return day.Before(cutoff)
+	})
+	s.auditLog.deleted(r, result.removed)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "fail to purge files", "err", err)
+		writeError(w, r, http.StatusInternalServerError, "")
+		return
+	}
+	writeJSON(w, http.StatusOK, result)
+}
+
+type dayStats struct {
+	Day   string `json:"day"`
+	Files int    `json:"files"`
+	Bytes int64  `json:"bytes"`
+	// DiskBytes is what the files take on disk, compressed or encrypted.
+	DiskBytes int64 `json:"disk_bytes"`
+}
+
+// adminStatsHandler counts files and bytes per day, optionally limited to
+// from/to.
+func (s *Server) adminStatsHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	from, to, err := parseDayRange(query.Get("from"), query.Get("to"))
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, "Dates must be YYYY-MM-DD")
+		return
+	}
+	days, err := s.collectDayStats()
+	if err != nil {
+		slog.ErrorContext(r.Context(), "fail to collect stats", "err", err)
+		writeError(w, r, http.StatusInternalServerError, "")
+		return
+	}
+	stats := struct {
+		Files       int            `json:"files"`
+		Bytes       int64          `json:"bytes"`
+		Days        []dayStats     `json:"days"`
+		Replication []replicaStats `json:"replication,omitempty"`
+	}{Days: []dayStats{}}
+	if s.replication != nil {
+		stats.Replication = s.replication.stats()
+	}
+	for _, entry := range days {
+		date, _ := time.Parse(dayLayout, entry.Day)
+		if !dayInRange(date, from, to) {
+			continue
+		}
+		stats.Files += entry.Files
+		stats.Bytes += entry.Bytes
+		stats.Days = append(stats.Days, entry)
+	}
+	writeJSON(w, http.StatusOK, stats)
+}
+
+// collectDayStats counts files per day from the index when there is one,
+// walking the upload tree otherwise.
+func (s *Server) collectDayStats() ([]dayStats, error) {
+	if s.metaIndex != nil {
+		return s.metaIndex.dayStats()
+	}
+	cfg := s.cfg
+	days := map[string]*dayStats{}
+	err := walkStored(cfg, func(entry storedEntry) error {
+		day := entry.Day.Format(dayLayout)
+		counted, ok := days[day]
+		if !ok {
+			counted = &dayStats{Day: day}
+			days[day] = counted
+		}
+		counted.Files++
+		counted.DiskBytes += entry.Info.Size()
+		counted.Bytes += logicalSize(cfg, filepath.Dir(entry.Path), entry.Info)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	stats := make([]dayStats, 0, len(days))
+	for _, counted := range days {
+		stats = append(stats, *counted)
+	}
+	sort.Slice(stats, func(i, j int) bool { return stats[i].Day < stats[j].Day })
+	return stats, nil
+}
+
+// adminLookupHandler finds a file by its stored name (uuid.ext).
+func (s *Server) adminLookupHandler(w http.ResponseWriter, r *http.Request) {
+	name := r.URL.Query().Get("name")
+	if len(name) == 0 || name != filepath.Base(name) || name[0] == '.' {
+		writeError(w, r, http.StatusBadRequest, "Invalid name")
+		return
+	}
+	if s.metaIndex != nil {
+		record, ok, err := s.metaIndex.lookupName(name)
+		if err != nil {
+			slog.ErrorContext(r.Context(), "fail to look up", "name", name, "err", err)
+			writeError(w, r, http.StatusInternalServerError, "")
+			return
+		}
+		if !ok {
+			notFoundHandler(w, r)
+			return
+		}
+		writeJSON(w, http.StatusOK, struct {
+			fileRecord
+			URL string `json:"url"`
+		}{record, publicURL(r, s.cfg, record.Path)})
+		return
+	}
+	var found *storedEntry
+	err := walkStored(s.cfg, func(entry storedEntry) error {
+		if path.Base(entry.Rel) == name {
+			found = &entry
+			return filepath.SkipAll
+		}
+		return nil
+	})
+	var info os.FileInfo
+	if err == nil && found != nil {
+		info, err = statStored(s.cfg, filepath.Join(s.cfg.UploadDir, filepath.FromSlash(found.Rel)))
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "fail to look up", "name", name, "err", err)
+		writeError(w, r, http.StatusInternalServerError, "")
+		return
+	}
+	if found == nil {
+		notFoundHandler(w, r)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{
+		"path":     found.Rel,
+		"url":      publicURL(r, s.cfg, found.Rel),
+		"size":     info.Size(),
+		"modified": info.ModTime().UTC(),
+	})
+}
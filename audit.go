@@ -0,0 +1,237 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	auditUpload      = "upload"
+	auditReplace     = "replace"
+	auditDelete      = "delete"
+	auditRestore     = "restore"
+	auditAdmin       = "admin"
+	auditAuthFailure = "auth_failure"
+	auditBlocked     = "blocked"
+)
+
+// auditEvent is one line of audit_log. prev is the sha256 of the line
+// before it, so a removed or edited line breaks the chain.
+type auditEvent struct {
+	Time         string `json:"time"`
+	Action       string `json:"action"`
+	User         string `json:"user,omitempty"`
+	IP           string `json:"ip"`
+	RequestID    string `json:"request_id,omitempty"`
+	Method       string `json:"method,omitempty"`
+	Target       string `json:"target,omitempty"`
+	Status       int    `json:"status,omitempty"`
+	Path         string `json:"path,omitempty"`
+	OriginalName string `json:"original_name,omitempty"`
+	Size         *int64 `json:"size,omitempty"`
+	SHA256       string `json:"sha256,omitempty"`
+	Reason       string `json:"reason,omitempty"`
+	Prev         string `json:"prev"`
+}
+
+// auditQueue is how many events wait for the writer before the next ones
+// are dropped.
+const auditQueue = 1024
+
+// auditLogger appends events to audit_log from a single goroutine, so
+// lines of concurrent requests never interleave. A failed write is logged
+// and the request goes on, and so does a request finding the queue full or
+// the logger closed: its event is dropped, counted and logged.
+type auditLogger struct {
+	cfg    *config
+	file   *logFile
+	events chan auditEvent
+	done   chan struct{}
+	// mu guards closed and dropped, and sends against the close of events.
+	mu      sync.Mutex
+	closed  bool
+	dropped int64
+}
+
+func openAuditLog(cfg *config) (*auditLogger, error) {
+	file, err := openLogFile(cfg.AuditLog, 0, 0)
+	if err != nil {
+		return nil, err
+	}
+	a := &auditLogger{cfg: cfg, file: file, events: make(chan auditEvent, auditQueue), done: make(chan struct{})}
+	go a.run()
+	return a, nil
+}
+
+// lastAuditHash is the hash of the last line of an existing audit log,
+// for carrying on its chain.
+func lastAuditHash(path string) (string, error) {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return "", err
+	}
+	offset := max(info.Size()-64<<10, 0)
+	tail := make([]byte, info.Size()-offset)
+	_, err = file.ReadAt(tail, offset)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return "", err
+	}
+	tail = bytes.TrimRight(tail, "\n")
+	if len(tail) == 0 {
+		return "", nil
+	}
+	return auditHash(tail[bytes.LastIndexByte(tail, '\n')+1:]), nil
+}
+
+func auditHash(line []byte) string {
+	sum := sha256.Sum256(line)
+	return hex.EncodeToString(sum[:])
+}
+
+// run writes the events. The chain goes on from the last line of the log,
+// read once the process handing over, if any, has closed it.
+func (a *auditLogger) run() {
+	defer close(a.done)
+	<-handoverDone()
+	prev, err := lastAuditHash(a.cfg.AuditLog)
+	if err != nil {
+		slog.Error("fail to read the audit log, its chain starts over", "path", a.cfg.AuditLog, "err", err)
+	}
+	for event := range a.events {
+		event.Prev = prev
+		line, _ := json.Marshal(event)
+		_, err := a.file.Write(append(line, '\n'))
+		if err != nil {
+			slog.Error("fail to write audit log", "path", a.cfg.AuditLog, "action", event.Action, "err", err)
+			continue
+		}
+		prev = auditHash(line)
+	}
+}
+
+// send queues event without ever waiting.
+func (a *auditLogger) send(event auditEvent) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if !a.closed {
+		select {
+		case a.events <- event:
+			return
+		default:
+		}
+	}
+	a.dropped++
+	slog.Error("audit event dropped", "action", event.Action, "path", event.Path, "closed", a.closed, "dropped", a.dropped)
+}
+
+// close writes the queued events and stops. Events sent after it are
+// dropped, like those of requests outliving a shutdown that timed out.
+func (a *auditLogger) close() {
+	if a == nil {
+		return
+	}
+	a.mu.Lock()
+	if !a.closed {
+		a.closed = true
+		close(a.events)
+	}
+	a.mu.Unlock()
+	<-a.done
+}
+
+// event fills in who sent r and when.
+func (a *auditLogger) event(r *http.Request, action string) auditEvent {
+	return auditEvent{
+		Time:      a.cfg.now().Format(time.RFC3339Nano),
+		Action:    action,
+		User:      requestUsername(r, a.cfg),
+		IP:        clientIP(r, a.cfg).String(),
+		RequestID: requestInfoOf(r).ID,
+	}
+}
+
+func (a *auditLogger) uploaded(r *http.Request, stored storedFile) {
+	a.stored(r, auditUpload, stored)
+}
+
+// replaced records new content put over an existing file.
+func (a *auditLogger) replaced(r *http.Request, stored storedFile) {
+	a.stored(r, auditReplace, stored)
+}
+func (a *auditLogger) stored(r *http.Request, action string, stored storedFile) {
+	if a == nil {
+		return
+	}
+	event := a.event(r, action)
+	event.Path, event.OriginalName, event.Size, event.SHA256 = stored.Rel, stored.OriginalName, &stored.Size, stored.SHA256
+	a.send(event)
+}
+
+func (a *auditLogger) deleted(r *http.Request, rels []string) {
+	if a == nil {
+		return
+	}
+	for _, rel := range rels {
+		event := a.event(r, auditDelete)
+		event.Path = rel
+		a.send(event)
+	}
+}
+
+// restored records a file moved back from the trash.
+func (a *auditLogger) restored(r *http.Request, rel string) {
+	if a == nil {
+		return
+	}
+	event := a.event(r, auditRestore)
+	event.Path = rel
+	a.send(event)
+}
+
+// blocked records an upload refused by the blocklist.
+func (a *auditLogger) blocked(r *http.Request, digest string) {
+	if a == nil {
+		return
+	}
+	event := a.event(r, auditBlocked)
+	event.SHA256 = digest
+	a.send(event)
+}
+
+// admin records an /admin/ request and its status.
+func (a *auditLogger) admin(r *http.Request, status int) {
+	if a == nil {
+		return
+	}
+	event := a.event(r, auditAdmin)
+	event.Method, event.Target, event.Status = r.Method, r.URL.RequestURI(), status
+	a.send(event)
+}
+
+// authFailed records rejected credentials. Requests without any, like the
+// first one of a browser, and stale Digest nonces aren't attempts.
+func (a *auditLogger) authFailed(r *http.Request, reason string) {
+	if a == nil || len(r.Header.Get("Authorization")) == 0 {
+		return
+	}
+	event := a.event(r, auditAuthFailure)
+	event.Method, event.Target, event.Reason = r.Method, r.URL.RequestURI(), reason
+	a.send(event)
+}
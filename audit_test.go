@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestAuditLog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	cfg := testConfig(t, "audit_log: "+path+"\nadmin_username: admin\nadmin_password: secret\n")
+	server := testServer(t, cfg)
+	routes := server.Routes()
+
+	var wg sync.WaitGroup
+	for range 20 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			testUpload(t, routes, "notes.txt", "hello", nil)
+		}()
+	}
+	wg.Wait()
+	req := httptest.NewRequest(http.MethodPost, "/upload", nil)
+	req.SetBasicAuth("u", "wrong")
+	routes.ServeHTTP(httptest.NewRecorder(), req)
+	// no credentials at all is not an attempt
+	routes.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/upload", nil))
+	today := cfg.today().Format(dayLayout)
+	req = httptest.NewRequest(http.MethodPost, "/admin/delete?from="+today+"&to="+today, nil)
+	req.SetBasicAuth("admin", "secret")
+	routes.ServeHTTP(httptest.NewRecorder(), req)
+	server.auditLog.close()
+
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	counts := map[string]int{}
+	prev := ""
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var event auditEvent
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			t.Fatalf("line %q: %v", scanner.Text(), err)
+		}
+		if event.Prev != prev {
+			t.Errorf("line %q doesn't chain to the one before", scanner.Text())
+		}
+		prev = auditHash(scanner.Bytes())
+		counts[event.Action]++
+		switch event.Action {
+		case auditUpload:
+			if event.User != "u" || event.OriginalName != "notes.txt" || event.Size == nil || *event.Size != 5 || len(event.SHA256) != 64 || len(event.RequestID) == 0 || len(event.IP) == 0 {
+				t.Errorf("upload event %q", scanner.Text())
+			}
+		case auditAuthFailure:
+			if event.User != "u" || !strings.Contains(event.Reason, "invalid credentials") {
+				t.Errorf("auth failure event %q", scanner.Text())
+			}
+		case auditAdmin:
+			if event.User != "admin" || event.Status != http.StatusOK || !strings.HasPrefix(event.Target, "/admin/delete") {
+				t.Errorf("admin event %q", scanner.Text())
+			}
+		}
+	}
+	if counts[auditUpload] != 20 || counts[auditDelete] != 20 || counts[auditAuthFailure] != 1 || counts[auditAdmin] != 1 {
+		t.Errorf("events %v", counts)
+	}
+
+	// a restart carries on the chain
+	reopened, err := openAuditLog(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reopened.send(auditEvent{Action: auditAdmin})
+	reopened.close()
+	content, _ := os.ReadFile(path)
+	lines := strings.Split(strings.TrimSpace(string(content)), "\n")
+	var event auditEvent
+	if err := json.Unmarshal([]byte(lines[len(lines)-1]), &event); err != nil || event.Prev != prev {
+		t.Errorf("the first line after a restart has prev %q, want %q: %v", event.Prev, prev, err)
+	}
+
+	// sends never wait, neither on a full queue nor after close
+	reopened.send(auditEvent{Action: auditAdmin})
+	full := &auditLogger{cfg: cfg, events: make(chan auditEvent, 1)}
+	full.send(auditEvent{Action: auditAdmin})
+	full.send(auditEvent{Action: auditAdmin})
+	if reopened.dropped != 1 || full.dropped != 1 {
+		t.Errorf("dropped %d after close, %d on a full queue", reopened.dropped, full.dropped)
+	}
+}
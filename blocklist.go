@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// blocklistRecheck is how long the blocklist is used without a stat, to
+// notice edits of blocklist_file.
+const blocklistRecheck = time.Second
+
+// blockedError is an upload whose sha256 is on the blocklist, answered with
+// 451 without saying why.
+type blockedError string
+
+func (e blockedError) Error() string {
+	return "blocked content " + string(e)
+}
+
+// hashBlocklist is the set of sha256 digests of blocklist_file, one hex
+// digest per line, "#" comments and blank lines ignored. It is read again
+// when the file's mtime changes and on SIGHUP.
+type hashBlocklist struct {
+	mu      sync.Mutex
+	path    string
+	digests map[string]bool
+	modTime time.Time
+	checked time.Time
+}
+
+func loadBlocklist(path string) (*hashBlocklist, error) {
+	b := &hashBlocklist{path: path}
+	err := b.reload()
+	if err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// reload reads the file again. A missing file is an empty list, a failed
+// read keeps the digests loaded before.
+func (b *hashBlocklist) reload() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.reloadLocked()
+}
+func (b *hashBlocklist) reloadLocked() error {
+	b.checked = time.Now()
+	file, err := os.Open(b.path)
+	if os.IsNotExist(err) {
+		b.digests, b.modTime = map[string]bool{}, time.Time{}
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("fail to open blocklist_file\n%w", err)
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	digests := map[string]bool{}
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if len(text) == 0 || strings.HasPrefix(text, "#") {
+			continue
+		}
+		digest, ok := parseSHA256(text)
+		if !ok {
+			return fmt.Errorf("blocklist_file line %d: %q is not a hex sha256", line, text)
+		}
+		digests[digest] = true
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	b.digests, b.modTime = digests, info.ModTime()
+	return nil
+}
+
+// parseSHA256 lowercases a hex sha256, false when it isn't one.
+func parseSHA256(text string) (string, bool) {
+	text = strings.ToLower(strings.TrimSpace(text))
+	decoded, err := hex.DecodeString(text)
+	return text, err == nil && len(decoded) == 32
+}
+
+// blocked reports whether digest is listed, reloading an edited file first.
+func (b *hashBlocklist) blocked(digest string) bool {
+	if b == nil {
+		return false
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if time.Since(b.checked) > blocklistRecheck {
+		info, err := os.Stat(b.path)
+		switch {
+		case err == nil && !info.ModTime().Equal(b.modTime), os.IsNotExist(err) && !b.modTime.IsZero():
+			if err := b.reloadLocked(); err != nil {
+				slog.Error("fail to reload the blocklist, keeping the old one", "err", err)
+			}
+		}
+		b.checked = time.Now()
+	}
+	return b.digests[digest]
+}
+
+// add appends digest to the file, reporting false when it was listed.
+func (b *hashBlocklist) add(digest string) (bool, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.digests[digest] {
+		return false, nil
+	}
+	file, err := os.OpenFile(b.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return false, err
+	}
+	_, err = fmt.Fprintln(file, digest)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return false, err
+	}
+	b.digests[digest] = true
+	if info, err := os.Stat(b.path); err == nil {
+		b.modTime = info.ModTime()
+	}
+	return true, nil
+}
+
+// reloadOnSignal reads the blocklist again on every SIGHUP, forever.
+func (b *hashBlocklist) reloadOnSignal() {
+	for range reopenSignal() {
+		err := b.reload()
+		if err != nil {
+			slog.Error("fail to reload the blocklist, keeping the old one", "err", err)
+			continue
+		}
+		slog.Info("blocklist reloaded", "path", b.path, "digests", len(b.digests))
+	}
+}
+
+// adminBlockHandler adds the sha256 query digest to the blocklist, and with
+// delete=1 deletes the files the database knows with it.
+func (s *Server) adminBlockHandler(w http.ResponseWriter, r *http.Request) {
+	if s.blocklist == nil {
+		writeError(w, r, http.StatusBadRequest, "The blocklist needs blocklist_file")
+		return
+	}
+	query := r.URL.Query()
+	digest, ok := parseSHA256(query.Get("sha256"))
+	if !ok {
+		writeError(w, r, http.StatusBadRequest, "sha256 must be 64 hex digits")
+		return
+	}
+	deleteCopies := query.Get("delete") == "1"
+	if deleteCopies && s.metaIndex == nil {
+		writeError(w, r, http.StatusBadRequest, "delete needs the database")
+		return
+	}
+	added, err := s.blocklist.add(digest)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "fail to add to the blocklist", "sha256", digest, "err", err)
+		writeError(w, r, http.StatusInternalServerError, "")
+		return
+	}
+	result := struct {
+		Added bool `json:"added"`
+		deleteResult
+	}{Added: added}
+	if deleteCopies {
+		var paths []string
+		paths, err = s.metaIndex.pathsWithSHA256(digest)
+		if err == nil {
+			result.deleteResult, err = s.deleteFiles(paths)
+		}
+		s.auditLog.deleted(r, result.removed)
+		if err != nil {
+			slog.ErrorContext(r.Context(), "fail to delete blocked files", "sha256", digest, "err", err)
+			writeError(w, r, http.StatusInternalServerError, "")
+			return
+		}
+	}
+	writeJSON(w, http.StatusOK, result)
+}
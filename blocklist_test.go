@@ -0,0 +1,66 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestBlocklist(t *testing.T) {
+	dir := t.TempDir()
+	listPath := filepath.Join(dir, "blocklist.txt")
+	os.WriteFile(listPath, []byte("# taken down\n"), 0o644)
+	cfg := testConfig(t, "blocklist_file: "+listPath+"\ndatabase: "+filepath.Join(dir, "index.db")+"\nadmin_username: admin\nadmin_password: secret\n")
+	server := testServer(t, cfg)
+	routes := server.Routes()
+
+	res := testUpload(t, routes, "bad.txt", "abusive", nil)
+	if res.Code != http.StatusCreated {
+		t.Fatalf("upload status %d: %s", res.Code, res.Body)
+	}
+	sum := sha256.Sum256([]byte("abusive"))
+	digest := hex.EncodeToString(sum[:])
+	req := httptest.NewRequest(http.MethodPost, "/admin/blocklist?delete=1&sha256="+digest, nil)
+	req.SetBasicAuth("admin", "secret")
+	block := httptest.NewRecorder()
+	routes.ServeHTTP(block, req)
+	var result struct {
+		Added bool `json:"added"`
+		Files int  `json:"files"`
+	}
+	if err := json.Unmarshal(block.Body.Bytes(), &result); err != nil || !result.Added || result.Files != 1 {
+		t.Fatalf("block status %d: %s", block.Code, block.Body)
+	}
+	if got := storedFiles(t, cfg); got != 0 {
+		t.Errorf("%d files left after the block", got)
+	}
+
+	res = testUpload(t, routes, "again.txt", "abusive", nil)
+	if res.Code != http.StatusUnavailableForLegalReasons {
+		t.Errorf("blocked upload status %d: %s", res.Code, res.Body)
+	}
+	if res := testUpload(t, routes, "fine.txt", "fine", nil); res.Code != http.StatusCreated {
+		t.Errorf("other upload status %d: %s", res.Code, res.Body)
+	}
+
+	// an edit of the file is picked up by its mtime
+	fine := sha256.Sum256([]byte("fine"))
+	os.WriteFile(listPath, []byte(hex.EncodeToString(fine[:])+"\n"), 0o644)
+	os.Chtimes(listPath, time.Now(), time.Now().Add(time.Minute))
+	server.blocklist.checked = time.Time{}
+	if res := testUpload(t, routes, "fine.txt", "fine", nil); res.Code != http.StatusUnavailableForLegalReasons {
+		t.Errorf("newly listed upload status %d: %s", res.Code, res.Body)
+	}
+	if res := testUpload(t, routes, "again.txt", "abusive", nil); res.Code != http.StatusCreated {
+		t.Errorf("unlisted upload status %d: %s", res.Code, res.Body)
+	}
+	if got := storedFiles(t, cfg); got != 2 {
+		t.Errorf("%d files, want the two allowed uploads", got)
+	}
+}
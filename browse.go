@@ -0,0 +1,179 @@
+package main
+
+import (
+	"html/template"
+	"log/slog"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	defaultBrowsePerPage = 100
+	maxBrowsePerPage     = 1000
+)
+
+// browseRoute lists the files of one day, with or without the slash.
+const browseRoute = "/browse/{year:[0-9]{4}}/{month:[0-9]{2}}/{day:[0-9]{2}}"
+
+type browseFile struct {
+	Name     string    `json:"name"`
+	Size     int64     `json:"size"`
+	Modified time.Time `json:"modified"`
+	URL      string    `json:"url"`
+	Trashed  bool      `json:"trashed,omitempty"`
+}
+
+type browseListing struct {
+	Day     string       `json:"day"`
+	Files   []browseFile `json:"files"`
+	Page    int          `json:"page"`
+	PerPage int          `json:"per_page"`
+	Total   int          `json:"total"`
+}
+
+// registerBrowse adds the day listings when browse_enabled is set.
+func (s *Server) registerBrowse(r *mux.Router) {
+	if !s.cfg.BrowseEnabled {
+		return
+	}
+	for _, path := range []string{s.cfg.route(browseRoute), s.cfg.route(browseRoute) + "/"} {
+		r.HandleFunc(path, s.browseHandler).Methods(http.MethodGet, http.MethodHead)
+		handleOptions(r, path)
+	}
+}
+
+// browseHandler lists a day of the client's namespace, newest first, as an
+// HTML table or JSON for Accept: application/json. A day without uploads is
+// an empty listing, include_trashed=1 adds the deleted files of the trash.
+func (s *Server) browseHandler(w http.ResponseWriter, r *http.Request) {
+	err := s.basicAuth(r)
+	if err != nil {
+		s.writeAuthError(w, r, err)
+		return
+	}
+	vars := mux.Vars(r)
+	date, err := time.Parse(dayLayout, vars["year"]+"-"+vars["month"]+"-"+vars["day"])
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, "Not a date")
+		return
+	}
+	listing := browseListing{Day: date.Format(dayLayout), Files: []browseFile{}, Page: 1, PerPage: defaultBrowsePerPage}
+	query := r.URL.Query()
+	if value := query.Get("page"); len(value) != 0 {
+		listing.Page, err = strconv.Atoi(value)
+		if err != nil || listing.Page < 1 {
+			writeError(w, r, http.StatusBadRequest, "page must be a positive number")
+			return
+		}
+	}
+	if value := query.Get("per_page"); len(value) != 0 {
+		listing.PerPage, err = strconv.Atoi(value)
+		if err != nil || listing.PerPage < 1 {
+			writeError(w, r, http.StatusBadRequest, "per_page must be a positive number")
+			return
+		}
+		listing.PerPage = min(listing.PerPage, maxBrowsePerPage)
+	}
+	// the route only matches digits, this can't leave upload_dir
+	rel := date.Format("2006/01/02")
+	if namespace := requestNamespace(r, s.cfg); len(namespace) != 0 {
+		rel = namespace + "/" + rel
+	}
+	dir := filepath.Join(s.cfg.UploadDir, filepath.FromSlash(rel))
+	files, err := dayFiles(dir)
+	if err != nil && !os.IsNotExist(err) {
+		slog.ErrorContext(r.Context(), "fail to list day", "path", rel, "err", err)
+		writeError(w, r, http.StatusInternalServerError, "")
+		return
+	}
+	type dayFile struct {
+		info    os.FileInfo
+		dir     string
+		trashed bool
+	}
+	var listed []dayFile
+	for _, file := range files {
+		if name, _ := storedName(file.Name()); validStoredName(name) {
+			listed = append(listed, dayFile{file, dir, false})
+		}
+	}
+	// with include_trashed=1 the day's files in the trash too
+	if query.Get("include_trashed") == "1" && s.cfg.TrashRetention > 0 {
+		err = walkTrash(s.cfg, rel, func(file trashedFile) error {
+			if path.Dir(file.rel) == rel {
+				listed = append(listed, dayFile{file.info, filepath.Dir(file.diskPath), true})
+			}
+			return nil
+		})
+		if err != nil {
+			slog.ErrorContext(r.Context(), "fail to list the trash", "path", rel, "err", err)
+			writeError(w, r, http.StatusInternalServerError, "")
+			return
+		}
+	}
+	slices.SortFunc(listed, func(a, b dayFile) int {
+		return b.info.ModTime().Compare(a.info.ModTime())
+	})
+	listing.Total = len(listed)
+	start := min((listing.Page-1)*listing.PerPage, len(listed))
+	for _, file := range listed[start:min(start+listing.PerPage, len(listed))] {
+		name, _ := storedName(file.info.Name())
+		listing.Files = append(listing.Files, browseFile{
+			Name:     name,
+			Size:     logicalSize(s.cfg, file.dir, file.info),
+			Modified: file.info.ModTime().In(s.cfg.now().Location()),
+			URL:      publicURL(r, s.cfg, rel+"/"+name),
+			Trashed:  file.trashed,
+		})
+	}
+	w.Header().Set("Vary", "Accept")
+	w.Header().Set("Cache-Control", "private, no-store")
+	if prefersJSON(r) {
+		writeJSON(w, http.StatusOK, listing)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	setHeader(w.Header(), "Content-Security-Policy", viewContentSecurityPolicy)
+	w.WriteHeader(http.StatusOK)
+	if r.Method == http.MethodHead {
+		return
+	}
+	page := struct {
+		browseListing
+		Prev, Next int
+	}{browseListing: listing}
+	if listing.Page > 1 {
+		page.Prev = listing.Page - 1
+	}
+	if start+listing.PerPage < listing.Total {
+		page.Next = listing.Page + 1
+	}
+	browseView.Execute(w, page)
+}
+
+var browseView = template.Must(template.New("browse").Funcs(template.FuncMap{"bytes": formatBytes}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>{{.Day}}</title>
+<style>body{margin:1em;font:14px/1.5 sans-serif}table{border-collapse:collapse}th,td{padding:.2em 1em .2em 0;text-align:left}td.size{text-align:right}</style>
+</head>
+<body>
+<h1>{{.Day}}</h1>
+<p>{{.Total}} files{{if gt .Total (len .Files)}}, page {{.Page}}{{end}}</p>
+<table>
+<tr><th>name</th><th>size</th><th>modified</th></tr>
+{{range .Files}}<tr><td><a href="{{.URL}}">{{.Name}}</a>{{if .Trashed}} (deleted){{end}}</td><td class="size">{{bytes .Size}}</td><td>{{.Modified.Format "2006-01-02 15:04:05"}}</td></tr>
+{{end}}</table>
+<p>{{if .Prev}}<a href="?page={{.Prev}}&amp;per_page={{.PerPage}}">previous</a> {{end}}{{if .Next}}<a href="?page={{.Next}}&amp;per_page={{.PerPage}}">next</a>{{end}}</p>
+</body>
+</html>
+`))
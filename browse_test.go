@@ -0,0 +1,56 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestBrowse(t *testing.T) {
+	cfg := testConfig(t, "browse_enabled: true\n")
+	routes := testServer(t, cfg).Routes()
+	for i := range 3 {
+		writeDayFile(t, cfg, fmt.Sprintf("0000000%d-0000-4000-8000-000000000000.txt", i), "abc")
+	}
+	writeDayFile(t, cfg, ".tmp-partial", "x")
+	get := func(path, accept string, auth bool) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		if len(accept) != 0 {
+			req.Header.Set("Accept", accept)
+		}
+		if auth {
+			req.SetBasicAuth("u", "p")
+		}
+		res := httptest.NewRecorder()
+		routes.ServeHTTP(res, req)
+		return res
+	}
+
+	res := get("/browse/2026/10/14/", "text/html", true)
+	if res.Code != http.StatusOK || !strings.Contains(res.Body.String(), `href="http://example.com/i/2026/10/14/00000001-0000-4000-8000-000000000000.txt"`) || strings.Contains(res.Body.String(), "partial") {
+		t.Errorf("html status %d: %s", res.Code, res.Body)
+	}
+	var listing browseListing
+	res = get("/browse/2026/10/14?per_page=2&page=2", "application/json", true)
+	if err := json.Unmarshal(res.Body.Bytes(), &listing); err != nil || listing.Total != 3 || len(listing.Files) != 1 || listing.Files[0].Size != 3 {
+		t.Errorf("json page 2 %d: %s", res.Code, res.Body)
+	}
+	res = get("/browse/2020/01/01", "application/json", true)
+	if err := json.Unmarshal(res.Body.Bytes(), &listing); err != nil || res.Code != http.StatusOK || listing.Total != 0 || listing.Files == nil {
+		t.Errorf("empty day %d: %s", res.Code, res.Body)
+	}
+	if res := get("/browse/2026/10/14", "", false); res.Code != http.StatusUnauthorized {
+		t.Errorf("without credentials %d", res.Code)
+	}
+	if res := get("/browse/2026/13/45", "", true); res.Code != http.StatusBadRequest {
+		t.Errorf("bad date %d", res.Code)
+	}
+
+	routes = testServer(t, testConfig(t, "")).Routes()
+	if res := get("/browse/2026/10/14", "", true); res.Code != http.StatusNotFound {
+		t.Errorf("disabled browse %d", res.Code)
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sync"
+)
+
+const (
+	defaultCopyBufferSize = 256 << 10
+	minCopyBufferSize     = 4 << 10
+	maxCopyBufferSize     = 16 << 20
+)
+
+// bufferPool reuses copy buffers across requests. A buffer is zeroed
+// before it goes back, so no copy can pass on what an earlier one read.
+type bufferPool struct {
+	size int
+	pool sync.Pool
+}
+
+func newBufferPool(size int) *bufferPool {
+	p := &bufferPool{size: size}
+	p.pool.New = func() any {
+		buf := make([]byte, size)
+		return &buf
+	}
+	return p
+}
+
+// copy is io.Copy through a pooled buffer. A WriterTo src or ReaderFrom
+// dst would bring a 32KB buffer of their own, so they are hidden.
+func (p *bufferPool) copy(dst io.Writer, src io.Reader) (int64, error) {
+	if _, ok := src.(io.WriterTo); ok {
+		src = struct{ io.Reader }{src}
+	}
+	if _, ok := dst.(io.ReaderFrom); ok {
+		dst = struct{ io.Writer }{dst}
+	}
+	buf := p.pool.Get().(*[]byte)
+	defer p.release(buf)
+	return io.CopyBuffer(dst, src, *buf)
+}
+
+func (p *bufferPool) release(buf *[]byte) {
+	clear(*buf)
+	p.pool.Put(buf)
+}
+
+// validateCopyBuffer checks copy_buffer_size.
+func (c *config) validateCopyBuffer() []error {
+	if c.CopyBufferSize == 0 {
+		c.CopyBufferSize = defaultCopyBufferSize
+	}
+	if c.CopyBufferSize < minCopyBufferSize || c.CopyBufferSize > maxCopyBufferSize {
+		return []error{fmt.Errorf("copy_buffer_size %d must be between 4KB and 16MB", int64(c.CopyBufferSize))}
+	}
+	return nil
+}
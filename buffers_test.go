@@ -0,0 +1,52 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestBufferPoolZeroes(t *testing.T) {
+	pool := newBufferPool(minCopyBufferSize)
+	var out bytes.Buffer
+	n, err := pool.copy(&out, strings.NewReader("secret upload"))
+	if err != nil || n != 13 || out.String() != "secret upload" {
+		t.Fatalf("copied %d %q: %v", n, out.String(), err)
+	}
+	buf := pool.pool.Get().(*[]byte)
+	if len(*buf) != minCopyBufferSize || bytes.Contains(*buf, []byte("secret")) {
+		t.Errorf("pooled buffer of %d keeps the last copy", len(*buf))
+	}
+}
+
+// zeros is an endless upload body.
+type zeros struct{}
+
+func (zeros) Read(p []byte) (int, error) {
+	clear(p)
+	return len(p), nil
+}
+
+// BenchmarkCopy compares io.Copy to the pooled copy of storeUpload, into a
+// sha256 like an upload, run with -benchmem to see the allocations.
+func BenchmarkCopy(b *testing.B) {
+	pool := newBufferPool(defaultCopyBufferSize)
+	copies := map[string]func(io.Writer, io.Reader) (int64, error){"io.Copy": io.Copy, "pool": pool.copy}
+	for _, size := range []int64{1 << 20, 100 << 20, 1 << 30} {
+		for _, name := range []string{"io.Copy", "pool"} {
+			b.Run(fmt.Sprintf("%s/%dMB", name, size>>20), func(b *testing.B) {
+				b.SetBytes(size)
+				b.ReportAllocs()
+				for b.Loop() {
+					_, err := copies[name](sha256.New(), io.LimitReader(zeros{}, size))
+					if err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		}
+	}
+}
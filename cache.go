@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+	"mime"
+	"strings"
+)
+
+// defaultCacheControl is the header sent when no cache_control block is
+// configured, kept identical to the historical hardcoded value.
+const defaultCacheControl = "public, max-age=315360000"
+
+// cacheControlConfig maps content to Cache-Control policies. Override keys
+// are either an extension (".txt"), an exact MIME type ("text/html") or a
+// MIME prefix ("image/*"). Values use a short policy syntax:
+//
+//	no-store | no-cache | <duration> [private] [immutable]
+//
+// where duration accepts time.ParseDuration units plus d, w and y.
+type cacheControlConfig struct {
+	Default   string            `yaml:"default" json:"default" toml:"default"`
+	Overrides map[string]string `yaml:"overrides" json:"overrides" toml:"overrides"`
+
+	defaultHeader string
+	byExt         map[string]string
+	byType        map[string]string
+	byPrefix      map[string]string
+}
+
+func (c *cacheControlConfig) compile() error {
+	c.defaultHeader = defaultCacheControl
+	if len(c.Default) != 0 {
+		header, err := parseCachePolicy(c.Default)
+		if err != nil {
+			return fmt.Errorf("invalid default cache policy\n%w", err)
+		}
+		c.defaultHeader = header
+	}
+	c.byExt = map[string]string{}
+	c.byType = map[string]string{}
+	c.byPrefix = map[string]string{}
+	for key, value := range c.Overrides {
+		header, err := parseCachePolicy(value)
+		if err != nil {
+			return fmt.Errorf("invalid cache policy for %q\n%w", key, err)
+		}
+		key = strings.ToLower(strings.TrimSpace(key))
+		switch {
+		case strings.HasPrefix(key, "."):
+			c.byExt[key] = header
+		case strings.HasSuffix(key, "/*"):
+			c.byPrefix[strings.TrimSuffix(key, "/*")] = header
+		case strings.Contains(key, "/"):
+			c.byType[key] = header
+		default:
+			return fmt.Errorf("invalid cache policy key %q, want .ext, type/subtype or type/*", key)
+		}
+	}
+	return nil
+}
+
+// header returns the Cache-Control value for a file. Extension overrides win
+// over exact MIME types, which win over MIME prefixes.
+func (c *cacheControlConfig) header(ext, contentType string) string {
+	if header, ok := c.byExt[strings.ToLower(ext)]; ok {
+		return header
+	}
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err == nil {
+		if header, ok := c.byType[mediaType]; ok {
+			return header
+		}
+		major, _, _ := strings.Cut(mediaType, "/")
+		if header, ok := c.byPrefix[major]; ok {
+			return header
+		}
+	}
+	if len(c.defaultHeader) == 0 {
+		return defaultCacheControl
+	}
+	return c.defaultHeader
+}
+func parseCachePolicy(policy string) (string, error) {
+	fields := strings.Fields(strings.ToLower(policy))
+	if len(fields) == 0 {
+		return "", fmt.Errorf("empty cache policy")
+	}
+	switch fields[0] {
+	case "no-store", "no-cache":
+		if len(fields) > 1 {
+			return "", fmt.Errorf("%s takes no options", fields[0])
+		}
+		return fields[0], nil
+	}
+	maxAge, err := parseDuration(fields[0])
+	if err != nil {
+		return "", err
+	}
+	scope := "public"
+	immutable := false
+	for _, field := range fields[1:] {
+		switch field {
+		case "private":
+			scope = "private"
+		case "immutable":
+			immutable = true
+		default:
+			return "", fmt.Errorf("unknown cache policy option %q", field)
+		}
+	}
+	header := fmt.Sprintf("%s, max-age=%d", scope, int64(maxAge.Seconds()))
+	if immutable {
+		header += ", immutable"
+	}
+	return header, nil
+}
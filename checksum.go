@@ -0,0 +1,63 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+)
+
+// digestCheck verifies the stored bytes against digests supplied by the
+// client in X-Content-SHA256 (hex) and Content-MD5 (base64 or hex).
+type digestCheck struct {
+	name     string
+	expected []byte
+	hash     hash.Hash
+}
+
+func parseDigestHeaders(h http.Header) ([]*digestCheck, error) {
+	var checks []*digestCheck
+	if value := h.Get("X-Content-SHA256"); len(value) != 0 {
+		expected, err := hex.DecodeString(value)
+		if err != nil || len(expected) != sha256.Size {
+			return nil, fmt.Errorf("X-Content-SHA256 must be %d hex characters", sha256.Size*2)
+		}
+		checks = append(checks, &digestCheck{name: "sha256", expected: expected, hash: sha256.New()})
+	}
+	if value := h.Get("Content-MD5"); len(value) != 0 {
+		expected, err := base64.StdEncoding.DecodeString(value)
+		if err != nil || len(expected) != md5.Size {
+			expected, err = hex.DecodeString(value)
+		}
+		if err != nil || len(expected) != md5.Size {
+			return nil, fmt.Errorf("Content-MD5 must be a base64 or hex encoded %d byte digest", md5.Size)
+		}
+		checks = append(checks, &digestCheck{name: "md5", expected: expected, hash: md5.New()})
+	}
+	return checks, nil
+}
+
+// digestWriter fans the copied bytes out to every check's hash.
+func digestWriter(dst io.Writer, checks []*digestCheck) io.Writer {
+	writers := []io.Writer{dst}
+	for _, check := range checks {
+		writers = append(writers, check.hash)
+	}
+	return io.MultiWriter(writers...)
+}
+
+// verifyDigests returns a description of the first mismatch, if any.
+func verifyDigests(checks []*digestCheck) (string, bool) {
+	for _, check := range checks {
+		actual := check.hash.Sum(nil)
+		if !bytes.Equal(actual, check.expected) {
+			return fmt.Sprintf("%s mismatch: expected %x, got %x", check.name, check.expected, actual), false
+		}
+	}
+	return "", true
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// clientConfig is read from ~/.config/file/client.yaml; flags and the
+// FILE_SERVER, FILE_USERNAME and FILE_PASSWORD variables override it.
+type clientConfig struct {
+	Server   string `yaml:"server"`
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+	// UploadPath is the server's upload_path, the server url includes its
+	// route_prefix.
+	UploadPath string `yaml:"upload_path"`
+}
+
+type uploadResult struct {
+	Path  string `json:"path"`
+	URL   string `json:"url,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+func defaultClientConfigPath() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "file", "client.yaml")
+}
+func loadClientConfig(path string) (*clientConfig, error) {
+	var cfg clientConfig
+	if len(path) == 0 {
+		return &cfg, nil
+	}
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return &cfg, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("fail to open client config\n%w", err)
+	}
+	defer file.Close()
+	err = yaml.NewDecoder(file).Decode(&cfg)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("fail to decode client config\n%w", err)
+	}
+	return &cfg, nil
+}
+
+// uploadCommand uploads local files (or stdin for "-") and prints their
+// urls, exiting non-zero when any upload failed.
+func uploadCommand(args []string) int {
+	flags := flag.NewFlagSet("upload", flag.ContinueOnError)
+	configPath := flags.String("config", defaultClientConfigPath(), "client config file")
+	server := flags.String("server", "", "server url like https://files.example.com, or $FILE_SERVER")
+	username := flags.String("username", "", "basic auth username, or $FILE_USERNAME")
+	password := flags.String("password", "", "basic auth password, or $FILE_PASSWORD")
+	uploadPath := flags.String("upload-path", "", "the server's upload_path, default "+defaultUploadPath)
+	name := flags.String("name", "stdin", "file name sent for -, its extension is kept")
+	asJSON := flags.Bool("json", false, "print a JSON array of results")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "usage: file upload [flags] <path|->...")
+		flags.PrintDefaults()
+	}
+	if flags.Parse(args) != nil {
+		return 2
+	}
+	if flags.NArg() == 0 {
+		flags.Usage()
+		return 2
+	}
+	cfg, err := loadClientConfig(*configPath)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	cfg.Server = firstNonEmpty(*server, os.Getenv("FILE_SERVER"), cfg.Server)
+	cfg.Username = firstNonEmpty(*username, os.Getenv("FILE_USERNAME"), cfg.Username)
+	cfg.Password = firstNonEmpty(*password, os.Getenv("FILE_PASSWORD"), cfg.Password)
+	cfg.UploadPath = firstNonEmpty(*uploadPath, cfg.UploadPath, defaultUploadPath)
+	if len(cfg.Server) == 0 {
+		fmt.Fprintln(os.Stderr, "no server given, use --server, $FILE_SERVER or the client config")
+		return 2
+	}
+	code := 0
+	var results []uploadResult
+	for _, path := range flags.Args() {
+		result := uploadResult{Path: path}
+		url, err := uploadFile(cfg, path, *name)
+		if err != nil {
+			result.Error = err.Error()
+			code = 1
+		} else {
+			result.URL = url
+		}
+		results = append(results, result)
+		if *asJSON {
+			continue
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", path, err)
+		} else {
+			fmt.Println(url)
+		}
+	}
+	if *asJSON {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		encoder.Encode(results)
+	}
+	return code
+}
+func firstNonEmpty(values ...string) string {
+	for _, value := range values {
+		if len(value) != 0 {
+			return value
+		}
+	}
+	return ""
+}
+
+// uploadFile streams one file to upload_path as multipart form data without
+// reading it into memory.
+func uploadFile(cfg *clientConfig, path, stdinName string) (string, error) {
+	var src io.Reader
+	filename := filepath.Base(path)
+	if path == "-" {
+		src = os.Stdin
+		filename = stdinName
+	} else {
+		file, err := os.Open(path)
+		if err != nil {
+			return "", err
+		}
+		defer file.Close()
+		src = file
+	}
+	body, pipe := io.Pipe()
+	form := multipart.NewWriter(pipe)
+	go func() {
+		part, err := form.CreateFormFile("file", filename)
+		if err == nil {
+			_, err = io.Copy(part, src)
+		}
+		if err == nil {
+			err = form.Close()
+		}
+		pipe.CloseWithError(err)
+	}()
+	req, err := http.NewRequest(http.MethodPost, joinURL(cfg.Server, cfg.UploadPath), body)
+	if err != nil {
+		body.Close()
+		return "", err
+	}
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	if len(cfg.Username) != 0 {
+		req.SetBasicAuth(cfg.Username, cfg.Password)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	respBody, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return "", err
+	}
+	text := strings.TrimSpace(string(respBody))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return "", fmt.Errorf("%s: %s", resp.Status, text)
+	}
+	// the body may be a response_template, the url is in Location
+	if location := resp.Header.Get("Location"); len(location) != 0 {
+		return location, nil
+	}
+	return text, nil
+}
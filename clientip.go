@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// parsePrefixes parses a list of addresses and CIDR ranges, treating a bare
+// address as a single-host range. Zones are rejected since they never match
+// a remote address.
+func parsePrefixes(values []string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, value := range values {
+		value = strings.TrimSpace(value)
+		if strings.Contains(value, "/") {
+			prefix, err := netip.ParsePrefix(value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid range %q", value)
+			}
+			prefixes = append(prefixes, unmapPrefix(prefix).Masked())
+			continue
+		}
+		addr, err := netip.ParseAddr(value)
+		if err != nil || len(addr.Zone()) != 0 {
+			return nil, fmt.Errorf("invalid address %q", value)
+		}
+		addr = addr.Unmap()
+		prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+	}
+	return prefixes, nil
+}
+
+// unmapPrefix turns ::ffff:a.b.c.d/n ranges into their IPv4 form so they
+// match unmapped client addresses.
+func unmapPrefix(prefix netip.Prefix) netip.Prefix {
+	if !prefix.Addr().Is4In6() || prefix.Bits() < 96 {
+		return prefix
+	}
+	return netip.PrefixFrom(prefix.Addr().Unmap(), prefix.Bits()-96)
+}
+func containsAddr(prefixes []netip.Prefix, addr netip.Addr) bool {
+	for _, prefix := range prefixes {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseAddr parses an address as found in RemoteAddr or X-Forwarded-For,
+// with or without a port, dropping any zone.
+func parseAddr(value string) (netip.Addr, bool) {
+	value = strings.TrimSpace(value)
+	if host, _, err := net.SplitHostPort(value); err == nil {
+		value = host
+	}
+	addr, err := netip.ParseAddr(strings.Trim(value, "[]"))
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	return addr.WithZone("").Unmap(), true
+}
+
+// clientIP returns the address of the client. X-Forwarded-For is only
+// believed when the connection comes from a trusted proxy, and is walked
+// from the right so a client can't spoof earlier hops.
+func clientIP(r *http.Request, cfg *config) netip.Addr {
+	addr, _ := parseAddr(r.RemoteAddr)
+	if !containsAddr(cfg.trustedProxies, addr) {
+		return addr
+	}
+	hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop, ok := parseAddr(hops[i])
+		if !ok {
+			break
+		}
+		addr = hop
+		if !containsAddr(cfg.trustedProxies, hop) {
+			break
+		}
+	}
+	return addr
+}
+
+// ipFilter rejects clients matching deny_ips, or not matching a non-empty
+// allow_ips, with 403 before any route or auth runs.
+func ipFilter(cfg *config, next http.Handler) http.Handler {
+	if len(cfg.allowIPs) == 0 && len(cfg.denyIPs) == 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		addr := clientIP(r, cfg)
+		if containsAddr(cfg.denyIPs, addr) || (len(cfg.allowIPs) != 0 && !containsAddr(cfg.allowIPs, addr)) {
+			writeError(w, r, http.StatusForbidden, "")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+)
+
+func TestParsePrefixes(t *testing.T) {
+	for _, test := range []struct {
+		value string
+		want  string
+	}{
+		{"192.0.2.7", "192.0.2.7/32"},
+		{"10.1.2.3/8", "10.0.0.0/8"},
+		{"2001:db8::1", "2001:db8::1/128"},
+		{" 2001:db8::/32 ", "2001:db8::/32"},
+		{"::ffff:192.0.2.7", "192.0.2.7/32"},
+		{"::ffff:10.0.0.0/104", "10.0.0.0/8"},
+		{"fe80::1%eth0", ""},
+		{"[2001:db8::1]", ""},
+		{"192.0.2.7:80", ""},
+		{"10.0.0.0/33", ""},
+		{"example.com", ""},
+	} {
+		prefixes, err := parsePrefixes([]string{test.value})
+		switch {
+		case len(test.want) == 0 && err == nil:
+			t.Errorf("%q parsed as %v", test.value, prefixes)
+		case len(test.want) != 0 && (err != nil || prefixes[0].String() != test.want):
+			t.Errorf("%q: %v, %v, want %s", test.value, prefixes, err, test.want)
+		}
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	proxies, _ := parsePrefixes([]string{"10.0.0.0/8", "2001:db8:ffff::/48"})
+	cfg := &config{trustedProxies: proxies}
+	for _, test := range []struct {
+		name, remote, forwarded, want string
+	}{
+		{"direct", "192.0.2.1:1234", "", "192.0.2.1"},
+		{"untrusted forwarded", "192.0.2.1:1234", "198.51.100.9", "192.0.2.1"},
+		{"trusted proxy", "10.0.0.1:1234", "198.51.100.9", "198.51.100.9"},
+		{"spoofed earlier hop", "10.0.0.1:1234", "203.0.113.5, 198.51.100.9", "198.51.100.9"},
+		{"proxy chain", "10.0.0.1:1234", "198.51.100.9, 10.0.0.2", "198.51.100.9"},
+		{"bracketed remote", "[2001:db8::1]:443", "", "2001:db8::1"},
+		{"zoned remote", "[fe80::1%eth0]:443", "", "fe80::1"},
+		{"mapped remote", "[::ffff:192.0.2.1]:443", "", "192.0.2.1"},
+		{"ipv6 proxy", "[2001:db8:ffff::1]:443", "2001:db8::9", "2001:db8::9"},
+		{"bracketed hop with port", "10.0.0.1:1234", "[2001:db8::9]:5555", "2001:db8::9"},
+		{"garbage hop", "10.0.0.1:1234", "nonsense", "10.0.0.1"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.RemoteAddr = test.remote
+			if len(test.forwarded) != 0 {
+				req.Header.Set("X-Forwarded-For", test.forwarded)
+			}
+			if got := clientIP(req, cfg); got != netip.MustParseAddr(test.want) {
+				t.Errorf("client %s, want %s", got, test.want)
+			}
+		})
+	}
+}
+
+func TestIPFilter(t *testing.T) {
+	cfg := testConfig(t, "allow_ips: [10.0.0.0/8, \"2001:db8::/32\"]\ndeny_ips: [10.6.6.6]\n")
+	routes := testServer(t, cfg).Routes()
+	for remote, want := range map[string]int{
+		"10.1.1.1:1234":      http.StatusNotFound,
+		"10.6.6.6:1234":      http.StatusForbidden,
+		"192.0.2.1:1234":     http.StatusForbidden,
+		"[2001:db8::5]:1234": http.StatusNotFound,
+		"[2001:db9::5]:1234": http.StatusForbidden,
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/nothing", nil)
+		req.RemoteAddr = remote
+		res := httptest.NewRecorder()
+		routes.ServeHTTP(res, req)
+		if res.Code != want {
+			t.Errorf("%s: status %d, want %d", remote, res.Code, want)
+		}
+	}
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	_ "embed"
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"os"
+)
+
+//go:embed config.yaml.example
+var sampleConfig []byte
+
+// runCommand runs a subcommand named by the first argument and returns its
+// exit code, or false when args don't name one and the server should start.
+func runCommand(args []string) (int, bool) {
+	if len(args) == 0 {
+		return 0, false
+	}
+	switch args[0] {
+	case "generate-config":
+		return generateConfigCommand(args[1:]), true
+	case "validate":
+		return validateCommand(args[1:]), true
+	case "upload":
+		return uploadCommand(args[1:]), true
+	case "reindex":
+		return reindexCommand(args[1:]), true
+	case "gc":
+		return gcCommand(args[1:]), true
+	}
+	return 0, false
+}
+
+// generateConfigCommand writes the annotated sample config, refusing to
+// replace an existing file without --force.
+func generateConfigCommand(args []string) int {
+	flags := flag.NewFlagSet("generate-config", flag.ContinueOnError)
+	force := flags.Bool("force", false, "overwrite an existing file")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "usage: file generate-config [--force] [path]")
+		flags.PrintDefaults()
+	}
+	if flags.Parse(args) != nil || flags.NArg() > 1 {
+		return 2
+	}
+	path := "config.yaml"
+	if flags.NArg() == 1 {
+		path = flags.Arg(0)
+	}
+	if path == "-" {
+		os.Stdout.Write(sampleConfig)
+		return 0
+	}
+	mode := os.O_WRONLY | os.O_CREATE | os.O_EXCL
+	if *force {
+		mode = os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	}
+	file, err := os.OpenFile(path, mode, 0600)
+	if errors.Is(err, fs.ErrExist) {
+		fmt.Fprintf(os.Stderr, "%s already exists, pass --force to overwrite it\n", path)
+		return 1
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "fail to create %s\n%v\n", path, err)
+		return 1
+	}
+	_, err = file.Write(sampleConfig)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "fail to write %s\n%v\n", path, err)
+		return 1
+	}
+	fmt.Printf("wrote %s\n", path)
+	return 0
+}
+
+// validateCommand loads a config like the server would and lists every
+// problem, exiting non-zero so CI can gate deploys on it.
+func validateCommand(args []string) int {
+	flags := flag.NewFlagSet("validate", flag.ContinueOnError)
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "usage: file validate [path]")
+	}
+	if flags.Parse(args) != nil || flags.NArg() > 1 {
+		return 2
+	}
+	path := "config.yaml"
+	if flags.NArg() == 1 {
+		path = flags.Arg(0)
+	}
+	_, err := loalConfig(path)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s is invalid\n%v\n", path, err)
+		return 1
+	}
+	fmt.Printf("%s is valid\n", path)
+	return 0
+}
+
+// reindexCommand rebuilds the metadata index from the upload tree, for
+// instances that enable the database after files were stored.
+func reindexCommand(args []string) int {
+	flags := flag.NewFlagSet("reindex", flag.ContinueOnError)
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "usage: file reindex [config path]")
+	}
+	if flags.Parse(args) != nil || flags.NArg() > 1 {
+		return 2
+	}
+	path := "config.yaml"
+	if flags.NArg() == 1 {
+		path = flags.Arg(0)
+	}
+	cfg, err := loalConfig(path)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "fail to load %s\n%v\n", path, err)
+		return 1
+	}
+	if len(cfg.Database) == 0 {
+		fmt.Fprintln(os.Stderr, "no database configured")
+		return 1
+	}
+	index, err := openFileIndex(cfg.Database)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer index.db.Close()
+	added, removed, err := index.reindex(cfg)
+	fmt.Printf("added %d, removed %d\n", added, removed)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "fail to reindex\n%v\n", err)
+		return 1
+	}
+	return 0
+}
+
+// gcCommand removes the empty directories left behind by deletions once,
+// for instances that don't set gc_interval.
+func gcCommand(args []string) int {
+	flags := flag.NewFlagSet("gc", flag.ContinueOnError)
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "usage: file gc [config path]")
+	}
+	if flags.Parse(args) != nil || flags.NArg() > 1 {
+		return 2
+	}
+	path := "config.yaml"
+	if flags.NArg() == 1 {
+		path = flags.Arg(0)
+	}
+	cfg, err := loalConfig(path)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "fail to load %s\n%v\n", path, err)
+		return 1
+	}
+	removed, err := removeEmptyDirs(cfg)
+	fmt.Printf("removed %d empty directories\n", removed)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "fail to gc\n%v\n", err)
+		return 1
+	}
+	return 0
+}
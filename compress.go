@@ -0,0 +1,290 @@
+package main
+
+import (
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// compressedSuffix is appended on disk to the name of files stored
+// compressed, uuid.txt is kept as uuid.txt.gz.
+const compressedSuffix = ".gz"
+
+// defaultCompressibleTypes compress well and are mostly text.
+var defaultCompressibleTypes = []string{
+	"text/*",
+	"application/json",
+	"application/x-ndjson",
+	"application/xml",
+	"application/javascript",
+	"application/sql",
+	"application/yaml",
+	"application/toml",
+	"image/svg+xml",
+}
+
+// incompressibleTypes are compressed already and never stored gzipped,
+// whatever types says.
+var incompressibleTypes = []string{
+	"image/*", "video/*", "audio/*", "font/woff", "font/woff2",
+	"application/zip", "application/gzip", "application/x-gzip", "application/zstd",
+	"application/x-7z-compressed", "application/x-bzip2", "application/x-xz", "application/vnd.rar",
+	"application/pdf",
+}
+
+// compressionConfig picks the uploads stored gzip compressed. Types are
+// media types or "type/*".
+type compressionConfig struct {
+	Enabled bool     `yaml:"enabled" json:"enabled" toml:"enabled"`
+	Types   []string `yaml:"types" json:"types" toml:"types"`
+
+	types map[string]bool
+}
+
+func (c *compressionConfig) compile() error {
+	if c.Types == nil {
+		c.Types = defaultCompressibleTypes
+	}
+	c.types = map[string]bool{}
+	for _, contentType := range c.Types {
+		mediaType := strings.ToLower(strings.TrimSpace(contentType))
+		if !strings.HasSuffix(mediaType, "/*") {
+			var err error
+			mediaType, _, err = mime.ParseMediaType(mediaType)
+			if err != nil || !strings.Contains(mediaType, "/") {
+				return fmt.Errorf("invalid type %q", contentType)
+			}
+		}
+		c.types[mediaType] = true
+	}
+	return nil
+}
+
+// matchType reports whether contentType is one of types, directly or by a
+// "type/*" entry.
+func matchType(types map[string]bool, contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	major, _, _ := strings.Cut(mediaType, "/")
+	return types[mediaType] || types[major+"/*"]
+}
+
+var incompressible = func() map[string]bool {
+	types := map[string]bool{}
+	for _, contentType := range incompressibleTypes {
+		types[contentType] = true
+	}
+	return types
+}()
+
+// compresses reports whether a file named filename is stored compressed.
+// Files need an extension so their name on disk can't be mistaken for an
+// uploaded .gz file.
+func (c *compressionConfig) compresses(filename string) bool {
+	if !c.Enabled || len(filename) == 0 || !strings.Contains(filename, ".") {
+		return false
+	}
+	contentType := contentTypeOf(filename)
+	if matchType(incompressible, contentType) && contentType != "image/svg+xml" {
+		return false
+	}
+	return matchType(c.types, contentType)
+}
+
+// storedName is the name a file on disk is served as, and whether it is
+// stored compressed: uuid.txt.gz and uuid.txt.gz.enc are uuid.txt, but an
+// uploaded uuid.gz is itself.
+func storedName(name string) (string, bool) {
+	name, _ = decryptedName(name)
+	base := strings.TrimSuffix(name, compressedSuffix)
+	if base == name || !strings.Contains(base, ".") {
+		return name, false
+	}
+	return base, true
+}
+
+// acceptsGzip reports whether the client takes gzip content coding.
+func acceptsGzip(r *http.Request) bool {
+	for _, value := range r.Header.Values("Accept-Encoding") {
+		for _, coding := range strings.Split(value, ",") {
+			name, params, _ := strings.Cut(strings.TrimSpace(coding), ";")
+			if !strings.EqualFold(strings.TrimSpace(name), "gzip") {
+				continue
+			}
+			return strings.ReplaceAll(strings.TrimSpace(params), " ", "") != "q=0"
+		}
+	}
+	return false
+}
+
+// gunzipContent reads a compressed stored file as its original content.
+// Seeks only move the offset, the next read starts over when it went
+// backwards and decompresses up to it, which is enough for ServeContent
+// and the odd range request.
+type gunzipContent struct {
+	raw    storedContent
+	gz     *gzip.Reader
+	size   int64
+	offset int64
+	// done is how much gz has decompressed.
+	done int64
+}
+
+func newGunzipContent(raw storedContent) (*gunzipContent, error) {
+	// gzip keeps the size modulo 4GB in the last 4 bytes
+	_, err := raw.Seek(-4, io.SeekEnd)
+	if err != nil {
+		return nil, err
+	}
+	var trailer [4]byte
+	_, err = io.ReadFull(raw, trailer[:])
+	if err != nil {
+		return nil, err
+	}
+	content := &gunzipContent{raw: raw, size: int64(binary.LittleEndian.Uint32(trailer[:]))}
+	err = content.rewind()
+	if err != nil {
+		return nil, err
+	}
+	return content, nil
+}
+func (g *gunzipContent) rewind() error {
+	_, err := g.raw.Seek(0, io.SeekStart)
+	if err != nil {
+		return err
+	}
+	if g.gz == nil {
+		g.gz, err = gzip.NewReader(g.raw)
+	} else {
+		err = g.gz.Reset(g.raw)
+	}
+	g.done = 0
+	return err
+}
+func (g *gunzipContent) Size() int64 {
+	return g.size
+}
+func (g *gunzipContent) Read(p []byte) (int, error) {
+	if g.offset >= g.size {
+		return 0, io.EOF
+	}
+	if g.offset < g.done {
+		err := g.rewind()
+		if err != nil {
+			return 0, err
+		}
+	}
+	if g.offset > g.done {
+		skipped, err := io.CopyN(io.Discard, g.gz, g.offset-g.done)
+		g.done += skipped
+		if err != nil {
+			return 0, err
+		}
+	}
+	n, err := g.gz.Read(p)
+	g.done += int64(n)
+	g.offset = g.done
+	return n, err
+}
+func (g *gunzipContent) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += g.offset
+	case io.SeekEnd:
+		offset += g.size
+	}
+	if offset < 0 {
+		return 0, errors.New("negative offset")
+	}
+	g.offset = offset
+	return offset, nil
+}
+func (g *gunzipContent) Close() error {
+	return g.raw.Close()
+}
+
+// defaultGzipResponseTypes are compressed on the fly by default.
+var defaultGzipResponseTypes = []string{"text/*", "application/json", "application/javascript", "image/svg+xml"}
+
+const defaultGzipMinSize = 1 << 10
+
+// gzipResponseConfig compresses downloads of the listed types, at least
+// MinSize bytes, for clients accepting gzip. Range requests are answered
+// uncompressed, so ranges always refer to the file as stored.
+type gzipResponseConfig struct {
+	Enabled bool     `yaml:"enabled" json:"enabled" toml:"enabled"`
+	Types   []string `yaml:"types" json:"types" toml:"types"`
+	MinSize byteSize `yaml:"min_size" json:"min_size" toml:"min_size"`
+
+	types compressionConfig
+}
+
+func (c *gzipResponseConfig) compile() error {
+	if c.Types == nil {
+		c.Types = defaultGzipResponseTypes
+	}
+	if c.MinSize == 0 {
+		c.MinSize = defaultGzipMinSize
+	}
+	c.types = compressionConfig{Enabled: c.Enabled, Types: c.Types}
+	return c.types.compile()
+}
+
+// compresses reports whether a response of contentType and size bytes is
+// compressed for clients that accept it, the reason for Vary.
+func (c *gzipResponseConfig) compresses(contentType string, size int64) bool {
+	if !c.Enabled || size < int64(c.MinSize) {
+		return false
+	}
+	if matchType(incompressible, contentType) && !strings.HasPrefix(contentType, "image/svg+xml") {
+		return false
+	}
+	return matchType(c.types.types, contentType)
+}
+
+// gzipResponseWriter compresses a 200 response of http.ServeContent. Any
+// other status, like 304, passes through as is.
+type gzipResponseWriter struct {
+	http.ResponseWriter
+	head bool
+	gz   *gzip.Writer
+}
+
+func (g *gzipResponseWriter) WriteHeader(code int) {
+	if code == http.StatusOK {
+		header := g.Header()
+		header.Del("Content-Length")
+		header.Del("Accept-Ranges")
+		header.Set("Content-Encoding", "gzip")
+		if !g.head {
+			g.gz = gzip.NewWriter(g.ResponseWriter)
+		}
+	}
+	g.ResponseWriter.WriteHeader(code)
+}
+func (g *gzipResponseWriter) Write(p []byte) (int, error) {
+	if g.gz == nil {
+		return g.ResponseWriter.Write(p)
+	}
+	return g.gz.Write(p)
+}
+
+// Close writes the end of the gzip stream.
+func (g *gzipResponseWriter) Close() error {
+	if g.gz == nil {
+		return nil
+	}
+	return g.gz.Close()
+}
+
+// Unwrap lets http.ResponseController reach the connection.
+func (g *gzipResponseWriter) Unwrap() http.ResponseWriter {
+	return g.ResponseWriter
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestGzipResponses(t *testing.T) {
+	cfg := testConfig(t, "gzip_responses:\n  enabled: true\n  types: [text/*, application/json, image/*]\n  min_size: 1KB\n")
+	r := testServer(t, cfg).Routes()
+	dir := filepath.Join(cfg.UploadDir, "2026", "10", "14")
+	os.MkdirAll(dir, 0755)
+	large := strings.Repeat(`{"key": "value"}`, 1000)
+	files := map[string]string{"large.json": large, "small.json": `{}`, "photo.png": large}
+	for name, content := range files {
+		err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	get := func(name string, header http.Header) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/i/2026/10/14/"+name, nil)
+		for key, values := range header {
+			req.Header[key] = values
+		}
+		res := httptest.NewRecorder()
+		r.ServeHTTP(res, req)
+		return res
+	}
+	gzipped := http.Header{"Accept-Encoding": {"gzip, deflate"}}
+
+	t.Run("compressed", func(t *testing.T) {
+		res := get("large.json", gzipped)
+		if res.Code != http.StatusOK || res.Header().Get("Content-Encoding") != "gzip" {
+			t.Fatalf("status %d, Content-Encoding %q", res.Code, res.Header().Get("Content-Encoding"))
+		}
+		if res.Header().Get("Vary") != "Accept-Encoding" {
+			t.Errorf("Vary %q", res.Header().Get("Vary"))
+		}
+		if res.Header().Get("Accept-Ranges") != "" || res.Header().Get("Content-Length") != "" {
+			t.Errorf("Accept-Ranges %q, Content-Length %q on a compressed response", res.Header().Get("Accept-Ranges"), res.Header().Get("Content-Length"))
+		}
+		gz, err := gzip.NewReader(res.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := io.ReadAll(gz)
+		if err != nil || string(body) != large {
+			t.Errorf("decompressed %d bytes, %v", len(body), err)
+		}
+	})
+	t.Run("not accepted", func(t *testing.T) {
+		res := get("large.json", nil)
+		if res.Header().Get("Content-Encoding") != "" || res.Body.String() != large {
+			t.Errorf("Content-Encoding %q", res.Header().Get("Content-Encoding"))
+		}
+		if res.Header().Get("Vary") != "Accept-Encoding" {
+			t.Errorf("Vary %q", res.Header().Get("Vary"))
+		}
+	})
+	t.Run("range", func(t *testing.T) {
+		header := gzipped.Clone()
+		header.Set("Range", "bytes=0-15")
+		res := get("large.json", header)
+		if res.Code != http.StatusPartialContent || res.Header().Get("Content-Encoding") != "" {
+			t.Fatalf("status %d, Content-Encoding %q", res.Code, res.Header().Get("Content-Encoding"))
+		}
+		if res.Body.String() != large[:16] {
+			t.Errorf("range body %q", res.Body)
+		}
+	})
+	t.Run("head", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodHead, "/i/2026/10/14/large.json", nil)
+		req.Header.Set("Accept-Encoding", "gzip")
+		res := httptest.NewRecorder()
+		r.ServeHTTP(res, req)
+		if res.Header().Get("Content-Encoding") != "gzip" || res.Body.Len() != 0 {
+			t.Errorf("Content-Encoding %q, %d body bytes", res.Header().Get("Content-Encoding"), res.Body.Len())
+		}
+	})
+	t.Run("not modified", func(t *testing.T) {
+		header := gzipped.Clone()
+		header.Set("If-Modified-Since", "Fri, 01 Jan 2100 00:00:00 GMT")
+		res := get("large.json", header)
+		if res.Code != http.StatusNotModified || res.Header().Get("Content-Encoding") != "" {
+			t.Errorf("status %d, Content-Encoding %q", res.Code, res.Header().Get("Content-Encoding"))
+		}
+	})
+	for _, name := range []string{"small.json", "photo.png"} {
+		t.Run(name, func(t *testing.T) {
+			res := get(name, gzipped)
+			if res.Header().Get("Content-Encoding") != "" || res.Header().Get("Vary") != "" || res.Body.String() != files[name] {
+				t.Errorf("Content-Encoding %q, Vary %q", res.Header().Get("Content-Encoding"), res.Header().Get("Vary"))
+			}
+		})
+	}
+}
+
+func TestCompressedStorage(t *testing.T) {
+	content := strings.Repeat("every line of this file is the same\n", 1000)
+	for _, extra := range []string{"", "encryption_key: " + testKey + "\n"} {
+		cfg := testConfig(t, "compression:\n  enabled: true\n"+extra)
+		routes := testServer(t, cfg).Routes()
+		path := downloadPath(t, testUpload(t, routes, "notes.txt", content, nil))
+		diskPath, compressed, err := findStored(filepath.Join(cfg.UploadDir, filepath.FromSlash(strings.TrimPrefix(path, "/i/"))))
+		if info, _ := os.Stat(diskPath); err != nil || !compressed || info.Size() >= int64(len(content)) {
+			t.Fatalf("%q: stored as %s, compressed %v, %v", extra, diskPath, compressed, err)
+		}
+
+		// a client without gzip gets the original, whole or in ranges
+		res := fetch(routes, path, "")
+		if res.Code != http.StatusOK || res.Header().Get("Content-Encoding") != "" || res.Body.String() != content {
+			t.Errorf("%q: status %d, Content-Encoding %q, %d bytes", extra, res.Code, res.Header().Get("Content-Encoding"), res.Body.Len())
+		}
+		if res.Header().Get("Content-Length") != strconv.Itoa(len(content)) {
+			t.Errorf("%q: Content-Length %q, want %d", extra, res.Header().Get("Content-Length"), len(content))
+		}
+		res = fetch(routes, path, "bytes=100-199")
+		if res.Code != http.StatusPartialContent || res.Body.String() != content[100:200] || res.Header().Get("Content-Length") != "100" {
+			t.Errorf("%q: range status %d, Content-Length %q, %q", extra, res.Code, res.Header().Get("Content-Length"), res.Body)
+		}
+		if want := "bytes 100-199/" + strconv.Itoa(len(content)); res.Header().Get("Content-Range") != want {
+			t.Errorf("%q: Content-Range %q, want %q", extra, res.Header().Get("Content-Range"), want)
+		}
+
+		// one with gzip gets the stream on disk
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.Header.Set("Accept-Encoding", "gzip")
+		res = httptest.NewRecorder()
+		routes.ServeHTTP(res, req)
+		gz, err := gzip.NewReader(res.Body)
+		if err != nil || res.Header().Get("Content-Encoding") != "gzip" {
+			t.Fatalf("%q: Content-Encoding %q, %v", extra, res.Header().Get("Content-Encoding"), err)
+		}
+		if body, err := io.ReadAll(gz); err != nil || string(body) != content {
+			t.Errorf("%q: decompressed %d bytes, %v", extra, len(body), err)
+		}
+	}
+}
@@ -0,0 +1,400 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/netip"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+type config struct {
+	Host         string `yaml:"host" json:"host" toml:"host"`
+	Port         string `yaml:"port" json:"port" toml:"port"`
+	UploadDir    string `yaml:"upload_dir" json:"upload_dir" toml:"upload_dir"`
+	AccessPrefix string `yaml:"access_prefix" json:"access_prefix" toml:"access_prefix"`
+	RoutePrefix  string `yaml:"route_prefix" json:"route_prefix" toml:"route_prefix"`
+	UploadPath   string `yaml:"upload_path" json:"upload_path" toml:"upload_path"`
+	Username     string `yaml:"username" json:"username" toml:"username"`
+	Password     string `yaml:"password" json:"password" toml:"password"`
+	Token        string `yaml:"token" json:"token" toml:"token"`
+
+	CacheControl         cacheControlConfig    `yaml:"cache_control" json:"cache_control" toml:"cache_control"`
+	MinFreeSpace         byteSize              `yaml:"min_free_space" json:"min_free_space" toml:"min_free_space"`
+	ZipMaxFiles          int                   `yaml:"zip_max_files" json:"zip_max_files" toml:"zip_max_files"`
+	ZipMaxBytes          byteSize              `yaml:"zip_max_bytes" json:"zip_max_bytes" toml:"zip_max_bytes"`
+	ExportMaxBytes       byteSize              `yaml:"export_max_bytes" json:"export_max_bytes" toml:"export_max_bytes"`
+	PasteMaxSize         byteSize              `yaml:"paste_max_size" json:"paste_max_size" toml:"paste_max_size"`
+	PasteHTMLView        bool                  `yaml:"paste_html_view" json:"paste_html_view" toml:"paste_html_view"`
+	RenderMarkdown       bool                  `yaml:"render_markdown" json:"render_markdown" toml:"render_markdown"`
+	MarkdownMaxSize      byteSize              `yaml:"markdown_max_size" json:"markdown_max_size" toml:"markdown_max_size"`
+	BaseURL              string                `yaml:"base_url" json:"base_url" toml:"base_url"`
+	AdminUsername        string                `yaml:"admin_username" json:"admin_username" toml:"admin_username"`
+	AdminPassword        string                `yaml:"admin_password" json:"admin_password" toml:"admin_password"`
+	TrustedProxies       []string              `yaml:"trusted_proxies" json:"trusted_proxies" toml:"trusted_proxies"`
+	DailyQuotaPerIP      byteSize              `yaml:"daily_quota_per_ip" json:"daily_quota_per_ip" toml:"daily_quota_per_ip"`
+	QuotaStateFile       string                `yaml:"quota_state_file" json:"quota_state_file" toml:"quota_state_file"`
+	AllowIPs             []string              `yaml:"allow_ips" json:"allow_ips" toml:"allow_ips"`
+	DenyIPs              []string              `yaml:"deny_ips" json:"deny_ips" toml:"deny_ips"`
+	Database             string                `yaml:"database" json:"database" toml:"database"`
+	SearchMaxDays        int                   `yaml:"search_max_days" json:"search_max_days" toml:"search_max_days"`
+	GCInterval           duration              `yaml:"gc_interval" json:"gc_interval" toml:"gc_interval"`
+	StatsInterval        duration              `yaml:"stats_interval" json:"stats_interval" toml:"stats_interval"`
+	DirMode              fileMode              `yaml:"dir_mode" json:"dir_mode" toml:"dir_mode"`
+	FileMode             fileMode              `yaml:"file_mode" json:"file_mode" toml:"file_mode"`
+	ShutdownTimeout      duration              `yaml:"shutdown_timeout" json:"shutdown_timeout" toml:"shutdown_timeout"`
+	MinUploadRate        byteRate              `yaml:"min_upload_rate" json:"min_upload_rate" toml:"min_upload_rate"`
+	MaxDownloadRate      byteRate              `yaml:"max_download_rate" json:"max_download_rate" toml:"max_download_rate"`
+	RequestDownloadRate  byteRate              `yaml:"per_request_download_rate" json:"per_request_download_rate" toml:"per_request_download_rate"`
+	UploadRateWindow     duration              `yaml:"upload_rate_window" json:"upload_rate_window" toml:"upload_rate_window"`
+	UploadTimeout        duration              `yaml:"upload_timeout" json:"upload_timeout" toml:"upload_timeout"`
+	MultipartMemory      byteSize              `yaml:"multipart_memory" json:"multipart_memory" toml:"multipart_memory"`
+	InfoRequiresAuth     bool                  `yaml:"info_requires_auth" json:"info_requires_auth" toml:"info_requires_auth"`
+	BrowseEnabled        bool                  `yaml:"browse_enabled" json:"browse_enabled" toml:"browse_enabled"`
+	ReadOnly             bool                  `yaml:"read_only" json:"read_only" toml:"read_only"`
+	TrashRetention       duration              `yaml:"trash_retention" json:"trash_retention" toml:"trash_retention"`
+	MultipartField       string                `yaml:"multipart_field" json:"multipart_field" toml:"multipart_field"`
+	CopyBufferSize       byteSize              `yaml:"copy_buffer_size" json:"copy_buffer_size" toml:"copy_buffer_size"`
+	MaxUploadSize        byteSize              `yaml:"max_upload_size" json:"max_upload_size" toml:"max_upload_size"`
+	Debug                bool                  `yaml:"debug" json:"debug" toml:"debug"`
+	LogLevel             string                `yaml:"log_level" json:"log_level" toml:"log_level"`
+	LogOutput            string                `yaml:"log_output" json:"log_output" toml:"log_output"`
+	LogMaxSize           byteSize              `yaml:"log_max_size" json:"log_max_size" toml:"log_max_size"`
+	LogMaxFiles          int                   `yaml:"log_max_files" json:"log_max_files" toml:"log_max_files"`
+	UploadProgress       progressConfig        `yaml:"upload_progress" json:"upload_progress" toml:"upload_progress"`
+	SecurityHeaders      securityHeadersConfig `yaml:"security_headers" json:"security_headers" toml:"security_headers"`
+	ActiveContent        activeContentConfig   `yaml:"active_content" json:"active_content" toml:"active_content"`
+	AuthScheme           string                `yaml:"auth_scheme" json:"auth_scheme" toml:"auth_scheme"`
+	AuthRealm            string                `yaml:"auth_realm" json:"auth_realm" toml:"auth_realm"`
+	Namespace            string                `yaml:"namespace" json:"namespace" toml:"namespace"`
+	Users                []userConfig          `yaml:"users" json:"users" toml:"users"`
+	NamespacePerUser     bool                  `yaml:"namespace_per_user" json:"namespace_per_user" toml:"namespace_per_user"`
+	Replicas             []replicaConfig       `yaml:"replicas" json:"replicas" toml:"replicas"`
+	ReadFallback         bool                  `yaml:"read_fallback" json:"read_fallback" toml:"read_fallback"`
+	ReplicationJournal   string                `yaml:"replication_journal" json:"replication_journal" toml:"replication_journal"`
+	IdempotencyRetention duration              `yaml:"idempotency_retention" json:"idempotency_retention" toml:"idempotency_retention"`
+	IdempotencyMaxKeys   int                   `yaml:"idempotency_max_keys" json:"idempotency_max_keys" toml:"idempotency_max_keys"`
+	IdempotencyStateFile string                `yaml:"idempotency_state_file" json:"idempotency_state_file" toml:"idempotency_state_file"`
+	WebDAVEnabled        bool                  `yaml:"webdav_enabled" json:"webdav_enabled" toml:"webdav_enabled"`
+	EncryptionKey        string                `yaml:"encryption_key" json:"encryption_key" toml:"encryption_key"`
+	OldEncryptionKeys    []string              `yaml:"old_encryption_keys" json:"old_encryption_keys" toml:"old_encryption_keys"`
+	Compression          compressionConfig     `yaml:"compression" json:"compression" toml:"compression"`
+	GzipResponses        gzipResponseConfig    `yaml:"gzip_responses" json:"gzip_responses" toml:"gzip_responses"`
+	QuotaCounts          string                `yaml:"quota_counts" json:"quota_counts" toml:"quota_counts"`
+	OtelEnabled          bool                  `yaml:"otel_enabled" json:"otel_enabled" toml:"otel_enabled"`
+	AllowCustomDirs      bool                  `yaml:"allow_custom_dirs" json:"allow_custom_dirs" toml:"allow_custom_dirs"`
+	CustomDirs           []string              `yaml:"custom_dirs" json:"custom_dirs" toml:"custom_dirs"`
+	CustomDirLayout      string                `yaml:"custom_dir_layout" json:"custom_dir_layout" toml:"custom_dir_layout"`
+	RobotsTxt            string                `yaml:"robots_txt" json:"robots_txt" toml:"robots_txt"`
+	NoIndex              bool                  `yaml:"noindex" json:"noindex" toml:"noindex"`
+	ResponseFormat       string                `yaml:"response_format" json:"response_format" toml:"response_format"`
+	AllowExtract         bool                  `yaml:"allow_extract" json:"allow_extract" toml:"allow_extract"`
+	ExtractMaxFiles      int                   `yaml:"extract_max_files" json:"extract_max_files" toml:"extract_max_files"`
+	ExtractMaxBytes      byteSize              `yaml:"extract_max_bytes" json:"extract_max_bytes" toml:"extract_max_bytes"`
+	CacheMaxBytes        byteSize              `yaml:"cache_max_bytes" json:"cache_max_bytes" toml:"cache_max_bytes"`
+	CacheMaxFileSize     byteSize              `yaml:"cache_max_file_size" json:"cache_max_file_size" toml:"cache_max_file_size"`
+	ResponseTemplate     string                `yaml:"response_template" json:"response_template" toml:"response_template"`
+	BlocklistFile        string                `yaml:"blocklist_file" json:"blocklist_file" toml:"blocklist_file"`
+	AuditLog             string                `yaml:"audit_log" json:"audit_log" toml:"audit_log"`
+	Timezone             string                `yaml:"timezone" json:"timezone" toml:"timezone"`
+
+	trustedProxies []netip.Prefix
+	allowIPs       []netip.Prefix
+	denyIPs        []netip.Prefix
+	// keys is nil unless encryption_key is set.
+	keys *keyRing
+	// accounts are the username/password account followed by users.
+	accounts []userConfig
+	// responseTemplate is nil unless response_template is set.
+	responseTemplate *template.Template
+	// location is timezone, the server's local time when it is empty.
+	location *time.Location
+}
+
+// now is the current time in timezone, which dates the upload paths.
+func (c *config) now() time.Time {
+	if c.location == nil {
+		return time.Now()
+	}
+	return time.Now().In(c.location)
+}
+
+// today is the date of now in timezone, at midnight UTC like the dates
+// parsed from day directories.
+func (c *config) today() time.Time {
+	now := c.now()
+	return time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+}
+
+// configFormats lists the config file extensions loalConfig understands.
+var configFormats = []string{".yaml", ".yml", ".json", ".toml"}
+
+func loalConfig(path string) (*config, error) {
+	format := strings.ToLower(filepath.Ext(path))
+	if !slices.Contains(configFormats, format) {
+		return nil, fmt.Errorf("unsupported config file %q, use one of %s", path, strings.Join(configFormats, ", "))
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("fail to open config file\n%w", err)
+	}
+	defer file.Close()
+	return loadConfigFrom(file, format)
+}
+
+// loadConfigFrom decodes a config in the format named by its extension
+// (".yaml", ".json", ...), so tests can skip the filesystem.
+func loadConfigFrom(r io.Reader, format string) (*config, error) {
+	var cfg config
+	var err error
+	switch format {
+	case ".yaml", ".yml":
+		err = yaml.NewDecoder(r).Decode(&cfg)
+	case ".json":
+		err = decodeJSONConfig(r, &cfg)
+	case ".toml":
+		err = decodeTOMLConfig(r, &cfg)
+	default:
+		err = fmt.Errorf("unsupported config format %q, use one of %s", format, strings.Join(configFormats, ", "))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("fail to decode config file\n%w", err)
+	}
+	err = cfg.validate()
+	if err != nil {
+		return nil, fmt.Errorf("invalid config\n%w", err)
+	}
+	return &cfg, nil
+}
+
+// validate checks the decoded values and prepares derived state. All
+// problems are reported at once, one per line.
+func (c *config) validate() error {
+	var problems []error
+	// an empty host listens on every interface, socket activation needs
+	// neither host nor port
+	port, err := strconv.Atoi(c.Port)
+	if len(os.Getenv("LISTEN_FDS")) == 0 && (err != nil || port < 1 || port > 65535) {
+		problems = append(problems, fmt.Errorf("port %q must be a number between 1 and 65535", c.Port))
+	}
+	if len(c.UploadDir) == 0 {
+		problems = append(problems, errors.New("upload_dir is required"))
+	}
+	if len(c.Username) == 0 || len(c.Password) == 0 {
+		problems = append(problems, errors.New("username and password are required"))
+	}
+	switch c.AuthScheme {
+	case "":
+		c.AuthScheme = authBasic
+	case authBasic, authDigest:
+	default:
+		problems = append(problems, fmt.Errorf("auth_scheme %q must be basic or digest", c.AuthScheme))
+	}
+	if len(c.AuthRealm) == 0 {
+		c.AuthRealm = defaultAuthRealm
+	} else if strings.ContainsFunc(c.AuthRealm, func(r rune) bool { return r < ' ' || r > '~' || r == '"' || r == '\\' }) {
+		problems = append(problems, fmt.Errorf("auth_realm %q must be printable ascii without quotes or backslashes", c.AuthRealm))
+	}
+	if len(c.AdminUsername) != 0 && len(c.AdminPassword) == 0 {
+		problems = append(problems, errors.New("admin_password is required with admin_username"))
+	}
+	problems = append(problems, c.compileUsers()...)
+	if len(c.BaseURL) != 0 {
+		u, err := url.Parse(c.BaseURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || len(u.Host) == 0 {
+			problems = append(problems, fmt.Errorf("base_url %q must be an absolute http or https url", c.BaseURL))
+		}
+	}
+	if c.DirMode == 0 {
+		c.DirMode = 0o755
+	}
+	if c.FileMode == 0 {
+		c.FileMode = 0o644
+	}
+	if c.DirMode&0o700 != 0o700 {
+		problems = append(problems, fmt.Errorf("dir_mode %04o must give the owner rwx", c.DirMode))
+	}
+	if c.FileMode&0o600 != 0o600 {
+		problems = append(problems, fmt.Errorf("file_mode %04o must give the owner rw", c.FileMode))
+	}
+	if c.UploadProgress.Interval < 0 || c.UploadProgress.Every < 0 || c.UploadProgress.MinSize < 0 {
+		problems = append(problems, errors.New("upload_progress values must not be negative"))
+	}
+	if c.UploadProgress.Interval == 0 {
+		c.UploadProgress.Interval = duration(defaultProgressInterval)
+	}
+	if c.UploadProgress.MinSize == 0 {
+		c.UploadProgress.MinSize = defaultProgressMinSize
+	}
+	if c.MultipartMemory < 0 || c.MaxUploadSize < 0 {
+		problems = append(problems, errors.New("multipart_memory and max_upload_size must not be negative"))
+	}
+	if c.MultipartMemory == 0 {
+		c.MultipartMemory = defaultMultipartMemory
+	}
+	if c.MinUploadRate < 0 || c.UploadRateWindow < 0 || c.UploadTimeout < 0 {
+		problems = append(problems, errors.New("min_upload_rate, upload_rate_window and upload_timeout must not be negative"))
+	}
+	if c.TrashRetention < 0 {
+		problems = append(problems, errors.New("trash_retention must not be negative"))
+	}
+	if c.MaxDownloadRate < 0 || c.RequestDownloadRate < 0 {
+		problems = append(problems, errors.New("max_download_rate and per_request_download_rate must not be negative"))
+	}
+	if c.UploadRateWindow == 0 {
+		c.UploadRateWindow = duration(defaultUploadRateWindow)
+	}
+	if c.ShutdownTimeout < 0 {
+		problems = append(problems, errors.New("shutdown_timeout must not be negative"))
+	}
+	if c.GCInterval < 0 {
+		problems = append(problems, errors.New("gc_interval must not be negative"))
+	}
+	if c.StatsInterval < 0 {
+		problems = append(problems, errors.New("stats_interval must not be negative"))
+	}
+	if c.StatsInterval == 0 {
+		c.StatsInterval = duration(defaultStatsInterval)
+	}
+	if c.ZipMaxFiles < 0 {
+		problems = append(problems, errors.New("zip_max_files must not be negative"))
+	}
+	c.trustedProxies, err = parsePrefixes(c.TrustedProxies)
+	if err != nil {
+		problems = append(problems, fmt.Errorf("trusted_proxies: %w", err))
+	}
+	c.allowIPs, err = parsePrefixes(c.AllowIPs)
+	if err != nil {
+		problems = append(problems, fmt.Errorf("allow_ips: %w", err))
+	}
+	c.denyIPs, err = parsePrefixes(c.DenyIPs)
+	if err != nil {
+		problems = append(problems, fmt.Errorf("deny_ips: %w", err))
+	}
+	if c.DailyQuotaPerIP > 0 && len(c.QuotaStateFile) == 0 {
+		c.QuotaStateFile = "quota.json"
+	}
+	switch c.QuotaCounts {
+	case "":
+		c.QuotaCounts = quotaCountsLogical
+	case quotaCountsLogical, quotaCountsDisk:
+	default:
+		problems = append(problems, fmt.Errorf("quota_counts %q must be logical or disk", c.QuotaCounts))
+	}
+	err = c.Compression.compile()
+	if err != nil {
+		problems = append(problems, fmt.Errorf("compression: %w", err))
+	}
+	err = c.GzipResponses.compile()
+	if err != nil {
+		problems = append(problems, fmt.Errorf("gzip_responses: %w", err))
+	}
+	problems = append(problems, c.validateReplicas()...)
+	problems = append(problems, c.validateLogging()...)
+	problems = append(problems, c.validateRoutes()...)
+	problems = append(problems, c.validateCustomDirs()...)
+	problems = append(problems, c.validateCopyBuffer()...)
+	if len(c.ResponseTemplate) != 0 {
+		c.responseTemplate, err = parseResponseTemplate(c.ResponseTemplate)
+		if err != nil {
+			problems = append(problems, fmt.Errorf("response_template: %w", err))
+		}
+	}
+	if len(c.Timezone) != 0 {
+		c.location, err = time.LoadLocation(c.Timezone)
+		if err != nil {
+			problems = append(problems, fmt.Errorf("timezone %q must be an IANA name like Asia/Shanghai\n%w", c.Timezone, err))
+		}
+	}
+	if len(c.RobotsTxt) == 0 {
+		c.RobotsTxt = c.defaultRobotsTxt()
+	}
+	if c.ExtractMaxFiles <= 0 {
+		c.ExtractMaxFiles = defaultExtractMaxFiles
+	}
+	if c.ExtractMaxBytes <= 0 {
+		c.ExtractMaxBytes = defaultExtractMaxBytes
+	}
+	if c.CacheMaxFileSize == 0 {
+		c.CacheMaxFileSize = defaultCacheMaxFileSize
+	}
+	c.ResponseFormat = strings.ToLower(c.ResponseFormat)
+	if len(c.ResponseFormat) != 0 && c.ResponseFormat != formatShareX {
+		problems = append(problems, fmt.Errorf("response_format %q must be empty or %s", c.ResponseFormat, formatShareX))
+	}
+	if len(c.EncryptionKey) != 0 {
+		c.keys, err = newKeyRing(c.EncryptionKey, c.OldEncryptionKeys)
+		if err != nil {
+			problems = append(problems, err)
+		}
+	} else if len(c.OldEncryptionKeys) != 0 {
+		problems = append(problems, errors.New("old_encryption_keys need encryption_key"))
+	}
+	if c.IdempotencyRetention <= 0 {
+		c.IdempotencyRetention = duration(defaultIdempotencyRetention)
+	}
+	if c.IdempotencyMaxKeys <= 0 {
+		c.IdempotencyMaxKeys = defaultIdempotencyMaxKeys
+	}
+	if len(c.IdempotencyStateFile) == 0 {
+		c.IdempotencyStateFile = filepath.Clean(c.UploadDir) + ".idempotency.json"
+	}
+	c.SecurityHeaders.setDefaults()
+	err = c.ActiveContent.compile()
+	if err != nil {
+		problems = append(problems, fmt.Errorf("active_content: %w", err))
+	}
+	err = c.CacheControl.compile()
+	if err != nil {
+		problems = append(problems, fmt.Errorf("cache_control: %w", err))
+	}
+	return errors.Join(problems...)
+}
+
+// decodeJSONConfig adds the line and column to the byte offsets
+// encoding/json reports.
+func decodeJSONConfig(r io.Reader, cfg *config) error {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	err = json.Unmarshal(data, cfg)
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	switch {
+	case errors.As(err, &syntaxErr):
+		line, col := offsetPosition(data, syntaxErr.Offset)
+		return fmt.Errorf("line %d, column %d: %w", line, col, err)
+	case errors.As(err, &typeErr):
+		line, col := offsetPosition(data, typeErr.Offset)
+		return fmt.Errorf("line %d, column %d: %w", line, col, err)
+	}
+	return err
+}
+func offsetPosition(data []byte, offset int64) (int, int) {
+	offset = min(max(offset, 0), int64(len(data)))
+	before := data[:offset]
+	line := bytes.Count(before, []byte("\n")) + 1
+	col := len(before) - bytes.LastIndexByte(before, '\n')
+	return line, col
+}
+func decodeTOMLConfig(r io.Reader, cfg *config) error {
+	_, err := toml.NewDecoder(r).Decode(cfg)
+	var parseErr toml.ParseError
+	if errors.As(err, &parseErr) {
+		return fmt.Errorf("line %d, column %d: %s", parseErr.Position.Line, parseErr.Position.Col, parseErr.Message)
+	}
+	return err
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestConfigFormats(t *testing.T) {
+	sources := map[string]string{
+		".yaml": `host: 127.0.0.1
+port: "8080"
+upload_dir: /srv/upload
+username: u
+password: p
+max_upload_size: 10MB
+trash_retention: 7d
+trusted_proxies: ["10.0.0.0/8", "::1"]
+users:
+  - username: alice
+    password: secret
+    namespace: alice
+`,
+		".json": `{
+  "host": "127.0.0.1",
+  "port": "8080",
+  "upload_dir": "/srv/upload",
+  "username": "u",
+  "password": "p",
+  "max_upload_size": "10MB",
+  "trash_retention": "7d",
+  "trusted_proxies": ["10.0.0.0/8", "::1"],
+  "users": [{"username": "alice", "password": "secret", "namespace": "alice"}]
+}`,
+		".toml": `host = "127.0.0.1"
+port = "8080"
+upload_dir = "/srv/upload"
+username = "u"
+password = "p"
+max_upload_size = "10MB"
+trash_retention = "7d"
+trusted_proxies = ["10.0.0.0/8", "::1"]
+
+[[users]]
+username = "alice"
+password = "secret"
+namespace = "alice"
+`,
+	}
+	configs := map[string]*config{}
+	for format, source := range sources {
+		cfg, err := loadConfigFrom(strings.NewReader(source), format)
+		if err != nil {
+			t.Fatalf("%s: %v", format, err)
+		}
+		configs[format] = cfg
+	}
+	want := configs[".yaml"]
+	if want.MaxUploadSize != 10<<20 || len(want.Users) != 1 || want.Users[0].Namespace != "alice" || len(want.TrustedProxies) != 2 || want.IdempotencyStateFile != "/srv/upload.idempotency.json" {
+		t.Errorf("yaml decoded to %+v", want)
+	}
+	for _, format := range []string{".json", ".toml"} {
+		if !reflect.DeepEqual(configs[format], want) {
+			t.Errorf("%s decoded to\n%+v\nwant\n%+v", format, configs[format], want)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	const base = "upload_dir: /srv/upload\nusername: u\npassword: p\n"
+	for _, test := range []struct {
+		name   string
+		source string
+		fds    string
+		want   string
+	}{
+		{"every interface", base + "port: 8080\n", "", ""},
+		{"host and port", base + "host: 127.0.0.1\nport: 8080\n", "", ""},
+		{"no port", base, "", "port"},
+		{"port out of range", base + "port: 70000\n", "", "port"},
+		{"socket activation", base, "3", ""},
+		{"no upload_dir", "username: u\npassword: p\nport: 8080\n", "", "upload_dir is required"},
+		{"no password", "upload_dir: /srv/upload\nusername: u\nport: 8080\n", "", "username and password are required"},
+		{"auth_scheme", base + "port: 8080\nauth_scheme: ntlm\n", "", "auth_scheme"},
+		{"every problem", "auth_scheme: ntlm\n", "", "upload_dir is required"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			t.Setenv("LISTEN_FDS", test.fds)
+			_, err := loadConfigFrom(strings.NewReader(test.source), ".yaml")
+			switch {
+			case len(test.want) == 0 && err != nil:
+				t.Errorf("unexpected error %v", err)
+			case len(test.want) != 0 && (err == nil || !strings.Contains(err.Error(), test.want)):
+				t.Errorf("error %v, want one about %q", err, test.want)
+			}
+			if test.name == "every problem" && err != nil && strings.Count(err.Error(), "\n") < 3 {
+				t.Errorf("not every problem is listed: %v", err)
+			}
+		})
+	}
+}
+
+func TestGenerateConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if code := generateConfigCommand([]string{path}); code != 0 {
+		t.Fatalf("generate-config exited %d", code)
+	}
+	if _, err := loalConfig(path); err != nil {
+		t.Errorf("the sample config doesn't load: %v", err)
+	}
+	if code := validateCommand([]string{path}); code != 0 {
+		t.Errorf("validate of the sample exited %d", code)
+	}
+	os.WriteFile(path, []byte("port: none\n"), 0o600)
+	if code := generateConfigCommand([]string{path}); code != 1 {
+		t.Errorf("generate-config over an existing file exited %d", code)
+	}
+	if code := validateCommand([]string{path}); code != 1 {
+		t.Errorf("validate of a broken config exited %d", code)
+	}
+	if code := generateConfigCommand([]string{"--force", path}); code != 0 {
+		t.Errorf("generate-config --force exited %d", code)
+	}
+	if content, _ := os.ReadFile(path); !bytes.Equal(content, sampleConfig) {
+		t.Error("--force didn't replace the file with the sample")
+	}
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+const (
+	// customDirReplace stores in [namespace/]dir/, customDirNested in
+	// [namespace/]year/month/day/dir/.
+	customDirReplace = "replace"
+	customDirNested  = "nested"
+
+	maxCustomDirDepth   = 8
+	maxCustomDirSegment = 64
+)
+
+// customFileRoute matches the stored files of custom dirs, whatever their
+// depth. It is registered after the dated routes, which keep their files.
+const customFileRoute = "{path:.+}"
+
+// validDirSegment is a directory name a client may pick: letters, digits,
+// ".", "_" and "-", not starting with ".".
+func validDirSegment(segment string) bool {
+	if len(segment) == 0 || len(segment) > maxCustomDirSegment || segment[0] == '.' {
+		return false
+	}
+	for _, c := range segment {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9', c == '.', c == '_', c == '-':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// splitCustomDir checks the shape of a relative dir and splits it.
+func splitCustomDir(value string) ([]string, error) {
+	if strings.HasPrefix(value, "/") || strings.Contains(value, `\`) || (len(value) >= 2 && value[1] == ':') {
+		return nil, fmt.Errorf("dir %q must be a relative path like a/b", value)
+	}
+	segments := strings.Split(strings.TrimSuffix(value, "/"), "/")
+	if len(segments) > maxCustomDirDepth {
+		return nil, fmt.Errorf("dir %q has more than %d levels", value, maxCustomDirDepth)
+	}
+	for _, segment := range segments {
+		if segment == "." || segment == ".." {
+			return nil, fmt.Errorf("dir %q must not contain . or .. levels", value)
+		}
+		if !validDirSegment(segment) {
+			return nil, fmt.Errorf("dir %q levels must be 1 to %d letters, digits, ., _ or -, not starting with .", value, maxCustomDirSegment)
+		}
+	}
+	return segments, nil
+}
+
+// parseCustomDir checks the dir field of an upload, returning it cleaned,
+// or "" for the date path when it is empty.
+func parseCustomDir(cfg *config, value string) (string, error) {
+	value = strings.TrimSpace(value)
+	if len(value) == 0 {
+		return "", nil
+	}
+	if !cfg.AllowCustomDirs {
+		return "", errors.New("dir is not allowed on this server")
+	}
+	segments, err := splitCustomDir(value)
+	if err != nil {
+		return "", err
+	}
+	// a replacing dir must not look like a date path or another route
+	if cfg.CustomDirLayout == customDirReplace && (isDigits(segments[0], 4) || slices.Contains(reservedNamespaces, strings.ToLower(segments[0]))) {
+		return "", fmt.Errorf("dir %q must not start with 4 digits or one of %s", value, strings.Join(reservedNamespaces, ", "))
+	}
+	dir := strings.Join(segments, "/")
+	if len(cfg.CustomDirs) != 0 && !slices.ContainsFunc(cfg.CustomDirs, func(prefix string) bool {
+		return dir == prefix || strings.HasPrefix(dir, prefix+"/")
+	}) {
+		return "", fmt.Errorf("dir %q must be one of, or below, %s", value, strings.Join(cfg.CustomDirs, ", "))
+	}
+	return dir, nil
+}
+
+// customRel reports whether the parts of a stored path are those of a file
+// in a custom dir: [namespace/][year/month/day/]dir/filename.
+func customRel(cfg *config, parts []string) bool {
+	if len(parts) < 2 {
+		return false
+	}
+	if cfg.NamespacePerUser && validNamespace(parts[0]) {
+		parts = parts[1:]
+	}
+	if cfg.CustomDirLayout == customDirNested {
+		if len(parts) < 5 || !isDigits(parts[0], 4) || !isDigits(parts[1], 2) || !isDigits(parts[2], 2) {
+			return false
+		}
+		parts = parts[3:]
+	}
+	dirs, filename := parts[:len(parts)-1], parts[len(parts)-1]
+	if len(dirs) == 0 || len(dirs) > maxCustomDirDepth || !validStoredName(filename) {
+		return false
+	}
+	for _, dir := range dirs {
+		if !validDirSegment(dir) {
+			return false
+		}
+	}
+	return true
+}
+
+// validateCustomDirs checks custom_dirs and custom_dir_layout.
+func (c *config) validateCustomDirs() []error {
+	var problems []error
+	switch c.CustomDirLayout {
+	case "":
+		c.CustomDirLayout = customDirReplace
+	case customDirReplace, customDirNested:
+	default:
+		problems = append(problems, fmt.Errorf("custom_dir_layout %q must be %s or %s", c.CustomDirLayout, customDirReplace, customDirNested))
+	}
+	for i, prefix := range c.CustomDirs {
+		segments, err := splitCustomDir(strings.TrimSpace(prefix))
+		if err != nil {
+			problems = append(problems, fmt.Errorf("custom_dirs: %w", err))
+			continue
+		}
+		c.CustomDirs[i] = strings.Join(segments, "/")
+	}
+	return problems
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestCustomDirTree checks that what goes through the whole tree sees the
+// files of custom dirs, with both layouts.
+func TestCustomDirTree(t *testing.T) {
+	for _, layout := range []string{customDirReplace, customDirNested} {
+		t.Run(layout, func(t *testing.T) {
+			cfg := testConfig(t, "allow_custom_dirs: true\ncustom_dir_layout: "+layout+"\nadmin_username: admin\nadmin_password: secret\n")
+			server := testServer(t, cfg)
+			routes := server.Routes()
+			custom := strings.TrimPrefix(downloadPath(t, testUpload(t, routes, "dump.sql", "backup", map[string]string{"dir": "backups/db"})), "/i/")
+			testUpload(t, routes, "notes.txt", "notes", nil)
+			if !strings.Contains(custom, "backups/db/") {
+				t.Fatalf("stored as %s", custom)
+			}
+
+			err := server.storageStats.scan(cfg)
+			if err != nil || server.storageStats.files != 2 || server.storageStats.bytes != int64(len("backup")+len("notes")) {
+				t.Errorf("the stats scan counted %d files of %d bytes: %v", server.storageStats.files, server.storageStats.bytes, err)
+			}
+			days, err := server.collectDayStats()
+			if err != nil || len(days) != 1 || days[0].Day != cfg.today().Format(dayLayout) || days[0].Files != 2 {
+				t.Errorf("day stats %+v: %v", days, err)
+			}
+			if paths, _ := searchPaths(t, routes, "q=.sql"); len(paths) != 1 || paths[0] != custom {
+				t.Errorf("search without the database found %v", paths)
+			}
+			entries, _, err := collectExport(cfg, cfg.today(), cfg.today())
+			if err != nil || len(entries) != 2 {
+				t.Errorf("export of today %+v: %v", entries, err)
+			}
+
+			// a database made afterwards learns them from the tree
+			index, err := openFileIndex(filepath.Join(t.TempDir(), "files.db"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer index.db.Close()
+			added, removed, err := index.reindex(cfg)
+			if err != nil || added != 2 || removed != 0 {
+				t.Errorf("reindex added %d, removed %d: %v", added, removed, err)
+			}
+			if _, found, _ := index.lookupPath(custom); !found {
+				t.Errorf("%s isn't indexed", custom)
+			}
+
+			// the admin delete takes it, the sweep its emptied dirs
+			req := httptest.NewRequest(http.MethodPost, "/admin/delete?from="+cfg.today().Format(dayLayout)+"&to="+cfg.today().Format(dayLayout), nil)
+			req.SetBasicAuth("admin", "secret")
+			res := httptest.NewRecorder()
+			routes.ServeHTTP(res, req)
+			if res.Code != http.StatusOK || storedFiles(t, cfg) != 0 || server.storageStats.files != 0 {
+				t.Errorf("delete: status %d, %d files left, %d counted", res.Code, storedFiles(t, cfg), server.storageStats.files)
+			}
+			old := time.Now().Add(-2 * gcGrace)
+			for dir := path.Dir(custom); dir != "."; dir = path.Dir(dir) {
+				os.Chtimes(filepath.Join(cfg.UploadDir, filepath.FromSlash(dir)), old, old)
+			}
+			removeEmptyDirs(cfg)
+			if _, err := os.Stat(filepath.Join(cfg.UploadDir, filepath.FromSlash(path.Dir(path.Dir(custom))))); !os.IsNotExist(err) {
+				t.Errorf("the custom dir is left: %v", err)
+			}
+		})
+	}
+}
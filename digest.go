@@ -0,0 +1,222 @@
+package main
+
+import (
+	"container/list"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Auth schemes for the auth_scheme config key.
+const (
+	authBasic  = "basic"
+	authDigest = "digest"
+)
+
+// defaultAuthRealm is the realm of both the Basic and the Digest challenge
+// unless auth_realm is set.
+const defaultAuthRealm = "file"
+
+// digestNonceLifetime is how long a Digest nonce is accepted.
+const digestNonceLifetime = 5 * time.Minute
+
+// maxDigestNonces caps the nonces tracked at once. Past it the oldest is
+// dropped, a client still holding it gets a stale challenge and retries.
+const maxDigestNonces = 10000
+
+// digestAlgorithms are the RFC 7616 algorithms offered, preferred first.
+var digestAlgorithms = map[string]func() hash.Hash{
+	"SHA-256": sha256.New,
+	"MD5":     md5.New,
+}
+
+// nonceStore tracks issued Digest nonces and the highest nc seen for each,
+// so a captured Authorization header can't be replayed.
+type nonceStore struct {
+	mu     sync.Mutex
+	max    int
+	nonces map[string]*list.Element
+	// order has the oldest first.
+	order *list.List
+}
+
+type digestNonce struct {
+	nonce  string
+	issued time.Time
+	nc     uint64
+}
+
+// newNonceStore tracks at most max nonces.
+func newNonceStore(max int) *nonceStore {
+	return &nonceStore{max: max, nonces: map[string]*list.Element{}, order: list.New()}
+}
+
+// issue returns a fresh nonce, dropping expired ones and, when the store
+// is full, the oldest.
+func (s *nonceStore) issue(now time.Time) string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	nonce := hex.EncodeToString(b)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for front := s.order.Front(); front != nil; front = s.order.Front() {
+		if s.order.Len() < s.max && now.Sub(front.Value.(*digestNonce).issued) <= digestNonceLifetime {
+			break
+		}
+		s.removeLocked(front)
+	}
+	s.nonces[nonce] = s.order.PushBack(&digestNonce{nonce: nonce, issued: now})
+	return nonce
+}
+
+func (s *nonceStore) removeLocked(elem *list.Element) {
+	s.order.Remove(elem)
+	delete(s.nonces, elem.Value.(*digestNonce).nonce)
+}
+
+// errStaleNonce is a correct response to an expired or unknown nonce, the
+// client may retry with a new one without asking the user again.
+var errStaleNonce = errors.New("stale nonce")
+
+// use accepts nc for nonce when it is higher than every nc seen before.
+func (s *nonceStore) use(nonce string, nc uint64, now time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	elem, ok := s.nonces[nonce]
+	if !ok {
+		return errStaleNonce
+	}
+	entry := elem.Value.(*digestNonce)
+	if now.Sub(entry.issued) > digestNonceLifetime {
+		s.removeLocked(elem)
+		return errStaleNonce
+	}
+	if nc <= entry.nc {
+		return errors.New("nonce count reused")
+	}
+	entry.nc = nc
+	return nil
+}
+
+// setChallenge adds the WWW-Authenticate headers of the configured scheme
+// to a 401.
+func (s *Server) setChallenge(w http.ResponseWriter, stale bool) {
+	if s.digestNonces == nil {
+		w.Header().Set("WWW-Authenticate", fmt.Sprintf("Basic realm=%q", s.cfg.AuthRealm))
+		return
+	}
+	nonce := s.digestNonces.issue(time.Now())
+	for _, algorithm := range []string{"SHA-256", "MD5"} {
+		challenge := fmt.Sprintf(`Digest realm=%q, qop="auth", algorithm=%s, nonce=%q`, s.cfg.AuthRealm, algorithm, nonce)
+		if stale {
+			challenge += ", stale=true"
+		}
+		w.Header().Add("WWW-Authenticate", challenge)
+	}
+}
+
+// parseDigestParams splits the comma separated key=value pairs of a Digest
+// Authorization header, unquoting quoted values.
+func parseDigestParams(s string) map[string]string {
+	params := map[string]string{}
+	for len(s) != 0 {
+		s = strings.TrimLeft(s, " ,")
+		key, rest, ok := strings.Cut(s, "=")
+		if !ok {
+			break
+		}
+		key = strings.ToLower(strings.TrimSpace(key))
+		rest = strings.TrimLeft(rest, " ")
+		var value string
+		if strings.HasPrefix(rest, `"`) {
+			var b strings.Builder
+			i := 1
+			for ; i < len(rest) && rest[i] != '"'; i++ {
+				if rest[i] == '\\' && i+1 < len(rest) {
+					i++
+				}
+				b.WriteByte(rest[i])
+			}
+			value = b.String()
+			s = rest[min(i+1, len(rest)):]
+		} else {
+			value, s, _ = strings.Cut(rest, ",")
+			value = strings.TrimSpace(value)
+		}
+		params[key] = value
+	}
+	return params
+}
+
+// digestUsername returns the username of a Digest Authorization header.
+func digestUsername(r *http.Request) (string, bool) {
+	scheme, rest, _ := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !strings.EqualFold(scheme, "Digest") {
+		return "", false
+	}
+	username, ok := parseDigestParams(rest)["username"]
+	return username, ok
+}
+
+// digestAuth checks a Digest Authorization header against username and
+// password and uses up its nonce count. It returns errStaleNonce when only
+// the nonce was wrong.
+func (s *Server) digestAuth(r *http.Request, username, password string) error {
+	nonce, nc, err := verifyDigest(r, s.cfg.AuthRealm, username, password)
+	if err != nil {
+		return err
+	}
+	return s.digestNonces.use(nonce, nc, time.Now())
+}
+
+// verifyDigest checks the response hash of a Digest Authorization header
+// made for realm, returning its nonce and nc.
+func verifyDigest(r *http.Request, realm, username, password string) (string, uint64, error) {
+	scheme, rest, _ := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !strings.EqualFold(scheme, "Digest") {
+		return "", 0, errors.New("invalid authorization type")
+	}
+	params := parseDigestParams(rest)
+	algorithm := params["algorithm"]
+	if len(algorithm) == 0 {
+		algorithm = "MD5"
+	}
+	newHash, ok := digestAlgorithms[strings.ToUpper(algorithm)]
+	if !ok {
+		return "", 0, fmt.Errorf("unsupported algorithm %q", algorithm)
+	}
+	if params["qop"] != "auth" || params["realm"] != realm {
+		return "", 0, errors.New("invalid qop or realm")
+	}
+	if params["uri"] != r.RequestURI {
+		return "", 0, errors.New("uri does not match the request")
+	}
+	nc, err := strconv.ParseUint(params["nc"], 16, 64)
+	if err != nil || len(params["cnonce"]) == 0 {
+		return "", 0, errors.New("invalid nc or cnonce")
+	}
+	digest := func(parts ...string) string {
+		h := newHash()
+		h.Write([]byte(strings.Join(parts, ":")))
+		return hex.EncodeToString(h.Sum(nil))
+	}
+	ha1 := digest(username, realm, password)
+	ha2 := digest(r.Method, params["uri"])
+	expected := digest(ha1, params["nonce"], params["nc"], params["cnonce"], params["qop"], ha2)
+	userOK := subtle.ConstantTimeCompare([]byte(params["username"]), []byte(username)) == 1
+	responseOK := subtle.ConstantTimeCompare([]byte(strings.ToLower(params["response"])), []byte(expected)) == 1
+	if !userOK || !responseOK {
+		return "", 0, errors.New("invalid credentials")
+	}
+	return params["nonce"], nc, nil
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestDigestRFC7616 checks the example exchange of RFC 7616 section 3.9.1,
+// with the MD5 response as corrected by its errata.
+func TestDigestRFC7616(t *testing.T) {
+	for _, test := range []struct {
+		algorithm string
+		response  string
+	}{
+		{"MD5", "8ca523f5e9506fed4657c9700eebdbec"},
+		{"SHA-256", "753927fa0e85d155564e2e272a28d1802ca10daf4496794697cf8db5856cb6c1"},
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/dir/index.html", nil)
+		req.Header.Set("Authorization", fmt.Sprintf(`Digest username="Mufasa", realm="http-auth@example.org", uri="/dir/index.html", algorithm=%s, nonce="7ypf/xlj9XXwfDPEoM4URrv/xwf94BcCAzFZH4GiTo0v", nc=00000001, cnonce="f2/wE4q74E6zIJEtWaHKaf5wv/H5QzzpXusqGemxURZJ", qop=auth, response="%s", opaque="FQhe/qaU925kfnzjCev0ciny7QMkPqMAFRtzCUYo5tdS"`, test.algorithm, test.response))
+		nonce, nc, err := verifyDigest(req, "http-auth@example.org", "Mufasa", "Circle of Life")
+		if err != nil || nonce != "7ypf/xlj9XXwfDPEoM4URrv/xwf94BcCAzFZH4GiTo0v" || nc != 1 {
+			t.Errorf("%s: nonce %q, nc %d, %v", test.algorithm, nonce, nc, err)
+		}
+		if _, _, err := verifyDigest(req, "http-auth@example.org", "Mufasa", "Circle of Death"); err == nil {
+			t.Errorf("%s: a wrong password passed", test.algorithm)
+		}
+		if _, _, err := verifyDigest(req, "file", "Mufasa", "Circle of Life"); err == nil {
+			t.Errorf("%s: another realm passed", test.algorithm)
+		}
+	}
+}
+
+func TestNonceStore(t *testing.T) {
+	now := time.Now()
+	store := newNonceStore(2)
+	first := store.issue(now)
+	if err := store.use(first, 1, now); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.use(first, 1, now); err == nil || errors.Is(err, errStaleNonce) {
+		t.Errorf("a reused nc: %v", err)
+	}
+	second, third := store.issue(now), store.issue(now)
+	if len(store.nonces) != 2 || store.order.Len() != 2 {
+		t.Errorf("%d nonces, %d in order, want the cap of 2", len(store.nonces), store.order.Len())
+	}
+	if err := store.use(first, 2, now); !errors.Is(err, errStaleNonce) {
+		t.Errorf("the evicted oldest: %v", err)
+	}
+	if err := store.use(second, 1, now); err != nil {
+		t.Errorf("second: %v", err)
+	}
+	if err := store.use(third, 1, now.Add(digestNonceLifetime+time.Second)); !errors.Is(err, errStaleNonce) {
+		t.Errorf("an expired nonce: %v", err)
+	}
+	store.issue(now.Add(2 * digestNonceLifetime))
+	if len(store.nonces) != 1 {
+		t.Errorf("%d nonces after the others expired", len(store.nonces))
+	}
+}
+
+func TestAuthRealm(t *testing.T) {
+	for _, scheme := range []string{authBasic, authDigest} {
+		routes := testServer(t, testConfig(t, "auth_scheme: "+scheme+"\nauth_realm: uploads@example.com\n")).Routes()
+		res := httptest.NewRecorder()
+		routes.ServeHTTP(res, httptest.NewRequest(http.MethodPost, "/upload", nil))
+		challenges := res.Header().Values("WWW-Authenticate")
+		if res.Code != http.StatusUnauthorized || len(challenges) == 0 {
+			t.Fatalf("%s: status %d, challenges %q", scheme, res.Code, challenges)
+		}
+		for _, challenge := range challenges {
+			if !strings.Contains(challenge, `realm="uploads@example.com"`) {
+				t.Errorf("%s: challenge %q", scheme, challenge)
+			}
+		}
+	}
+	if _, err := loadConfigFrom(strings.NewReader("upload_dir: /tmp\nusername: u\npassword: p\nauth_realm: \"a\\\"b\"\n"), ".yaml"); err == nil || !strings.Contains(err.Error(), "auth_realm") {
+		t.Errorf("a realm with a quote: %v", err)
+	}
+}
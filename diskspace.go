@@ -0,0 +1,60 @@
+package main
+
+import (
+	"errors"
+	"io/fs"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// diskSpaceTTL bounds how stale the cached free space figure may get, so busy
+// servers don't statfs on every upload.
+const diskSpaceTTL = 5 * time.Second
+
+var diskSpace struct {
+	sync.Mutex
+	dir     string
+	free    uint64
+	checked time.Time
+}
+
+// freeSpace returns the bytes available to unprivileged users on the
+// filesystem holding dir. A dir that doesn't exist yet is resolved to its
+// nearest existing parent.
+func freeSpace(dir string) (uint64, error) {
+	diskSpace.Lock()
+	defer diskSpace.Unlock()
+	if diskSpace.dir == dir && time.Since(diskSpace.checked) < diskSpaceTTL {
+		return diskSpace.free, nil
+	}
+	path := dir
+	for {
+		free, err := statfsFree(path)
+		if err == nil {
+			diskSpace.dir = dir
+			diskSpace.free = free
+			diskSpace.checked = time.Now()
+			return free, nil
+		}
+		parent := filepath.Dir(path)
+		if !errors.Is(err, fs.ErrNotExist) || parent == path {
+			return 0, err
+		}
+		path = parent
+	}
+}
+
+// hasFreeSpace reports whether an upload of contentLength bytes (-1 if
+// unknown) fits while keeping min_free_space available.
+func hasFreeSpace(cfg *config, contentLength int64) (uint64, bool, error) {
+	free, err := freeSpace(cfg.UploadDir)
+	if err != nil {
+		return 0, true, err
+	}
+	need := uint64(cfg.MinFreeSpace)
+	if contentLength > 0 {
+		need += uint64(contentLength)
+	}
+	return free, free >= need, nil
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+	"mime"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// maxFilenameBytes caps the filename sent in Content-Disposition.
+const maxFilenameBytes = 255
+
+// contentDisposition builds a Content-Disposition value per RFC 6266: an
+// ASCII filename for old clients, plus filename* (RFC 5987) with the UTF-8
+// name when the two differ. Control characters and path separators never
+// survive, so a filename can't break the header or name a directory.
+func contentDisposition(dispositionType, name string) string {
+	name = sanitizeFilename(name)
+	fallback := strings.Map(func(c rune) rune {
+		if c > unicode.MaxASCII || c == '"' || c == '\\' || c == '%' {
+			return '_'
+		}
+		return c
+	}, name)
+	value := mime.FormatMediaType(dispositionType, map[string]string{"filename": fallback})
+	if fallback != name {
+		value += "; filename*=UTF-8''" + encodeExtValue(name)
+	}
+	return value
+}
+
+// sanitizeFilename drops control characters, replaces path separators and
+// trims name to maxFilenameBytes without splitting a character.
+func sanitizeFilename(name string) string {
+	name = strings.Map(func(c rune) rune {
+		switch {
+		case c == '/' || c == '\\':
+			return '_'
+		case unicode.IsControl(c) || c == utf8.RuneError:
+			return -1
+		}
+		return c
+	}, name)
+	name = strings.TrimSpace(name)
+	if len(name) > maxFilenameBytes {
+		cut := maxFilenameBytes
+		for cut > 0 && !utf8.RuneStart(name[cut]) {
+			cut--
+		}
+		name = name[:cut]
+	}
+	if len(name) == 0 || name == "." || name == ".." {
+		return "file"
+	}
+	return name
+}
+
+// encodeExtValue percent-encodes everything but RFC 5987 attr-char.
+func encodeExtValue(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c < utf8.RuneSelf && (c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || strings.IndexByte("!#$&+-.^_`|~", c) >= 0) {
+			b.WriteByte(c)
+			continue
+		}
+		fmt.Fprintf(&b, "%%%02X", c)
+	}
+	return b.String()
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"mime"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestContentDisposition(t *testing.T) {
+	for _, test := range []struct {
+		name, filename, want string
+	}{
+		{"plain", "a.png", "inline; filename=a.png"},
+		{"quotes", `say "hi".txt`, `inline; filename="say _hi_.txt"; filename*=UTF-8''say%20%22hi%22.txt`},
+		{"backslash", `a\b.txt`, "inline; filename=a_b.txt"},
+		{"path", "../../etc/passwd", "inline; filename=.._.._etc_passwd"},
+		{"percent", "100%.txt", "inline; filename=100_.txt; filename*=UTF-8''100%25.txt"},
+		{"chinese", "报告.pdf", "inline; filename=__.pdf; filename*=UTF-8''%E6%8A%A5%E5%91%8A.pdf"},
+		{"emoji", "😀.png", "inline; filename=_.png; filename*=UTF-8''%F0%9F%98%80.png"},
+		{"accents", "naïve résumé.txt", `inline; filename="na_ve r_sum_.txt"; filename*=UTF-8''na%C3%AFve%20r%C3%A9sum%C3%A9.txt`},
+		{"header injection", "a\r\nSet-Cookie: x.txt", `inline; filename="aSet-Cookie: x.txt"`},
+		{"control characters", "a\x00b\x1f\x7f.txt", "inline; filename=ab.txt"},
+		{"invalid utf-8", "a\xffb.txt", "inline; filename=ab.txt"},
+		{"empty", "", "inline; filename=file"},
+		{"only controls", "\x00\n", "inline; filename=file"},
+		{"dot dot", "..", "inline; filename=file"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			if got := contentDisposition("inline", test.filename); got != test.want {
+				t.Errorf("got %s, want %s", got, test.want)
+			}
+		})
+	}
+}
+
+func TestContentDispositionLongNames(t *testing.T) {
+	for _, filename := range []string{
+		strings.Repeat("a", 1000) + ".txt",
+		strings.Repeat("é", 300) + ".txt",
+		strings.Repeat("😀", 100) + ".png",
+	} {
+		value := contentDisposition("attachment", filename)
+		_, params, err := mime.ParseMediaType(value)
+		if err != nil {
+			t.Fatalf("%s doesn't parse: %v", value, err)
+		}
+		// filename* decoded by mime is the UTF-8 name
+		name := params["filename"]
+		if len(name) > maxFilenameBytes || !utf8.ValidString(name) {
+			t.Errorf("%d bytes name %q", len(name), name)
+		}
+		if sanitized := sanitizeFilename(filename); len(sanitized) > maxFilenameBytes || !utf8.ValidString(sanitized) {
+			t.Errorf("sanitized to %d bytes, valid %v", len(sanitized), utf8.ValidString(sanitized))
+		}
+	}
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// Encrypted files are a header followed by AES-256-GCM sealed chunks of
+// encryptChunkSize plaintext bytes, the last one shorter or empty. Each
+// chunk is sealed with the header as additional data and a nonce of the
+// file's random prefix, the chunk number and a final flag, so chunks can't
+// be reordered, dropped or moved to another file, and any chunk can be
+// decrypted on its own for range requests.
+//
+//	magic [8]byte | key id [8]byte | chunk size uint32 | nonce prefix [7]byte
+const (
+	encryptMagic      = "FILEENC\x01"
+	encryptHeaderSize = 8 + 8 + 4 + 7
+	encryptChunkSize  = 64 << 10
+	encryptMaxChunk   = 16 << 20
+	encryptTagSize    = 16
+)
+
+var errCorruptEncrypted = errors.New("corrupt encrypted file")
+
+// encryptedSuffix is appended on disk to the name of encrypted files, after
+// compressedSuffix. Stored names have at most the one dot of their
+// extension, so one without an extension or ending in a dot gets a second
+// one: uuid is stored as uuid..enc and no upload can be named like an
+// encrypted file.
+const encryptedSuffix = ".enc"
+
+// encryptedName is the name on disk of name encrypted.
+func encryptedName(name string) string {
+	if !strings.Contains(name, ".") || strings.HasSuffix(name, ".") {
+		name += "."
+	}
+	return name + encryptedSuffix
+}
+
+// decryptedName undoes encryptedName, and reports whether name is the name
+// of an encrypted file.
+func decryptedName(name string) (string, bool) {
+	base := strings.TrimSuffix(name, encryptedSuffix)
+	if base == name || !strings.Contains(base, ".") {
+		return name, false
+	}
+	return strings.TrimSuffix(base, "."), true
+}
+
+// keyRing holds encryption_key for new files and old_encryption_keys for
+// reading files written before a rotation, by key id.
+type keyRing struct {
+	current [8]byte
+	keys    map[[8]byte]cipher.AEAD
+}
+
+// parseEncryptionKey accepts 32 bytes as hex or base64.
+func parseEncryptionKey(value string) ([]byte, error) {
+	value = strings.TrimSpace(value)
+	key, err := hex.DecodeString(value)
+	if err != nil {
+		key, err = base64.StdEncoding.DecodeString(value)
+	}
+	if err != nil {
+		key, err = base64.RawStdEncoding.DecodeString(value)
+	}
+	if err != nil || len(key) != 32 {
+		return nil, errors.New("must be 32 bytes as hex or base64")
+	}
+	return key, nil
+}
+func newKeyRing(current string, old []string) (*keyRing, error) {
+	ring := &keyRing{keys: map[[8]byte]cipher.AEAD{}}
+	for i, value := range append([]string{current}, old...) {
+		key, err := parseEncryptionKey(value)
+		if err != nil {
+			if i == 0 {
+				return nil, fmt.Errorf("encryption_key %w", err)
+			}
+			return nil, fmt.Errorf("old_encryption_keys[%d] %w", i-1, err)
+		}
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, err
+		}
+		// the id is a hash prefix, so it names the key without revealing it
+		sum := sha256.Sum256(key)
+		var id [8]byte
+		copy(id[:], sum[:8])
+		if i == 0 {
+			ring.current = id
+		}
+		ring.keys[id] = aead
+	}
+	return ring, nil
+}
+
+// chunkNonce is the nonce of chunk n of a file.
+func chunkNonce(prefix []byte, n uint32, final bool) []byte {
+	nonce := make([]byte, 12)
+	copy(nonce, prefix)
+	binary.BigEndian.PutUint32(nonce[7:], n)
+	if final {
+		nonce[11] = 1
+	}
+	return nonce
+}
+
+// encryptWriter seals what is written to it chunk by chunk. Close writes
+// the final chunk and must be called before the file is closed.
+type encryptWriter struct {
+	w      io.Writer
+	aead   cipher.AEAD
+	header []byte
+	chunk  uint32
+	buf    []byte
+}
+
+func newEncryptWriter(w io.Writer, ring *keyRing) (*encryptWriter, error) {
+	header := make([]byte, encryptHeaderSize)
+	copy(header, encryptMagic)
+	copy(header[8:], ring.current[:])
+	binary.BigEndian.PutUint32(header[16:], encryptChunkSize)
+	_, err := rand.Read(header[20:])
+	if err != nil {
+		return nil, err
+	}
+	_, err = w.Write(header)
+	if err != nil {
+		return nil, err
+	}
+	return &encryptWriter{w: w, aead: ring.keys[ring.current], header: header, buf: make([]byte, 0, encryptChunkSize)}, nil
+}
+
+// Write keeps up to a full chunk buffered, since only Close knows which
+// chunk is the last one.
+func (e *encryptWriter) Write(p []byte) (int, error) {
+	written := len(p)
+	for len(p) != 0 {
+		if len(e.buf) == encryptChunkSize {
+			err := e.seal(false)
+			if err != nil {
+				return 0, err
+			}
+		}
+		n := min(len(p), encryptChunkSize-len(e.buf))
+		e.buf = append(e.buf, p[:n]...)
+		p = p[n:]
+	}
+	return written, nil
+}
+func (e *encryptWriter) Close() error {
+	return e.seal(true)
+}
+func (e *encryptWriter) seal(final bool) error {
+	sealed := e.aead.Seal(nil, chunkNonce(e.header[20:], e.chunk, final), e.buf, e.header)
+	e.chunk++
+	e.buf = e.buf[:0]
+	_, err := e.w.Write(sealed)
+	return err
+}
+
+// decryptReader reads an encrypted file like the plain one, decrypting
+// only the chunks that are read.
+type decryptReader struct {
+	file      *os.File
+	aead      cipher.AEAD
+	header    []byte
+	chunkSize int64
+	chunks    int64
+	// body is the size of the sealed chunks, size that of the plain content.
+	body   int64
+	size   int64
+	offset int64
+	// current is the decrypted chunk number loaded, -1 for none.
+	current int64
+	plain   []byte
+}
+
+func newDecryptReader(ring *keyRing, file *os.File, header []byte, fileSize int64) (*decryptReader, error) {
+	if ring == nil {
+		return nil, errors.New("encrypted but no encryption_key is set")
+	}
+	var id [8]byte
+	copy(id[:], header[8:16])
+	aead, ok := ring.keys[id]
+	if !ok {
+		return nil, fmt.Errorf("encrypted with the unknown key id %x", id)
+	}
+	chunkSize := int64(binary.BigEndian.Uint32(header[16:20]))
+	body := fileSize - encryptHeaderSize
+	if chunkSize == 0 || chunkSize > encryptMaxChunk || body < encryptTagSize {
+		return nil, errCorruptEncrypted
+	}
+	sealedSize := chunkSize + encryptTagSize
+	chunks := (body + sealedSize - 1) / sealedSize
+	if body-(chunks-1)*sealedSize < encryptTagSize {
+		return nil, errCorruptEncrypted
+	}
+	return &decryptReader{
+		file:      file,
+		aead:      aead,
+		header:    header,
+		chunkSize: chunkSize,
+		chunks:    chunks,
+		body:      body,
+		size:      body - chunks*encryptTagSize,
+		current:   -1,
+	}, nil
+}
+func (d *decryptReader) Size() int64 {
+	return d.size
+}
+func (d *decryptReader) load(n int64) error {
+	if n == d.current {
+		return nil
+	}
+	sealedSize := d.chunkSize + encryptTagSize
+	sealed := make([]byte, min(sealedSize, d.body-n*sealedSize))
+	_, err := d.file.ReadAt(sealed, encryptHeaderSize+n*sealedSize)
+	if err != nil {
+		return err
+	}
+	plain, err := d.aead.Open(d.plain[:0], chunkNonce(d.header[20:], uint32(n), n == d.chunks-1), sealed, d.header)
+	if err != nil {
+		d.current = -1
+		return errCorruptEncrypted
+	}
+	d.plain = plain
+	d.current = n
+	return nil
+}
+func (d *decryptReader) Read(p []byte) (int, error) {
+	if d.offset >= d.size {
+		return 0, io.EOF
+	}
+	n := d.offset / d.chunkSize
+	err := d.load(n)
+	if err != nil {
+		return 0, err
+	}
+	read := copy(p, d.plain[d.offset-n*d.chunkSize:])
+	d.offset += int64(read)
+	return read, nil
+}
+func (d *decryptReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += d.offset
+	case io.SeekEnd:
+		offset += d.size
+	}
+	if offset < 0 {
+		return 0, errors.New("negative offset")
+	}
+	d.offset = offset
+	return offset, nil
+}
+func (d *decryptReader) Close() error {
+	return d.file.Close()
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var (
+	testKey    = strings.Repeat("11", 32)
+	testNewKey = strings.Repeat("22", 32)
+)
+
+// testContent is n bytes that differ from chunk to chunk.
+func testContent(n int) string {
+	content := make([]byte, n)
+	for i := range content {
+		content[i] = byte(i*7 + i/encryptChunkSize)
+	}
+	return string(content)
+}
+
+// encryptedUpload uploads content and returns its url path and file on disk.
+func encryptedUpload(t *testing.T, cfg *config, routes http.Handler, content string) (string, string) {
+	t.Helper()
+	path := downloadPath(t, testUpload(t, routes, "data.bin", content, nil))
+	diskPath, _, err := findStored(filepath.Join(cfg.UploadDir, filepath.FromSlash(strings.TrimPrefix(path, "/i/"))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path, diskPath
+}
+
+// fetch GETs path, with a Range header unless it is empty.
+func fetch(routes http.Handler, path, rangeHeader string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodGet, path, nil)
+	if len(rangeHeader) != 0 {
+		req.Header.Set("Range", rangeHeader)
+	}
+	res := httptest.NewRecorder()
+	routes.ServeHTTP(res, req)
+	return res
+}
+
+func TestEncryption(t *testing.T) {
+	cfg := testConfig(t, "encryption_key: "+testKey+"\n")
+	routes := testServer(t, cfg).Routes()
+	for _, size := range []int{100, encryptChunkSize, 2*encryptChunkSize + 100} {
+		content := testContent(size)
+		path, diskPath := encryptedUpload(t, cfg, routes, content)
+		if !strings.HasSuffix(diskPath, ".bin"+encryptedSuffix) {
+			t.Errorf("%d bytes stored as %s", size, diskPath)
+		}
+		disk, _ := os.ReadFile(diskPath)
+		chunks := max(1, (size+encryptChunkSize-1)/encryptChunkSize)
+		if len(disk) != encryptHeaderSize+size+chunks*encryptTagSize || bytes.Contains(disk, []byte(content[:64])) {
+			t.Errorf("%d bytes are %d on disk", size, len(disk))
+		}
+		if res := fetch(routes, path, ""); res.Body.String() != content {
+			t.Errorf("%d bytes downloaded as %d", size, res.Body.Len())
+		}
+		if size <= encryptChunkSize {
+			continue
+		}
+		// a range across the chunk boundary
+		res := fetch(routes, path, "bytes=65530-65545")
+		if res.Code != http.StatusPartialContent || res.Body.String() != content[65530:65546] {
+			t.Errorf("%d bytes: range %d %q", size, res.Code, res.Body)
+		}
+	}
+
+	// without the suffix nothing is decrypted, whatever the content
+	plain := testConfig(t, "")
+	plainRoutes := testServer(t, plain).Routes()
+	forged := encryptMagic + testContent(100)
+	path, diskPath := encryptedUpload(t, plain, plainRoutes, forged)
+	if strings.HasSuffix(diskPath, encryptedSuffix) {
+		t.Errorf("stored as %s without encryption_key", diskPath)
+	}
+	if res := fetch(plainRoutes, path, ""); res.Code != http.StatusOK || res.Body.String() != forged {
+		t.Errorf("a file starting like an encrypted one: %d %q", res.Code, res.Body)
+	}
+	plain.keys = cfg.keys
+	if res := fetch(testServer(t, plain).Routes(), path, ""); res.Code != http.StatusOK || res.Body.String() != forged {
+		t.Errorf("the same with encryption_key: %d %q", res.Code, res.Body)
+	}
+}
+
+func TestKeyRotation(t *testing.T) {
+	old := testConfig(t, "encryption_key: "+testKey+"\n")
+	oldPath, _ := encryptedUpload(t, old, testServer(t, old).Routes(), "written with the old key")
+
+	rotated := testConfig(t, "encryption_key: "+testNewKey+"\nold_encryption_keys: ["+testKey+"]\n")
+	rotated.UploadDir = old.UploadDir
+	routes := testServer(t, rotated).Routes()
+	if res := fetch(routes, oldPath, ""); res.Body.String() != "written with the old key" {
+		t.Errorf("the old file after the rotation: %d %q", res.Code, res.Body)
+	}
+	newPath, diskPath := encryptedUpload(t, rotated, routes, "written with the new key")
+	disk, _ := os.ReadFile(diskPath)
+	if !bytes.Equal(disk[8:16], rotated.keys.current[:]) || bytes.Equal(disk[8:16], old.keys.current[:]) {
+		t.Errorf("the new file names the key %x", disk[8:16])
+	}
+
+	// the old key is needed for the old file only
+	dropped := testConfig(t, "encryption_key: "+testNewKey+"\n")
+	dropped.UploadDir = old.UploadDir
+	routes = testServer(t, dropped).Routes()
+	if res := fetch(routes, newPath, ""); res.Body.String() != "written with the new key" {
+		t.Errorf("the new file without the old key: %d %q", res.Code, res.Body)
+	}
+	if res := fetch(routes, oldPath, ""); res.Code != http.StatusInternalServerError {
+		t.Errorf("the old file without its key: %d %q", res.Code, res.Body)
+	}
+}
+
+func TestCorruptEncrypted(t *testing.T) {
+	cfg := testConfig(t, "encryption_key: "+testKey+"\n")
+	routes := testServer(t, cfg).Routes()
+	content := testContent(2*encryptChunkSize + 100)
+	sealedSize := encryptChunkSize + encryptTagSize
+	for _, test := range []struct {
+		name   string
+		damage func([]byte) []byte
+	}{
+		{"a flipped byte in the second chunk", func(disk []byte) []byte {
+			disk[encryptHeaderSize+sealedSize+10] ^= 1
+			return disk
+		}},
+		{"a changed header", func(disk []byte) []byte {
+			disk[20] ^= 1
+			return disk
+		}},
+		{"swapped chunks", func(disk []byte) []byte {
+			first := bytes.Clone(disk[encryptHeaderSize : encryptHeaderSize+sealedSize])
+			copy(disk[encryptHeaderSize:], disk[encryptHeaderSize+sealedSize:encryptHeaderSize+2*sealedSize])
+			copy(disk[encryptHeaderSize+sealedSize:], first)
+			return disk
+		}},
+		{"truncated by a byte", func(disk []byte) []byte {
+			return disk[:len(disk)-1]
+		}},
+		{"truncated at a chunk boundary", func(disk []byte) []byte {
+			return disk[:encryptHeaderSize+2*sealedSize]
+		}},
+		{"truncated in the header", func(disk []byte) []byte {
+			return disk[:10]
+		}},
+	} {
+		path, diskPath := encryptedUpload(t, cfg, routes, content)
+		disk, _ := os.ReadFile(diskPath)
+		os.WriteFile(diskPath, test.damage(disk), 0o644)
+		if data, err := readStored(cfg, diskPath); !errors.Is(err, errCorruptEncrypted) {
+			t.Errorf("%s: read %d bytes, %v", test.name, len(data), err)
+		}
+		if res := fetch(routes, path, ""); res.Code == http.StatusOK && res.Body.String() == content {
+			t.Errorf("%s: downloaded whole", test.name)
+		}
+	}
+}
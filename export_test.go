@@ -0,0 +1,106 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"path/filepath"
+	"testing"
+)
+
+// writeFixtureTree stores a file yesterday and two today, one of them in
+// alice's namespace, and a fourth today that goes to the trash. It returns
+// the contents of the stored ones by rel.
+func writeFixtureTree(t *testing.T, server *Server) map[string]string {
+	t.Helper()
+	cfg := server.cfg
+	today := cfg.today().Format("2006/01/02")
+	files := map[string]string{
+		cfg.today().AddDate(0, 0, -1).Format("2006/01/02") + "/a.txt": "stored yesterday",
+		today + "/b.txt":            "stored today",
+		"alice/" + today + "/c.txt": "stored today by alice",
+	}
+	trashed := today + "/d.txt"
+	files[trashed] = "deleted today"
+	for rel, content := range files {
+		filePath := filepath.Join(cfg.UploadDir, filepath.FromSlash(rel))
+		os.MkdirAll(filepath.Dir(filePath), 0o755)
+		err := os.WriteFile(filePath, []byte(content), 0o644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := server.removeStored(trashed, filepath.Join(cfg.UploadDir, filepath.FromSlash(trashed)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	delete(files, trashed)
+	return files
+}
+
+func TestExport(t *testing.T) {
+	cfg := testConfig(t, "admin_username: admin\nadmin_password: secret\ntrash_retention: 30d\n")
+	server := testServer(t, cfg)
+	routes := server.Routes()
+	files := writeFixtureTree(t, server)
+	export := func(query string) (*httptest.ResponseRecorder, map[string]string) {
+		req := httptest.NewRequest(http.MethodGet, "/admin/export"+query, nil)
+		req.SetBasicAuth("admin", "secret")
+		res := httptest.NewRecorder()
+		routes.ServeHTTP(res, req)
+		if res.Code != http.StatusOK {
+			return res, nil
+		}
+		gz, err := gzip.NewReader(res.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		archive := tar.NewReader(gz)
+		entries := map[string]string{}
+		for {
+			header, err := archive.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			content, _ := io.ReadAll(archive)
+			entries[header.Name] = string(content)
+		}
+		return res, entries
+	}
+
+	_, entries := export("")
+	if len(entries) != len(files) {
+		t.Errorf("exported %v, want %v", entries, files)
+	}
+	for rel, content := range files {
+		if entries[rel] != content {
+			t.Errorf("%s exported as %q, want %q", rel, entries[rel], content)
+		}
+	}
+
+	today := cfg.today().Format(dayLayout)
+	res, entries := export("?from=" + today + "&to=" + today)
+	if want := "attachment; filename=files-" + today + "-" + today + ".tar.gz"; res.Header().Get("Content-Disposition") != want {
+		t.Errorf("Content-Disposition %q, want %q", res.Header().Get("Content-Disposition"), want)
+	}
+	if len(entries) != 2 {
+		t.Errorf("today exported %v", entries)
+	}
+	for rel := range entries {
+		if path.Base(rel) != "b.txt" && path.Base(rel) != "c.txt" {
+			t.Errorf("today exported %s", rel)
+		}
+	}
+
+	cfg.ExportMaxBytes = 10
+	if res, _ := export(""); res.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("over export_max_bytes: status %d", res.Code)
+	}
+}
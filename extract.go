@@ -0,0 +1,270 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/flate"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	defaultExtractMaxFiles = 1000
+	defaultExtractMaxBytes = 1 << 30
+)
+
+// extractError is an archive refused for what it contains, answered with
+// 422.
+type extractError string
+
+func (e extractError) Error() string {
+	return string(e)
+}
+
+// archiveKind is "zip" or "tar.gz" by the name of an upload, "" for
+// anything else.
+func archiveKind(name string) string {
+	lower := strings.ToLower(name)
+	switch {
+	case strings.HasSuffix(lower, ".zip"):
+		return "zip"
+	case strings.HasSuffix(lower, ".tar.gz"), strings.HasSuffix(lower, ".tgz"):
+		return "tar.gz"
+	}
+	return ""
+}
+
+// checkMemberName refuses absolute member paths and any with a ".." level.
+func checkMemberName(name string) error {
+	slashed := strings.ReplaceAll(name, `\`, "/")
+	if strings.HasPrefix(slashed, "/") || (len(slashed) >= 2 && slashed[1] == ':') {
+		return extractError(fmt.Sprintf("Member %q has an absolute path", name))
+	}
+	for _, segment := range strings.Split(slashed, "/") {
+		if segment == ".." {
+			return extractError(fmt.Sprintf("Member %q leaves the archive", name))
+		}
+	}
+	return nil
+}
+
+// archiveMember is one regular file of an archive.
+type archiveMember struct {
+	name string
+	// size is what the archive declares, the copy is limited anyway.
+	size int64
+	open func() (io.ReadCloser, error)
+}
+
+// extractor stores the members of one archive. Every stored file is
+// discarded again when one member fails.
+type extractor struct {
+	ctx       context.Context
+	server    *Server
+	namespace string
+	dir       string
+	files     int
+	bytes     int64
+	stored    []storedFile
+}
+
+func (e *extractor) add(member archiveMember) error {
+	err := checkMemberName(member.name)
+	if err != nil {
+		return err
+	}
+	e.files++
+	if e.files > e.server.cfg.ExtractMaxFiles {
+		return extractError(fmt.Sprintf("The archive has more than %d files", e.server.cfg.ExtractMaxFiles))
+	}
+	left := int64(e.server.cfg.ExtractMaxBytes) - e.bytes
+	if member.size > left {
+		return extractError(fmt.Sprintf("The archive expands to more than %d bytes", int64(e.server.cfg.ExtractMaxBytes)))
+	}
+	src, err := member.open()
+	if err != nil {
+		return extractError(fmt.Sprintf("Member %q can't be read: %v", member.name, err))
+	}
+	defer src.Close()
+	// a lying size header gets one byte past the limit, then it's refused
+	stored, err := e.server.storeUpload(e.ctx, e.namespace, e.dir, io.LimitReader(src, left+1), path.Base(filepath.ToSlash(member.name)), member.size, nil)
+	if err != nil {
+		if corruptArchive(err) {
+			return extractError(fmt.Sprintf("Member %q is corrupt", member.name))
+		}
+		return err
+	}
+	e.stored = append(e.stored, stored)
+	e.bytes += stored.Size
+	if e.bytes > int64(e.server.cfg.ExtractMaxBytes) {
+		return extractError(fmt.Sprintf("The archive expands to more than %d bytes", int64(e.server.cfg.ExtractMaxBytes)))
+	}
+	return nil
+}
+
+// corruptArchive reports whether err comes from reading a broken archive
+// rather than from storing.
+func corruptArchive(err error) bool {
+	var corrupt flate.CorruptInputError
+	return errors.Is(err, zip.ErrChecksum) || errors.Is(err, zip.ErrFormat) || errors.Is(err, gzip.ErrChecksum) ||
+		errors.Is(err, gzip.ErrHeader) || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, tar.ErrHeader) || errors.As(err, &corrupt)
+}
+
+// discard removes the files stored so far.
+func (e *extractor) discard() {
+	for _, stored := range e.stored {
+		diskPath, _, err := findStored(filepath.Join(e.server.cfg.UploadDir, filepath.FromSlash(stored.Rel)))
+		if err == nil {
+			os.Remove(diskPath)
+		}
+	}
+	e.stored = nil
+}
+
+// extractZip stores the regular files of a zip, refusing links.
+func (e *extractor) extractZip(archive io.ReaderAt, size int64) error {
+	reader, err := zip.NewReader(archive, size)
+	if err != nil {
+		return extractError("The upload is not a valid zip")
+	}
+	if len(reader.File) > e.server.cfg.ExtractMaxFiles {
+		return extractError(fmt.Sprintf("The archive has more than %d files", e.server.cfg.ExtractMaxFiles))
+	}
+	for _, file := range reader.File {
+		mode := file.Mode()
+		switch {
+		case mode.IsDir():
+			continue
+		case !mode.IsRegular():
+			return extractError(fmt.Sprintf("Member %q is a link or special file", file.Name))
+		}
+		err := e.add(archiveMember{name: file.Name, size: int64(min(file.UncompressedSize64, 1<<62)), open: file.Open})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// extractTarGz stores the regular files of a gzipped tar, refusing links.
+func (e *extractor) extractTarGz(archive io.Reader) error {
+	unpacked, err := gzip.NewReader(archive)
+	if err != nil {
+		return extractError("The upload is not a valid tar.gz")
+	}
+	defer unpacked.Close()
+	reader := tar.NewReader(unpacked)
+	for {
+		header, err := reader.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return extractError("The upload is not a valid tar.gz")
+		}
+		switch header.Typeflag {
+		case tar.TypeDir, tar.TypeXGlobalHeader:
+			continue
+		case tar.TypeReg:
+		default:
+			return extractError(fmt.Sprintf("Member %q is a link or special file", header.Name))
+		}
+		err = e.add(archiveMember{name: header.Name, size: header.Size, open: func() (io.ReadCloser, error) {
+			return io.NopCloser(reader), nil
+		}})
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// writeExtractResponse answers 201 listing the urls of the extracted
+// files as a JSON array, or one response_template per line. There is no
+// Location for several files.
+func writeExtractResponse(w http.ResponseWriter, r *http.Request, cfg *config, stored []storedFile) {
+	if prefersJSON(r) {
+		urls := []string{}
+		for _, file := range stored {
+			urls = append(urls, publicURL(r, cfg, file.Rel))
+		}
+		writeJSON(w, http.StatusCreated, urls)
+		return
+	}
+	var lines []string
+	for _, file := range stored {
+		line, err := plainUploadBody(r, cfg, file)
+		if err != nil {
+			slog.ErrorContext(r.Context(), "fail to render response_template", "path", file.Rel, "err", err)
+			line = publicURL(r, cfg, file.Rel)
+		}
+		lines = append(lines, line)
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(http.StatusCreated)
+	io.WriteString(w, strings.Join(lines, "\n")+"\n")
+}
+
+// extractUpload stores the files of an uploaded archive instead of the
+// archive, all of them or none.
+func (s *Server) extractUpload(w http.ResponseWriter, r *http.Request, file multipart.File, header *multipart.FileHeader, dir string, tags []string, private bool, digests []*digestCheck) {
+	if !s.cfg.AllowExtract {
+		writeError(w, r, http.StatusBadRequest, "extract is not allowed on this server")
+		return
+	}
+	kind := archiveKind(header.Filename)
+	if len(kind) == 0 {
+		writeError(w, r, http.StatusBadRequest, "extract needs a .zip, .tar.gz or .tgz upload")
+		return
+	}
+	// the digest headers are those of the archive itself
+	if len(digests) != 0 {
+		_, err := io.Copy(digestWriter(io.Discard, digests), file)
+		if err == nil {
+			_, err = file.Seek(0, io.SeekStart)
+		}
+		if err != nil {
+			s.writeStoreError(w, r, err)
+			return
+		}
+		if mismatch, ok := verifyDigests(digests); !ok {
+			s.writeStoreError(w, r, digestMismatchError(mismatch))
+			return
+		}
+	}
+	e := &extractor{ctx: r.Context(), server: s, namespace: requestNamespace(r, s.cfg), dir: dir}
+	var err error
+	if kind == "zip" {
+		err = e.extractZip(file, header.Size)
+	} else {
+		err = e.extractTarGz(file)
+	}
+	if err == nil && len(e.stored) == 0 {
+		err = extractError("The archive has no files")
+	}
+	if err != nil {
+		e.discard()
+		var refused extractError
+		if errors.As(err, &refused) {
+			writeErrorCode(w, r, http.StatusUnprocessableEntity, "extract_refused", err.Error())
+			return
+		}
+		s.writeStoreError(w, r, err)
+		return
+	}
+	for _, stored := range e.stored {
+		stored.Tags = tags
+		stored.Private = private
+		s.afterStore(r, stored)
+	}
+	writeExtractResponse(w, r, s.cfg, e.stored)
+}
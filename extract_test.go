@@ -0,0 +1,153 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"io/fs"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func zipArchive(t *testing.T, members map[string]string) string {
+	t.Helper()
+	var buf bytes.Buffer
+	archive := zip.NewWriter(&buf)
+	for name, content := range members {
+		w, err := archive.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write([]byte(content))
+	}
+	archive.Close()
+	return buf.String()
+}
+
+func tarGzArchive(t *testing.T, headers []*tar.Header, contents []string) string {
+	t.Helper()
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	archive := tar.NewWriter(gz)
+	for i, header := range headers {
+		header.Size = int64(len(contents[i]))
+		if err := archive.WriteHeader(header); err != nil {
+			t.Fatal(err)
+		}
+		archive.Write([]byte(contents[i]))
+	}
+	archive.Close()
+	gz.Close()
+	return buf.String()
+}
+
+// storedFiles counts the files below upload_dir.
+func storedFiles(t *testing.T, cfg *config) int {
+	t.Helper()
+	count := 0
+	filepath.WalkDir(cfg.UploadDir, func(_ string, entry fs.DirEntry, err error) error {
+		if err == nil && !entry.IsDir() {
+			count++
+		}
+		return nil
+	})
+	return count
+}
+
+func TestExtract(t *testing.T) {
+	cfg := testConfig(t, "allow_extract: true\n")
+	routes := testServer(t, cfg).Routes()
+
+	res := testUpload(t, routes, "photos.zip", zipArchive(t, map[string]string{"a/one.txt": "one", "two.png": "two"}), map[string]string{"extract": "1"})
+	if res.Code != http.StatusCreated {
+		t.Fatalf("zip status %d: %s", res.Code, res.Body)
+	}
+	urls := strings.Split(strings.TrimSpace(res.Body.String()), "\n")
+	if len(urls) != 2 {
+		t.Fatalf("zip answered %q", res.Body)
+	}
+	for _, url := range urls {
+		if !strings.HasSuffix(url, ".txt") && !strings.HasSuffix(url, ".png") {
+			t.Errorf("url %q doesn't keep the member extension", url)
+		}
+		get := httptest.NewRecorder()
+		routes.ServeHTTP(get, httptest.NewRequest(http.MethodGet, url[strings.Index(url, "/i/"):], nil))
+		if body := get.Body.String(); get.Code != http.StatusOK || (body != "one" && body != "two") {
+			t.Errorf("download %s: %d %q", url, get.Code, body)
+		}
+	}
+
+	archive := tarGzArchive(t, []*tar.Header{{Name: "dir/", Typeflag: tar.TypeDir, Mode: 0o755}, {Name: "dir/notes.md", Typeflag: tar.TypeReg, Mode: 0o644}}, []string{"", "# notes"})
+	res = testUpload(t, routes, "notes.tgz", archive, map[string]string{"extract": "true"})
+	if res.Code != http.StatusCreated {
+		t.Fatalf("tar.gz status %d: %s", res.Code, res.Body)
+	}
+	if url := strings.TrimSpace(res.Body.String()); !strings.HasSuffix(url, ".md") || strings.Contains(url, "\n") {
+		t.Errorf("tar.gz answered %q", url)
+	}
+	if got := storedFiles(t, cfg); got != 3 {
+		t.Errorf("%d stored files, want 3", got)
+	}
+}
+
+func TestExtractRefused(t *testing.T) {
+	cfg := testConfig(t, "allow_extract: true\nextract_max_files: 2\nextract_max_bytes: 10\n")
+	routes := testServer(t, cfg).Routes()
+	for _, test := range []struct {
+		name, filename, archive string
+	}{
+		{"dot dot", "a.zip", zipArchive(t, map[string]string{"ok.txt": "ok", "../evil.txt": "evil"})},
+		{"absolute", "a.zip", zipArchive(t, map[string]string{"ok.txt": "ok", "/etc/evil": "evil"})},
+		{"too many files", "a.zip", zipArchive(t, map[string]string{"a": "a", "b": "b", "c": "c"})},
+		{"too many bytes", "a.zip", zipArchive(t, map[string]string{"a": "123456", "b": "123456"})},
+		{"symlink", "a.tar.gz", tarGzArchive(t, []*tar.Header{{Name: "ok.txt", Typeflag: tar.TypeReg, Mode: 0o644}, {Name: "link", Typeflag: tar.TypeSymlink, Linkname: "/etc/passwd"}}, []string{"ok", ""})},
+		{"tar dot dot", "a.tgz", tarGzArchive(t, []*tar.Header{{Name: "ok.txt", Typeflag: tar.TypeReg, Mode: 0o644}, {Name: "a/../../evil", Typeflag: tar.TypeReg, Mode: 0o644}}, []string{"ok", "evil"})},
+		{"not an archive", "a.zip", "plain text"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			res := testUpload(t, routes, test.filename, test.archive, map[string]string{"extract": "1"})
+			if res.Code != http.StatusUnprocessableEntity {
+				t.Fatalf("status %d: %s", res.Code, res.Body)
+			}
+			if got := storedFiles(t, cfg); got != 0 {
+				t.Errorf("%d files left behind", got)
+			}
+		})
+	}
+}
+
+func TestExtractJSON(t *testing.T) {
+	cfg := testConfig(t, "allow_extract: true\n")
+	routes := testServer(t, cfg).Routes()
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	form.WriteField("extract", "1")
+	part, _ := form.CreateFormFile("file", "a.zip")
+	io.WriteString(part, zipArchive(t, map[string]string{"a.txt": "a", "b.txt": "b"}))
+	form.Close()
+	req := httptest.NewRequest(http.MethodPost, "/upload", &body)
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	req.Header.Set("Accept", "application/json")
+	req.SetBasicAuth("u", "p")
+	res := httptest.NewRecorder()
+	routes.ServeHTTP(res, req)
+	var urls []string
+	if err := json.Unmarshal(res.Body.Bytes(), &urls); err != nil || len(urls) != 2 {
+		t.Errorf("status %d, %q: %v", res.Code, res.Body, err)
+	}
+}
+
+func TestExtractDisabled(t *testing.T) {
+	cfg := testConfig(t, "")
+	res := testUpload(t, testServer(t, cfg).Routes(), "a.zip", zipArchive(t, map[string]string{"a.txt": "a"}), map[string]string{"extract": "1"})
+	if res.Code != http.StatusBadRequest {
+		t.Errorf("status %d: %s", res.Code, res.Body)
+	}
+}
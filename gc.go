@@ -0,0 +1,66 @@
+package main
+
+import (
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+)
+
+// gcGrace keeps freshly created directories, which an upload may be about
+// to write into, out of the sweep.
+const gcGrace = time.Minute
+
+// removeEmptyDirs removes every empty directory below UploadDir, deepest
+// first, so a day directory emptied by the sweep takes its month and year
+// along. Symlinks are never followed and UploadDir itself is kept. A
+// directory that gained a file since it was listed simply fails to be
+// removed and stays.
+func removeEmptyDirs(cfg *config) (int, error) {
+	root := filepath.Clean(cfg.UploadDir)
+	var dirs []string
+	err := filepath.WalkDir(root, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if !entry.IsDir() || path == root {
+			return nil
+		}
+		// The mtime is taken before the sweep, removing a child touches
+		// its parent.
+		info, err := entry.Info()
+		if err == nil && time.Since(info.ModTime()) >= gcGrace {
+			dirs = append(dirs, path)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	slices.Reverse(dirs)
+	removed := 0
+	for _, dir := range dirs {
+		if os.Remove(dir) == nil {
+			removed++
+		}
+	}
+	return removed, nil
+}
+
+// runGC sweeps empty directories every interval.
+func runGC(cfg *config, interval time.Duration) {
+	for range time.Tick(interval) {
+		removed, err := removeEmptyDirs(cfg)
+		if err != nil {
+			slog.Error("fail to remove empty directories", "err", err)
+		}
+		if removed != 0 {
+			slog.Info("removed empty directories", "count", removed)
+		}
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRemoveEmptyDirs(t *testing.T) {
+	cfg := testConfig(t, "")
+	root := cfg.UploadDir
+	old := time.Now().Add(-2 * gcGrace)
+	for _, dir := range []string{"2026/10/01", "2026/10/02", "2026/09/30", "2026/10/14"} {
+		os.MkdirAll(filepath.Join(root, dir), 0o755)
+	}
+	os.WriteFile(filepath.Join(root, "2026/10/02/a.txt"), []byte("a"), 0o644)
+	outside := t.TempDir()
+	os.Mkdir(filepath.Join(outside, "empty"), 0o755)
+	os.Symlink(outside, filepath.Join(root, "2026/10/02/link"))
+	// the parents are listed as old too, their mtime is taken before the
+	// sweep removes their children
+	for _, dir := range []string{"2026/10/01", "2026/10/02", "2026/09/30", "2026/09", "2026/10", "2026"} {
+		os.Chtimes(filepath.Join(root, dir), old, old)
+	}
+
+	removed, err := removeEmptyDirs(cfg)
+	if err != nil || removed != 3 {
+		t.Errorf("removed %d: %v", removed, err)
+	}
+	for dir, kept := range map[string]bool{
+		"2026/10/01": false,
+		"2026/09/30": false,
+		"2026/09":    false,
+		"2026/10/02": true,
+		// created within the grace, an upload may be about to use it
+		"2026/10/14": true,
+		"2026/10":    true,
+		"":           true,
+	} {
+		if _, err := os.Stat(filepath.Join(root, dir)); (err == nil) != kept {
+			t.Errorf("%q kept %v, want %v", dir, err == nil, kept)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(outside, "empty")); err != nil {
+		t.Errorf("the sweep followed a symlink: %v", err)
+	}
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"container/list"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	defaultCacheMaxFileSize = 256 << 10
+	// hotCacheRecheck is how long a cached file is served without a stat,
+	// to notice files changed behind the server's back.
+	hotCacheRecheck = time.Second
+)
+
+// hotCache keeps the original content of small downloaded files in
+// memory, dropping the least recently used past maxBytes. Deleting or
+// changing a file through the server removes it, files changed behind its
+// back are noticed within hotCacheRecheck.
+type hotCache struct {
+	mu       sync.Mutex
+	maxBytes int64
+	maxFile  int64
+	size     int64
+	entries  map[string]*list.Element
+	// order has the most recently used first.
+	order  *list.List
+	hits   int64
+	misses int64
+	// removes is the generation, a put of what was looked up before a
+	// remove could bring back what it removed.
+	removes uint64
+}
+
+type hotEntry struct {
+	rel      string
+	diskPath string
+	data     []byte
+	modTime  time.Time
+	// compressed, private and paste are what findStored and downloadFlags
+	// said.
+	compressed bool
+	private    bool
+	paste      bool
+	checked    time.Time
+	// generation is the cache's before the lookups the entry holds.
+	generation uint64
+}
+
+func newHotCache(maxBytes, maxFile int64) *hotCache {
+	return &hotCache{maxBytes: maxBytes, maxFile: maxFile, entries: map[string]*list.Element{}, order: list.New()}
+}
+
+// cacheable reports whether a file of size is kept.
+func (c *hotCache) cacheable(size int64) bool {
+	return c != nil && size <= c.maxFile && size <= c.maxBytes
+}
+
+// get returns the cached entry of rel, nil on a miss.
+func (c *hotCache) get(rel string) *hotEntry {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	elem, ok := c.entries[rel]
+	if !ok {
+		c.misses++
+		c.mu.Unlock()
+		return nil
+	}
+	c.order.MoveToFront(elem)
+	entry := elem.Value.(*hotEntry)
+	if time.Since(entry.checked) <= hotCacheRecheck {
+		c.hits++
+		c.mu.Unlock()
+		return entry
+	}
+	c.mu.Unlock()
+	info, err := os.Stat(entry.diskPath)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err != nil || !info.ModTime().Equal(entry.modTime) {
+		if c.entries[rel] == elem {
+			c.removeLocked(rel)
+		}
+		c.misses++
+		return nil
+	}
+	entry.checked = time.Now()
+	c.hits++
+	return entry
+}
+
+// generation is taken before looking up what a put caches.
+func (c *hotCache) generation() uint64 {
+	if c == nil {
+		return 0
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.removes
+}
+
+// put caches entry, replacing the one of the same file, unless something
+// was removed since its generation.
+func (c *hotCache) put(entry *hotEntry) {
+	if !c.cacheable(int64(len(entry.data))) {
+		return
+	}
+	entry.checked = time.Now()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if entry.generation != c.removes {
+		return
+	}
+	c.removeLocked(entry.rel)
+	c.entries[entry.rel] = c.order.PushFront(entry)
+	c.size += int64(len(entry.data))
+	for c.size > c.maxBytes {
+		c.removeLocked(c.order.Back().Value.(*hotEntry).rel)
+	}
+}
+
+// remove forgets rel, after it was deleted or changed.
+func (c *hotCache) remove(rel string) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.removes++
+	c.removeLocked(rel)
+}
+func (c *hotCache) removeLocked(rel string) {
+	elem, ok := c.entries[rel]
+	if !ok {
+		return
+	}
+	c.order.Remove(elem)
+	delete(c.entries, rel)
+	c.size -= int64(len(elem.Value.(*hotEntry).data))
+}
+
+type hotCacheStats struct {
+	Files    int     `json:"files"`
+	Bytes    int64   `json:"bytes"`
+	MaxBytes int64   `json:"max_bytes"`
+	Hits     int64   `json:"hits"`
+	Misses   int64   `json:"misses"`
+	HitRatio float64 `json:"hit_ratio"`
+}
+
+// stats is nil when the cache is off.
+func (c *hotCache) stats() *hotCacheStats {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	stats := &hotCacheStats{Files: len(c.entries), Bytes: c.size, MaxBytes: c.maxBytes, Hits: c.hits, Misses: c.misses}
+	if lookups := c.hits + c.misses; lookups != 0 {
+		stats.HitRatio = float64(c.hits) / float64(lookups)
+	}
+	return stats
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeDayFile stores content as a file uploaded on 2026-10-14.
+func writeDayFile(t testing.TB, cfg *config, name, content string) {
+	t.Helper()
+	dir := filepath.Join(cfg.UploadDir, "2026", "10", "14")
+	os.MkdirAll(dir, 0755)
+	err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestHotCache(t *testing.T) {
+	cfg := testConfig(t, "cache_max_bytes: 1KB\ncache_max_file_size: 512B\n")
+	server := testServer(t, cfg)
+	routes := server.Routes()
+	writeDayFile(t, cfg, "small.txt", "hello")
+	writeDayFile(t, cfg, "large.bin", strings.Repeat("x", 600))
+	get := func(name string, header ...string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/i/2026/10/14/"+name, nil)
+		for i := 0; i+1 < len(header); i += 2 {
+			req.Header.Set(header[i], header[i+1])
+		}
+		res := httptest.NewRecorder()
+		routes.ServeHTTP(res, req)
+		return res
+	}
+
+	miss, hit := get("small.txt"), get("small.txt")
+	if hit.Code != http.StatusOK || hit.Body.String() != "hello" {
+		t.Fatalf("hit status %d: %q", hit.Code, hit.Body)
+	}
+	for _, key := range []string{"ETag", "Last-Modified", "Content-Type", "Cache-Control"} {
+		if miss.Header().Get(key) != hit.Header().Get(key) || len(hit.Header().Get(key)) == 0 {
+			t.Errorf("%s %q on a miss, %q on a hit", key, miss.Header().Get(key), hit.Header().Get(key))
+		}
+	}
+	if stats := server.hotFiles.stats(); stats.Hits != 1 || stats.Misses != 1 || stats.Files != 1 || stats.Bytes != 5 {
+		t.Errorf("stats %+v", stats)
+	}
+	if res := get("small.txt", "If-None-Match", hit.Header().Get("ETag")); res.Code != http.StatusNotModified {
+		t.Errorf("If-None-Match status %d", res.Code)
+	}
+	if res := get("small.txt", "Range", "bytes=1-2"); res.Code != http.StatusPartialContent || res.Body.String() != "el" {
+		t.Errorf("range status %d: %q", res.Code, res.Body)
+	}
+	get("large.bin")
+	if stats := server.hotFiles.stats(); stats.Files != 1 {
+		t.Errorf("large.bin got cached, %+v", stats)
+	}
+
+	// changed behind the server's back, seen once the entry is rechecked
+	path := filepath.Join(cfg.UploadDir, "2026", "10", "14", "small.txt")
+	os.WriteFile(path, []byte("changed"), 0644)
+	os.Chtimes(path, time.Now(), time.Now().Add(time.Hour))
+	server.hotFiles.entries["2026/10/14/small.txt"].Value.(*hotEntry).checked = time.Time{}
+	if res := get("small.txt"); res.Body.String() != "changed" {
+		t.Errorf("after a change %q", res.Body)
+	}
+
+	_, err := server.deleteFiles([]string{"2026/10/14/small.txt"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res := get("small.txt"); res.Code != http.StatusNotFound {
+		t.Errorf("after delete status %d", res.Code)
+	}
+}
+
+func TestHotCacheEviction(t *testing.T) {
+	cache := newHotCache(10, 10)
+	for _, rel := range []string{"a", "b"} {
+		cache.put(&hotEntry{rel: rel, data: []byte("1234")})
+	}
+	cache.get("a")
+	cache.put(&hotEntry{rel: "c", data: []byte("1234")})
+	for rel, want := range map[string]bool{"a": true, "b": false, "c": true} {
+		if _, ok := cache.entries[rel]; ok != want {
+			t.Errorf("%s cached %v, want %v", rel, ok, want)
+		}
+	}
+	if cache.size != 8 {
+		t.Errorf("size %d", cache.size)
+	}
+}
+
+// BenchmarkDownload serves one small file from many goroutines. Uncached
+// every request stats, opens, reads and closes it; cached only one stat a
+// second is left.
+func BenchmarkDownload(b *testing.B) {
+	for _, bench := range []struct{ name, config string }{
+		{"uncached", ""},
+		{"cached", "cache_max_bytes: 1MB\n"},
+	} {
+		b.Run(bench.name, func(b *testing.B) {
+			cfg := testConfig(b, bench.config)
+			routes := testServer(b, cfg).Routes()
+			writeDayFile(b, cfg, "icon.png", strings.Repeat("p", 4<<10))
+			b.ReportAllocs()
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					res := httptest.NewRecorder()
+					routes.ServeHTTP(res, httptest.NewRequest(http.MethodGet, "/i/2026/10/14/icon.png", nil))
+					if res.Code != http.StatusOK {
+						b.Errorf("status %d", res.Code)
+					}
+				}
+			})
+		})
+	}
+}
+
+// TestHotCacheStalePut puts what a download looked up before a PATCH
+// removed the entry, which must not come back.
+func TestHotCacheStalePut(t *testing.T) {
+	cache := newHotCache(10, 10)
+	cache.put(&hotEntry{rel: "a", data: []byte("1234")})
+	generation := cache.generation()
+	cache.remove("a")
+	cache.put(&hotEntry{rel: "a", data: []byte("1234"), private: false, generation: generation})
+	if cache.get("a") != nil {
+		t.Error("a put older than the remove was cached")
+	}
+	cache.put(&hotEntry{rel: "a", data: []byte("1234"), private: true, generation: cache.generation()})
+	if entry := cache.get("a"); entry == nil || !entry.private {
+		t.Errorf("a fresh put: %+v", entry)
+	}
+}
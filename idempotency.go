@@ -0,0 +1,317 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	defaultIdempotencyRetention = 24 * time.Hour
+	defaultIdempotencyMaxKeys   = 10000
+	idempotencyPruneEvery       = time.Minute
+	maxIdempotencyKeyLength     = 255
+)
+
+var (
+	errIdempotencyConflict = errors.New("Idempotency-Key was used for a different upload")
+	errIdempotencyBusy     = errors.New("An upload with this Idempotency-Key is in progress")
+)
+
+// idempotentUpload is the response of a finished upload made under an
+// Idempotency-Key, replayed to retries of the same file: name, size and
+// SHA-256 of the form's file part.
+type idempotentUpload struct {
+	Name        string    `json:"name"`
+	Size        int64     `json:"size"`
+	SHA256      string    `json:"sha256"`
+	Path        string    `json:"path"`
+	ContentType string    `json:"content_type"`
+	Body        []byte    `json:"body"`
+	StoredAt    time.Time `json:"stored_at"`
+}
+
+// idempotencyStore remembers the uploads of the last retention window by
+// user and Idempotency-Key, at most maxKeys of them, persisted so restarts
+// don't forget them. The state file is only read and written once an
+// upload uses the header.
+type idempotencyStore struct {
+	mu        sync.Mutex
+	path      string
+	retention time.Duration
+	maxKeys   int
+	// loaded tells whether entries holds the state file yet.
+	loaded  bool
+	entries map[string]*idempotentUpload
+	// running holds the keys of uploads in progress.
+	running map[string]bool
+	// changes counts the changes to entries, saved is the count the state
+	// file has.
+	changes, saved int64
+}
+
+func newIdempotencyStore(cfg *config) *idempotencyStore {
+	return &idempotencyStore{
+		path:      cfg.IdempotencyStateFile,
+		retention: time.Duration(cfg.IdempotencyRetention),
+		maxKeys:   cfg.IdempotencyMaxKeys,
+		entries:   map[string]*idempotentUpload{},
+		running:   map[string]bool{},
+	}
+}
+
+// readState decodes the state file, which may not exist yet.
+func (s *idempotencyStore) readState() (map[string]*idempotentUpload, error) {
+	entries := map[string]*idempotentUpload{}
+	data, err := os.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return entries, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("fail to read idempotency state\n%w", err)
+	}
+	err = json.Unmarshal(data, &entries)
+	if err != nil {
+		return nil, fmt.Errorf("fail to decode idempotency state\n%w", err)
+	}
+	return entries, nil
+}
+
+// loadLocked reads the state file at the first use.
+func (s *idempotencyStore) loadLocked() error {
+	if s.loaded {
+		return nil
+	}
+	entries, err := s.readState()
+	if err != nil {
+		return err
+	}
+	s.entries, s.loaded = entries, true
+	return nil
+}
+
+// catchUp adds the keys the process that handed over to this one saved
+// after this one loaded the state, if it did already.
+func (s *idempotencyStore) catchUp() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.loaded {
+		return nil
+	}
+	entries, err := s.readState()
+	if err != nil {
+		return err
+	}
+	for key, entry := range entries {
+		if _, ok := s.entries[key]; !ok {
+			s.entries[key] = entry
+			s.changes++
+		}
+	}
+	s.pruneLocked(time.Now())
+	return nil
+}
+
+// begin returns the remembered upload of key, or reserves key for a new
+// upload.
+func (s *idempotencyStore) begin(key string, now time.Time) (*idempotentUpload, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	err := s.loadLocked()
+	if err != nil {
+		return nil, err
+	}
+	if entry, ok := s.entries[key]; ok && now.Sub(entry.StoredAt) < s.retention {
+		return entry, nil
+	}
+	if s.running[key] {
+		return nil, errIdempotencyBusy
+	}
+	s.running[key] = true
+	return nil, nil
+}
+
+// finish releases key, remembering entry unless the upload failed. The
+// state is saved by run.
+func (s *idempotencyStore) finish(key string, entry *idempotentUpload) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.running, key)
+	if entry == nil {
+		return
+	}
+	s.entries[key] = entry
+	s.changes++
+	if len(s.entries) > s.maxKeys {
+		keys := make([]string, 0, len(s.entries))
+		for key := range s.entries {
+			keys = append(keys, key)
+		}
+		sort.Slice(keys, func(i, j int) bool { return s.entries[keys[i]].StoredAt.Before(s.entries[keys[j]].StoredAt) })
+		for _, key := range keys[:len(keys)-s.maxKeys] {
+			delete(s.entries, key)
+		}
+	}
+}
+
+// run drops expired keys and saves the state periodically, forever.
+func (s *idempotencyStore) run() {
+	for now := range time.Tick(idempotencyPruneEvery) {
+		s.mu.Lock()
+		s.pruneLocked(now)
+		s.mu.Unlock()
+		err := s.save()
+		if err != nil {
+			slog.Error("fail to save idempotency state", "err", err)
+		}
+	}
+}
+func (s *idempotencyStore) pruneLocked(now time.Time) {
+	for key, entry := range s.entries {
+		if now.Sub(entry.StoredAt) >= s.retention {
+			delete(s.entries, key)
+			s.changes++
+		}
+	}
+}
+
+// save writes the state file when it changed since the last save.
+func (s *idempotencyStore) save() error {
+	s.mu.Lock()
+	if s.changes == s.saved {
+		s.mu.Unlock()
+		return nil
+	}
+	data, err := json.Marshal(s.entries)
+	changes := s.changes
+	s.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	tmp := s.path + ".tmp"
+	err = os.WriteFile(tmp, data, 0600)
+	if err == nil {
+		err = os.Rename(tmp, s.path)
+	}
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	s.saved = max(s.saved, changes)
+	s.mu.Unlock()
+	return nil
+}
+
+// idempotentRequest is an upload made under an Idempotency-Key.
+type idempotentRequest struct {
+	store *idempotencyStore
+	key   string
+	// replay is the finished upload of key, which replayed answers with.
+	replay *idempotentUpload
+	entry  *idempotentUpload
+}
+
+// startIdempotent handles the Idempotency-Key header of an authenticated
+// upload, refusing it while another one with the key runs. The request is
+// nil without the header.
+func (s *Server) startIdempotent(w http.ResponseWriter, r *http.Request) (*idempotentRequest, bool) {
+	cfg := s.cfg
+	key := r.Header.Get("Idempotency-Key")
+	if len(key) == 0 {
+		return nil, true
+	}
+	if !validIdempotencyKey(key) {
+		writeError(w, r, http.StatusBadRequest, fmt.Sprintf("Idempotency-Key must be at most %d printable characters", maxIdempotencyKeyLength))
+		return nil, false
+	}
+	// keys are per user, one can't replay another's upload
+	req := &idempotentRequest{store: s.idempotency, key: requestUsername(r, cfg) + "\x00" + key}
+	replay, err := s.idempotency.begin(req.key, time.Now())
+	if errors.Is(err, errIdempotencyBusy) {
+		writeError(w, r, http.StatusConflict, err.Error())
+		return nil, false
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "fail to load idempotency state", "err", err)
+		writeError(w, r, http.StatusInternalServerError, "")
+		return nil, false
+	}
+	req.replay = replay
+	return req, true
+}
+
+// replayed answers a retry of a finished upload with its response, as 200
+// since nothing new was created, once the form's file part is known, and
+// refuses another file under the key. It returns false when the upload is
+// new.
+func (req *idempotentRequest) replayed(w http.ResponseWriter, r *http.Request, cfg *config, header *multipart.FileHeader, file io.Reader) bool {
+	if req == nil || req.replay == nil {
+		return false
+	}
+	hash := sha256.New()
+	size, err := io.Copy(hash, file)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "fail to read the form file", "err", err)
+		writeError(w, r, http.StatusInternalServerError, "")
+		return true
+	}
+	replay := req.replay
+	if header.Filename != replay.Name || size != replay.Size || hex.EncodeToString(hash.Sum(nil)) != replay.SHA256 {
+		writeError(w, r, http.StatusConflict, errIdempotencyConflict.Error())
+		return true
+	}
+	w.Header().Set("Content-Type", replay.ContentType)
+	w.Header().Set("Idempotent-Replayed", "true")
+	w.Header().Set("Location", publicURL(r, cfg, replay.Path))
+	w.WriteHeader(http.StatusOK)
+	w.Write(replay.Body)
+	return true
+}
+
+func validIdempotencyKey(key string) bool {
+	if len(key) > maxIdempotencyKeyLength {
+		return false
+	}
+	for _, c := range key {
+		if c < ' ' || c > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// remember records the response of the stored upload of the file part
+// name for retries.
+func (req *idempotentRequest) remember(r *http.Request, cfg *config, name string, stored storedFile) {
+	if req == nil {
+		return
+	}
+	contentType, body := uploadResponse(r, cfg, stored)
+	req.entry = &idempotentUpload{
+		Name:        name,
+		Size:        stored.Size,
+		SHA256:      stored.SHA256,
+		Path:        stored.Rel,
+		ContentType: contentType,
+		Body:        body,
+		StoredAt:    stored.StoredAt,
+	}
+}
+
+// release frees the key, keeping the response if there is one. A replay
+// holds no key.
+func (req *idempotentRequest) release() {
+	if req != nil && req.replay == nil {
+		req.store.finish(req.key, req.entry)
+	}
+}
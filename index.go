@@ -0,0 +1,498 @@
+package main
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+const indexSchema = `
+CREATE TABLE IF NOT EXISTS files (
+	path          TEXT PRIMARY KEY,
+	name          TEXT NOT NULL,
+	original_name TEXT NOT NULL,
+	size          INTEGER NOT NULL,
+	content_type  TEXT NOT NULL,
+	sha256        TEXT NOT NULL,
+	uploader      TEXT NOT NULL,
+	uploaded_at   INTEGER NOT NULL,
+	expires_at    INTEGER,
+	private       INTEGER NOT NULL DEFAULT 0,
+	disk_size     INTEGER NOT NULL DEFAULT 0,
+	paste         INTEGER NOT NULL DEFAULT 0
+);
+CREATE INDEX IF NOT EXISTS files_name ON files (name);
+CREATE INDEX IF NOT EXISTS files_uploaded_at ON files (uploaded_at);
+CREATE TABLE IF NOT EXISTS tags (
+	path TEXT NOT NULL,
+	tag  TEXT NOT NULL,
+	PRIMARY KEY (path, tag)
+);
+CREATE INDEX IF NOT EXISTS tags_tag ON tags (tag);
+`
+
+// indexColumns are added to files tables created by older versions.
+var indexColumns = []struct{ name, definition string }{
+	{"private", "INTEGER NOT NULL DEFAULT 0"},
+	// filled with size by migrateIndex, nothing was compressed before it
+	{"disk_size", "INTEGER NOT NULL DEFAULT 0"},
+	{"paste", "INTEGER NOT NULL DEFAULT 0"},
+}
+
+// fileIndex is the optional SQLite metadata index of every stored file,
+// enabled by the database config option.
+type fileIndex struct {
+	db *sql.DB
+}
+
+// fileRecord is one row of the index.
+type fileRecord struct {
+	Path         string     `json:"path"`
+	OriginalName string     `json:"original_name"`
+	Size         int64      `json:"size"`
+	DiskSize     int64      `json:"disk_size"`
+	ContentType  string     `json:"content_type"`
+	SHA256       string     `json:"sha256"`
+	Uploader     string     `json:"uploader"`
+	UploadedAt   time.Time  `json:"uploaded_at"`
+	ExpiresAt    *time.Time `json:"expires_at,omitempty"`
+	Tags         []string   `json:"tags"`
+	Private      bool       `json:"private"`
+	Paste        bool       `json:"paste"`
+}
+
+func openFileIndex(path string) (*fileIndex, error) {
+	db, err := sql.Open("sqlite", "file:"+path+"?_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)")
+	if err != nil {
+		return nil, fmt.Errorf("fail to open database\n%w", err)
+	}
+	_, err = db.Exec(indexSchema)
+	if err == nil {
+		err = migrateIndex(db)
+	}
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("fail to create database schema\n%w", err)
+	}
+	return &fileIndex{db: db}, nil
+}
+
+// migrateIndex adds the indexColumns an existing files table lacks.
+func migrateIndex(db *sql.DB) error {
+	rows, err := db.Query(`SELECT name FROM pragma_table_info('files')`)
+	if err != nil {
+		return err
+	}
+	have := map[string]bool{}
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			rows.Close()
+			return err
+		}
+		have[name] = true
+	}
+	rows.Close()
+	for _, column := range indexColumns {
+		if have[column.name] {
+			continue
+		}
+		_, err := db.Exec(`ALTER TABLE files ADD COLUMN ` + column.name + ` ` + column.definition)
+		if err != nil {
+			return err
+		}
+		if column.name == "disk_size" {
+			_, err = db.Exec(`UPDATE files SET disk_size = size`)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+func (x *fileIndex) insert(record fileRecord) error {
+	tx, err := x.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	var expiresAt any
+	if record.ExpiresAt != nil {
+		expiresAt = record.ExpiresAt.Unix()
+	}
+	_, err = tx.Exec(
+		`INSERT OR REPLACE INTO files (path, name, original_name, size, content_type, sha256, uploader, uploaded_at, expires_at, private, disk_size, paste)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		record.Path, filepath.Base(record.Path), record.OriginalName, record.Size, record.ContentType,
+		record.SHA256, record.Uploader, record.UploadedAt.Unix(), expiresAt, record.Private, record.DiskSize, record.Paste,
+	)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`DELETE FROM tags WHERE path = ?`, record.Path)
+	if err != nil {
+		return err
+	}
+	for _, tag := range record.Tags {
+		_, err = tx.Exec(`INSERT OR IGNORE INTO tags (path, tag) VALUES (?, ?)`, record.Path, tag)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+func (x *fileIndex) delete(path string) error {
+	tx, err := x.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	_, err = tx.Exec(`DELETE FROM files WHERE path = ?`, path)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`DELETE FROM tags WHERE path = ?`, path)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// loadTags fills in the tags of records.
+func (x *fileIndex) loadTags(records []fileRecord) error {
+	for i := range records {
+		rows, err := x.db.Query(`SELECT tag FROM tags WHERE path = ? ORDER BY tag`, records[i].Path)
+		if err != nil {
+			return err
+		}
+		records[i].Tags = []string{}
+		for rows.Next() {
+			var tag string
+			if err := rows.Scan(&tag); err != nil {
+				rows.Close()
+				return err
+			}
+			records[i].Tags = append(records[i].Tags, tag)
+		}
+		rows.Close()
+	}
+	return nil
+}
+
+const recordColumns = `path, original_name, size, content_type, sha256, uploader, uploaded_at, expires_at, private, disk_size, paste`
+
+func scanRecord(row interface{ Scan(...any) error }) (fileRecord, error) {
+	var record fileRecord
+	var uploadedAt int64
+	var expiresAt sql.NullInt64
+	err := row.Scan(&record.Path, &record.OriginalName, &record.Size, &record.ContentType,
+		&record.SHA256, &record.Uploader, &uploadedAt, &expiresAt, &record.Private, &record.DiskSize, &record.Paste)
+	record.UploadedAt = time.Unix(uploadedAt, 0).UTC()
+	if expiresAt.Valid {
+		expires := time.Unix(expiresAt.Int64, 0).UTC()
+		record.ExpiresAt = &expires
+	}
+	return record, err
+}
+
+// lookupName finds a file by its stored name, returning false when the
+// index doesn't know it.
+func (x *fileIndex) lookupName(name string) (fileRecord, bool, error) {
+	return x.lookup(`name = ?`, name)
+}
+
+// lookupPath finds a file by its path relative to UploadDir.
+func (x *fileIndex) lookupPath(rel string) (fileRecord, bool, error) {
+	return x.lookup(`path = ?`, rel)
+}
+func (x *fileIndex) lookup(where string, arg any) (fileRecord, bool, error) {
+	record, err := scanRecord(x.db.QueryRow(`SELECT `+recordColumns+` FROM files WHERE `+where, arg))
+	if errors.Is(err, sql.ErrNoRows) {
+		return record, false, nil
+	}
+	if err != nil {
+		return record, false, err
+	}
+	records := []fileRecord{record}
+	err = x.loadTags(records)
+	return records[0], err == nil, err
+}
+
+// setPrivate changes the visibility of a file, returning false when the
+// index doesn't know it.
+func (x *fileIndex) setPrivate(rel string, private bool) (bool, error) {
+	result, err := x.db.Exec(`UPDATE files SET private = ? WHERE path = ?`, private, rel)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n != 0, err
+}
+
+// setContent records the new size and sha256 of a replaced file,
+// returning false when the index doesn't know it.
+func (x *fileIndex) setContent(rel string, size, diskSize int64, sha string) (bool, error) {
+	result, err := x.db.Exec(`UPDATE files SET size = ?, disk_size = ?, sha256 = ? WHERE path = ?`, size, diskSize, sha, rel)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n != 0, err
+}
+
+// downloadFlags reports whether rel needs credentials to download and
+// whether /paste made it. Without the index every file is a public upload.
+func (s *Server) downloadFlags(rel string) (private, paste bool, err error) {
+	if s.metaIndex == nil {
+		return false, false, nil
+	}
+	err = s.metaIndex.db.QueryRow(`SELECT private, paste FROM files WHERE path = ?`, rel).Scan(&private, &paste)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, false, nil
+	}
+	return private, paste, err
+}
+
+// dayStats aggregates the index per day, oldest first, across namespaces.
+func (x *fileIndex) dayStats() ([]dayStats, error) {
+	rows, err := x.db.Query(`SELECT CASE WHEN substr(path, 5, 1) = '/' THEN substr(path, 1, 10)
+		ELSE substr(path, instr(path, '/') + 1, 10) END, COUNT(*), SUM(size), SUM(disk_size) FROM files GROUP BY 1 ORDER BY 1`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var stats []dayStats
+	for rows.Next() {
+		var entry dayStats
+		var day string
+		err := rows.Scan(&day, &entry.Files, &entry.Bytes, &entry.DiskBytes)
+		if err != nil {
+			return nil, err
+		}
+		date, err := time.Parse("2006/01/02", day)
+		if err != nil {
+			continue
+		}
+		entry.Day = date.Format(dayLayout)
+		stats = append(stats, entry)
+	}
+	return stats, rows.Err()
+}
+
+// indexStored records a freshly stored upload, logging rather than failing
+// the request since reindex can repair a missing row.
+func (s *Server) indexStored(record fileRecord) {
+	if s.metaIndex == nil {
+		return
+	}
+	err := s.metaIndex.insert(record)
+	if err != nil {
+		slog.Error("fail to index", "path", record.Path, "err", err)
+	}
+}
+
+// indexRemoved forgets a deleted file.
+func (s *Server) indexRemoved(rel string) {
+	if s.metaIndex == nil {
+		return
+	}
+	err := s.metaIndex.delete(rel)
+	if err != nil {
+		slog.Error("fail to remove from the index", "path", rel, "err", err)
+	}
+}
+
+// reindex adds every stored file missing from the index, dated or in a
+// custom dir, and drops rows whose file is gone. Existing rows keep their
+// metadata, a private file stays private.
+func (x *fileIndex) reindex(cfg *config) (added, removed int, err error) {
+	seen := map[string]bool{}
+	err = walkStored(cfg, func(entry storedEntry) error {
+		seen[entry.Rel] = true
+		var exists int
+		err := x.db.QueryRow(`SELECT COUNT(*) FROM files WHERE path = ?`, entry.Rel).Scan(&exists)
+		if err != nil || exists != 0 {
+			return err
+		}
+		name := path.Base(entry.Rel)
+		sum, size, err := fileSHA256(cfg, filepath.Join(cfg.UploadDir, filepath.FromSlash(entry.Rel)))
+		if err != nil {
+			return err
+		}
+		err = x.insert(fileRecord{
+			Path:         entry.Rel,
+			OriginalName: name,
+			Size:         size,
+			DiskSize:     entry.Info.Size(),
+			ContentType:  contentTypeOf(name),
+			SHA256:       sum,
+			UploadedAt:   entry.Info.ModTime(),
+		})
+		if err == nil {
+			added++
+		}
+		return err
+	})
+	if err != nil {
+		return added, removed, err
+	}
+	rows, err := x.db.Query(`SELECT path FROM files`)
+	if err != nil {
+		return added, removed, err
+	}
+	var stale []string
+	for rows.Next() {
+		var rel string
+		if rows.Scan(&rel) == nil && !seen[rel] {
+			stale = append(stale, rel)
+		}
+	}
+	rows.Close()
+	for _, rel := range stale {
+		// a row the walk can't have seen, its file still there, is kept
+		_, _, err := findStored(filepath.Join(cfg.UploadDir, filepath.FromSlash(rel)))
+		if !os.IsNotExist(err) {
+			continue
+		}
+		err = x.delete(rel)
+		if err != nil {
+			return added, removed, err
+		}
+		removed++
+	}
+	return added, removed, nil
+}
+
+// fileSHA256 hashes the plain content of a stored file and returns its size.
+func fileSHA256(cfg *config, path string) (string, int64, error) {
+	file, _, err := openStored(cfg, path)
+	if err != nil {
+		return "", 0, err
+	}
+	defer file.Close()
+	hash := sha256.New()
+	size, err := io.Copy(hash, file)
+	if err != nil {
+		return "", 0, err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), size, nil
+}
+
+// contentTypeOf guesses the content type of a stored file from its name.
+func contentTypeOf(name string) string {
+	contentType := mime.TypeByExtension(filepath.Ext(name))
+	if len(contentType) == 0 {
+		return "application/octet-stream"
+	}
+	return contentType
+}
+
+// searchFilter turns a searchQuery into a FROM ... WHERE clause.
+func searchFilter(query searchQuery) (string, []any) {
+	where := []string{"instr(lower(original_name), ?) > 0", "lower(content_type) LIKE ? ESCAPE '\\'"}
+	args := []any{query.Text, escapeLike(query.ContentType) + "%"}
+	if !query.From.IsZero() {
+		where = append(where, "uploaded_at >= ?")
+		args = append(args, query.From.Unix())
+	}
+	if !query.To.IsZero() {
+		where = append(where, "uploaded_at < ?")
+		args = append(args, query.To.AddDate(0, 0, 1).Unix())
+	}
+	if len(query.Uploader) != 0 {
+		where = append(where, "uploader = ?")
+		args = append(args, query.Uploader)
+	}
+	for _, tag := range query.Tags {
+		where = append(where, "path IN (SELECT path FROM tags WHERE tag = ?)")
+		args = append(args, tag)
+	}
+	if len(query.Namespace) != 0 {
+		where = append(where, "path LIKE ? ESCAPE '\\'")
+		args = append(args, escapeLike(query.Namespace)+"/%")
+	}
+	return " FROM files WHERE " + strings.Join(where, " AND "), args
+}
+
+// search runs a searchQuery against the index, newest first.
+func (x *fileIndex) search(query searchQuery) ([]fileRecord, int, error) {
+	filter, args := searchFilter(query)
+	var total int
+	err := x.db.QueryRow("SELECT COUNT(*)"+filter, args...).Scan(&total)
+	if err != nil {
+		return nil, 0, err
+	}
+	rows, err := x.db.Query("SELECT "+recordColumns+filter+" ORDER BY uploaded_at DESC LIMIT ? OFFSET ?",
+		append(args, query.PerPage, (query.Page-1)*query.PerPage)...)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+	var records []fileRecord
+	for rows.Next() {
+		record, err := scanRecord(rows)
+		if err != nil {
+			return nil, 0, err
+		}
+		records = append(records, record)
+	}
+	err = rows.Err()
+	if err != nil {
+		return nil, 0, err
+	}
+	err = x.loadTags(records)
+	return records, total, err
+}
+
+// searchPaths returns the path of every file matching query, ignoring
+// pagination.
+func (x *fileIndex) searchPaths(query searchQuery) ([]string, error) {
+	filter, args := searchFilter(query)
+	rows, err := x.db.Query("SELECT path"+filter, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var paths []string
+	for rows.Next() {
+		var path string
+		if err := rows.Scan(&path); err != nil {
+			return nil, err
+		}
+		paths = append(paths, path)
+	}
+	return paths, rows.Err()
+}
+
+// pathsWithSHA256 returns the path of every file with the content digest.
+func (x *fileIndex) pathsWithSHA256(digest string) ([]string, error) {
+	rows, err := x.db.Query(`SELECT path FROM files WHERE sha256 = ?`, digest)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var paths []string
+	for rows.Next() {
+		var path string
+		if err := rows.Scan(&path); err != nil {
+			return nil, err
+		}
+		paths = append(paths, path)
+	}
+	return paths, rows.Err()
+}
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(s)
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestReindexCustomDir reindexes a private upload of a custom dir, which
+// must keep its row and stay private.
+func TestReindexCustomDir(t *testing.T) {
+	cfg := testConfig(t, "allow_custom_dirs: true\ndatabase: "+filepath.Join(t.TempDir(), "files.db")+"\n")
+	server := testServer(t, cfg)
+	routes := server.Routes()
+	path := downloadPath(t, testUpload(t, routes, "a.txt", "secret", map[string]string{"dir": "backups", "visibility": "private"}))
+	gone := downloadPath(t, testUpload(t, routes, "b.txt", "gone", nil))
+	stored, _ := storedRelPath(cfg, gone[len("/i/"):])
+	os.Remove(stored)
+	added, removed, err := server.metaIndex.reindex(cfg)
+	if err != nil || added != 0 || removed != 1 {
+		t.Errorf("reindex added %d, removed %d: %v", added, removed, err)
+	}
+	res := httptest.NewRecorder()
+	routes.ServeHTTP(res, httptest.NewRequest(http.MethodGet, path, nil))
+	if res.Code != http.StatusUnauthorized {
+		t.Errorf("anonymous download of %s after reindex: status %d", path, res.Code)
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"cmp"
+	"net/http"
+	"slices"
+)
+
+// infoAPIVersion is the schema version of /api/info, raised when a field
+// changes meaning or goes away.
+const infoAPIVersion = 1
+
+type serverInfo struct {
+	APIVersion int    `json:"api_version"`
+	Version    string `json:"version"`
+	ReadOnly   bool   `json:"read_only"`
+	// BaseURL is where routes start, DownloadURL what a stored path is
+	// appended to.
+	BaseURL      string      `json:"base_url"`
+	AccessPrefix string      `json:"access_prefix"`
+	UploadURL    string      `json:"upload_url"`
+	DownloadURL  string      `json:"download_url"`
+	Auth         infoAuth    `json:"auth"`
+	Limits       infoLimits  `json:"limits"`
+	Upload       infoUpload  `json:"upload"`
+	Features     infoFeature `json:"features"`
+}
+
+type infoAuth struct {
+	Scheme string `json:"scheme"`
+	Bearer bool   `json:"bearer"`
+	// DownloadsRequireAuth is false, only private files need credentials.
+	DownloadsRequireAuth bool `json:"downloads_require_auth"`
+	PrivateFiles         bool `json:"private_files"`
+}
+
+// infoLimits are in bytes, 0 is unlimited.
+type infoLimits struct {
+	MaxUploadSize   int64 `json:"max_upload_size"`
+	PasteMaxSize    int64 `json:"paste_max_size"`
+	DailyQuotaPerIP int64 `json:"daily_quota_per_ip"`
+	ZipMaxFiles     int   `json:"zip_max_files"`
+	ZipMaxBytes     int64 `json:"zip_max_bytes"`
+	ExtractMaxFiles int   `json:"extract_max_files,omitempty"`
+	ExtractMaxBytes int64 `json:"extract_max_bytes,omitempty"`
+	// the download rates are bytes per second
+	MaxDownloadRate        int64 `json:"max_download_rate"`
+	PerRequestDownloadRate int64 `json:"per_request_download_rate"`
+}
+
+type infoUpload struct {
+	MultipartField string `json:"multipart_field"`
+	// AllowedExtensions is null, every extension is taken.
+	AllowedExtensions []string `json:"allowed_extensions"`
+	DigestHeaders     []string `json:"digest_headers"`
+	Idempotency       bool     `json:"idempotency"`
+	Chunked           bool     `json:"chunked"`
+	Tus               bool     `json:"tus"`
+	Extract           bool     `json:"extract"`
+	CustomDirs        bool     `json:"custom_dirs"`
+	Tags              bool     `json:"tags"`
+	ResponseFormats   []string `json:"response_formats"`
+}
+
+type infoFeature struct {
+	Paste  bool `json:"paste"`
+	Zip    bool `json:"zip"`
+	Search bool `json:"search"`
+	Browse bool `json:"browse"`
+	WebDAV bool `json:"webdav"`
+	ShareX bool `json:"sharex"`
+	PicGo  bool `json:"picgo"`
+	Trash  bool `json:"trash"`
+}
+
+// infoHandler describes what clients can rely on, from the live config
+// and never with a secret. With info_requires_auth it needs the upload
+// credentials.
+func (s *Server) infoHandler(w http.ResponseWriter, r *http.Request) {
+	cfg := s.cfg
+	if cfg.InfoRequiresAuth {
+		if err := s.basicAuth(r); err != nil {
+			s.writeAuthError(w, r, err)
+			return
+		}
+	}
+	bearer := slices.ContainsFunc(cfg.accounts, func(account userConfig) bool { return len(account.Token) != 0 })
+	info := serverInfo{
+		APIVersion:   infoAPIVersion,
+		Version:      version,
+		ReadOnly:     s.readOnly.Load(),
+		BaseURL:      routeURL(r, cfg, ""),
+		AccessPrefix: cfg.AccessPrefix,
+		UploadURL:    routeURL(r, cfg, cfg.UploadPath),
+		DownloadURL:  publicURL(r, cfg, "") + "/",
+		Auth: infoAuth{
+			Scheme:       cfg.AuthScheme,
+			Bearer:       bearer,
+			PrivateFiles: s.metaIndex != nil,
+		},
+		Limits: infoLimits{
+			MaxUploadSize:          int64(cfg.MaxUploadSize),
+			PasteMaxSize:           cmp.Or(int64(cfg.PasteMaxSize), defaultPasteMaxSize),
+			DailyQuotaPerIP:        int64(cfg.DailyQuotaPerIP),
+			ZipMaxFiles:            cmp.Or(cfg.ZipMaxFiles, defaultZipMaxFiles),
+			ZipMaxBytes:            cmp.Or(int64(cfg.ZipMaxBytes), defaultZipMaxBytes),
+			MaxDownloadRate:        int64(cfg.MaxDownloadRate),
+			PerRequestDownloadRate: int64(cfg.RequestDownloadRate),
+		},
+		Upload: infoUpload{
+			MultipartField:  cfg.MultipartField,
+			DigestHeaders:   []string{"X-Content-SHA256", "Content-MD5"},
+			Idempotency:     true,
+			Extract:         cfg.AllowExtract,
+			CustomDirs:      cfg.AllowCustomDirs,
+			Tags:            s.metaIndex != nil,
+			ResponseFormats: []string{"text", "json", formatShareX},
+		},
+		Features: infoFeature{
+			Paste:  true,
+			Zip:    true,
+			Search: true,
+			Browse: cfg.BrowseEnabled,
+			WebDAV: cfg.WebDAVEnabled,
+			ShareX: true,
+			PicGo:  bearer,
+			Trash:  cfg.TrashRetention > 0,
+		},
+	}
+	if cfg.AllowExtract {
+		info.Limits.ExtractMaxFiles, info.Limits.ExtractMaxBytes = cfg.ExtractMaxFiles, int64(cfg.ExtractMaxBytes)
+	}
+	writeJSON(w, http.StatusOK, info)
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// defaultShutdownTimeout bounds how long in-flight requests may finish
+// after SIGINT or SIGTERM when shutdown_timeout is unset.
+const defaultShutdownTimeout = 10 * time.Second
+
+// serverListeners are the systemd sockets when activated, otherwise a new
+// listener on Host:Port.
+func serverListeners(cfg *config) ([]net.Listener, error) {
+	listeners, err := activationListeners()
+	if err != nil || len(listeners) != 0 {
+		for _, listener := range listeners {
+			slog.Info("socket activation, serving", "network", listener.Addr().Network(), "addr", listener.Addr().String())
+		}
+		return listeners, err
+	}
+	listeners, err = inheritedListeners()
+	if err != nil || len(listeners) != 0 {
+		for _, listener := range listeners {
+			slog.Info("took over listener", "network", listener.Addr().Network(), "addr", listener.Addr().String())
+		}
+		return listeners, err
+	}
+	hostAndPort := fmt.Sprintf("%s:%s", cfg.Host, cfg.Port)
+	listener, err := net.Listen("tcp", hostAndPort)
+	if err != nil {
+		return nil, err
+	}
+	slog.Info("the server start listening", "addr", hostAndPort)
+	return []net.Listener{listener}, nil
+}
+
+// serve runs server on every listener until SIGINT or SIGTERM, or until
+// SIGUSR2 handed the listeners to a new process, then lets in-flight
+// requests finish for up to the shutdown timeout. Closing the
+// listeners only drops this process's copies, a unix socket file passed by
+// systemd is never unlinked, so the unit can be restarted on the same
+// sockets.
+func (s *Server) serve(server *http.Server, listeners []net.Listener) error {
+	cfg := s.cfg
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	errs := make(chan error, len(listeners))
+	var wg sync.WaitGroup
+	for _, listener := range listeners {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := server.Serve(listener)
+			if !errors.Is(err, http.ErrServerClosed) {
+				errs <- err
+			}
+		}()
+	}
+	notifyReady()
+	upgrade := upgradeSignal()
+	var err error
+	var handover *os.File
+wait:
+	for {
+		select {
+		case err = <-errs:
+			break wait
+		case <-ctx.Done():
+			slog.Info("shutting down")
+			break wait
+		case <-upgrade:
+			// The new process loads the quota state at start and catches up
+			// with the last save once handover is closed.
+			if s.quotas != nil {
+				s.quotas.save()
+			}
+			var upgradeErr error
+			handover, upgradeErr = startUpgrade(listeners)
+			if upgradeErr != nil {
+				slog.Error("upgrade failed, still serving", "err", upgradeErr)
+				continue
+			}
+			break wait
+		}
+	}
+	timeout := time.Duration(cfg.ShutdownTimeout)
+	if timeout == 0 {
+		timeout = defaultShutdownTimeout
+	}
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	shutdownErr := server.Shutdown(shutdownCtx)
+	wg.Wait()
+	s.auditLog.close()
+	if s.quotas != nil {
+		if saveErr := s.quotas.save(); saveErr != nil {
+			slog.Error("fail to save quota state", "err", saveErr)
+		}
+	}
+	if saveErr := s.idempotency.save(); saveErr != nil {
+		slog.Error("fail to save idempotency state", "err", saveErr)
+	}
+	if handover != nil {
+		handover.Close()
+	}
+	if err == nil {
+		err = shutdownErr
+	}
+	return err
+}
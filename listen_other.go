@@ -0,0 +1,35 @@
+//go:build !unix
+
+package main
+
+import (
+	"errors"
+	"net"
+	"os"
+)
+
+// activationListeners is a no-op where systemd can't pass sockets.
+func activationListeners() ([]net.Listener, error) {
+	return nil, nil
+}
+
+// inheritedListeners is a no-op where listeners can't be handed over.
+func inheritedListeners() ([]net.Listener, error) {
+	return nil, nil
+}
+
+// upgradeSignal never fires, there is no SIGUSR2.
+func upgradeSignal() <-chan os.Signal {
+	return nil
+}
+func startUpgrade(listeners []net.Listener) (*os.File, error) {
+	return nil, errors.New("listener handover is not supported on this platform")
+}
+func notifyReady() {}
+
+// handoverDone is closed from the start, nothing hands over.
+func handoverDone() <-chan struct{} {
+	done := make(chan struct{})
+	close(done)
+	return done
+}
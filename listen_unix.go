@@ -0,0 +1,201 @@
+//go:build unix
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// listenFDsStart is the first file descriptor systemd passes, SD_LISTEN_FDS_START.
+const listenFDsStart = 3
+
+// activationListeners returns the sockets systemd passed through LISTEN_FDS,
+// or nil when the process wasn't socket activated. TCP and unix sockets both
+// work since net.FileListener handles either.
+func activationListeners() ([]net.Listener, error) {
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, nil
+	}
+	count, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || count < 1 {
+		return nil, fmt.Errorf("invalid LISTEN_FDS %q", os.Getenv("LISTEN_FDS"))
+	}
+	// Children like a handed over server must not take these as their own.
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+	return fdListeners(listenFDsStart, count)
+}
+
+// fdListeners turns count inherited descriptors from start on into
+// listeners.
+func fdListeners(start, count int) ([]net.Listener, error) {
+	var listeners []net.Listener
+	for fd := start; fd < start+count; fd++ {
+		syscall.CloseOnExec(fd)
+		file := os.NewFile(uintptr(fd), "LISTEN_FD_"+strconv.Itoa(fd))
+		// FileListener dups the descriptor, closing either copy later leaves
+		// the socket systemd holds open.
+		listener, err := net.FileListener(file)
+		file.Close()
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return nil, fmt.Errorf("fd %d is not a listening socket\n%w", fd, err)
+		}
+		listeners = append(listeners, listener)
+	}
+	return listeners, nil
+}
+
+// upgradeTimeout bounds how long a new process may take to become ready
+// after SIGUSR2 before it is killed and the old one keeps serving.
+const upgradeTimeout = 30 * time.Second
+
+// executable is resolved at start, so SIGUSR2 runs whatever binary was
+// installed at that path since.
+var executable, _ = os.Executable()
+
+// inheritedListeners returns the listeners a previous process handed over
+// through FILE_LISTEN_FDS, or nil.
+func inheritedListeners() ([]net.Listener, error) {
+	value, ok := os.LookupEnv("FILE_LISTEN_FDS")
+	if !ok {
+		return nil, nil
+	}
+	os.Unsetenv("FILE_LISTEN_FDS")
+	count, err := strconv.Atoi(value)
+	if err != nil || count < 1 {
+		return nil, fmt.Errorf("invalid FILE_LISTEN_FDS %q", value)
+	}
+	return fdListeners(listenFDsStart, count)
+}
+
+// upgradeSignal delivers SIGUSR2, the request to hand over to a new binary.
+func upgradeSignal() <-chan os.Signal {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGUSR2)
+	return signals
+}
+
+// startUpgrade starts executable with the same arguments and a copy of
+// every listener, and waits until it reports ready. On error the new
+// process is gone and the caller keeps serving. Otherwise the caller closes
+// the returned file once its last requests are done and its state saved,
+// what handoverDone in the new process waits for.
+func startUpgrade(listeners []net.Listener) (*os.File, error) {
+	var files []*os.File
+	defer func() {
+		for _, file := range files {
+			file.Close()
+		}
+	}()
+	for _, listener := range listeners {
+		filer, ok := listener.(interface{ File() (*os.File, error) })
+		if !ok {
+			return nil, fmt.Errorf("can't hand over the %s listener", listener.Addr().Network())
+		}
+		file, err := filer.File()
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, file)
+	}
+	ready, readyWriter, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	defer ready.Close()
+	doneReader, done, err := os.Pipe()
+	if err != nil {
+		readyWriter.Close()
+		return nil, err
+	}
+	cmd := exec.Command(executable, os.Args[1:]...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = append(files, readyWriter, doneReader)
+	cmd.Env = append(os.Environ(),
+		"FILE_LISTEN_FDS="+strconv.Itoa(len(files)),
+		"FILE_READY_FD="+strconv.Itoa(listenFDsStart+len(files)),
+		"FILE_HANDOVER_FD="+strconv.Itoa(listenFDsStart+len(files)+1))
+	err = cmd.Start()
+	readyWriter.Close()
+	doneReader.Close()
+	if err != nil {
+		done.Close()
+		return nil, fmt.Errorf("fail to start %s\n%w", executable, err)
+	}
+	result := make(chan error, 1)
+	go func() {
+		// EOF without a byte means the new process exited early.
+		_, err := ready.Read(make([]byte, 1))
+		result <- err
+	}()
+	select {
+	case err = <-result:
+	case <-time.After(upgradeTimeout):
+		err = errors.New("timed out")
+	}
+	if err != nil {
+		done.Close()
+		cmd.Process.Kill()
+		cmd.Wait()
+		return nil, fmt.Errorf("new process %d didn't become ready\n%w", cmd.Process.Pid, err)
+	}
+	slog.Info("handed over", "pid", cmd.Process.Pid)
+	return done, nil
+}
+
+// notifyReady tells the process that started this one through
+// FILE_READY_FD that it is serving.
+func notifyReady() {
+	value, ok := os.LookupEnv("FILE_READY_FD")
+	if !ok {
+		return
+	}
+	os.Unsetenv("FILE_READY_FD")
+	fd, err := strconv.Atoi(value)
+	if err != nil {
+		return
+	}
+	file := os.NewFile(uintptr(fd), "FILE_READY_FD")
+	file.Write([]byte{1})
+	file.Close()
+}
+
+// handoverDone is closed once the process that started this one through
+// SIGUSR2 has finished its last requests and saved its state, which it
+// tells by closing FILE_HANDOVER_FD or exiting. Without one it is closed
+// from the start.
+var handoverDone = sync.OnceValue(func() <-chan struct{} {
+	done := make(chan struct{})
+	value, ok := os.LookupEnv("FILE_HANDOVER_FD")
+	os.Unsetenv("FILE_HANDOVER_FD")
+	fd, err := strconv.Atoi(value)
+	if !ok || err != nil {
+		close(done)
+		return done
+	}
+	syscall.CloseOnExec(fd)
+	file := os.NewFile(uintptr(fd), "FILE_HANDOVER_FD")
+	go func() {
+		io.Copy(io.Discard, file)
+		file.Close()
+		close(done)
+	}()
+	return done
+})
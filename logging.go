@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+)
+
+const (
+	logStderr = "stderr"
+	logStdout = "stdout"
+
+	defaultLogMaxFiles = 5
+)
+
+var logLevels = map[string]slog.Level{
+	"debug": slog.LevelDebug,
+	"info":  slog.LevelInfo,
+	"warn":  slog.LevelWarn,
+	"error": slog.LevelError,
+}
+
+// setupLogging makes slog, and the log package through it, write at
+// log_level to log_output. debug: true is log_level: debug.
+func setupLogging(cfg *config) error {
+	level := logLevels[cfg.LogLevel]
+	var out io.Writer
+	switch cfg.LogOutput {
+	case logStderr:
+		out = os.Stderr
+	case logStdout:
+		out = os.Stdout
+	default:
+		file, err := openLogFile(cfg.LogOutput, int64(cfg.LogMaxSize), cfg.LogMaxFiles)
+		if err != nil {
+			return err
+		}
+		out = file
+		go reopenOnSignal(file)
+	}
+	slog.SetDefault(slog.New(requestIDHandler{slog.NewTextHandler(out, &slog.HandlerOptions{Level: level})}))
+	return nil
+}
+
+// validateLogging checks the log_* keys and sets their defaults.
+func (c *config) validateLogging() []error {
+	var problems []error
+	if len(c.LogLevel) == 0 {
+		c.LogLevel = "info"
+		if c.Debug {
+			c.LogLevel = "debug"
+		}
+	}
+	c.LogLevel = strings.ToLower(c.LogLevel)
+	if _, ok := logLevels[c.LogLevel]; !ok {
+		problems = append(problems, fmt.Errorf("log_level %q must be debug, info, warn or error", c.LogLevel))
+	}
+	if len(c.LogOutput) == 0 {
+		c.LogOutput = logStderr
+	}
+	if c.LogMaxFiles < 0 {
+		problems = append(problems, fmt.Errorf("log_max_files must not be negative"))
+	}
+	if c.LogMaxFiles == 0 {
+		c.LogMaxFiles = defaultLogMaxFiles
+	}
+	return problems
+}
+
+// fatal logs an error that ends the process.
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
+
+// requestIDHandler adds the request_id of the request a record is logged
+// for, when it is logged with the request's context.
+type requestIDHandler struct {
+	slog.Handler
+}
+
+func (h requestIDHandler) Handle(ctx context.Context, record slog.Record) error {
+	if info, ok := ctx.Value(requestInfoKey{}).(requestInfo); ok {
+		record.AddAttrs(slog.String("request_id", info.ID))
+	}
+	return h.Handler.Handle(ctx, record)
+}
+func (h requestIDHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return requestIDHandler{h.Handler.WithAttrs(attrs)}
+}
+func (h requestIDHandler) WithGroup(name string) slog.Handler {
+	return requestIDHandler{h.Handler.WithGroup(name)}
+}
+
+// logFile appends to log_output. Past maxSize bytes it is renamed to
+// path.1, the older ones shifting to path.2 and so on up to maxFiles, and
+// a new one is started. reopen starts a new one too, after logrotate moved
+// it away.
+type logFile struct {
+	mu       sync.Mutex
+	path     string
+	maxSize  int64
+	maxFiles int
+	file     *os.File
+	size     int64
+}
+
+func openLogFile(path string, maxSize int64, maxFiles int) (*logFile, error) {
+	l := &logFile{path: path, maxSize: maxSize, maxFiles: maxFiles}
+	err := l.open()
+	if err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+func (l *logFile) open() error {
+	file, err := os.OpenFile(l.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("fail to open log file\n%w", err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	l.file = file
+	l.size = info.Size()
+	return nil
+}
+func (l *logFile) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.maxSize > 0 && l.size > 0 && l.size+int64(len(p)) > l.maxSize {
+		err := l.rotateLocked()
+		if err != nil {
+			// keep logging to stderr rather than losing the line
+			fmt.Fprintf(os.Stderr, "fail to rotate log file: %v\n", err)
+		}
+	}
+	if l.file == nil {
+		return os.Stderr.Write(p)
+	}
+	n, err := l.file.Write(p)
+	l.size += int64(n)
+	return n, err
+}
+func (l *logFile) rotateLocked() error {
+	l.file.Close()
+	l.file = nil
+	os.Remove(fmt.Sprintf("%s.%d", l.path, l.maxFiles))
+	for i := l.maxFiles - 1; i >= 1; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", l.path, i), fmt.Sprintf("%s.%d", l.path, i+1))
+	}
+	err := os.Rename(l.path, l.path+".1")
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return l.open()
+}
+
+// reopen closes the file and opens path again.
+func (l *logFile) reopen() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.file != nil {
+		l.file.Close()
+		l.file = nil
+	}
+	return l.open()
+}
+
+// reopenOnSignal reopens the log file on every SIGHUP, forever.
+func reopenOnSignal(file *logFile) {
+	for range reopenSignal() {
+		err := file.reopen()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "fail to reopen log file: %v\n", err)
+			continue
+		}
+		slog.Info("log file reopened", "path", file.path)
+	}
+}
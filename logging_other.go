@@ -0,0 +1,10 @@
+//go:build !unix
+
+package main
+
+import "os"
+
+// reopenSignal never fires, there is no SIGHUP.
+func reopenSignal() <-chan os.Signal {
+	return nil
+}
@@ -0,0 +1,52 @@
+//go:build unix
+
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestLogReopen(t *testing.T) {
+	// an unhandled SIGHUP would end the test binary
+	held := make(chan os.Signal, 1)
+	signal.Notify(held, syscall.SIGHUP)
+	defer signal.Stop(held)
+
+	path := t.TempDir() + "/file.log"
+	file, err := openLogFile(path, 0, defaultLogMaxFiles)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go reopenOnSignal(file)
+	file.Write([]byte("before\n"))
+	// what logrotate does before signaling
+	err = os.Rename(path, path+".rotated")
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Write([]byte("until the signal\n"))
+
+	// reopenOnSignal may not be listening yet, signal until it is
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		syscall.Kill(os.Getpid(), syscall.SIGHUP)
+		time.Sleep(10 * time.Millisecond)
+		if _, err := os.Stat(path); err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the log file wasn't reopened")
+		}
+	}
+	file.Write([]byte("after\n"))
+	if content, _ := os.ReadFile(path + ".rotated"); string(content) != "before\nuntil the signal\n" {
+		t.Errorf("the moved file holds %q", content)
+	}
+	if content, _ := os.ReadFile(path); string(content) != "after\n" {
+		t.Errorf("the reopened file holds %q", content)
+	}
+}
@@ -1,147 +1,491 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"encoding/base64"
 	"errors"
+	"flag"
 	"fmt"
 	"io"
-	"log"
-	"mime"
+	"log/slog"
+	"maps"
+	"mime/multipart"
 	"net/http"
 	"os"
+	"path"
 	"path/filepath"
+	"slices"
 	"strings"
 	"time"
 
-	"github.com/google/uuid"
 	"github.com/gorilla/mux"
-	"gopkg.in/yaml.v3"
 )
 
-type config struct {
-	Host         string `yaml:"host"`
-	Port         string `yaml:"port"`
-	UploadDir    string `yaml:"upload_dir"`
-	AccessPrefix string `yaml:"access_prefix"`
-	Username     string `yaml:"username"`
-	Password     string `yaml:"password"`
-}
-
-func loalConfig(filepath string) (*config, error) {
-	file, err := os.Open(filepath)
-	if err != nil {
-		return nil, fmt.Errorf("fail to open config file\n%w", err)
-	}
-	defer file.Close()
-	var cfg config
-	decoder := yaml.NewDecoder(file)
-	err = decoder.Decode(&cfg)
-	if err != nil {
-		return nil, fmt.Errorf("fail to decode config file\n%w", err)
-	}
-	return &cfg, nil
-}
-func basicAuth(r *http.Request, cfg *config) error {
+// basicCredentials extracts the username and password of a Basic
+// Authorization header.
+func basicCredentials(r *http.Request) (string, string, error) {
 	authHeader := r.Header.Get("Authorization")
 	if len(authHeader) == 0 {
-		return errors.New("authorization header is missing")
+		return "", "", errors.New("authorization header is missing")
 	}
 	authType, authInfo, ok := strings.Cut(authHeader, " ")
 	if !ok || authType != "Basic" {
-		return errors.New("invalid authorization type")
+		return "", "", errors.New("invalid authorization type")
 	}
 	decoded, err := base64.StdEncoding.DecodeString(authInfo)
 	if err != nil {
-		return fmt.Errorf("failed to decode basic auth info\n%w", err)
+		return "", "", fmt.Errorf("failed to decode basic auth info\n%w", err)
 	}
 	username, password, ok := strings.Cut(string(decoded), ":")
-	if !ok || username != cfg.Username || password != cfg.Password {
+	if !ok {
+		return "", "", errors.New("invalid basic auth info")
+	}
+	return username, password, nil
+}
+
+// basicAuth requires the credentials of an upload account, with the
+// configured auth_scheme.
+func (s *Server) basicAuth(r *http.Request) error {
+	_, err := s.authenticate(r)
+	return err
+}
+
+// checkCredentials checks the Authorization header against username and
+// password, with Digest when it is enabled and Basic otherwise.
+func (s *Server) checkCredentials(r *http.Request, username, password string) error {
+	if s.digestNonces != nil {
+		return s.digestAuth(r, username, password)
+	}
+	user, pass, err := basicCredentials(r)
+	if err != nil {
+		return err
+	}
+	if user != username || pass != password {
 		return errors.New("invalid credentials")
 	}
 	return nil
 }
-func uploadHander(w http.ResponseWriter, r *http.Request, cfg *config) {
-	if r.Method != http.MethodPost {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+
+// matchesCredentials is checkCredentials without using up a Digest nonce,
+// for telling which account a rejected request used.
+func (s *Server) matchesCredentials(r *http.Request, username, password string) bool {
+	if s.digestNonces != nil {
+		_, _, err := verifyDigest(r, s.cfg.AuthRealm, username, password)
+		return err == nil
+	}
+	user, pass, err := basicCredentials(r)
+	return err == nil && user == username && pass == password
+}
+
+// requestUsername is the username the client claims, Basic or Digest,
+// without checking it, or the owner of its Bearer token.
+func requestUsername(r *http.Request, cfg *config) string {
+	if account, ok := bearerAccount(r, cfg); ok {
+		return account.Username
+	}
+	if username, ok := digestUsername(r); ok {
+		return username
+	}
+	username, _, _ := basicCredentials(r)
+	return username
+}
+func (s *Server) uploadHander(w http.ResponseWriter, r *http.Request) {
+	_, auth := startPhase(r.Context(), "upload.auth")
+	digests, reservation, ok := s.uploadPreflight(w, r)
+	auth.end(nil)
+	if !ok {
 		return
 	}
-	err := basicAuth(r, cfg)
+	defer reservation.release()
+	idem, ok := s.startIdempotent(w, r)
+	if !ok {
+		return
+	}
+	defer idem.release()
+	if s.cfg.MaxUploadSize > 0 {
+		r.Body = http.MaxBytesReader(w, r.Body, int64(s.cfg.MaxUploadSize))
+	}
+	_, parse := startPhase(r.Context(), "upload.parse")
+	parse.setInt("http.request.body.size", r.ContentLength)
+	err := r.ParseMultipartForm(int64(s.cfg.MultipartMemory))
+	parse.end(err)
+	if r.MultipartForm != nil {
+		defer r.MultipartForm.RemoveAll()
+	}
+	if bodyAborted(err) {
+		s.writeStoreError(w, r, err)
+		return
+	}
+	if err != nil && !errors.Is(err, http.ErrNotMultipart) {
+		writeError(w, r, http.StatusBadRequest, "Invalid form")
+		return
+	}
+	header, err := formFilePart(s.cfg, r.MultipartForm)
 	if err != nil {
-		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		writeError(w, r, http.StatusBadRequest, "Missing file: "+err.Error())
 		return
 	}
-	file, header, err := r.FormFile("file")
+	file, err := header.Open()
 	if err != nil {
-		http.Error(w, "Bad Request: Missing file", http.StatusBadRequest)
+		slog.ErrorContext(r.Context(), "fail to open the form file", "err", err)
+		writeError(w, r, http.StatusInternalServerError, "")
 		return
 	}
 	defer file.Close()
-	ext := filepath.Ext(header.Filename)
-	filename := fmt.Sprintf("%s%s", uuid.New().String(), ext)
-	now := time.Now()
-	timePath := fmt.Sprintf("%d/%02d/%02d", now.Year(), now.Month(), now.Day())
-	timeNameString := fmt.Sprintf("%s/%s", timePath, filename)
-	dirPath := filepath.Join(cfg.UploadDir, timePath)
-	filePath := filepath.Join(cfg.UploadDir, timeNameString)
-	err = os.MkdirAll(dirPath, os.ModePerm)
+	// The form is parsed, the rest of the body doesn't matter.
+	r.Body.Close()
+	if idem.replayed(w, r, s.cfg, header, file) {
+		return
+	}
+	tags, err := parseTags(r)
 	if err != nil {
-		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		writeError(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	if len(tags) != 0 && s.metaIndex == nil {
+		writeError(w, r, http.StatusBadRequest, "Tags need the database")
 		return
 	}
-	dst, err := os.Create(filePath)
+	private, err := s.parseVisibility(r.FormValue("visibility"))
 	if err != nil {
-		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		writeError(w, r, http.StatusBadRequest, err.Error())
 		return
 	}
-	defer dst.Close()
-	_, err = io.Copy(dst, file)
+	dir, err := parseCustomDir(s.cfg, r.FormValue("dir"))
 	if err != nil {
-		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		writeError(w, r, http.StatusBadRequest, err.Error())
 		return
 	}
-	url := fmt.Sprintf("%s/%s", cfg.AccessPrefix, timeNameString)
-	w.WriteHeader(http.StatusOK)
-	w.Write([]byte(url))
+	if extract := r.FormValue("extract"); extract == "1" || extract == "true" {
+		s.extractUpload(w, r, file, header, dir, tags, private, digests)
+		return
+	}
+	stored, err := s.storeUpload(r.Context(), requestNamespace(r, s.cfg), dir, file, header.Filename, header.Size, digests)
+	if err != nil {
+		s.writeStoreError(w, r, err)
+		return
+	}
+	stored.Tags = tags
+	stored.Private = private
+	s.afterStore(r, stored)
+	idem.remember(r, s.cfg, header.Filename, stored)
+	writeUploadResponse(w, r, s.cfg, stored)
+}
+
+// formFilePart picks the file part of an upload form: the multipart_field one
+// when it is set, otherwise "file", or else the first file field by name,
+// for tools posting "image" or "files[]".
+func formFilePart(cfg *config, form *multipart.Form) (*multipart.FileHeader, error) {
+	if form == nil {
+		return nil, errors.New("the body is not multipart/form-data")
+	}
+	fields := []string{cfg.MultipartField}
+	if len(cfg.MultipartField) == 0 {
+		fields = append([]string{"file"}, slices.Sorted(maps.Keys(form.File))...)
+	}
+	for _, field := range fields {
+		if headers := form.File[field]; len(headers) != 0 {
+			return headers[0], nil
+		}
+	}
+	// list what the client sent, to debug its field names
+	var present []string
+	for _, field := range slices.Sorted(maps.Keys(form.File)) {
+		present = append(present, field+" (file)")
+	}
+	present = append(present, slices.Sorted(maps.Keys(form.Value))...)
+	missing := "no file part"
+	if len(cfg.MultipartField) != 0 {
+		missing = fmt.Sprintf("no %q file part", cfg.MultipartField)
+	}
+	if len(present) == 0 {
+		return nil, fmt.Errorf("the form has %s and no other fields", missing)
+	}
+	return nil, fmt.Errorf("the form has %s, its fields are %s", missing, strings.Join(present, ", "))
+}
+
+// storedFileRoute and namespacedFileRoute are the route patterns of stored
+// files, the second for namespace_per_user uploads.
+const (
+	storedFileRoute     = "{year}/{month}/{day}/{filename}"
+	namespacedFileRoute = "{namespace:[a-z0-9_-]+}/{year}/{month}/{day}/{filename}"
+)
+
+// routeRel is the stored path named by the route vars of storedFileRoute,
+// namespacedFileRoute or customFileRoute.
+func routeRel(vars map[string]string) string {
+	if rel, ok := vars["path"]; ok {
+		return rel
+	}
+	rel := joinURL(vars["year"], vars["month"], vars["day"], vars["filename"])
+	if namespace, ok := vars["namespace"]; ok {
+		rel = joinURL(namespace, rel)
+	}
+	return rel
+}
+
+// storedPath maps the route vars of a stored file to disk.
+func storedPath(cfg *config, vars map[string]string) string {
+	return filepath.Join(cfg.UploadDir, filepath.FromSlash(routeRel(vars)))
 }
-func getHandler(w http.ResponseWriter, r *http.Request, cfg *config) {
+
+// storedRelPath maps a "[namespace/]year/month/day/filename" path as
+// returned by uploads (without the access prefix) to disk, or one in a
+// custom dir when they are allowed, refusing anything else.
+func storedRelPath(cfg *config, rel string) (string, bool) {
+	if !datedRel(rel) && !(cfg.AllowCustomDirs && customRel(cfg, strings.Split(rel, "/"))) {
+		return "", false
+	}
+	return filepath.Join(cfg.UploadDir, filepath.FromSlash(rel)), true
+}
+func datedRel(rel string) bool {
+	parts := strings.Split(rel, "/")
+	if len(parts) == 5 && validNamespace(parts[0]) {
+		parts = parts[1:]
+	}
+	return len(parts) == 4 && isDigits(parts[0], 4) && isDigits(parts[1], 2) && isDigits(parts[2], 2) && validStoredName(parts[3])
+}
+
+// validStoredName is a file name uploads may have created.
+func validStoredName(filename string) bool {
+	return len(filename) != 0 && !strings.HasPrefix(filename, ".") && !strings.ContainsAny(filename, `\`)
+}
+func isDigits(s string, n int) bool {
+	if len(s) != n {
+		return false
+	}
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+func (s *Server) getHandler(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
-	year := vars["year"]
-	month := vars["month"]
-	day := vars["day"]
-	filename := vars["filename"]
+	filePath := storedPath(s.cfg, vars)
+	rel := routeRel(vars)
+	filename := path.Base(rel)
 	ext := filepath.Ext(filename)
-	filePath := filepath.Join(cfg.UploadDir, year, month, day, filename)
-	_, err := os.Stat(filePath)
-	if os.IsNotExist(err) {
-		http.NotFound(w, r)
+	_, stat := startPhase(r.Context(), "download.stat")
+	stat.setString("file.path", rel)
+	// a cache hit needs neither the disk nor the database
+	cached := s.hotFiles.get(rel)
+	stat.setBool("file.cached", cached != nil)
+	var diskPath string
+	var compressed, private, paste, fromReplica bool
+	var generation uint64
+	var err error
+	if cached != nil {
+		diskPath, compressed, private, paste = cached.diskPath, cached.compressed, cached.private, cached.paste
+	} else {
+		// a PATCH or delete meanwhile keeps what is looked up out of the
+		// cache
+		generation = s.hotFiles.generation()
+		diskPath, compressed, err = findStored(filePath)
+		if os.IsNotExist(err) {
+			if s.cfg.ReadFallback {
+				filePath, fromReplica = replicaPath(s.cfg, rel)
+			}
+			stat.setBool("file.replica", fromReplica)
+			if !fromReplica {
+				stat.end(nil)
+				if trashed(s.cfg, rel) {
+					writeError(w, r, http.StatusGone, "The file was deleted")
+					return
+				}
+				notFoundHandler(w, r)
+				return
+			}
+			diskPath, compressed, _ = findStored(filePath)
+		}
+		private, paste, err = s.downloadFlags(rel)
+	}
+	stat.setBool("file.private", private)
+	stat.end(err)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "fail to look up", "path", rel, "err", err)
+		writeError(w, r, http.StatusInternalServerError, "")
 		return
 	}
-	contentType := mime.TypeByExtension(ext)
-	if len(contentType) == 0 {
-		contentType = "application/octet-stream"
+	if private {
+		if err := s.basicAuth(r); err != nil {
+			s.writeAuthError(w, r, err)
+			return
+		}
+		if !inNamespace(s.cfg, requestNamespace(r, s.cfg), rel) {
+			writeError(w, r, http.StatusForbidden, "The file belongs to another user")
+			return
+		}
+	}
+	contentType := contentTypeOf(filename)
+	isMarkdown := strings.EqualFold(ext, ".md")
+	switch {
+	case isMarkdown:
+		contentType = "text/markdown; charset=utf-8"
+	case paste:
+		contentType = "text/plain; charset=utf-8"
 	}
+	if s.cfg.NoIndex {
+		w.Header().Set("X-Robots-Tag", "noindex, nofollow")
+	}
+	if private {
+		w.Header().Set("Cache-Control", "private, no-store")
+	} else {
+		w.Header().Set("Cache-Control", s.cfg.CacheControl.header(ext, contentType))
+	}
+	raw := r.URL.Query().Get("raw") == "1"
+	switch {
+	case isMarkdown && s.cfg.RenderMarkdown:
+		w.Header().Set("Vary", "Accept")
+		if !raw && prefersHTML(r, "text/markdown") && s.serveMarkdown(w, r, filePath, filename) {
+			return
+		}
+	case paste && s.cfg.PasteHTMLView:
+		w.Header().Set("Vary", "Accept")
+		if !raw && prefersHTML(r, "text/plain") && servePasteView(w, r, s.cfg, filePath, filename) {
+			return
+		}
+	}
+	contentType, disposition := serveAs(w, s.cfg, contentType)
 	w.Header().Set("Content-Type", contentType)
-	w.Header().Set("Cache-Control", "public, max-age=315360000")
-	w.Header().Set("Content-Disposition", fmt.Sprintf(`inline; filename="%s"`, filename))
+	w.Header().Set("Content-Disposition", contentDisposition(disposition, filename))
+	if compressed {
+		w.Header().Add("Vary", "Accept-Encoding")
+	}
+	rawGzip := compressed && acceptsGzip(r)
+	if rawGzip {
+		// the gzip stream on disk is sent as is, the cache only has the
+		// original
+		w.Header().Set("Content-Encoding", "gzip")
+		filePath = diskPath
+		cached = nil
+	}
+	_, serve := startPhase(r.Context(), "download.serve")
+	serve.setString("http.response.content_type", contentType)
+	serve.setBool("file.compressed", compressed)
+	var content io.ReadSeeker
+	var size int64
+	var modTime time.Time
+	if cached != nil {
+		content, size, modTime = bytes.NewReader(cached.data), int64(len(cached.data)), cached.modTime
+	} else {
+		stored, info, err := openStored(s.cfg, filePath)
+		if err == nil {
+			defer stored.Close()
+			content, size, modTime = stored, stored.Size(), info.ModTime()
+		}
+		if err == nil && !rawGzip && !fromReplica && s.hotFiles.cacheable(size) {
+			var data []byte
+			data, err = io.ReadAll(stored)
+			if err == nil {
+				s.hotFiles.put(&hotEntry{rel: rel, diskPath: diskPath, data: data, modTime: modTime, compressed: compressed, private: private, paste: paste, generation: generation})
+				content = bytes.NewReader(data)
+			}
+		}
+		if err != nil {
+			serve.end(err)
+			slog.ErrorContext(r.Context(), "fail to open", "path", rel, "err", err)
+			writeError(w, r, http.StatusInternalServerError, "")
+			return
+		}
+	}
+	serve.setInt("file.size", size)
+	w = s.throttle(w, r)
+	defer s.egress.finished()
+	// ranges are served from the plain file, never compressed
+	var out http.ResponseWriter = w
+	if !compressed && s.cfg.GzipResponses.compresses(contentType, size) {
+		w.Header().Add("Vary", "Accept-Encoding")
+		if acceptsGzip(r) && len(r.Header.Get("Range")) == 0 {
+			gz := &gzipResponseWriter{ResponseWriter: w, head: r.Method == http.MethodHead}
+			defer gz.Close()
+			out = gz
+			serve.setBool("http.response.gzip", true)
+		}
+	}
+	// the same for cache hits and misses, per encoding
+	etag := fmt.Sprintf("%x-%x", modTime.UnixNano(), size)
+	if len(w.Header().Get("Content-Encoding")) != 0 || out != w {
+		etag += "-gzip"
+	}
+	w.Header().Set("ETag", `"`+etag+`"`)
+	// HEAD gets exactly the GET headers: ServeContent sets Content-Length
+	// from the plain size and skips the body. Anything counting downloads
+	// must ignore HEAD requests.
+	http.ServeContent(out, r, filename, modTime, content)
+	serve.end(nil)
+}
 
-	http.ServeFile(w, r, filePath)
+// registerFileRoutes serves, replaces, describes, deletes, restores and
+// encodes as QR code the stored files matching route.
+func (s *Server) registerFileRoutes(r *mux.Router, route string) {
+	// customFileRoute matches anything, only stored paths get through
+	handle := func(handler http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			if _, ok := storedRelPath(s.cfg, routeRel(mux.Vars(r))); !ok {
+				notFoundHandler(w, r)
+				return
+			}
+			handler(w, r)
+		}
+	}
+	getPath := joinURL(s.cfg.RoutePrefix, s.cfg.AccessPrefix, route)
+	r.HandleFunc(getPath, handle(s.getHandler)).Methods(http.MethodGet, http.MethodHead)
+	r.HandleFunc(getPath, handle(s.writable(s.replaceHandler))).Methods(http.MethodPut)
+	handleOptions(r, getPath)
+	qrPath := joinURL(s.cfg.RoutePrefix, "/qr", route)
+	r.HandleFunc(qrPath, handle(s.qrHandler)).Methods(http.MethodGet, http.MethodHead)
+	handleOptions(r, qrPath)
+	infoPath := joinURL(s.cfg.RoutePrefix, "/api/files", route)
+	r.HandleFunc(infoPath, handle(s.fileInfoHandler)).Methods(http.MethodGet)
+	r.HandleFunc(infoPath, handle(s.writable(s.fileInfoHandler))).Methods(http.MethodPatch)
+	r.HandleFunc(infoPath, handle(s.writable(s.deleteFileHandler))).Methods(http.MethodDelete)
+	handleOptions(r, infoPath)
+	restorePath := joinURL(s.cfg.RoutePrefix, "/api/restore", route)
+	r.HandleFunc(restorePath, handle(s.writable(s.restoreHandler))).Methods(http.MethodPost)
+	handleOptions(r, restorePath)
 }
+
+// version is set at build time with -ldflags "-X main.version=...".
+var version = "dev"
+
 func main() {
-	cfg, err := loalConfig("./config.yaml")
+	// until log_output is known
+	slog.SetDefault(slog.New(requestIDHandler{slog.NewTextHandler(os.Stderr, nil)}))
+	if code, ok := runCommand(os.Args[1:]); ok {
+		os.Exit(code)
+	}
+	configPath := flag.String("config", "./config.yaml", "config file, one of "+strings.Join(configFormats, ", "))
+	flag.Parse()
+	cfg, err := loalConfig(*configPath)
+	if err != nil {
+		fatal("fail to load configuration", "err", err)
+	}
+	err = setupLogging(cfg)
 	if err != nil {
-		log.Fatalf("Failed to load configuration\n%v", err)
-	}
-	r := mux.NewRouter()
-	r.HandleFunc("/upload", func(w http.ResponseWriter, r *http.Request) {
-		uploadHander(w, r, cfg)
-	})
-	r.HandleFunc(
-		fmt.Sprintf("/%s/{year}/{month}/{day}/{filename}", cfg.AccessPrefix),
-		func(w http.ResponseWriter, r *http.Request) {
-			getHandler(w, r, cfg)
-		},
-	)
-	hostAndPort := fmt.Sprintf("%s:%s", cfg.Host, cfg.Port)
-	log.Printf("the server start listening on %s\n", hostAndPort)
-	log.Fatal(http.ListenAndServe(hostAndPort, r))
+		fatal("fail to set up logging", "err", err)
+	}
+	server, err := NewServer(cfg)
+	if err != nil {
+		fatal("fail to start", "err", err)
+	}
+	server.Start()
+	if cfg.OtelEnabled {
+		shutdownTracing, err := setupTracing(context.Background())
+		if err != nil {
+			fatal("fail to set up tracing", "err", err)
+		}
+		defer shutdownTracing(context.Background())
+	}
+	slog.Info("starting", "version", version, "pid", os.Getpid())
+	listeners, err := serverListeners(cfg)
+	if err != nil {
+		fatal("fail to listen", "err", err)
+	}
+	err = server.serve(&http.Server{Handler: server.Routes()}, listeners)
+	if err != nil {
+		fatal("fail to serve", "err", err)
+	}
 }
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// testConfig loads a config storing into a temp dir, with extra yaml
+// lines appended.
+func testConfig(t testing.TB, extra string) *config {
+	t.Helper()
+	dir := t.TempDir()
+	cfg, err := loadConfigFrom(strings.NewReader("host: 127.0.0.1\nport: 8080\nupload_dir: "+filepath.Join(dir, "upload")+"\naccess_prefix: i\nusername: u\npassword: p\nidempotency_state_file: "+filepath.Join(dir, "idempotency.json")+"\n"+extra), ".yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cfg
+}
+
+// testServer is a Server for cfg, without its background work.
+func testServer(t testing.TB, cfg *config) *Server {
+	t.Helper()
+	server, err := NewServer(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return server
+}
+
+func TestBasicAuth(t *testing.T) {
+	server := testServer(t, testConfig(t, "token: secret\n"))
+	for _, test := range []struct {
+		name          string
+		authorization string
+		want          string
+	}{
+		{"missing header", "", "authorization header is missing"},
+		{"wrong scheme", "Token dTpw", "invalid authorization type"},
+		{"bad base64", "Basic !!!", "failed to decode basic auth info"},
+		{"no colon", "Basic dXA=", "invalid basic auth info"},
+		{"bad credentials", "Basic dTp4", "invalid credentials"},
+		{"unknown user", "Basic eDpw", "invalid credentials"},
+		{"valid", "Basic dTpw", ""},
+		{"bad token", "Bearer nope", "invalid token"},
+		{"valid token", "Bearer secret", ""},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/upload", nil)
+			if len(test.authorization) != 0 {
+				req.Header.Set("Authorization", test.authorization)
+			}
+			err := server.basicAuth(req)
+			switch {
+			case len(test.want) == 0 && err != nil:
+				t.Errorf("got %v, want nil", err)
+			case len(test.want) != 0 && (err == nil || !strings.HasPrefix(err.Error(), test.want)):
+				t.Errorf("got %v, want %q", err, test.want)
+			}
+		})
+	}
+}
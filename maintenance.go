@@ -0,0 +1,50 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// readOnlyRetryAfter is the Retry-After of requests refused in read-only
+// mode.
+const readOnlyRetryAfter = 5 * time.Minute
+
+// writable refuses next with 503 while the server is read-only. Reading
+// the flag is all it does, flipping it never waits for a request.
+func (s *Server) writable(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.readOnly.Load() {
+			w.Header().Set("Retry-After", strconv.Itoa(int(readOnlyRetryAfter.Seconds())))
+			writeError(w, r, http.StatusServiceUnavailable, "The server is in maintenance mode, downloads work but nothing can be changed")
+			return
+		}
+		next(w, r)
+	}
+}
+
+// adminReadOnlyHandler switches read-only mode with {"read_only": true} or
+// false, until the next one or a restart.
+func (s *Server) adminReadOnlyHandler(w http.ResponseWriter, r *http.Request) {
+	var change struct {
+		ReadOnly *bool `json:"read_only"`
+	}
+	err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<10)).Decode(&change)
+	if err != nil || change.ReadOnly == nil {
+		writeError(w, r, http.StatusBadRequest, `Body must be {"read_only": true or false}`)
+		return
+	}
+	if s.readOnly.Swap(*change.ReadOnly) != *change.ReadOnly {
+		slog.InfoContext(r.Context(), "read-only mode switched", "read_only", *change.ReadOnly)
+	}
+	writeJSON(w, http.StatusOK, map[string]bool{"read_only": *change.ReadOnly})
+}
+
+// healthHandler tells load balancers the server is up, with the mode so
+// they can tell a read-only one apart.
+func (s *Server) healthHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, http.StatusOK, map[string]any{"status": "ok", "read_only": s.readOnly.Load()})
+}
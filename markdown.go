@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bytes"
+	"html/template"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/yuin/goldmark"
+	"github.com/yuin/goldmark/extension"
+)
+
+const (
+	defaultMarkdownMaxSize = 1 << 20
+	markdownCacheEntries   = 256
+)
+
+// markdownRenderer leaves goldmark's safe defaults on: raw HTML is omitted
+// and javascript:-style links are dropped, so uploads can't inject script.
+var markdownRenderer = goldmark.New(goldmark.WithExtensions(extension.GFM))
+
+var markdownView = template.Must(template.New("markdown").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>{{.Name}}</title>
+<style>body{max-width:48em;margin:0 auto;padding:1em;font:16px/1.6 sans-serif}pre{overflow:auto;padding:1em;background:#f5f5f5}code{font-family:monospace}img{max-width:100%}table{border-collapse:collapse}td,th{border:1px solid #ccc;padding:.3em .6em}</style>
+</head>
+<body>
+{{.Body}}
+</body>
+</html>
+`))
+
+type markdownEntry struct {
+	modTime time.Time
+	size    int64
+	html    []byte
+}
+
+// markdownCache keeps rendered pages keyed by path, invalidated by mtime and
+// size so repeated views skip parsing.
+type markdownCache struct {
+	mu      sync.Mutex
+	entries map[string]markdownEntry
+}
+
+func newMarkdownCache() *markdownCache {
+	return &markdownCache{entries: map[string]markdownEntry{}}
+}
+
+// get returns the page rendered for filePath, if it was rendered from the
+// file info describes.
+func (c *markdownCache) get(filePath string, info os.FileInfo) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok := c.entries[filePath]
+	if !ok || !entry.modTime.Equal(info.ModTime()) || entry.size != info.Size() {
+		return nil, false
+	}
+	return entry.html, true
+}
+
+// put keeps the page of filePath, dropping any other one when it is full.
+func (c *markdownCache) put(filePath string, info os.FileInfo, html []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.entries) >= markdownCacheEntries {
+		for key := range c.entries {
+			delete(c.entries, key)
+			break
+		}
+	}
+	c.entries[filePath] = markdownEntry{modTime: info.ModTime(), size: info.Size(), html: html}
+}
+
+// serveMarkdown answers with the rendered HTML of a Markdown file. It returns
+// false when the file is too large and should be served raw instead.
+func (s *Server) serveMarkdown(w http.ResponseWriter, r *http.Request, filePath, filename string) bool {
+	cfg := s.cfg
+	maxSize := int64(cfg.MarkdownMaxSize)
+	if maxSize <= 0 {
+		maxSize = defaultMarkdownMaxSize
+	}
+	info, err := statStored(cfg, filePath)
+	if err != nil || info.Size() > maxSize {
+		return false
+	}
+	html, err := s.renderMarkdown(filePath, filename, info)
+	if err != nil {
+		return false
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	setHeader(w.Header(), "Content-Security-Policy", viewContentSecurityPolicy)
+	http.ServeContent(w, r, "", info.ModTime(), bytes.NewReader(html))
+	return true
+}
+func (s *Server) renderMarkdown(filePath, filename string, info os.FileInfo) ([]byte, error) {
+	if html, ok := s.markdownPages.get(filePath, info); ok {
+		return html, nil
+	}
+	source, err := readStored(s.cfg, filePath)
+	if err != nil {
+		return nil, err
+	}
+	var body bytes.Buffer
+	err = markdownRenderer.Convert(source, &body)
+	if err != nil {
+		return nil, err
+	}
+	var page bytes.Buffer
+	err = markdownView.Execute(&page, struct {
+		Name string
+		Body template.HTML
+	}{filename, template.HTML(body.String())})
+	if err != nil {
+		return nil, err
+	}
+	s.markdownPages.put(filePath, info, page.Bytes())
+	return page.Bytes(), nil
+}
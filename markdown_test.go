@@ -0,0 +1,40 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRenderMarkdown(t *testing.T) {
+	routes := testServer(t, testConfig(t, "render_markdown: true\n")).Routes()
+	source := "# Notes\n\n| a | b |\n|---|---|\n| 1 | 2 |\n\n<script>alert(1)</script>\n\n<img src=x onerror=alert(2)>\n\n[link](javascript:alert(3))\n"
+	path := downloadPath(t, testUpload(t, routes, "notes.md", source, nil))
+	get := func(target, accept string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, target, nil)
+		req.Header.Set("Accept", accept)
+		res := httptest.NewRecorder()
+		routes.ServeHTTP(res, req)
+		return res
+	}
+
+	page := get(path, "text/html,*/*;q=0.8")
+	body := page.Body.String()
+	if page.Header().Get("Content-Type") != "text/html; charset=utf-8" || page.Header().Get("Content-Security-Policy") != viewContentSecurityPolicy {
+		t.Errorf("rendered headers %v", page.Header())
+	}
+	if !strings.Contains(body, "<h1>Notes</h1>") || !strings.Contains(body, "<td>1</td>") {
+		t.Errorf("heading or table not rendered: %s", body)
+	}
+	for _, unsafe := range []string{"<script", "onerror", "javascript:"} {
+		if strings.Contains(body, unsafe) {
+			t.Errorf("%q passed through: %s", unsafe, body)
+		}
+	}
+	for _, res := range []*httptest.ResponseRecorder{get(path+"?raw=1", "text/html"), get(path, "*/*")} {
+		if res.Header().Get("Content-Type") != "text/markdown; charset=utf-8" || res.Body.String() != source {
+			t.Errorf("raw markdown: %q: %q", res.Header().Get("Content-Type"), res.Body)
+		}
+	}
+}
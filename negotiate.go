@@ -0,0 +1,67 @@
+package main
+
+import (
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// acceptQuality returns the q value the request's Accept header gives
+// mediaType, honoring type/* and */* ranges. A missing header accepts
+// everything with q=1.
+func acceptQuality(r *http.Request, mediaType string) float64 {
+	accept := r.Header.Get("Accept")
+	if len(accept) == 0 {
+		return 1
+	}
+	major, _, _ := strings.Cut(mediaType, "/")
+	best, bestSpecificity := 0.0, -1
+	for _, part := range strings.Split(accept, ",") {
+		rangeType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		specificity := -1
+		switch {
+		case rangeType == mediaType:
+			specificity = 2
+		case rangeType == major+"/*":
+			specificity = 1
+		case rangeType == "*/*":
+			specificity = 0
+		}
+		if specificity <= bestSpecificity {
+			continue
+		}
+		q := 1.0
+		if value, ok := params["q"]; ok {
+			q, err = strconv.ParseFloat(value, 64)
+			if err != nil {
+				continue
+			}
+		}
+		best, bestSpecificity = q, specificity
+	}
+	return best
+}
+
+// prefersHTML reports whether the client explicitly asked for HTML over the
+// alternative representation, as browsers do and curl doesn't.
+func prefersHTML(r *http.Request, alternative string) bool {
+	if !strings.Contains(r.Header.Get("Accept"), "text/html") {
+		return false
+	}
+	html := acceptQuality(r, "text/html")
+	return html > 0 && html >= acceptQuality(r, alternative)
+}
+
+// prefersJSON reports whether the client explicitly asked for JSON over
+// plain text.
+func prefersJSON(r *http.Request) bool {
+	if !strings.Contains(r.Header.Get("Accept"), "application/json") {
+		return false
+	}
+	json := acceptQuality(r, "application/json")
+	return json > 0 && json >= acceptQuality(r, "text/plain")
+}
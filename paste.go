@@ -0,0 +1,148 @@
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+const defaultPasteMaxSize = 1 << 20
+
+// pasteLanguages maps the lang parameter of /paste to the stored extension.
+// Pastes are served as UTF-8 plain text whatever it is, when the index
+// remembers them; uploads with these extensions keep their type.
+var pasteLanguages = map[string]string{
+	"text":       ".txt",
+	"txt":        ".txt",
+	"log":        ".log",
+	"markdown":   ".md",
+	"md":         ".md",
+	"go":         ".go",
+	"python":     ".py",
+	"py":         ".py",
+	"javascript": ".js",
+	"js":         ".js",
+	"typescript": ".ts",
+	"ts":         ".ts",
+	"json":       ".json",
+	"yaml":       ".yaml",
+	"yml":        ".yaml",
+	"toml":       ".toml",
+	"ini":        ".ini",
+	"shell":      ".sh",
+	"bash":       ".sh",
+	"sh":         ".sh",
+	"sql":        ".sql",
+	"c":          ".c",
+	"cpp":        ".cpp",
+	"java":       ".java",
+	"rust":       ".rs",
+	"rs":         ".rs",
+	"ruby":       ".rb",
+	"rb":         ".rb",
+	"php":        ".php",
+	"css":        ".css",
+	"diff":       ".diff",
+}
+
+// pasteHandler stores a text body (raw, or the "text" form field) through the
+// same pipeline as uploads and returns its url.
+func (s *Server) pasteHandler(w http.ResponseWriter, r *http.Request) {
+	digests, reservation, ok := s.uploadPreflight(w, r)
+	if !ok {
+		return
+	}
+	defer reservation.release()
+	maxSize := int64(s.cfg.PasteMaxSize)
+	if maxSize <= 0 {
+		maxSize = defaultPasteMaxSize
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, maxSize)
+	var text io.Reader = r.Body
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType == "multipart/form-data" || mediaType == "application/x-www-form-urlencoded" {
+		var err error
+		if mediaType == "multipart/form-data" {
+			err = r.ParseMultipartForm(maxSize)
+		} else {
+			err = r.ParseForm()
+		}
+		if bodyAborted(err) {
+			s.writeStoreError(w, r, err)
+			return
+		}
+		if err != nil {
+			writeError(w, r, http.StatusBadRequest, "Invalid form")
+			return
+		}
+		value := r.FormValue("text")
+		if len(value) == 0 {
+			writeError(w, r, http.StatusBadRequest, "Empty paste")
+			return
+		}
+		text = strings.NewReader(value)
+	} else if r.ContentLength == 0 {
+		writeError(w, r, http.StatusBadRequest, "Empty paste")
+		return
+	}
+	ext := ".txt"
+	if lang := strings.ToLower(r.FormValue("lang")); len(lang) != 0 {
+		ext, ok = pasteLanguages[lang]
+		if !ok {
+			writeError(w, r, http.StatusBadRequest, fmt.Sprintf("Unknown lang %q", lang))
+			return
+		}
+	}
+	private, err := s.parseVisibility(r.FormValue("visibility"))
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	stored, err := s.storeUpload(r.Context(), requestNamespace(r, s.cfg), "", text, "paste"+ext, maxSize, digests)
+	if err != nil {
+		s.writeStoreError(w, r, err)
+		return
+	}
+	stored.Private, stored.Paste = private, true
+	s.afterStore(r, stored)
+	writeUploadResponse(w, r, s.cfg, stored)
+}
+
+var pasteView = template.Must(template.New("paste").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>{{.Name}}</title>
+<style>body{margin:0}pre{margin:0;padding:1em;font:14px/1.5 monospace;white-space:pre-wrap;word-wrap:break-word}</style>
+</head>
+<body><pre>{{.Text}}</pre></body>
+</html>
+`))
+
+// servePasteView wraps a text file in a minimal monospace page. It returns
+// false when the file is too large for the view and should be served raw.
+func servePasteView(w http.ResponseWriter, r *http.Request, cfg *config, filePath, filename string) bool {
+	maxSize := int64(cfg.PasteMaxSize)
+	if maxSize <= 0 {
+		maxSize = defaultPasteMaxSize
+	}
+	info, err := statStored(cfg, filePath)
+	if err != nil || info.Size() > maxSize {
+		return false
+	}
+	text, err := readStored(cfg, filePath)
+	if err != nil {
+		return false
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	setHeader(w.Header(), "Content-Security-Policy", viewContentSecurityPolicy)
+	w.WriteHeader(http.StatusOK)
+	if r.Method != http.MethodHead {
+		pasteView.Execute(w, struct{ Name, Text string }{filename, string(text)})
+	}
+	return true
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"maps"
+	"mime/multipart"
+	"net/http"
+	"slices"
+)
+
+// picGoKey marks requests of the PicGo endpoint. Its errors are sent as
+// {"success": false, "message": ...} with 200, the plugins only look at
+// success.
+type picGoKey struct{}
+
+func picGoRequest(r *http.Request) bool {
+	picGo, _ := r.Context().Value(picGoKey{}).(bool)
+	return picGo
+}
+
+type picGoResult struct {
+	Success bool     `json:"success"`
+	Result  []string `json:"result,omitempty"`
+	Message string   `json:"message,omitempty"`
+}
+
+// picGoHandler stores every file of a multipart form, whatever the field is
+// called, and answers like the PicGo server: {"success": true, "result":
+// ["url", ...]}. It only takes Bearer tokens. Files before a failing one
+// stay stored.
+func (s *Server) picGoHandler(w http.ResponseWriter, r *http.Request) {
+	r = r.WithContext(context.WithValue(r.Context(), picGoKey{}, true))
+	if !isBearer(r) {
+		s.auditLog.authFailed(r, "not a Bearer token")
+		writeError(w, r, http.StatusUnauthorized, "A Bearer token is required")
+		return
+	}
+	digests, reservation, ok := s.uploadPreflight(w, r)
+	if !ok {
+		return
+	}
+	defer reservation.release()
+	if s.cfg.MaxUploadSize > 0 {
+		r.Body = http.MaxBytesReader(w, r.Body, int64(s.cfg.MaxUploadSize))
+	}
+	err := r.ParseMultipartForm(int64(s.cfg.MultipartMemory))
+	if r.MultipartForm != nil {
+		defer r.MultipartForm.RemoveAll()
+	}
+	if bodyAborted(err) {
+		s.writeStoreError(w, r, err)
+		return
+	}
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, "Invalid form")
+		return
+	}
+	r.Body.Close()
+	result := picGoResult{Success: true}
+	for _, field := range slices.Sorted(maps.Keys(r.MultipartForm.File)) {
+		for _, header := range r.MultipartForm.File[field] {
+			stored, err := s.storePart(r, header, digests)
+			if err != nil {
+				s.writeStoreError(w, r, err)
+				return
+			}
+			result.Result = append(result.Result, publicURL(r, s.cfg, stored.Rel))
+		}
+	}
+	if len(result.Result) == 0 {
+		writeError(w, r, http.StatusBadRequest, "Missing file")
+		return
+	}
+	writeJSON(w, http.StatusOK, result)
+}
+
+// storePart stores one file of a parsed multipart form.
+func (s *Server) storePart(r *http.Request, header *multipart.FileHeader, digests []*digestCheck) (storedFile, error) {
+	file, err := header.Open()
+	if err != nil {
+		return storedFile{}, err
+	}
+	defer file.Close()
+	stored, err := s.storeUpload(r.Context(), requestNamespace(r, s.cfg), "", file, header.Filename, header.Size, digests)
+	if err != nil {
+		return storedFile{}, err
+	}
+	s.afterStore(r, stored)
+	return stored, nil
+}
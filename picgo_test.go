@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// picGoBoundary is how the form-data package PicGo uses delimits parts.
+const picGoBoundary = "--------------------------512741575517256636757283"
+
+// picGoBody is a request body as PicGo sends it, parts given as field,
+// file name, type and content.
+func picGoBody(parts ...[4]string) string {
+	var body strings.Builder
+	for _, part := range parts {
+		body.WriteString("--" + picGoBoundary + "\r\n")
+		body.WriteString(`Content-Disposition: form-data; name="` + part[0] + `"; filename="` + part[1] + "\"\r\n")
+		body.WriteString("Content-Type: " + part[2] + "\r\n\r\n")
+		body.WriteString(part[3] + "\r\n")
+	}
+	body.WriteString("--" + picGoBoundary + "--\r\n")
+	return body.String()
+}
+
+func TestPicGoUpload(t *testing.T) {
+	routes := testServer(t, testConfig(t, "token: picgo-token\n")).Routes()
+	post := func(authorization, contentType, body string) picGoResult {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodPost, "/api/picgo/upload", strings.NewReader(body))
+		req.Header.Set("Content-Type", contentType)
+		req.Header.Set("User-Agent", "PicGo")
+		if len(authorization) != 0 {
+			req.Header.Set("Authorization", authorization)
+		}
+		res := httptest.NewRecorder()
+		routes.ServeHTTP(res, req)
+		if res.Code != http.StatusOK {
+			t.Fatalf("status %d: %s", res.Code, res.Body)
+		}
+		var result picGoResult
+		if err := json.Unmarshal(res.Body.Bytes(), &result); err != nil {
+			t.Fatalf("%v in %s", err, res.Body)
+		}
+		return result
+	}
+	form := "multipart/form-data; boundary=" + picGoBoundary
+	png := string([]byte{0x89, 'P', 'N', 'G', '\r', '\n', 0x1a, '\n'})
+
+	result := post("Bearer picgo-token", form, picGoBody([4]string{"file", "screenshot.png", "image/png", png}))
+	if !result.Success || len(result.Result) != 1 || !strings.HasSuffix(result.Result[0], ".png") {
+		t.Errorf("single file: %+v", result)
+	}
+	res := httptest.NewRecorder()
+	routes.ServeHTTP(res, httptest.NewRequest(http.MethodGet, result.Result[0][strings.Index(result.Result[0], "/i/"):], nil))
+	if res.Body.String() != png {
+		t.Errorf("download %q", res.Body)
+	}
+
+	result = post("Bearer picgo-token", form, picGoBody(
+		[4]string{"image", "a.jpg", "image/jpeg", "jpeg"},
+		[4]string{"image", "b.gif", "image/gif", "gif"},
+		[4]string{"smfile", "c.webp", "image/webp", "webp"},
+	))
+	if !result.Success || len(result.Result) != 3 || !strings.HasSuffix(result.Result[0], ".jpg") || !strings.HasSuffix(result.Result[1], ".gif") {
+		t.Errorf("three files: %+v", result)
+	}
+
+	for _, test := range []struct {
+		name, authorization, contentType, body string
+	}{
+		{"no token", "", form, picGoBody([4]string{"file", "a.png", "image/png", png})},
+		{"wrong token", "Bearer nope", form, picGoBody([4]string{"file", "a.png", "image/png", png})},
+		{"basic auth", "Basic dTpw", form, picGoBody([4]string{"file", "a.png", "image/png", png})},
+		{"no file", "Bearer picgo-token", form, picGoBody()},
+		{"not a form", "Bearer picgo-token", "application/json", `{"list": ["/home/me/a.png"]}`},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			result := post(test.authorization, test.contentType, test.body)
+			if result.Success || len(result.Message) == 0 || len(result.Result) != 0 {
+				t.Errorf("%+v", result)
+			}
+		})
+	}
+}
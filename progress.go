@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// Defaults of the upload_progress block.
+const (
+	defaultProgressInterval = 10 * time.Second
+	defaultProgressMinSize  = 64 << 20
+)
+
+// progressConfig controls the progress lines of large uploads. Progress is
+// logged at debug level; the line once a large upload is stored always is.
+type progressConfig struct {
+	Interval duration `yaml:"interval" json:"interval" toml:"interval"`
+	Every    byteSize `yaml:"every" json:"every" toml:"every"`
+	MinSize  byteSize `yaml:"min_size" json:"min_size" toml:"min_size"`
+}
+
+// isLarge reports whether an upload of size bytes gets logged.
+func (c progressConfig) isLarge(size int64) bool {
+	return size >= int64(c.MinSize)
+}
+
+// progressReader logs how much of a request body has arrived every
+// Interval, or every Every bytes, once MinSize bytes arrived.
+type progressReader struct {
+	body  io.ReadCloser
+	cfg   progressConfig
+	id    string
+	total int64
+	start time.Time
+
+	received     int64
+	lastLog      time.Time
+	lastReceived int64
+}
+
+// watchProgress wraps r.Body in a progressReader, unless debug logging is
+// off or Content-Length says the upload is small.
+func watchProgress(r *http.Request, cfg *config) {
+	if !slog.Default().Enabled(r.Context(), slog.LevelDebug) || (r.ContentLength >= 0 && !cfg.UploadProgress.isLarge(r.ContentLength)) {
+		return
+	}
+	info := requestInfoOf(r)
+	r.Body = &progressReader{
+		body:    r.Body,
+		cfg:     cfg.UploadProgress,
+		id:      info.ID,
+		total:   r.ContentLength,
+		start:   info.Start,
+		lastLog: info.Start,
+	}
+}
+func (p *progressReader) Read(b []byte) (int, error) {
+	n, err := p.body.Read(b)
+	p.received += int64(n)
+	if n == 0 || !p.cfg.isLarge(p.received) {
+		return n, err
+	}
+	now := time.Now()
+	due := now.Sub(p.lastLog) >= time.Duration(p.cfg.Interval)
+	if p.cfg.Every > 0 && p.received-p.lastReceived >= int64(p.cfg.Every) {
+		due = true
+	}
+	if !due {
+		return n, err
+	}
+	rate := float64(p.received-p.lastReceived) / now.Sub(p.lastLog).Seconds()
+	if p.total > 0 {
+		slog.Debug("upload progress", "request_id", p.id, "bytes", p.received, "total", p.total, "percent", fmt.Sprintf("%.1f", float64(p.received)*100/float64(p.total)), "rate", formatBytes(int64(rate))+"/s")
+	} else {
+		slog.Debug("upload progress", "request_id", p.id, "bytes", p.received, "rate", formatBytes(int64(rate))+"/s")
+	}
+	p.lastLog = now
+	p.lastReceived = p.received
+	return n, err
+}
+func (p *progressReader) Close() error {
+	return p.body.Close()
+}
+
+// logStored is the final line of a large upload.
+func logStored(r *http.Request, cfg *config, stored storedFile) {
+	if !cfg.UploadProgress.isLarge(stored.Size) {
+		return
+	}
+	info := requestInfoOf(r)
+	elapsed := time.Since(info.Start)
+	slog.InfoContext(r.Context(), "upload stored", "path", stored.Rel, "bytes", stored.Size, "duration", elapsed.Round(time.Millisecond), "rate", formatBytes(int64(float64(stored.Size)/elapsed.Seconds()))+"/s")
+}
+
+// formatBytes writes n with a binary suffix, like 12.5MB.
+func formatBytes(n int64) string {
+	const units = "KMGT"
+	if n < 1024 {
+		return fmt.Sprintf("%dB", n)
+	}
+	value := float64(n)
+	i := -1
+	for value >= 1024 && i < len(units)-1 {
+		value /= 1024
+		i++
+	}
+	return fmt.Sprintf("%.1f%cB", value, units[i])
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestUploadProgress(t *testing.T) {
+	var logs bytes.Buffer
+	previous := slog.Default()
+	slog.SetDefault(slog.New(slog.NewJSONHandler(&logs, &slog.HandlerOptions{Level: slog.LevelDebug})))
+	t.Cleanup(func() { slog.SetDefault(previous) })
+	cfg := testConfig(t, "upload_progress:\n  interval: 20ms\n  min_size: 4KB\n")
+	routes := testServer(t, cfg).Routes()
+	lines := func() []map[string]any {
+		var found []map[string]any
+		for _, line := range strings.Split(strings.TrimSpace(logs.String()), "\n") {
+			var record map[string]any
+			if json.Unmarshal([]byte(line), &record) == nil && strings.HasPrefix(record["msg"].(string), "upload ") {
+				found = append(found, record)
+			}
+		}
+		logs.Reset()
+		return found
+	}
+
+	if res := slowUpload(routes, strings.Repeat("a", 16<<10), 256, 2*time.Millisecond); res.Code != http.StatusCreated {
+		t.Fatalf("upload status %d: %s", res.Code, res.Body)
+	}
+	found := lines()
+	if len(found) < 2 || found[len(found)-1]["msg"] != "upload stored" {
+		t.Fatalf("progress lines %v", found)
+	}
+	for _, line := range found[:len(found)-1] {
+		if line["msg"] != "upload progress" || line["percent"] == nil || line["rate"] == nil || len(line["request_id"].(string)) == 0 {
+			t.Errorf("progress line %v", line)
+		}
+	}
+	if stored := found[len(found)-1]; stored["bytes"] != float64(16<<10) || stored["duration"] == nil {
+		t.Errorf("stored line %v", stored)
+	}
+
+	if res := slowUpload(routes, "small", 1, time.Millisecond); res.Code != http.StatusCreated {
+		t.Fatalf("small upload status %d: %s", res.Code, res.Body)
+	}
+	if found := lines(); len(found) != 0 {
+		t.Errorf("a small upload logged %v", found)
+	}
+}
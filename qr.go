@@ -0,0 +1,52 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	"github.com/skip2/go-qrcode"
+)
+
+const (
+	qrDefaultSize = 256
+	qrMinSize     = 64
+	qrMaxSize     = 1024
+)
+
+// qrHandler renders a PNG QR code pointing at the public URL of a stored
+// file, so it can be opened on a phone.
+func (s *Server) qrHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	filePath := storedPath(s.cfg, vars)
+	_, _, err := findStored(filePath)
+	if os.IsNotExist(err) {
+		notFoundHandler(w, r)
+		return
+	}
+	size := qrDefaultSize
+	if value := r.URL.Query().Get("size"); len(value) != 0 {
+		size, err = strconv.Atoi(value)
+		if err != nil {
+			writeError(w, r, http.StatusBadRequest, "Invalid size")
+			return
+		}
+		size = min(max(size, qrMinSize), qrMaxSize)
+	}
+	url := publicURL(r, s.cfg, routeRel(vars))
+	png, err := qrcode.Encode(url, qrcode.Medium, size)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "fail to encode qr code", "err", err)
+		writeError(w, r, http.StatusInternalServerError, "")
+		return
+	}
+	w.Header().Set("Content-Type", "image/png")
+	w.Header().Set("Cache-Control", "public, max-age=86400")
+	w.Header().Set("Content-Length", strconv.Itoa(len(png)))
+	w.WriteHeader(http.StatusOK)
+	if r.Method != http.MethodHead {
+		w.Write(png)
+	}
+}
@@ -0,0 +1,310 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	quotaWindow    = 24 * time.Hour
+	quotaSaveEvery = 30 * time.Second
+	// quotaForget drops clients idle this long from the state file.
+	quotaForget = 3 * 24 * time.Hour
+)
+
+// quotaTracker accounts stored bytes per client IP over a rolling 24 hour
+// window, in hourly buckets, persisted so restarts don't reset it.
+type quotaTracker struct {
+	mu   sync.Mutex
+	path string
+	// changes counts the changes to ips, saved is the count the state file
+	// has, so a failed save is tried again.
+	changes, saved int64
+	ips            map[string]*ipUsage
+	// reserved holds the bytes uploads in flight may still store, per IP,
+	// counted against the quota until they finish.
+	reserved map[string]int64
+	// loaded is the state file as read at start, what catchUp compares a
+	// handed over process's last save with.
+	loaded map[string]*ipUsage
+}
+
+type ipUsage struct {
+	// Hours maps unix hour numbers to the bytes stored during that hour.
+	Hours    map[int64]int64 `json:"hours"`
+	LastSeen time.Time       `json:"last_seen"`
+}
+
+// quota_counts picks whether quotas count the uploaded bytes or what they
+// take on disk after compression.
+const (
+	quotaCountsLogical = "logical"
+	quotaCountsDisk    = "disk"
+)
+
+func loadQuotaTracker(path string) (*quotaTracker, error) {
+	tracker := &quotaTracker{path: path, ips: map[string]*ipUsage{}, reserved: map[string]int64{}}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return tracker, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("fail to read quota state\n%w", err)
+	}
+	err = json.Unmarshal(data, &tracker.ips)
+	if err != nil {
+		return nil, fmt.Errorf("fail to decode quota state\n%w", err)
+	}
+	json.Unmarshal(data, &tracker.loaded)
+	return tracker, nil
+}
+
+// catchUp adds what the process that handed over to this one stored after
+// the state was loaded, the difference between its last save and the file
+// as loaded.
+func (t *quotaTracker) catchUp() error {
+	data, err := os.ReadFile(t.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("fail to read quota state\n%w", err)
+	}
+	var last map[string]*ipUsage
+	err = json.Unmarshal(data, &last)
+	if err != nil {
+		return fmt.Errorf("fail to decode quota state\n%w", err)
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for ip, saved := range last {
+		usage, ok := t.ips[ip]
+		if !ok {
+			usage = &ipUsage{Hours: map[int64]int64{}}
+			t.ips[ip] = usage
+		}
+		loaded := t.loaded[ip]
+		for hour, bytes := range saved.Hours {
+			if loaded != nil {
+				bytes -= loaded.Hours[hour]
+			}
+			if bytes > 0 {
+				usage.Hours[hour] += bytes
+				t.changes++
+			}
+		}
+		if saved.LastSeen.After(usage.LastSeen) {
+			usage.LastSeen = saved.LastSeen
+		}
+	}
+	t.loaded = nil
+	return nil
+}
+
+// usage returns the bytes stored by ip within the window and when the
+// oldest of them falls out of it.
+func (t *quotaTracker) usage(ip string, now time.Time) (int64, time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.usageLocked(ip, now)
+}
+func (t *quotaTracker) usageLocked(ip string, now time.Time) (int64, time.Time) {
+	usage, ok := t.ips[ip]
+	if !ok {
+		return 0, now
+	}
+	current := now.Unix() / 3600
+	var used int64
+	oldest := current
+	for hour, bytes := range usage.Hours {
+		if hour <= current-24 {
+			continue
+		}
+		used += bytes
+		oldest = min(oldest, hour)
+	}
+	return used, time.Unix((oldest+24)*3600, 0)
+}
+
+// reserve sets up to n bytes aside for ip within quota, counting what is
+// stored and reserved already, and returns how many it got. It fails when
+// that is less than n.
+func (t *quotaTracker) reserve(ip string, n, quota int64, now time.Time) (int64, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	used, reset := t.usageLocked(ip, now)
+	used += t.reserved[ip]
+	granted := min(n, max(quota-used, 0))
+	t.reserved[ip] += granted
+	if granted < n {
+		return granted, quotaError{quota: quota, used: used, reset: reset}
+	}
+	return granted, nil
+}
+
+// release gives back n reserved bytes of ip.
+func (t *quotaTracker) release(ip string, n int64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.reserved[ip] -= n
+	if t.reserved[ip] <= 0 {
+		delete(t.reserved, ip)
+	}
+}
+func (t *quotaTracker) add(ip string, bytes int64, now time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	usage, ok := t.ips[ip]
+	if !ok {
+		usage = &ipUsage{Hours: map[int64]int64{}}
+		t.ips[ip] = usage
+	}
+	usage.Hours[now.Unix()/3600] += bytes
+	usage.LastSeen = now
+	t.changes++
+}
+
+// prune drops expired buckets and clients not seen for a few days.
+func (t *quotaTracker) prune(now time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	current := now.Unix() / 3600
+	for ip, usage := range t.ips {
+		if now.Sub(usage.LastSeen) > quotaForget {
+			delete(t.ips, ip)
+			t.changes++
+			continue
+		}
+		for hour := range usage.Hours {
+			if hour <= current-24 {
+				delete(usage.Hours, hour)
+				t.changes++
+			}
+		}
+	}
+}
+func (t *quotaTracker) save() error {
+	t.mu.Lock()
+	if t.changes == t.saved {
+		t.mu.Unlock()
+		return nil
+	}
+	data, err := json.Marshal(t.ips)
+	changes := t.changes
+	t.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	tmp := t.path + ".tmp"
+	err = os.WriteFile(tmp, data, 0600)
+	if err == nil {
+		err = os.Rename(tmp, t.path)
+	}
+	if err != nil {
+		return err
+	}
+	t.mu.Lock()
+	t.saved = max(t.saved, changes)
+	t.mu.Unlock()
+	return nil
+}
+
+// quotaError refuses an upload that would take its client past the daily
+// quota.
+type quotaError struct {
+	quota, used int64
+	reset       time.Time
+}
+
+func (e quotaError) Error() string {
+	return fmt.Sprintf("Daily upload quota of %d bytes exceeded, %d bytes used, resets at %s", e.quota, e.used, e.reset.UTC().Format(time.RFC3339))
+}
+
+// quotaReader reserves the quota of a request body as it is read and fails
+// it once nothing is left, so an upload of unknown length stops at the
+// quota and concurrent ones can't spend the same bytes. Past the
+// reservation it reads one byte to tell the end of the body from more and
+// never returns it, a reader finding the end of a form in what it got can't
+// miss the error.
+type quotaReader struct {
+	io.ReadCloser
+	tracker *quotaTracker
+	ip      string
+	quota   int64
+	// credit is what may be read without a reservation, the size of a
+	// file being replaced.
+	credit, read, reserved int64
+}
+
+func (q *quotaReader) Read(p []byte) (int, error) {
+	if need := q.read + int64(len(p)) - q.credit - q.reserved; need > 0 {
+		granted, err := q.tracker.reserve(q.ip, need, q.quota, time.Now())
+		q.reserved += granted
+		left := q.credit + q.reserved - q.read
+		if left <= 0 && err != nil {
+			n, readErr := q.ReadCloser.Read(make([]byte, 1))
+			if n == 0 {
+				return 0, readErr
+			}
+			return 0, err
+		}
+		p = p[:min(int64(len(p)), left)]
+	}
+	n, err := q.ReadCloser.Read(p)
+	q.read += int64(n)
+	return n, err
+}
+
+// release gives back the reservation once the upload is charged or failed.
+func (q *quotaReader) release() {
+	if q == nil {
+		return
+	}
+	q.tracker.release(q.ip, q.reserved)
+	q.reserved = 0
+}
+
+// checkQuota refuses r when what is left of its client's quota can't take
+// it, as far as its length tells, and otherwise reserves that length and
+// wraps its body to reserve the rest as it is read. credit is not charged,
+// only what a replacement grows by counts. The caller releases the
+// reservation when done.
+func (s *Server) checkQuota(r *http.Request, credit int64) (*quotaReader, error) {
+	q := &quotaReader{
+		ReadCloser: r.Body,
+		tracker:    s.quotas,
+		ip:         clientIP(r, s.cfg).String(),
+		quota:      int64(s.cfg.DailyQuotaPerIP),
+		credit:     credit,
+	}
+	// one of unknown length needs a byte left to start
+	need := r.ContentLength - credit
+	if r.ContentLength < 0 {
+		need = 1 - credit
+	}
+	granted, err := s.quotas.reserve(q.ip, max(need, 0), q.quota, time.Now())
+	q.reserved = granted
+	if err != nil {
+		q.release()
+		return nil, err
+	}
+	r.Body = q
+	return q, nil
+}
+
+// run prunes and saves the state periodically, forever.
+func (t *quotaTracker) run() {
+	for range time.Tick(quotaSaveEvery) {
+		t.prune(time.Now())
+		err := t.save()
+		if err != nil {
+			slog.Error("fail to save quota state", "err", err)
+		}
+	}
+}
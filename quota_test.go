@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestQuotaRemaining(t *testing.T) {
+	cfg := testConfig(t, "daily_quota_per_ip: 1KB\nquota_state_file: "+filepath.Join(t.TempDir(), "quota.json")+"\n")
+	routes := testServer(t, cfg).Routes()
+	if res := testUpload(t, routes, "a.txt", strings.Repeat("a", 600), nil); res.Code != http.StatusCreated {
+		t.Fatalf("first upload: status %d: %s", res.Code, res.Body)
+	}
+	res := testUpload(t, routes, "b.txt", strings.Repeat("b", 600), nil)
+	if res.Code != http.StatusTooManyRequests || len(res.Header().Get("Retry-After")) == 0 {
+		t.Errorf("upload past the quota: status %d, Retry-After %q", res.Code, res.Header().Get("Retry-After"))
+	}
+
+	// without a length the body is cut off at the quota
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	part, _ := form.CreateFormFile("file", "c.txt")
+	io.WriteString(part, strings.Repeat("c", 600))
+	form.Close()
+	req := httptest.NewRequest(http.MethodPost, "/upload", struct{ io.Reader }{&body})
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	req.SetBasicAuth("u", "p")
+	res = httptest.NewRecorder()
+	routes.ServeHTTP(res, req)
+	if req.ContentLength != -1 || res.Code != http.StatusTooManyRequests {
+		t.Errorf("chunked upload past the quota: length %d, status %d: %s", req.ContentLength, res.Code, res.Body)
+	}
+	if files := storedFiles(t, cfg); files != 1 {
+		t.Errorf("%d files stored, want the first one", files)
+	}
+}
+
+func TestQuotaReplace(t *testing.T) {
+	cfg := testConfig(t, "daily_quota_per_ip: 1KB\nquota_state_file: "+filepath.Join(t.TempDir(), "quota.json")+"\n")
+	server := testServer(t, cfg)
+	routes := server.Routes()
+	path := downloadPath(t, testUpload(t, routes, "a.txt", strings.Repeat("a", 100), nil))
+	req := httptest.NewRequest(http.MethodPut, path, strings.NewReader(strings.Repeat("b", 150)))
+	req.SetBasicAuth("u", "p")
+	res := httptest.NewRecorder()
+	routes.ServeHTTP(res, req)
+	if res.Code != http.StatusOK {
+		t.Fatalf("replace status %d: %s", res.Code, res.Body)
+	}
+	if used, _ := server.quotas.usage(clientIP(req, cfg).String(), time.Now()); used != 150 {
+		t.Errorf("%d bytes charged, want the 100 stored and the 50 grown", used)
+	}
+
+	// only the growth has to fit, not the whole new content
+	path = downloadPath(t, testUpload(t, routes, "c.txt", strings.Repeat("c", 600), nil))
+	req = httptest.NewRequest(http.MethodPut, path, strings.NewReader(strings.Repeat("d", 700)))
+	req.SetBasicAuth("u", "p")
+	res = httptest.NewRecorder()
+	routes.ServeHTTP(res, req)
+	if res.Code != http.StatusOK {
+		t.Errorf("replace growing within the quota: status %d: %s", res.Code, res.Body)
+	}
+	req = httptest.NewRequest(http.MethodPut, path, strings.NewReader(strings.Repeat("e", 1000)))
+	req.SetBasicAuth("u", "p")
+	res = httptest.NewRecorder()
+	routes.ServeHTTP(res, req)
+	if res.Code != http.StatusTooManyRequests {
+		t.Errorf("replace growing past the quota: status %d", res.Code)
+	}
+}
+
+// TestQuotaConcurrent starts uploads that each fit into the quota but not
+// all together, they must not all pass on the same remaining bytes.
+func TestQuotaConcurrent(t *testing.T) {
+	cfg := testConfig(t, "daily_quota_per_ip: 1KB\nquota_state_file: "+filepath.Join(t.TempDir(), "quota.json")+"\n")
+	server := testServer(t, cfg)
+	routes := server.Routes()
+	var wg sync.WaitGroup
+	codes := make([]int, 8)
+	for i := range codes {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			codes[i] = testUpload(t, routes, "a.txt", strings.Repeat("a", 300), nil).Code
+		}()
+	}
+	wg.Wait()
+	stored := 0
+	for _, code := range codes {
+		if code == http.StatusCreated {
+			stored++
+		}
+	}
+	used, _ := server.quotas.usage("192.0.2.1", time.Now())
+	if stored == 0 || used > 1024 || used != int64(stored*300) || storedFiles(t, cfg) != stored {
+		t.Errorf("%d uploads stored, %d files, %d bytes charged of 1024", stored, storedFiles(t, cfg), used)
+	}
+	if len(server.quotas.reserved) != 0 {
+		t.Errorf("reservations left: %v", server.quotas.reserved)
+	}
+}
+
+func TestQuotaCatchUp(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "quota.json")
+	now := time.Now()
+	old, _ := loadQuotaTracker(path)
+	old.add("192.0.2.1", 100, now)
+	old.save()
+	tracker, _ := loadQuotaTracker(path)
+	// the old process stores more while this one already serves
+	old.add("192.0.2.1", 50, now)
+	old.add("192.0.2.2", 30, now)
+	old.save()
+	tracker.add("192.0.2.1", 20, now)
+	if err := tracker.catchUp(); err != nil {
+		t.Fatal(err)
+	}
+	for ip, want := range map[string]int64{"192.0.2.1": 170, "192.0.2.2": 30} {
+		if used, _ := tracker.usage(ip, now); used != want {
+			t.Errorf("%s: %d bytes, want %d", ip, used, want)
+		}
+	}
+}
+
+func TestQuotaSaveRetried(t *testing.T) {
+	dir := t.TempDir()
+	tracker, _ := loadQuotaTracker(filepath.Join(dir, "missing", "quota.json"))
+	tracker.add("192.0.2.1", 10, time.Now())
+	if err := tracker.save(); err == nil {
+		t.Fatal("saving into a missing directory worked")
+	}
+	tracker.path = filepath.Join(dir, "quota.json")
+	if err := tracker.save(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(tracker.path); err != nil {
+		t.Errorf("the failed save was not tried again: %v", err)
+	}
+}
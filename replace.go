@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// sniffLen is how much content http.DetectContentType looks at.
+const sniffLen = 512
+
+// sniffType is the media type of content by its first bytes, without
+// parameters.
+func sniffType(head []byte) string {
+	mediaType, _, _ := mime.ParseMediaType(http.DetectContentType(head))
+	return mediaType
+}
+
+// sniffStored sniffs the original content of a stored file.
+func sniffStored(cfg *config, path string) (string, error) {
+	content, _, err := openStored(cfg, path)
+	if err != nil {
+		return "", err
+	}
+	defer content.Close()
+	head, err := io.ReadAll(io.LimitReader(content, sniffLen))
+	if err != nil {
+		return "", err
+	}
+	return sniffType(head), nil
+}
+
+// replaceHandler puts the request body over an existing stored file, which
+// keeps its url. The new content must sniff as the type of the old one
+// unless force=1. It is written next to the file and renamed over it, so
+// downloads get the old content or the new, never a mix.
+func (s *Server) replaceHandler(w http.ResponseWriter, r *http.Request) {
+	digests, ok := s.uploadAuth(w, r)
+	if !ok {
+		return
+	}
+	cfg := s.cfg
+	rel := routeRel(mux.Vars(r))
+	filePath, ok := storedRelPath(cfg, rel)
+	if !ok || !inNamespace(cfg, requestNamespace(r, cfg), rel) {
+		notFoundHandler(w, r)
+		return
+	}
+	diskPath, _, err := findStored(filePath)
+	var old os.FileInfo
+	if err == nil {
+		old, err = os.Stat(diskPath)
+	}
+	if os.IsNotExist(err) {
+		notFoundHandler(w, r)
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "fail to open the file to replace", "path", rel, "err", err)
+		writeError(w, r, http.StatusInternalServerError, "")
+		return
+	}
+	// the quota counts only what the file grows by
+	oldSize := logicalSize(cfg, filepath.Dir(filePath), old)
+	credit := oldSize
+	if cfg.QuotaCounts == quotaCountsDisk {
+		credit = old.Size()
+	}
+	reservation, ok := s.admitUpload(w, r, credit)
+	if !ok {
+		return
+	}
+	defer reservation.release()
+	if r.ContentLength == 0 {
+		writeError(w, r, http.StatusBadRequest, "Empty body")
+		return
+	}
+	if cfg.MaxUploadSize > 0 {
+		r.Body = http.MaxBytesReader(w, r.Body, int64(cfg.MaxUploadSize))
+	}
+	// a failed peek is the error of the copy below
+	body := bufio.NewReaderSize(r.Body, sniffLen)
+	if r.URL.Query().Get("force") != "1" {
+		head, _ := body.Peek(sniffLen)
+		oldType, err := sniffStored(cfg, filePath)
+		if err != nil {
+			slog.ErrorContext(r.Context(), "fail to read the file to replace", "path", rel, "err", err)
+			writeError(w, r, http.StatusInternalServerError, "")
+			return
+		}
+		if newType := sniffType(head); newType != oldType {
+			writeError(w, r, http.StatusUnsupportedMediaType, fmt.Sprintf("The new content is %s, the file is %s; force=1 replaces it anyway", newType, oldType))
+			return
+		}
+	}
+	name := filepath.Base(filePath)
+	compress := r.ContentLength > 0 && r.ContentLength <= maxCompressedSize && cfg.Compression.compresses(name)
+	target := filePath
+	if compress {
+		target += compressedSuffix
+	}
+	if cfg.keys != nil {
+		target = filepath.Join(filepath.Dir(target), encryptedName(filepath.Base(target)))
+	}
+	dst, err := os.CreateTemp(filepath.Dir(filePath), "."+name+"-*")
+	if err == nil {
+		err = dst.Chmod(os.FileMode(cfg.FileMode))
+		if err != nil {
+			dst.Close()
+			os.Remove(dst.Name())
+		}
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "fail to create the replacement", "path", rel, "err", err)
+		writeError(w, r, http.StatusInternalServerError, "")
+		return
+	}
+	tempPath := dst.Name()
+	size, info, sha, err := s.writeContent(r.Context(), dst, name, compress, body, digests)
+	if err == nil && !info.ModTime().After(old.ModTime()) {
+		// the ETag is made of mtime and size, it has to change
+		modTime := old.ModTime().Add(time.Second)
+		err = os.Chtimes(tempPath, modTime, modTime)
+	}
+	if err == nil {
+		err = os.Rename(tempPath, target)
+	}
+	if err != nil {
+		os.Remove(tempPath)
+		s.writeStoreError(w, r, err)
+		return
+	}
+	if target != diskPath {
+		os.Remove(diskPath)
+	}
+	stored := storedFile{
+		Rel:          rel,
+		Size:         size,
+		DiskSize:     info.Size(),
+		SHA256:       sha,
+		OriginalName: name,
+		ContentType:  contentTypeOf(name),
+		StoredAt:     cfg.now(),
+	}
+	s.hotFiles.remove(rel)
+	s.storageStats.removed(rel, oldSize, old.Size())
+	s.storageStats.added(rel, stored.Size, stored.DiskSize)
+	if s.quotas != nil {
+		// only what the file grew by, a smaller one refunds nothing
+		counted := stored.Size - oldSize
+		if cfg.QuotaCounts == quotaCountsDisk {
+			counted = stored.DiskSize - old.Size()
+		}
+		if counted > 0 {
+			s.quotas.add(clientIP(r, cfg).String(), counted, time.Now())
+		}
+	}
+	if s.metaIndex != nil {
+		record, found, err := s.metaIndex.lookupPath(rel)
+		if err == nil && found {
+			stored.OriginalName, stored.Tags, stored.Private = record.OriginalName, record.Tags, record.Private
+			_, err = s.metaIndex.setContent(rel, stored.Size, stored.DiskSize, sha)
+		}
+		if err != nil {
+			slog.ErrorContext(r.Context(), "fail to index the replacement", "path", rel, "err", err)
+		}
+	}
+	s.replicateStored(rel)
+	s.auditLog.replaced(r, stored)
+	slog.InfoContext(r.Context(), "file replaced", "path", rel, "bytes", stored.Size, "sha256", sha)
+	if !stored.Private && strings.Contains(cfg.CacheControl.header(filepath.Ext(name), stored.ContentType), "immutable") {
+		w.Header().Set("Warning", `299 - "Cache-Control is immutable, caches may keep serving the old content"`)
+	}
+	contentType, response := uploadResponse(r, cfg, stored)
+	w.Header().Set("Content-Type", contentType)
+	w.WriteHeader(http.StatusOK)
+	w.Write(response)
+}
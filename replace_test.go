@@ -0,0 +1,93 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestReplace(t *testing.T) {
+	cfg := testConfig(t, "cache_control:\n  default: 1y immutable\n")
+	routes := testServer(t, cfg).Routes()
+	path := downloadPath(t, testUpload(t, routes, "notes.txt", "hello", nil))
+	get := func() *httptest.ResponseRecorder {
+		res := httptest.NewRecorder()
+		routes.ServeHTTP(res, httptest.NewRequest(http.MethodGet, path, nil))
+		return res
+	}
+	put := func(path, query, body string, auth bool) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPut, path+query, strings.NewReader(body))
+		if auth {
+			req.SetBasicAuth("u", "p")
+		}
+		res := httptest.NewRecorder()
+		routes.ServeHTTP(res, req)
+		return res
+	}
+	before := get()
+
+	res := put(path, "", "hello, world", true)
+	if res.Code != http.StatusOK {
+		t.Fatalf("replace status %d: %s", res.Code, res.Body)
+	}
+	if !strings.HasSuffix(strings.TrimSpace(res.Body.String()), path) {
+		t.Errorf("replace answered %q, want the same url", res.Body)
+	}
+	if !strings.Contains(res.Header().Get("Warning"), "immutable") {
+		t.Errorf("Warning %q, want one about immutable caching", res.Header().Get("Warning"))
+	}
+	after := get()
+	if after.Body.String() != "hello, world" {
+		t.Errorf("download %q after replacing", after.Body)
+	}
+	if etag := after.Header().Get("ETag"); etag == before.Header().Get("ETag") {
+		t.Errorf("ETag %s didn't change", etag)
+	}
+
+	png := "\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR"
+	if res := put(path, "", png, true); res.Code != http.StatusUnsupportedMediaType {
+		t.Errorf("replacing text with a png: status %d", res.Code)
+	}
+	if res := put(path, "?force=1", png, true); res.Code != http.StatusOK || get().Body.String() != png {
+		t.Errorf("forced replace: status %d, content %q", res.Code, get().Body)
+	}
+	if res := put(path, "", "hello", false); res.Code != http.StatusUnauthorized {
+		t.Errorf("without credentials: status %d", res.Code)
+	}
+	missing := path[:strings.LastIndex(path, "/")+1] + "00000000-0000-4000-8000-000000000000.txt"
+	if res := put(missing, "", "hello", true); res.Code != http.StatusNotFound {
+		t.Errorf("replacing a missing file: status %d", res.Code)
+	}
+	if files := storedFiles(t, cfg); files != 1 {
+		t.Errorf("%d files stored, want the one", files)
+	}
+}
+
+func TestReplaceIndexed(t *testing.T) {
+	cfg := testConfig(t, "database: "+filepath.Join(t.TempDir(), "files.db")+"\ncompression:\n  enabled: true\n")
+	server := testServer(t, cfg)
+	routes := server.Routes()
+	path := downloadPath(t, testUpload(t, routes, "notes.txt", "hello", nil))
+	req := httptest.NewRequest(http.MethodPut, path, strings.NewReader("hello, world"))
+	req.SetBasicAuth("u", "p")
+	res := httptest.NewRecorder()
+	routes.ServeHTTP(res, req)
+	if res.Code != http.StatusOK {
+		t.Fatalf("replace status %d: %s", res.Code, res.Body)
+	}
+	record, found, err := server.metaIndex.lookupPath(strings.TrimPrefix(path, "/i/"))
+	if err != nil || !found {
+		t.Fatalf("lookup: found %v, %v", found, err)
+	}
+	sum := sha256.Sum256([]byte("hello, world"))
+	if record.Size != 12 || record.SHA256 != hex.EncodeToString(sum[:]) || record.OriginalName != "notes.txt" {
+		t.Errorf("indexed %+v after replacing", record)
+	}
+	if files := storedFiles(t, cfg); files != 1 {
+		t.Errorf("%d files stored, want the compressed one", files)
+	}
+}
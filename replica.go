@@ -0,0 +1,353 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	replicationWorkers    = 2
+	replicationQueueSize  = 256
+	replicationRetryEvery = 10 * time.Second
+	// replicationMaxBackoff caps the wait between attempts of a failing job.
+	replicationMaxBackoff = 10 * time.Minute
+)
+
+const (
+	replicateCopy   = "copy"
+	replicateDelete = "delete"
+)
+
+// replicaConfig is one extra storage target of the replicas list. Only
+// directories are supported, a bucket has to be mounted.
+type replicaConfig struct {
+	Dir string `yaml:"dir" json:"dir" toml:"dir"`
+}
+
+// replicationJob is a pending copy or delete of one file on one replica.
+type replicationJob struct {
+	Op       string    `json:"op"`
+	Rel      string    `json:"rel"`
+	Replica  string    `json:"replica"`
+	Queued   time.Time `json:"queued"`
+	Attempts int       `json:"attempts"`
+	NextTry  time.Time `json:"next_try"`
+}
+
+func (j *replicationJob) key() string {
+	return j.Replica + "\x00" + j.Rel
+}
+
+// replicator mirrors the upload tree to the replicas in the background.
+// Pending jobs are journaled so a restart picks them up again.
+type replicator struct {
+	mu       sync.Mutex
+	path     string
+	root     string
+	dirMode  os.FileMode
+	fileMode os.FileMode
+	replicas []string
+	jobs     map[string]*replicationJob
+	// busy keys are queued or running, so one file is never copied and
+	// deleted at the same time.
+	busy     map[string]bool
+	failures map[string]int64
+	queue    chan string
+}
+
+func loadReplicator(cfg *config) (*replicator, error) {
+	rep := &replicator{
+		path:     cfg.ReplicationJournal,
+		root:     cfg.UploadDir,
+		dirMode:  os.FileMode(cfg.DirMode),
+		fileMode: os.FileMode(cfg.FileMode),
+		jobs:     map[string]*replicationJob{},
+		busy:     map[string]bool{},
+		failures: map[string]int64{},
+		queue:    make(chan string, replicationQueueSize),
+	}
+	for _, replica := range cfg.Replicas {
+		rep.replicas = append(rep.replicas, replica.Dir)
+	}
+	data, err := os.ReadFile(rep.path)
+	if os.IsNotExist(err) {
+		return rep, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("fail to read replication journal\n%w", err)
+	}
+	var jobs []*replicationJob
+	err = json.Unmarshal(data, &jobs)
+	if err != nil {
+		return nil, fmt.Errorf("fail to decode replication journal\n%w", err)
+	}
+	for _, job := range jobs {
+		if !rep.configured(job.Replica) {
+			slog.Warn("dropping replication of a removed replica", "op", job.Op, "path", job.Rel, "replica", job.Replica)
+			continue
+		}
+		rep.jobs[job.key()] = job
+	}
+	return rep, nil
+}
+
+func (rep *replicator) configured(replica string) bool {
+	for _, dir := range rep.replicas {
+		if dir == replica {
+			return true
+		}
+	}
+	return false
+}
+
+// add journals op of rel for every replica and queues it. A newer job
+// replaces a pending one of the same file.
+func (rep *replicator) add(op, rel string) {
+	rep.mu.Lock()
+	defer rep.mu.Unlock()
+	now := time.Now()
+	for _, replica := range rep.replicas {
+		job := &replicationJob{Op: op, Rel: rel, Replica: replica, Queued: now}
+		rep.jobs[job.key()] = job
+	}
+	rep.saveLocked()
+	for _, replica := range rep.replicas {
+		rep.scheduleLocked(replica + "\x00" + rel)
+	}
+}
+
+// scheduleLocked queues key unless it already is, leaving it to the retry
+// loop when the queue is full.
+func (rep *replicator) scheduleLocked(key string) {
+	if rep.busy[key] {
+		return
+	}
+	select {
+	case rep.queue <- key:
+		rep.busy[key] = true
+	default:
+	}
+}
+
+// run starts the workers and requeues due jobs periodically, forever.
+func (rep *replicator) run() {
+	for range replicationWorkers {
+		go rep.work()
+	}
+	rep.requeue()
+	for range time.Tick(replicationRetryEvery) {
+		rep.requeue()
+	}
+}
+func (rep *replicator) requeue() {
+	rep.mu.Lock()
+	defer rep.mu.Unlock()
+	now := time.Now()
+	for key, job := range rep.jobs {
+		if !now.Before(job.NextTry) {
+			rep.scheduleLocked(key)
+		}
+	}
+}
+func (rep *replicator) work() {
+	for key := range rep.queue {
+		rep.mu.Lock()
+		job, ok := rep.jobs[key]
+		var todo replicationJob
+		if ok {
+			todo = *job
+		}
+		rep.mu.Unlock()
+		var err error
+		if ok {
+			err = rep.apply(todo)
+		}
+		rep.mu.Lock()
+		delete(rep.busy, key)
+		// a job replaced while running is picked up by the retry loop
+		if ok && rep.jobs[key] == job {
+			if err == nil {
+				delete(rep.jobs, key)
+			} else {
+				rep.failures[job.Replica]++
+				job.Attempts++
+				job.NextTry = time.Now().Add(min(time.Duration(1<<min(job.Attempts, 20))*time.Second, replicationMaxBackoff))
+				slog.Error("fail to replicate", "op", job.Op, "path", job.Rel, "replica", job.Replica, "attempt", job.Attempts, "err", err)
+			}
+			rep.saveLocked()
+		}
+		rep.mu.Unlock()
+	}
+}
+
+// apply runs one job. Files are copied as they are on disk, compressed or
+// encrypted. Copying a file deleted meanwhile is done, its delete job
+// follows.
+func (rep *replicator) apply(job replicationJob) error {
+	target := filepath.Join(job.Replica, filepath.FromSlash(job.Rel))
+	if job.Op == replicateDelete {
+		return removeDiskNames(target, "")
+	}
+	diskPath, _, err := findStored(filepath.Join(rep.root, filepath.FromSlash(job.Rel)))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	// a replaced file can change between plain, compressed and encrypted,
+	// the other names go
+	stored := target
+	target += diskSuffix(diskPath, target)
+	src, err := os.Open(diskPath)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	info, err := src.Stat()
+	if err != nil {
+		return err
+	}
+	err = mkdirAllMode(job.Replica, path.Dir(job.Rel), rep.dirMode)
+	if err != nil {
+		return err
+	}
+	// copy next to the target and rename, a reader of the replica never
+	// sees half a file
+	dst, err := os.CreateTemp(filepath.Dir(target), "."+filepath.Base(target)+"-*")
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(dst, src)
+	if err == nil {
+		err = dst.Chmod(rep.fileMode)
+	}
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chtimes(dst.Name(), info.ModTime(), info.ModTime())
+	}
+	if err == nil {
+		err = os.Rename(dst.Name(), target)
+	}
+	if err != nil {
+		os.Remove(dst.Name())
+		return err
+	}
+	return removeDiskNames(stored, target)
+}
+
+// saveLocked writes the journal, logging rather than failing since the jobs
+// are still held in memory.
+func (rep *replicator) saveLocked() {
+	jobs := make([]*replicationJob, 0, len(rep.jobs))
+	for _, job := range rep.jobs {
+		jobs = append(jobs, job)
+	}
+	sort.Slice(jobs, func(i, j int) bool { return jobs[i].Queued.Before(jobs[j].Queued) })
+	data, err := json.Marshal(jobs)
+	if err == nil {
+		tmp := rep.path + ".tmp"
+		err = os.WriteFile(tmp, data, 0600)
+		if err == nil {
+			err = os.Rename(tmp, rep.path)
+		}
+	}
+	if err != nil {
+		slog.Error("fail to save replication journal", "err", err)
+	}
+}
+
+type replicaStats struct {
+	Dir     string `json:"dir"`
+	Pending int    `json:"pending"`
+	// Failures counts failed attempts since the start.
+	Failures int64 `json:"failures"`
+	// LagSeconds is the age of the oldest pending job.
+	LagSeconds float64 `json:"lag_seconds"`
+}
+
+func (rep *replicator) stats() []replicaStats {
+	rep.mu.Lock()
+	defer rep.mu.Unlock()
+	now := time.Now()
+	var stats []replicaStats
+	for _, replica := range rep.replicas {
+		entry := replicaStats{Dir: replica, Failures: rep.failures[replica]}
+		for _, job := range rep.jobs {
+			if job.Replica != replica {
+				continue
+			}
+			entry.Pending++
+			entry.LagSeconds = max(entry.LagSeconds, now.Sub(job.Queued).Seconds())
+		}
+		stats = append(stats, entry)
+	}
+	return stats
+}
+
+// replicateStored queues copying a freshly stored file to the replicas.
+func (s *Server) replicateStored(rel string) {
+	if s.replication != nil {
+		s.replication.add(replicateCopy, rel)
+	}
+}
+
+// replicateRemoved queues deleting a file from the replicas.
+func (s *Server) replicateRemoved(rel string) {
+	if s.replication != nil {
+		s.replication.add(replicateDelete, rel)
+	}
+}
+
+// replicaPath finds rel on the first replica that has it, for read_fallback.
+func replicaPath(cfg *config, rel string) (string, bool) {
+	for _, replica := range cfg.Replicas {
+		filePath := filepath.Join(replica.Dir, filepath.FromSlash(rel))
+		if _, _, err := findStored(filePath); err == nil {
+			return filePath, true
+		}
+	}
+	return "", false
+}
+
+// validateReplicas checks the replicas are distinct directories apart from
+// upload_dir.
+func (c *config) validateReplicas() []error {
+	var problems []error
+	seen := map[string]bool{c.UploadDir: true}
+	if abs, err := filepath.Abs(c.UploadDir); err == nil {
+		seen[abs] = true
+	}
+	for i, replica := range c.Replicas {
+		if len(replica.Dir) == 0 {
+			problems = append(problems, fmt.Errorf("replicas[%d] needs a dir", i))
+			continue
+		}
+		dir := replica.Dir
+		if abs, err := filepath.Abs(dir); err == nil {
+			dir = abs
+		}
+		if seen[dir] {
+			problems = append(problems, fmt.Errorf("replicas[%d] dir %q must differ from upload_dir and the other replicas", i, replica.Dir))
+		}
+		seen[dir] = true
+	}
+	if c.ReadFallback && len(c.Replicas) == 0 {
+		problems = append(problems, errors.New("read_fallback needs replicas"))
+	}
+	if len(c.Replicas) != 0 && len(c.ReplicationJournal) == 0 {
+		c.ReplicationJournal = "replication.json"
+	}
+	return problems
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// waitReplication waits until done holds under the replicator's lock.
+func waitReplication(t *testing.T, rep *replicator, done func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		rep.mu.Lock()
+		ok := done()
+		rep.mu.Unlock()
+		if ok {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("replication didn't get there in time")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestReplicationRetry(t *testing.T) {
+	dir := t.TempDir()
+	replica := filepath.Join(dir, "replica")
+	// a file where the replica should be fails every copy
+	os.WriteFile(replica, nil, 0o644)
+	cfg := testConfig(t, "replicas:\n  - dir: "+replica+"\nreplication_journal: "+filepath.Join(dir, "journal.json")+"\n")
+	server := testServer(t, cfg)
+	rep := server.replication
+	go rep.work()
+	path := downloadPath(t, testUpload(t, server.Routes(), "a.txt", "replicated", nil))
+	rel := path[len("/i/"):]
+	key := replica + "\x00" + rel
+	waitReplication(t, rep, func() bool { return rep.jobs[key] != nil && rep.jobs[key].Attempts == 1 })
+	if stats := rep.stats(); len(stats) != 1 || stats[0].Pending != 1 || stats[0].Failures != 1 {
+		t.Errorf("stats after a failure %+v", stats)
+	}
+	if job := rep.jobs[key]; !job.NextTry.After(time.Now()) {
+		t.Errorf("the failed job is retried at %v, not after a backoff", job.NextTry)
+	}
+
+	// a restart takes the journaled job over
+	restarted, err := loadReplicator(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	job := restarted.jobs[key]
+	if len(restarted.jobs) != 1 || job == nil || job.Op != replicateCopy || job.Attempts != 1 {
+		t.Fatalf("journal loaded as %v", restarted.jobs)
+	}
+	os.Remove(replica)
+	// not due yet, nothing happens
+	restarted.requeue()
+	if len(restarted.queue) != 0 {
+		t.Error("a job was retried before its backoff")
+	}
+	job.NextTry = time.Time{}
+	go restarted.work()
+	restarted.requeue()
+	waitReplication(t, restarted, func() bool { return len(restarted.jobs) == 0 })
+	copied, err := os.ReadFile(filepath.Join(replica, filepath.FromSlash(rel)))
+	if string(copied) != "replicated" {
+		t.Errorf("replica has %q: %v", copied, err)
+	}
+	if journal, _ := os.ReadFile(cfg.ReplicationJournal); strings.TrimSpace(string(journal)) != "[]" {
+		t.Errorf("journal left %s", journal)
+	}
+
+	restarted.add(replicateDelete, rel)
+	waitReplication(t, restarted, func() bool { return len(restarted.jobs) == 0 })
+	if _, err := os.Stat(filepath.Join(replica, filepath.FromSlash(rel))); !os.IsNotExist(err) {
+		t.Errorf("the delete didn't reach the replica: %v", err)
+	}
+}
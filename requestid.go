@@ -0,0 +1,50 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// requestInfo is what withRequestID attaches to every request context.
+type requestInfo struct {
+	ID    string
+	Start time.Time
+}
+
+type requestInfoKey struct{}
+
+// withRequestID tags each request with an id, the client's X-Request-ID when
+// it is short and printable, otherwise a new uuid, and echoes it back so log
+// lines can be matched to responses.
+func withRequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("X-Request-ID")
+		if !validRequestID(id) {
+			id = uuid.New().String()
+		}
+		w.Header().Set("X-Request-ID", id)
+		ctx := context.WithValue(r.Context(), requestInfoKey{}, requestInfo{ID: id, Start: time.Now()})
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+func validRequestID(id string) bool {
+	if len(id) == 0 || len(id) > 64 {
+		return false
+	}
+	for _, c := range id {
+		if c <= ' ' || c > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// requestInfoOf returns the id and start time of r, zero outside
+// withRequestID.
+func requestInfoOf(r *http.Request) requestInfo {
+	info, _ := r.Context().Value(requestInfoKey{}).(requestInfo)
+	return info
+}
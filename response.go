@@ -0,0 +1,90 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+func writeJSON(w http.ResponseWriter, status int, value any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(value)
+}
+
+// errorCodes are the machine readable codes of error responses, one per
+// status. They are part of the api and must not change.
+var errorCodes = map[int]string{
+	http.StatusBadRequest:                 "bad_request",
+	http.StatusUnauthorized:               "unauthorized",
+	http.StatusForbidden:                  "forbidden",
+	http.StatusNotFound:                   "not_found",
+	http.StatusMethodNotAllowed:           "method_not_allowed",
+	http.StatusRequestTimeout:             "timeout",
+	http.StatusConflict:                   "conflict",
+	http.StatusGone:                       "gone",
+	http.StatusRequestEntityTooLarge:      "too_large",
+	http.StatusUnsupportedMediaType:       "unsupported_type",
+	http.StatusUnprocessableEntity:        "digest_mismatch",
+	http.StatusUnavailableForLegalReasons: "blocked",
+	http.StatusTooManyRequests:            "quota_exceeded",
+	http.StatusInternalServerError:        "internal",
+	http.StatusInsufficientStorage:        "storage_full",
+	http.StatusServiceUnavailable:         "maintenance",
+}
+
+// writeError sends an error as {"error": {"code", "message", "request_id"}}
+// to clients that ask for JSON, and as "Status Text: message" otherwise.
+// A 500 never carries a message, log the cause before calling it; other
+// server errors like 503 and 507 tell the client what it can do about them.
+func writeError(w http.ResponseWriter, r *http.Request, status int, message string) {
+	code, ok := errorCodes[status]
+	if !ok {
+		code = "internal"
+	}
+	writeErrorCode(w, r, status, code, message)
+}
+
+// writeErrorCode is writeError with a code other than the one of status.
+func writeErrorCode(w http.ResponseWriter, r *http.Request, status int, code, message string) {
+	if status == http.StatusInternalServerError {
+		message = ""
+	}
+	if picGoRequest(r) {
+		if len(message) == 0 {
+			message = http.StatusText(status)
+		}
+		writeJSON(w, http.StatusOK, picGoResult{Message: message})
+		return
+	}
+	if prefersJSON(r) {
+		if len(message) == 0 {
+			message = http.StatusText(status)
+		}
+		writeJSON(w, status, map[string]any{
+			"error": map[string]string{
+				"code":       code,
+				"message":    message,
+				"request_id": requestInfoOf(r).ID,
+			},
+		})
+		return
+	}
+	text := http.StatusText(status)
+	if len(message) != 0 {
+		text = fmt.Sprintf("%s: %s", text, message)
+	}
+	http.Error(w, text, status)
+}
+
+// writeAuthError answers a failed credential check with 401 and a fresh
+// challenge, flagged stale when only the Digest nonce had expired.
+func (s *Server) writeAuthError(w http.ResponseWriter, r *http.Request, err error) {
+	stale := errors.Is(err, errStaleNonce)
+	if !stale {
+		s.auditLog.authFailed(r, err.Error())
+	}
+	s.setChallenge(w, stale)
+	writeError(w, r, http.StatusUnauthorized, "")
+}
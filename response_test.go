@@ -0,0 +1,41 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestErrorMessages(t *testing.T) {
+	for _, test := range []struct {
+		status  int
+		message string
+		want    string
+	}{
+		{http.StatusBadRequest, "Dates must be YYYY-MM-DD", "Dates must be YYYY-MM-DD"},
+		{http.StatusInternalServerError, "open /srv/upload: permission denied", "Internal Server Error"},
+		{http.StatusServiceUnavailable, "In maintenance", "In maintenance"},
+		{http.StatusInsufficientStorage, "1024 bytes free", "1024 bytes free"},
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("Accept", "application/json")
+		res := httptest.NewRecorder()
+		writeError(res, req, test.status, test.message)
+		var body struct {
+			Error struct{ Code, Message string }
+		}
+		if err := json.Unmarshal(res.Body.Bytes(), &body); err != nil || res.Code != test.status || body.Error.Message != test.want || body.Error.Code != errorCodes[test.status] {
+			t.Errorf("%d: status %d: %s", test.status, res.Code, res.Body)
+		}
+	}
+}
+
+func TestStorageFullMessage(t *testing.T) {
+	routes := testServer(t, testConfig(t, "min_free_space: 1000000TB\n")).Routes()
+	res := testUpload(t, routes, "a.txt", "a", nil)
+	if res.Code != http.StatusInsufficientStorage || !strings.HasSuffix(strings.TrimSpace(res.Body.String()), "bytes free") {
+		t.Errorf("upload on a full disk: status %d: %q", res.Code, res.Body)
+	}
+}
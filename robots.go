@@ -0,0 +1,21 @@
+package main
+
+import (
+	"io"
+	"net/http"
+)
+
+// defaultRobotsTxt keeps crawlers out of the stored files.
+func (c *config) defaultRobotsTxt() string {
+	return "User-agent: *\nDisallow: " + joinURL(c.RoutePrefix, c.AccessPrefix) + "/\n"
+}
+
+// robotsHandler serves robots_txt, so no robots.txt file is needed on disk.
+func (s *Server) robotsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Cache-Control", "public, max-age=86400")
+	w.WriteHeader(http.StatusOK)
+	if r.Method != http.MethodHead {
+		io.WriteString(w, s.cfg.RobotsTxt)
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// allowedMethods collects the methods of every route whose path matches the
+// request, so a 405 can tell the client what it may use instead.
+func allowedMethods(router *mux.Router, r *http.Request) []string {
+	var methods []string
+	router.Walk(func(route *mux.Route, _ *mux.Router, _ []*mux.Route) error {
+		routeMethods, err := route.GetMethods()
+		if err != nil {
+			return nil
+		}
+		probe := r.Clone(r.Context())
+		for _, method := range routeMethods {
+			probe.Method = method
+			var match mux.RouteMatch
+			if route.Match(probe, &match) && !slices.Contains(methods, method) {
+				methods = append(methods, method)
+			}
+		}
+		return nil
+	})
+	return methods
+}
+
+// handleOptions answers OPTIONS on path with the methods registered for it.
+func handleOptions(router *mux.Router, path string) {
+	router.HandleFunc(path, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Allow", strings.Join(allowedMethods(router, r), ", "))
+		w.WriteHeader(http.StatusNoContent)
+	}).Methods(http.MethodOptions)
+}
+func notFoundHandler(w http.ResponseWriter, r *http.Request) {
+	writeError(w, r, http.StatusNotFound, "")
+}
+func methodNotAllowedHandler(router *mux.Router) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Allow", strings.Join(allowedMethods(router, r), ", "))
+		writeError(w, r, http.StatusMethodNotAllowed, "")
+	})
+}
+
+const defaultUploadPath = "/upload"
+
+// route is path below route_prefix.
+func (c *config) route(path string) string {
+	return joinURL(c.RoutePrefix, path)
+}
+
+// normalizeRoute turns a route setting into "/a/b", or "" for an empty
+// one, refusing what can't be a plain path or would be read as a mux
+// pattern.
+func normalizeRoute(key, value string) (string, error) {
+	trimmed := strings.Trim(strings.TrimSpace(value), "/")
+	if len(trimmed) == 0 {
+		return "", nil
+	}
+	for _, segment := range strings.Split(trimmed, "/") {
+		if len(segment) == 0 || segment == "." || segment == ".." {
+			return "", fmt.Errorf("%s %q must be a plain path like /a/b", key, value)
+		}
+	}
+	if strings.ContainsAny(trimmed, "{}?#%\\ ") {
+		return "", fmt.Errorf("%s %q must not contain { } ? # %% \\ or spaces", key, value)
+	}
+	return "/" + trimmed, nil
+}
+
+// validateRoutes normalizes route_prefix and upload_path and checks no two
+// fixed routes end up the same.
+func (c *config) validateRoutes() []error {
+	var problems []error
+	var err error
+	c.RoutePrefix, err = normalizeRoute("route_prefix", c.RoutePrefix)
+	if err != nil {
+		problems = append(problems, err)
+	}
+	if len(strings.TrimSpace(c.UploadPath)) == 0 {
+		c.UploadPath = defaultUploadPath
+	}
+	c.UploadPath, err = normalizeRoute("upload_path", c.UploadPath)
+	if err != nil {
+		problems = append(problems, err)
+	} else if len(c.UploadPath) == 0 {
+		problems = append(problems, errors.New("upload_path must not be /"))
+	}
+	if len(problems) != 0 {
+		return problems
+	}
+	seen := map[string]string{}
+	for _, route := range c.fixedRoutes() {
+		path := strings.ToLower(route.path)
+		if other, ok := seen[path]; ok {
+			problems = append(problems, fmt.Errorf("%s and %s are both %s", other, route.name, route.path))
+			continue
+		}
+		seen[path] = route.name
+	}
+	if c.WebDAVEnabled {
+		dav := strings.ToLower(c.route(davPrefix)) + "/"
+		if strings.HasPrefix(strings.ToLower(c.route(c.UploadPath)), dav) {
+			problems = append(problems, fmt.Errorf("upload_path %s is inside the WebDAV share %s", c.UploadPath, dav))
+		}
+	}
+	return problems
+}
+
+// fixedRoutes are the routes without variables, by what configures them.
+func (c *config) fixedRoutes() []struct{ name, path string } {
+	routes := []struct{ name, path string }{
+		{"upload_path", c.UploadPath},
+		{"the paste route", "/paste"},
+		{"the zip route", "/api/zip"},
+		{"the search route", "/api/search"},
+		{"the stats route", "/api/stats"},
+		{"the info route", "/api/info"},
+		{"the health route", "/api/health"},
+		{"the ShareX route", "/api/sharex"},
+		{"the PicGo route", "/api/picgo/upload"},
+		{"robots.txt", "/robots.txt"},
+	}
+	if len(c.AdminUsername) != 0 {
+		for _, route := range adminRoutes {
+			routes = append(routes, struct{ name, path string }{"the admin route", route.path})
+		}
+	}
+	if c.WebDAVEnabled {
+		routes = append(routes, struct{ name, path string }{"the WebDAV share", davPrefix})
+	}
+	for i := range routes {
+		routes[i].path = c.route(routes[i].path)
+	}
+	return routes
+}
@@ -0,0 +1,74 @@
+#!/bin/sh
+# Exercises the SIGUSR2 listener handover: an upload that is still running
+# while v1 hands over to v2 must succeed, v2 must answer afterwards, and a
+# binary that fails to start must leave the running server alone.
+# usage: scripts/upgrade-test.sh [port]
+set -eu
+
+port=${1:-18090}
+root=$(cd "$(dirname "$0")/.." && pwd)
+work=$(mktemp -d)
+trap 'kill $(cat "$work/pids" 2>/dev/null) 2>/dev/null || true; rm -rf "$work"' EXIT
+
+fail() {
+	echo "FAIL: $*"
+	echo "--- log"
+	cat "$work/log"
+	exit 1
+}
+
+cd "$root"
+go build -ldflags "-X main.version=v1" -o "$work/v1" .
+go build -ldflags "-X main.version=v2" -o "$work/v2" .
+
+cd "$work"
+cat > config.yaml <<EOC
+host: 127.0.0.1
+port: $port
+upload_dir: upload
+username: u
+password: p
+shutdown_timeout: 60s
+EOC
+head -c 2000000 /dev/urandom > big.bin
+cp v1 file
+./file -config config.yaml > log 2>&1 &
+old=$!
+echo $old > pids
+sleep 1
+url=http://127.0.0.1:$port
+
+# a slow upload, about 10s at 200KB/s
+curl -s -o slow.out -w '%{http_code}' --limit-rate 200k -u u:p -F file=@big.bin "$url/upload" > slow.code &
+slow=$!
+sleep 2
+
+# deploys replace the binary by rename, like this
+# a binary that can't start, the old server must keep serving
+printf '#!/bin/sh\nexit 1\n' > broken
+chmod +x broken
+mv -f broken file
+kill -USR2 $old
+sleep 2
+kill -0 $old 2>/dev/null || fail "v1 exited after a failed upgrade"
+grep -q "upgrade failed" log || fail "no upgrade failure logged"
+
+cp v2 file.new
+mv -f file.new file
+kill -USR2 $old
+sleep 2
+grep -q "file v2" log || fail "v2 did not start"
+grep -q "took over" log || fail "v2 did not take the listener"
+new=$(sed -n 's/.*file v2, pid \([0-9]*\).*/\1/p' log)
+echo "$old $new" > pids
+code=$(curl -s -o /dev/null -w '%{http_code}' -u u:p -F file=@config.yaml "$url/upload")
+[ "$code" = 200 ] || fail "upload during the drain got $code"
+
+wait $slow
+[ "$(cat slow.code)" = 200 ] || fail "in-flight upload got $(cat slow.code)"
+stored=upload/$(sed 's|^http://[^/]*/||' slow.out)
+cmp -s big.bin "$stored" || fail "in-flight upload stored $stored differs"
+sleep 1
+kill -0 $old 2>/dev/null && fail "v1 still running after the drain"
+kill -0 "$new" 2>/dev/null || fail "v2 is not running"
+echo PASS
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultSearchPerPage = 50
+	maxSearchPerPage     = 500
+	// defaultSearchMaxDays bounds the tree walk on instances without a
+	// metadata index.
+	defaultSearchMaxDays = 31
+)
+
+type searchQuery struct {
+	Text        string
+	From, To    time.Time
+	ContentType string
+	Uploader    string
+	Tags        []string
+	// Namespace limits the results to one user's files.
+	Namespace string
+	Page      int
+	PerPage   int
+}
+
+type searchResult struct {
+	Path         string    `json:"path"`
+	OriginalName string    `json:"original_name"`
+	Size         int64     `json:"size"`
+	ContentType  string    `json:"content_type"`
+	UploadedAt   time.Time `json:"uploaded_at"`
+	URL          string    `json:"url"`
+	Tags         []string  `json:"tags"`
+	Private      bool      `json:"private"`
+}
+
+// resultOf describes record for the api.
+func resultOf(r *http.Request, cfg *config, record fileRecord) searchResult {
+	return searchResult{
+		Path:         record.Path,
+		OriginalName: record.OriginalName,
+		Size:         record.Size,
+		ContentType:  record.ContentType,
+		UploadedAt:   record.UploadedAt,
+		URL:          publicURL(r, cfg, record.Path),
+		Tags:         append([]string{}, record.Tags...),
+		Private:      record.Private,
+	}
+}
+
+func parseSearchQuery(r *http.Request) (searchQuery, error) {
+	values := r.URL.Query()
+	query := searchQuery{
+		Text:        strings.ToLower(values.Get("q")),
+		ContentType: strings.ToLower(values.Get("type")),
+		Uploader:    values.Get("uploader"),
+		Tags:        values["tag"],
+		Page:        1,
+		PerPage:     defaultSearchPerPage,
+	}
+	var err error
+	query.From, query.To, err = parseDayRange(values.Get("from"), values.Get("to"))
+	if err != nil {
+		return query, fmt.Errorf("dates must be YYYY-MM-DD")
+	}
+	if value := values.Get("page"); len(value) != 0 {
+		query.Page, err = strconv.Atoi(value)
+		if err != nil || query.Page < 1 {
+			return query, fmt.Errorf("page must be a positive number")
+		}
+	}
+	if value := values.Get("per_page"); len(value) != 0 {
+		query.PerPage, err = strconv.Atoi(value)
+		if err != nil || query.PerPage < 1 {
+			return query, fmt.Errorf("per_page must be a positive number")
+		}
+		query.PerPage = min(query.PerPage, maxSearchPerPage)
+	}
+	return query, nil
+}
+
+// searchHandler finds files by a case-insensitive substring of their
+// original name, with optional date, content type and uploader filters.
+func (s *Server) searchHandler(w http.ResponseWriter, r *http.Request) {
+	err := s.basicAuth(r)
+	if err != nil {
+		s.writeAuthError(w, r, err)
+		return
+	}
+	query, err := parseSearchQuery(r)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	query.Namespace = requestNamespace(r, s.cfg)
+	var records []fileRecord
+	var total int
+	if s.metaIndex != nil {
+		records, total, err = s.metaIndex.search(query)
+	} else {
+		records, total, err = walkSearch(s.cfg, query)
+	}
+	var badQuery searchLimitError
+	if errors.As(err, &badQuery) {
+		writeError(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "fail to search", "err", err)
+		writeError(w, r, http.StatusInternalServerError, "")
+		return
+	}
+	results := []searchResult{}
+	for _, record := range records {
+		results = append(results, resultOf(r, s.cfg, record))
+	}
+	writeJSON(w, http.StatusOK, map[string]any{
+		"results":  results,
+		"page":     query.Page,
+		"per_page": query.PerPage,
+		"total":    total,
+	})
+}
+
+// searchLimitError is a query the tree walk refuses to run.
+type searchLimitError string
+
+func (e searchLimitError) Error() string {
+	return string(e)
+}
+
+// walkSearch scans the day directories of a bounded date range, for
+// instances without a metadata index. Only stored names are known here.
+func walkSearch(cfg *config, query searchQuery) ([]fileRecord, int, error) {
+	if len(query.Uploader) != 0 || len(query.Tags) != 0 {
+		return nil, 0, searchLimitError("the uploader and tag filters need the database")
+	}
+	maxDays := cfg.SearchMaxDays
+	if maxDays <= 0 {
+		maxDays = defaultSearchMaxDays
+	}
+	to, from := query.To, query.From
+	if to.IsZero() {
+		to = cfg.today()
+	}
+	if from.IsZero() {
+		from = to.AddDate(0, 0, -(maxDays - 1))
+	}
+	if to.Sub(from) >= time.Duration(maxDays)*24*time.Hour {
+		return nil, 0, searchLimitError(fmt.Sprintf("without the database at most %d days can be searched", maxDays))
+	}
+	var matches []fileRecord
+	err := walkStored(cfg, func(entry storedEntry) error {
+		if !dayInRange(entry.Day, from, to) || (len(query.Namespace) != 0 && entry.Namespace != query.Namespace) {
+			return nil
+		}
+		name := path.Base(entry.Rel)
+		record := fileRecord{
+			Path:         entry.Rel,
+			OriginalName: name,
+			Size:         entry.Info.Size(),
+			DiskSize:     entry.Info.Size(),
+			ContentType:  contentTypeOf(name),
+			UploadedAt:   entry.Info.ModTime().UTC(),
+		}
+		if strings.Contains(strings.ToLower(record.OriginalName), query.Text) && strings.HasPrefix(record.ContentType, query.ContentType) {
+			matches = append(matches, record)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	sort.Slice(matches, func(i, j int) bool { return matches[i].UploadedAt.After(matches[j].UploadedAt) })
+	start := min((query.Page-1)*query.PerPage, len(matches))
+	end := min(start+query.PerPage, len(matches))
+	return matches[start:end], len(matches), nil
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+// searchPaths runs a search and returns the paths found and the total.
+func searchPaths(t *testing.T, handler http.Handler, query string) ([]string, int) {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodGet, "/api/search?"+query, nil)
+	req.SetBasicAuth("u", "p")
+	res := httptest.NewRecorder()
+	handler.ServeHTTP(res, req)
+	var body struct {
+		Results []searchResult `json:"results"`
+		Total   int            `json:"total"`
+	}
+	if res.Code != http.StatusOK || json.Unmarshal(res.Body.Bytes(), &body) != nil {
+		t.Fatalf("search %q: status %d: %s", query, res.Code, res.Body)
+	}
+	var paths []string
+	for _, result := range body.Results {
+		paths = append(paths, result.Path)
+	}
+	slices.Sort(paths)
+	return paths, body.Total
+}
+
+func TestSearchFilters(t *testing.T) {
+	cfg := testConfig(t, "database: "+filepath.Join(t.TempDir(), "files.db")+"\n")
+	routes := testServer(t, cfg).Routes()
+	var all []string
+	for _, name := range []string{"Invoice-March.pdf", "invoice-april.txt", "photo.png"} {
+		path := downloadPath(t, testUpload(t, routes, name, "content of "+name, nil))
+		all = append(all, path[len("/i/"):])
+	}
+	today := cfg.today().Format(dayLayout)
+	yesterday := cfg.today().AddDate(0, 0, -1).Format(dayLayout)
+	for _, test := range []struct {
+		query string
+		want  []string
+	}{
+		{"q=INVOICE", all[:2]},
+		{"q=invoice&type=text/", all[1:2]},
+		{"type=image/png", all[2:]},
+		{"uploader=u", all},
+		{"uploader=someone", nil},
+		{"from=" + today + "&to=" + today, all},
+		{"to=" + yesterday, nil},
+	} {
+		got, total := searchPaths(t, routes, test.query)
+		want := slices.Sorted(slices.Values(test.want))
+		if !slices.Equal(got, want) || total != len(want) {
+			t.Errorf("%s: %v (total %d), want %v", test.query, got, total, want)
+		}
+	}
+	if got, total := searchPaths(t, routes, "per_page=2&page=2"); len(got) != 1 || total != 3 {
+		t.Errorf("second page: %v, total %d", got, total)
+	}
+}
+
+// TestSearchWalkParity searches one tree with and without the database,
+// the filters the walk knows must find the same files.
+func TestSearchWalkParity(t *testing.T) {
+	cfg := testConfig(t, "database: "+filepath.Join(t.TempDir(), "files.db")+"\n")
+	indexed := testServer(t, cfg).Routes()
+	for _, name := range []string{"a.txt", "b.txt", "c.png", "d.json"} {
+		testUpload(t, indexed, name, "content of "+name, nil)
+	}
+	walkCfg := *cfg
+	walkCfg.Database = ""
+	walked := testServer(t, &walkCfg).Routes()
+	today := cfg.today().Format(dayLayout)
+	for _, query := range []string{"", "type=text/", "type=image/", "from=" + today, "to=" + cfg.today().AddDate(0, 0, -1).Format(dayLayout), "per_page=2"} {
+		want, wantTotal := searchPaths(t, indexed, query)
+		got, total := searchPaths(t, walked, query)
+		if !slices.Equal(got, want) && query != "per_page=2" || total != wantTotal || len(got) != len(want) {
+			t.Errorf("%q: walk found %v (total %d), the index %v (total %d)", query, got, total, want, wantTotal)
+		}
+	}
+	req := httptest.NewRequest(http.MethodGet, "/api/search?uploader=u", nil)
+	req.SetBasicAuth("u", "p")
+	res := httptest.NewRecorder()
+	walked.ServeHTTP(res, req)
+	if res.Code != http.StatusBadRequest {
+		t.Errorf("uploader filter without the database: status %d", res.Code)
+	}
+}
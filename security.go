@@ -0,0 +1,126 @@
+package main
+
+import (
+	"fmt"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// Defaults of the security_headers block. "off" leaves a header out.
+const (
+	defaultContentTypeOptions    = "nosniff"
+	defaultFrameOptions          = "DENY"
+	defaultReferrerPolicy        = "no-referrer"
+	defaultContentSecurityPolicy = "sandbox; default-src 'none'"
+)
+
+// viewContentSecurityPolicy covers the markdown and paste pages, which need
+// their inline style and, for markdown, images.
+const viewContentSecurityPolicy = "default-src 'none'; style-src 'unsafe-inline'; img-src * data:"
+
+// securityHeadersConfig overrides the headers securityHeaders sends.
+// ContentSecurityPolicy only goes on active content, see activeContentConfig.
+type securityHeadersConfig struct {
+	ContentTypeOptions    string `yaml:"content_type_options" json:"content_type_options" toml:"content_type_options"`
+	FrameOptions          string `yaml:"frame_options" json:"frame_options" toml:"frame_options"`
+	ReferrerPolicy        string `yaml:"referrer_policy" json:"referrer_policy" toml:"referrer_policy"`
+	ContentSecurityPolicy string `yaml:"content_security_policy" json:"content_security_policy" toml:"content_security_policy"`
+}
+
+func (c *securityHeadersConfig) setDefaults() {
+	for _, value := range []struct {
+		field    *string
+		fallback string
+	}{
+		{&c.ContentTypeOptions, defaultContentTypeOptions},
+		{&c.FrameOptions, defaultFrameOptions},
+		{&c.ReferrerPolicy, defaultReferrerPolicy},
+		{&c.ContentSecurityPolicy, defaultContentSecurityPolicy},
+	} {
+		if len(*value.field) == 0 {
+			*value.field = value.fallback
+		}
+	}
+}
+
+// setHeader sets name unless value is "off".
+func setHeader(h http.Header, name, value string) {
+	if value != "off" {
+		h.Set(name, value)
+	}
+}
+
+// securityHeaders adds the headers every response gets.
+func securityHeaders(cfg *config, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h := w.Header()
+		setHeader(h, "X-Content-Type-Options", cfg.SecurityHeaders.ContentTypeOptions)
+		setHeader(h, "X-Frame-Options", cfg.SecurityHeaders.FrameOptions)
+		setHeader(h, "Referrer-Policy", cfg.SecurityHeaders.ReferrerPolicy)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Active content policies: serve with the sandbox CSP, as text/plain, or
+// as a download.
+const (
+	activeSandbox    = "sandbox"
+	activeText       = "text"
+	activeAttachment = "attachment"
+)
+
+// defaultActiveTypes can run script when a browser renders them.
+var defaultActiveTypes = []string{"text/html", "image/svg+xml", "application/xhtml+xml"}
+
+// activeContentConfig picks how files of Types are served. Uploading them
+// is unaffected.
+type activeContentConfig struct {
+	Types  []string `yaml:"types" json:"types" toml:"types"`
+	Policy string   `yaml:"policy" json:"policy" toml:"policy"`
+
+	types map[string]bool
+}
+
+func (c *activeContentConfig) compile() error {
+	if c.Types == nil {
+		c.Types = defaultActiveTypes
+	}
+	c.types = map[string]bool{}
+	for _, contentType := range c.Types {
+		mediaType, _, err := mime.ParseMediaType(contentType)
+		if err != nil || !strings.Contains(mediaType, "/") {
+			return fmt.Errorf("invalid type %q", contentType)
+		}
+		c.types[mediaType] = true
+	}
+	switch c.Policy {
+	case "":
+		c.Policy = activeSandbox
+	case activeSandbox, activeText, activeAttachment:
+	default:
+		return fmt.Errorf("unknown policy %q, want %s, %s or %s", c.Policy, activeSandbox, activeText, activeAttachment)
+	}
+	return nil
+}
+func (c *activeContentConfig) isActive(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	return err == nil && c.types[mediaType]
+}
+
+// serveAs returns the Content-Type and disposition type a stored file of
+// contentType is sent with, applying the active_content policy. The
+// sandbox CSP goes on active content under every policy.
+func serveAs(w http.ResponseWriter, cfg *config, contentType string) (string, string) {
+	if !cfg.ActiveContent.isActive(contentType) {
+		return contentType, "inline"
+	}
+	setHeader(w.Header(), "Content-Security-Policy", cfg.SecurityHeaders.ContentSecurityPolicy)
+	switch cfg.ActiveContent.Policy {
+	case activeText:
+		return "text/plain; charset=utf-8", "inline"
+	case activeAttachment:
+		return contentType, "attachment"
+	}
+	return contentType, "inline"
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestSecurityHeaders(t *testing.T) {
+	routes := testServer(t, testConfig(t, "")).Routes()
+	for _, test := range []struct {
+		name    string
+		content string
+		want    map[string]string
+	}{
+		{"photo.png", "\x89PNG\r\n\x1a\n", map[string]string{
+			"Content-Type":            "image/png",
+			"Content-Security-Policy": "",
+		}},
+		{"report.pdf", "%PDF-1.7", map[string]string{
+			"Content-Type":            "application/pdf",
+			"Content-Security-Policy": "",
+		}},
+		{"page.html", "<script>alert(1)</script>", map[string]string{
+			"Content-Type":            "text/html; charset=utf-8",
+			"Content-Security-Policy": "sandbox; default-src 'none'",
+		}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			path := downloadPath(t, testUpload(t, routes, test.name, test.content, nil))
+			res := httptest.NewRecorder()
+			routes.ServeHTTP(res, httptest.NewRequest(http.MethodGet, path, nil))
+			if res.Code != http.StatusOK {
+				t.Fatalf("status %d", res.Code)
+			}
+			test.want["Content-Disposition"] = "inline; filename=" + path[strings.LastIndex(path, "/")+1:]
+			test.want["X-Content-Type-Options"] = "nosniff"
+			test.want["X-Frame-Options"] = "DENY"
+			test.want["Referrer-Policy"] = "no-referrer"
+			for name, want := range test.want {
+				if got := res.Header().Get(name); got != want {
+					t.Errorf("%s %q, want %q", name, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestSecurityHeadersOverride(t *testing.T) {
+	routes := testServer(t, testConfig(t, "security_headers:\n  frame_options: SAMEORIGIN\n  referrer_policy: \"off\"\n")).Routes()
+	res := httptest.NewRecorder()
+	routes.ServeHTTP(res, httptest.NewRequest(http.MethodGet, "/nothing", nil))
+	if got := res.Header().Get("X-Frame-Options"); got != "SAMEORIGIN" {
+		t.Errorf("X-Frame-Options %q", got)
+	}
+	if _, sent := res.Header()["Referrer-Policy"]; sent {
+		t.Errorf("Referrer-Policy sent though off: %q", res.Header().Get("Referrer-Policy"))
+	}
+	if got := res.Header().Get("X-Content-Type-Options"); got != "nosniff" {
+		t.Errorf("X-Content-Type-Options %q", got)
+	}
+}
+
+func TestActiveSVG(t *testing.T) {
+	const svg = `<svg xmlns="http://www.w3.org/2000/svg"><script>alert(document.cookie)</script></svg>`
+	for _, test := range []struct {
+		policy, contentType, disposition string
+	}{
+		{activeSandbox, "image/svg+xml", "inline"},
+		{activeText, "text/plain; charset=utf-8", "inline"},
+		{activeAttachment, "image/svg+xml", "attachment"},
+	} {
+		t.Run(test.policy, func(t *testing.T) {
+			routes := testServer(t, testConfig(t, "active_content:\n  policy: "+test.policy+"\n")).Routes()
+			path := downloadPath(t, testUpload(t, routes, "drawing.svg", svg, nil))
+			res := httptest.NewRecorder()
+			routes.ServeHTTP(res, httptest.NewRequest(http.MethodGet, path, nil))
+			if res.Body.String() != svg {
+				t.Errorf("body %q", res.Body)
+			}
+			// the script can't run: no origin, no script source
+			if csp := res.Header().Get("Content-Security-Policy"); !strings.Contains(csp, "sandbox") || !strings.Contains(csp, "default-src 'none'") {
+				t.Errorf("Content-Security-Policy %q", csp)
+			}
+			if got := res.Header().Get("Content-Type"); got != test.contentType {
+				t.Errorf("Content-Type %q, want %q", got, test.contentType)
+			}
+			if got := res.Header().Get("Content-Disposition"); !strings.HasPrefix(got, test.disposition+";") {
+				t.Errorf("Content-Disposition %q, want %s", got, test.disposition)
+			}
+			if got := res.Header().Get("X-Content-Type-Options"); got != "nosniff" {
+				t.Errorf("X-Content-Type-Options %q", got)
+			}
+		})
+	}
+}
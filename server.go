@@ -0,0 +1,187 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Server serves the uploads of one config. Its optional parts are nil when
+// cfg doesn't ask for them.
+type Server struct {
+	cfg *config
+	// readOnly starts as read_only and is switched by /admin/readonly.
+	readOnly atomic.Bool
+	// metaIndex is nil unless a database is configured; callers fall back
+	// to walking the upload tree.
+	metaIndex *fileIndex
+	// quotas is nil unless daily_quota_per_ip is set.
+	quotas *quotaTracker
+	// digestNonces is nil unless auth_scheme is digest.
+	digestNonces *nonceStore
+	// replication is nil unless replicas are configured.
+	replication *replicator
+	// idempotency reads its state file at the first upload with the header.
+	idempotency *idempotencyStore
+	// hotFiles is nil unless cache_max_bytes is set.
+	hotFiles *hotCache
+	// markdownPages is nil unless render_markdown is set.
+	markdownPages *markdownCache
+	// blocklist is nil unless blocklist_file is set.
+	blocklist *hashBlocklist
+	// auditLog is nil unless audit_log is set.
+	auditLog *auditLogger
+	// copyBuffers holds the buffers of upload, zip and export copies, sized
+	// by copy_buffer_size.
+	copyBuffers *bufferPool
+	// downloadLimit is nil unless max_download_rate is set.
+	downloadLimit *rateLimiter
+	// egress counts what downloads send, throttled or not.
+	egress *egressMeter
+	// storageStats are the totals of /api/stats.
+	storageStats *storageCounters
+}
+
+// NewServer opens the state cfg asks for: quota and idempotency state, the
+// metadata index, the replication journal, the download cache, the copy
+// buffers, the blocklist and the audit log.
+func NewServer(cfg *config) (*Server, error) {
+	s := &Server{
+		cfg:          cfg,
+		copyBuffers:  newBufferPool(int(cfg.CopyBufferSize)),
+		egress:       &egressMeter{},
+		storageStats: &storageCounters{days: map[string]*dayStats{}},
+	}
+	s.readOnly.Store(cfg.ReadOnly)
+	var err error
+	if cfg.AuthScheme == authDigest {
+		s.digestNonces = newNonceStore(maxDigestNonces)
+	}
+	if cfg.DailyQuotaPerIP > 0 {
+		s.quotas, err = loadQuotaTracker(cfg.QuotaStateFile)
+		if err != nil {
+			return nil, fmt.Errorf("fail to load quota state\n%w", err)
+		}
+	}
+	if len(cfg.Database) != 0 {
+		s.metaIndex, err = openFileIndex(cfg.Database)
+		if err != nil {
+			return nil, fmt.Errorf("fail to open the metadata index\n%w", err)
+		}
+	}
+	if cfg.MaxDownloadRate > 0 {
+		s.downloadLimit = newRateLimiter(int64(cfg.MaxDownloadRate))
+	}
+	if cfg.CacheMaxBytes > 0 {
+		s.hotFiles = newHotCache(int64(cfg.CacheMaxBytes), int64(cfg.CacheMaxFileSize))
+	}
+	if cfg.RenderMarkdown {
+		s.markdownPages = newMarkdownCache()
+	}
+	if len(cfg.BlocklistFile) != 0 {
+		s.blocklist, err = loadBlocklist(cfg.BlocklistFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(cfg.AuditLog) != 0 {
+		s.auditLog, err = openAuditLog(cfg)
+		if err != nil {
+			return nil, fmt.Errorf("fail to open the audit log\n%w", err)
+		}
+	}
+	s.idempotency = newIdempotencyStore(cfg)
+	if len(cfg.Replicas) != 0 {
+		s.replication, err = loadReplicator(cfg)
+		if err != nil {
+			return nil, fmt.Errorf("fail to load the replication journal\n%w", err)
+		}
+	}
+	return s, nil
+}
+
+// Start runs the background work, forever: quota and idempotency expiry,
+// audit log reopening, blocklist reloading, replication, the stats scans,
+// the trash janitor and gc.
+func (s *Server) Start() {
+	if s.quotas != nil {
+		go func() {
+			<-handoverDone()
+			err := s.quotas.catchUp()
+			if err != nil {
+				slog.Error("fail to catch up with the quota state", "err", err)
+			}
+			s.quotas.run()
+		}()
+	}
+	go func() {
+		<-handoverDone()
+		err := s.idempotency.catchUp()
+		if err != nil {
+			slog.Error("fail to catch up with the idempotency state", "err", err)
+		}
+		s.idempotency.run()
+	}()
+	if s.auditLog != nil {
+		go reopenOnSignal(s.auditLog.file)
+	}
+	if s.blocklist != nil {
+		go s.blocklist.reloadOnSignal()
+	}
+	if s.replication != nil {
+		go s.replication.run()
+	}
+	go s.storageStats.run(s.cfg, time.Duration(s.cfg.StatsInterval))
+	if s.cfg.TrashRetention > 0 {
+		go runTrashJanitor(s.cfg)
+	}
+	if s.cfg.GCInterval > 0 {
+		go runGC(s.cfg, time.Duration(s.cfg.GCInterval))
+	}
+}
+
+// Routes is the handler of every route, behind the request id, security
+// headers and ip filter middleware.
+func (s *Server) Routes() http.Handler {
+	cfg := s.cfg
+	r := mux.NewRouter()
+	r.Use(tracing)
+	r.HandleFunc(cfg.route(cfg.UploadPath), s.writable(s.uploadHander)).Methods(http.MethodPost)
+	handleOptions(r, cfg.route(cfg.UploadPath))
+	r.HandleFunc(cfg.route("/robots.txt"), s.robotsHandler).Methods(http.MethodGet, http.MethodHead)
+	handleOptions(r, cfg.route("/robots.txt"))
+	r.HandleFunc(cfg.route("/paste"), s.writable(s.pasteHandler)).Methods(http.MethodPost)
+	handleOptions(r, cfg.route("/paste"))
+	r.HandleFunc(cfg.route("/api/zip"), s.zipHandler).Methods(http.MethodGet, http.MethodPost)
+	handleOptions(r, cfg.route("/api/zip"))
+	r.HandleFunc(cfg.route("/api/search"), s.searchHandler).Methods(http.MethodGet)
+	handleOptions(r, cfg.route("/api/search"))
+	r.HandleFunc(cfg.route("/api/stats"), s.statsHandler).Methods(http.MethodGet)
+	handleOptions(r, cfg.route("/api/stats"))
+	r.HandleFunc(cfg.route("/api/info"), s.infoHandler).Methods(http.MethodGet)
+	handleOptions(r, cfg.route("/api/info"))
+	r.HandleFunc(cfg.route("/api/health"), s.healthHandler).Methods(http.MethodGet, http.MethodHead)
+	handleOptions(r, cfg.route("/api/health"))
+	r.HandleFunc(cfg.route("/api/sharex"), s.shareXHandler).Methods(http.MethodGet)
+	handleOptions(r, cfg.route("/api/sharex"))
+	r.HandleFunc(cfg.route("/api/picgo/upload"), s.writable(s.picGoHandler)).Methods(http.MethodPost)
+	handleOptions(r, cfg.route("/api/picgo/upload"))
+	s.registerAdminRoutes(r)
+	s.registerBrowse(r)
+	s.registerWebDAV(r)
+	// the namespaced routes come last, with an empty access_prefix they
+	// would catch everything else
+	for _, route := range []string{storedFileRoute, namespacedFileRoute} {
+		s.registerFileRoutes(r, route)
+	}
+	if cfg.AllowCustomDirs {
+		s.registerFileRoutes(r, customFileRoute)
+	}
+	r.NotFoundHandler = http.HandlerFunc(notFoundHandler)
+	r.MethodNotAllowedHandler = methodNotAllowedHandler(r)
+	return withRequestID(securityHeaders(cfg, ipFilter(cfg, r)))
+}
@@ -0,0 +1,535 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testUpload posts content as the file field and returns the response.
+func testUpload(t *testing.T, handler http.Handler, name, content string, fields map[string]string) *httptest.ResponseRecorder {
+	t.Helper()
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	for key, value := range fields {
+		form.WriteField(key, value)
+	}
+	part, _ := form.CreateFormFile("file", name)
+	io.WriteString(part, content)
+	form.Close()
+	req := httptest.NewRequest(http.MethodPost, "/upload", &body)
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	req.SetBasicAuth("u", "p")
+	res := httptest.NewRecorder()
+	handler.ServeHTTP(res, req)
+	return res
+}
+
+// downloadPath is the path of the url an upload answered with.
+func downloadPath(t *testing.T, res *httptest.ResponseRecorder) string {
+	t.Helper()
+	url := strings.TrimSpace(res.Body.String())
+	i := strings.Index(url, "/i/")
+	if i < 0 {
+		t.Fatalf("upload answered %q", url)
+	}
+	return url[i:]
+}
+
+func TestUploadDownload(t *testing.T) {
+	cfg := testConfig(t, "")
+	routes := testServer(t, cfg).Routes()
+	res := testUpload(t, routes, "notes.txt", "hello", nil)
+	if res.Code != http.StatusCreated {
+		t.Fatalf("upload status %d: %s", res.Code, res.Body)
+	}
+	path := downloadPath(t, res)
+	if !strings.HasSuffix(path, ".txt") {
+		t.Errorf("url %q doesn't keep the extension", path)
+	}
+	if location := res.Header().Get("Location"); location != res.Body.String() {
+		t.Errorf("Location %q, body %q", location, res.Body)
+	}
+	stored := filepath.Join(cfg.UploadDir, filepath.FromSlash(strings.TrimPrefix(path, "/i/")))
+	if content, err := os.ReadFile(stored); err != nil || string(content) != "hello" {
+		t.Errorf("stored %q, %v", content, err)
+	}
+
+	get := func(path string) *httptest.ResponseRecorder {
+		res := httptest.NewRecorder()
+		routes.ServeHTTP(res, httptest.NewRequest(http.MethodGet, path, nil))
+		return res
+	}
+	res = get(path)
+	if res.Code != http.StatusOK || res.Body.String() != "hello" {
+		t.Fatalf("download status %d: %q", res.Code, res.Body)
+	}
+	if got := res.Header().Get("Content-Type"); got != "text/plain; charset=utf-8" {
+		t.Errorf("Content-Type %q", got)
+	}
+	for _, missing := range []string{
+		strings.TrimSuffix(path, ".txt") + ".png",
+		"/i/2026/10/14/00000000-0000-0000-0000-000000000000.txt",
+		"/i/2026/10/14/.hidden",
+		"/nothing",
+	} {
+		if res := get(missing); res.Code != http.StatusNotFound {
+			t.Errorf("%s: status %d, want 404", missing, res.Code)
+		}
+	}
+	// mux redirects to the cleaned path rather than serving anything
+	if res := get("/i/../../etc/passwd"); res.Code == http.StatusOK {
+		t.Errorf("traversal served %q", res.Body)
+	}
+}
+
+func TestHead(t *testing.T) {
+	routes := testServer(t, testConfig(t, "")).Routes()
+	path := downloadPath(t, testUpload(t, routes, "notes.txt", "hello", nil))
+	send := func(method, path string) *httptest.ResponseRecorder {
+		res := httptest.NewRecorder()
+		routes.ServeHTTP(res, httptest.NewRequest(method, path, nil))
+		return res
+	}
+	get, head := send(http.MethodGet, path), send(http.MethodHead, path)
+	if head.Code != get.Code || head.Code != http.StatusOK {
+		t.Fatalf("HEAD status %d, GET %d", head.Code, get.Code)
+	}
+	for _, name := range []string{"Content-Length", "ETag", "Content-Type", "Content-Disposition", "Cache-Control"} {
+		if head.Header().Get(name) != get.Header().Get(name) {
+			t.Errorf("HEAD %s %q, GET %q", name, head.Header().Get(name), get.Header().Get(name))
+		}
+	}
+	if head.Header().Get("Content-Length") != "5" {
+		t.Errorf("Content-Length %q, want 5", head.Header().Get("Content-Length"))
+	}
+	if head.Body.Len() != 0 {
+		t.Errorf("HEAD has a body %q", head.Body)
+	}
+	missing := path[:strings.LastIndex(path, "/")+1] + "00000000-0000-4000-8000-000000000000.txt"
+	if res := send(http.MethodHead, missing); res.Code != http.StatusNotFound {
+		t.Errorf("HEAD of a missing file: status %d", res.Code)
+	}
+	if res := send(http.MethodPost, path); res.Code != http.StatusMethodNotAllowed || !strings.Contains(res.Header().Get("Allow"), http.MethodHead) {
+		t.Errorf("POST to a file: status %d, Allow %q", res.Code, res.Header().Get("Allow"))
+	}
+}
+
+func TestPasteContentType(t *testing.T) {
+	routes := testServer(t, testConfig(t, "paste_html_view: true\ndatabase: "+filepath.Join(t.TempDir(), "files.db")+"\n")).Routes()
+	req := httptest.NewRequest(http.MethodPost, "/paste?lang=css", strings.NewReader("body{}"))
+	req.SetBasicAuth("u", "p")
+	pasted := httptest.NewRecorder()
+	routes.ServeHTTP(pasted, req)
+	for _, test := range []struct {
+		name    string
+		res     *httptest.ResponseRecorder
+		want    string
+		browser string
+	}{
+		{"upload", testUpload(t, routes, "style.css", "body{}", nil), "text/css; charset=utf-8", "text/css; charset=utf-8"},
+		{"paste", pasted, "text/plain; charset=utf-8", "text/html; charset=utf-8"},
+	} {
+		res := httptest.NewRecorder()
+		routes.ServeHTTP(res, httptest.NewRequest(http.MethodGet, downloadPath(t, test.res), nil))
+		if got := res.Header().Get("Content-Type"); got != test.want {
+			t.Errorf("%s of a .css: Content-Type %q, want %q", test.name, got, test.want)
+		}
+		req := httptest.NewRequest(http.MethodGet, downloadPath(t, test.res), nil)
+		req.Header.Set("Accept", "text/html,*/*;q=0.8")
+		res = httptest.NewRecorder()
+		routes.ServeHTTP(res, req)
+		if got := res.Header().Get("Content-Type"); got != test.browser {
+			t.Errorf("%s of a .css to a browser: Content-Type %q, want %q", test.name, got, test.browser)
+		}
+	}
+}
+
+func TestNameCollision(t *testing.T) {
+	cfg := testConfig(t, "")
+	routes := testServer(t, cfg).Routes()
+	dir := filepath.Join(cfg.UploadDir, filepath.FromSlash(cfg.now().Format("2006/01/02")))
+	taken := filepath.Join(dir, "taken.txt")
+	os.MkdirAll(dir, 0o755)
+	os.WriteFile(taken, []byte("first"), 0o644)
+	drawn := 0
+	realName := newName
+	newName = func(ext string) string {
+		drawn++
+		if drawn == 1 {
+			return "taken" + ext
+		}
+		return realName(ext)
+	}
+	t.Cleanup(func() { newName = realName })
+
+	res := testUpload(t, routes, "notes.txt", "second", nil)
+	if res.Code != http.StatusCreated || strings.HasSuffix(downloadPath(t, res), "/taken.txt") || drawn != 2 {
+		t.Errorf("upload after a collision: status %d, %d names drawn: %s", res.Code, drawn, res.Body)
+	}
+	if content, _ := os.ReadFile(taken); string(content) != "first" {
+		t.Errorf("the taken file now holds %q", content)
+	}
+
+	newName = func(ext string) string { return "taken" + ext }
+	if res := testUpload(t, routes, "notes.txt", "third", nil); res.Code != http.StatusInternalServerError {
+		t.Errorf("upload without a free name: status %d", res.Code)
+	}
+	if content, _ := os.ReadFile(taken); string(content) != "first" {
+		t.Errorf("the taken file now holds %q", content)
+	}
+}
+
+func TestMultipartMemory(t *testing.T) {
+	tmp := t.TempDir()
+	t.Setenv("TMPDIR", tmp)
+	cfg := testConfig(t, "multipart_memory: 1KB\n")
+	routes := testServer(t, cfg).Routes()
+	content := strings.Repeat("0123456789abcdef", 64<<10)
+	before, _ := os.Stat(tmp)
+	res := testUpload(t, routes, "large.bin", content, nil)
+	if res.Code != http.StatusCreated {
+		t.Fatalf("1MB upload with 1KB in memory: status %d: %s", res.Code, res.Body)
+	}
+	stored := filepath.Join(cfg.UploadDir, filepath.FromSlash(strings.TrimPrefix(downloadPath(t, res), "/i/")))
+	if data, err := os.ReadFile(stored); err != nil || string(data) != content {
+		t.Errorf("stored %d bytes, %v", len(data), err)
+	}
+	// the spilled part was created and removed there
+	if after, _ := os.Stat(tmp); !after.ModTime().After(before.ModTime()) {
+		t.Error("nothing was spilled to a temp file")
+	}
+	if left, _ := os.ReadDir(tmp); len(left) != 0 {
+		t.Errorf("temp files left behind: %v", left)
+	}
+}
+
+func TestUploadRejected(t *testing.T) {
+	routes := testServer(t, testConfig(t, "")).Routes()
+	req := httptest.NewRequest(http.MethodPost, "/upload", strings.NewReader("x"))
+	res := httptest.NewRecorder()
+	routes.ServeHTTP(res, req)
+	if res.Code != http.StatusUnauthorized {
+		t.Errorf("without credentials: status %d, want 401", res.Code)
+	}
+	req = httptest.NewRequest(http.MethodPost, "/upload", strings.NewReader("x"))
+	req.SetBasicAuth("u", "p")
+	res = httptest.NewRecorder()
+	routes.ServeHTTP(res, req)
+	if res.Code != http.StatusBadRequest {
+		t.Errorf("without file: status %d, want 400", res.Code)
+	}
+	if res := testUpload(t, routes, "a.txt", "x", map[string]string{"dir": "backups"}); res.Code != http.StatusBadRequest {
+		t.Errorf("dir without allow_custom_dirs: status %d, want 400", res.Code)
+	}
+}
+
+func TestShareXResponse(t *testing.T) {
+	routes := testServer(t, testConfig(t, "response_format: sharex\n")).Routes()
+	res := testUpload(t, routes, "shot.png", "png", nil)
+	var body struct {
+		Status int `json:"status"`
+		Data   struct {
+			Link string `json:"link"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal(res.Body.Bytes(), &body); err != nil || body.Status != http.StatusOK {
+		t.Fatalf("status %d, body %s, %v", res.Code, res.Body, err)
+	}
+	if !strings.HasPrefix(body.Data.Link, "http://example.com/i/") || !strings.HasSuffix(body.Data.Link, ".png") {
+		t.Errorf("link %q", body.Data.Link)
+	}
+}
+
+func TestTimezone(t *testing.T) {
+	for _, zone := range []string{"Pacific/Kiritimati", "Etc/GMT+12"} {
+		cfg := testConfig(t, "timezone: "+zone+"\n")
+		res := testUpload(t, testServer(t, cfg).Routes(), "a.txt", "a", nil)
+		location, _ := time.LoadLocation(zone)
+		if want := time.Now().In(location).Format("/i/2006/01/02/"); !strings.HasPrefix(downloadPath(t, res), want) {
+			t.Errorf("%s upload stored at %s, want %s", zone, downloadPath(t, res), want)
+		}
+	}
+	_, err := loadConfigFrom(strings.NewReader("upload_dir: "+t.TempDir()+"\ntimezone: Mars/Olympus\n"), ".yaml")
+	if err == nil || !strings.Contains(err.Error(), "timezone") {
+		t.Errorf("unknown timezone: %v", err)
+	}
+}
+
+func TestResponseTemplate(t *testing.T) {
+	cfg := testConfig(t, "response_template: '![{{.OriginalName}}]({{.URL}}) {{.Size}}'\n")
+	routes := testServer(t, cfg).Routes()
+	res := testUpload(t, routes, "cat.png", "meow", nil)
+	location := res.Header().Get("Location")
+	if want := "![cat.png](" + location + ") 4"; res.Code != http.StatusCreated || res.Body.String() != want {
+		t.Errorf("status %d, body %q, want %q", res.Code, res.Body, want)
+	}
+
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	part, _ := form.CreateFormFile("file", "cat.png")
+	io.WriteString(part, "meow")
+	form.Close()
+	req := httptest.NewRequest(http.MethodPost, "/upload", &body)
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	req.Header.Set("Accept", "application/json")
+	req.SetBasicAuth("u", "p")
+	res = httptest.NewRecorder()
+	routes.ServeHTTP(res, req)
+	var described struct{ URL string }
+	if err := json.Unmarshal(res.Body.Bytes(), &described); err != nil || described.URL != res.Header().Get("Location") {
+		t.Errorf("json upload %q: %v", res.Body, err)
+	}
+
+	for _, text := range []string{"{{.URL", "{{.Nope}}"} {
+		_, err := loadConfigFrom(strings.NewReader("upload_dir: "+t.TempDir()+"\nresponse_template: '"+text+"'\n"), ".yaml")
+		if err == nil || !strings.Contains(err.Error(), "response_template") {
+			t.Errorf("template %q: %v", text, err)
+		}
+	}
+}
+
+func TestUploadFieldNames(t *testing.T) {
+	post := func(handler http.Handler, fileField string) *httptest.ResponseRecorder {
+		var body bytes.Buffer
+		form := multipart.NewWriter(&body)
+		form.WriteField("note", "x")
+		if len(fileField) != 0 {
+			part, _ := form.CreateFormFile(fileField, "a.png")
+			io.WriteString(part, "png")
+		}
+		form.Close()
+		req := httptest.NewRequest(http.MethodPost, "/upload", &body)
+		req.Header.Set("Content-Type", form.FormDataContentType())
+		req.SetBasicAuth("u", "p")
+		res := httptest.NewRecorder()
+		handler.ServeHTTP(res, req)
+		return res
+	}
+	routes := testServer(t, testConfig(t, "")).Routes()
+	for _, field := range []string{"image", "files[]"} {
+		if res := post(routes, field); res.Code != http.StatusCreated {
+			t.Errorf("field %q: status %d %s", field, res.Code, res.Body)
+		}
+	}
+	if res := post(routes, ""); res.Code != http.StatusBadRequest || !strings.Contains(res.Body.String(), "no file part, its fields are note") {
+		t.Errorf("no file: status %d %s", res.Code, res.Body)
+	}
+
+	pinned := testServer(t, testConfig(t, "multipart_field: image\n")).Routes()
+	if res := post(pinned, "image"); res.Code != http.StatusCreated {
+		t.Errorf("pinned field: status %d %s", res.Code, res.Body)
+	}
+	if res := post(pinned, "file"); res.Code != http.StatusBadRequest || !strings.Contains(res.Body.String(), `no "image" file part, its fields are file (file), note`) {
+		t.Errorf("other field: status %d %s", res.Code, res.Body)
+	}
+}
+
+func TestInfo(t *testing.T) {
+	routes := testServer(t, testConfig(t, "token: s3cret-token\nmax_upload_size: 10MB\n")).Routes()
+	res := httptest.NewRecorder()
+	routes.ServeHTTP(res, httptest.NewRequest(http.MethodGet, "/api/info", nil))
+	var info serverInfo
+	if err := json.Unmarshal(res.Body.Bytes(), &info); err != nil || res.Code != http.StatusOK {
+		t.Fatalf("info status %d: %s", res.Code, res.Body)
+	}
+	if info.APIVersion != 1 || info.UploadURL != "http://example.com/upload" || info.DownloadURL != "http://example.com/i/" || info.Limits.MaxUploadSize != 10<<20 || !info.Auth.Bearer {
+		t.Errorf("info %s", res.Body)
+	}
+	if strings.Contains(res.Body.String(), "s3cret") {
+		t.Errorf("info leaks the token: %s", res.Body)
+	}
+
+	routes = testServer(t, testConfig(t, "info_requires_auth: true\n")).Routes()
+	res = httptest.NewRecorder()
+	routes.ServeHTTP(res, httptest.NewRequest(http.MethodGet, "/api/info", nil))
+	if res.Code != http.StatusUnauthorized {
+		t.Errorf("gated info without credentials %d", res.Code)
+	}
+}
+
+func TestReadOnly(t *testing.T) {
+	routes := testServer(t, testConfig(t, "admin_username: admin\nadmin_password: secret\n")).Routes()
+	path := downloadPath(t, testUpload(t, routes, "notes.txt", "hello", nil))
+	send := func(method, path, body, user, password string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		if len(user) != 0 {
+			req.SetBasicAuth(user, password)
+		}
+		res := httptest.NewRecorder()
+		routes.ServeHTTP(res, req)
+		return res
+	}
+	switchMode := func(readOnly string) {
+		t.Helper()
+		if res := send(http.MethodPost, "/admin/readonly", `{"read_only": `+readOnly+`}`, "admin", "secret"); res.Code != http.StatusOK {
+			t.Fatalf("switching read-only mode: status %d: %s", res.Code, res.Body)
+		}
+	}
+	switchMode("true")
+
+	res := testUpload(t, routes, "notes.txt", "hello", nil)
+	if res.Code != http.StatusServiceUnavailable || len(res.Header().Get("Retry-After")) == 0 || !strings.Contains(res.Body.String(), "maintenance") {
+		t.Errorf("read-only upload: status %d, Retry-After %q: %s", res.Code, res.Header().Get("Retry-After"), res.Body)
+	}
+	for _, req := range []struct{ method, path, body, user, password string }{
+		{http.MethodPost, "/paste", "text", "u", "p"},
+		{http.MethodPut, path, "hello, world", "u", "p"},
+		{http.MethodPost, "/admin/delete?from=2020-01-01&to=2030-01-01", "", "admin", "secret"},
+	} {
+		if res := send(req.method, req.path, req.body, req.user, req.password); res.Code != http.StatusServiceUnavailable {
+			t.Errorf("read-only %s %s: status %d", req.method, req.path, res.Code)
+		}
+	}
+	if res := send(http.MethodGet, path, "", "", ""); res.Code != http.StatusOK || res.Body.String() != "hello" {
+		t.Errorf("read-only download: status %d: %s", res.Code, res.Body)
+	}
+	for _, check := range []string{"/api/health", "/api/info"} {
+		var mode struct {
+			ReadOnly bool `json:"read_only"`
+		}
+		res := send(http.MethodGet, check, "", "", "")
+		if err := json.Unmarshal(res.Body.Bytes(), &mode); err != nil || !mode.ReadOnly {
+			t.Errorf("%s doesn't show read-only mode: %s", check, res.Body)
+		}
+	}
+
+	switchMode("false")
+	if res := testUpload(t, routes, "notes.txt", "hello", nil); res.Code != http.StatusCreated {
+		t.Errorf("upload after leaving read-only mode: status %d: %s", res.Code, res.Body)
+	}
+	if res := send(http.MethodPost, "/admin/readonly", `{}`, "admin", "secret"); res.Code != http.StatusBadRequest {
+		t.Errorf("switching without read_only: status %d", res.Code)
+	}
+
+	routes = testServer(t, testConfig(t, "read_only: true\n")).Routes()
+	if res := testUpload(t, routes, "notes.txt", "hello", nil); res.Code != http.StatusServiceUnavailable {
+		t.Errorf("upload with read_only: true: status %d", res.Code)
+	}
+}
+
+func TestIdempotentReplay(t *testing.T) {
+	cfg := testConfig(t, "")
+	server := testServer(t, cfg)
+	routes := server.Routes()
+	upload := func(name, content string, chunked bool) *httptest.ResponseRecorder {
+		var body bytes.Buffer
+		form := multipart.NewWriter(&body)
+		part, _ := form.CreateFormFile("file", name)
+		io.WriteString(part, content)
+		form.Close()
+		var reader io.Reader = &body
+		if chunked {
+			reader = struct{ io.Reader }{&body}
+		}
+		req := httptest.NewRequest(http.MethodPost, "/upload", reader)
+		req.Header.Set("Content-Type", form.FormDataContentType())
+		req.Header.Set("Idempotency-Key", "retry-1")
+		req.SetBasicAuth("u", "p")
+		res := httptest.NewRecorder()
+		routes.ServeHTTP(res, req)
+		return res
+	}
+	if res := testUpload(t, routes, "b.txt", "without a key", nil); res.Code != http.StatusCreated {
+		t.Fatalf("upload without a key: status %d", res.Code)
+	}
+	if server.idempotency.loaded {
+		t.Error("the state was loaded for an upload without the header")
+	}
+	first := upload("a.txt", "hello", true)
+	if first.Code != http.StatusCreated {
+		t.Fatalf("first upload: status %d: %s", first.Code, first.Body)
+	}
+	// chunked or not, with another boundary, it is the same file
+	for _, chunked := range []bool{true, false} {
+		retry := upload("a.txt", "hello", chunked)
+		if retry.Code != http.StatusOK || retry.Body.String() != first.Body.String() || retry.Header().Get("Idempotent-Replayed") != "true" || retry.Header().Get("Location") != first.Header().Get("Location") {
+			t.Errorf("retry, chunked %v: status %d, headers %v: %s", chunked, retry.Code, retry.Header(), retry.Body)
+		}
+	}
+	for _, other := range [][2]string{{"a.txt", "hallo"}, {"b.txt", "hello"}, {"a.txt", "hello, world"}} {
+		if res := upload(other[0], other[1], true); res.Code != http.StatusConflict {
+			t.Errorf("%s %q under the key: status %d", other[0], other[1], res.Code)
+		}
+	}
+	if files := storedFiles(t, cfg); files != 2 {
+		t.Errorf("%d files stored, want two", files)
+	}
+
+	// saved periodically, not by every upload, and read back lazily
+	if _, err := os.Stat(cfg.IdempotencyStateFile); !os.IsNotExist(err) {
+		t.Errorf("the state file was written by the upload: %v", err)
+	}
+	if err := server.idempotency.save(); err != nil {
+		t.Fatal(err)
+	}
+	routes = testServer(t, cfg).Routes()
+	if retry := upload("a.txt", "hello", false); retry.Code != http.StatusOK || retry.Body.String() != first.Body.String() {
+		t.Errorf("retry after a restart: status %d: %s", retry.Code, retry.Body)
+	}
+}
+
+func TestPrivateDownload(t *testing.T) {
+	cfg := testConfig(t, "database: "+filepath.Join(t.TempDir(), "files.db")+"\ncache_max_bytes: 1MB\n")
+	server := testServer(t, cfg)
+	routes := server.Routes()
+	path := downloadPath(t, testUpload(t, routes, "secret.txt", "secret", map[string]string{"visibility": "private"}))
+	public := downloadPath(t, testUpload(t, routes, "public.txt", "public", nil))
+	get := func(path string, auth bool) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		if auth {
+			req.SetBasicAuth("u", "p")
+		}
+		res := httptest.NewRecorder()
+		routes.ServeHTTP(res, req)
+		return res
+	}
+	check := func(when string) {
+		t.Helper()
+		if res := get(path, false); res.Code != http.StatusUnauthorized || strings.Contains(res.Body.String(), "secret") {
+			t.Errorf("%s: anonymous download status %d: %s", when, res.Code, res.Body)
+		}
+		res := get(path, true)
+		if res.Code != http.StatusOK || res.Body.String() != "secret" || res.Header().Get("Cache-Control") != "private, no-store" {
+			t.Errorf("%s: download with credentials status %d, Cache-Control %q", when, res.Code, res.Header().Get("Cache-Control"))
+		}
+		if res := get(public, false); res.Code != http.StatusOK || strings.Contains(res.Header().Get("Cache-Control"), "private") {
+			t.Errorf("%s: public download status %d, Cache-Control %q", when, res.Code, res.Header().Get("Cache-Control"))
+		}
+	}
+	check("fresh")
+	// the downloads above put both into the hot cache
+	if server.hotFiles.get(path[len("/i/"):]) == nil {
+		t.Fatal("the private file is not cached")
+	}
+	check("cached")
+	if _, _, err := server.metaIndex.reindex(cfg); err != nil {
+		t.Fatal(err)
+	}
+	server.hotFiles.remove(path[len("/i/"):])
+	check("reindexed")
+
+	patch := func(visibility string) {
+		req := httptest.NewRequest(http.MethodPatch, "/api/files/"+path[len("/i/"):], strings.NewReader(`{"visibility": "`+visibility+`"}`))
+		req.SetBasicAuth("u", "p")
+		res := httptest.NewRecorder()
+		routes.ServeHTTP(res, req)
+		if res.Code != http.StatusOK {
+			t.Fatalf("PATCH %s: status %d: %s", visibility, res.Code, res.Body)
+		}
+	}
+	patch("public")
+	if res := get(path, false); res.Code != http.StatusOK {
+		t.Errorf("made public: anonymous download status %d", res.Code)
+	}
+	patch("private")
+	check("private again")
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+// formatShareX is the response_format, or ?format=, of ShareX.
+const formatShareX = "sharex"
+
+// responseFormat is ?format= when it is set and response_format otherwise.
+func responseFormat(r *http.Request, cfg *config) string {
+	if format := strings.ToLower(r.URL.Query().Get("format")); len(format) != 0 {
+		return format
+	}
+	return cfg.ResponseFormat
+}
+
+// shareXResponse is the upload response ShareX custom uploaders read the
+// link from as {json:data.link}. There are no delete tokens yet, so no
+// deletion_url either.
+func shareXResponse(url string) map[string]any {
+	return map[string]any{
+		"status": http.StatusOK,
+		"data":   map[string]string{"link": url},
+	}
+}
+
+// shareXHandler sends a ShareX custom uploader (.sxcu) for this server,
+// posting to upload_path with the caller's Basic credentials or token.
+func (s *Server) shareXHandler(w http.ResponseWriter, r *http.Request) {
+	err := s.basicAuth(r)
+	if err != nil {
+		s.writeAuthError(w, r, err)
+		return
+	}
+	uploader := map[string]any{
+		"Version":         "15.0.0",
+		"Name":            "file (" + r.Host + ")",
+		"DestinationType": "ImageUploader, TextUploader, FileUploader",
+		"RequestMethod":   "POST",
+		"RequestURL":      routeURL(r, s.cfg, s.cfg.UploadPath),
+		"Parameters":      map[string]string{"format": formatShareX},
+		"Body":            "MultipartFormData",
+		"FileFormName":    "file",
+		"URL":             "{json:data.link}",
+		"ErrorMessage":    "{response}",
+	}
+	// Digest can't be replayed from a static header
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Basic ") || isBearer(r) {
+		uploader["Headers"] = map[string]string{"Authorization": auth}
+	}
+	w.Header().Set("Content-Disposition", contentDisposition("attachment", strings.ReplaceAll(r.Host, ":", "-")+".sxcu"))
+	w.Header().Set("Cache-Control", "private, no-store")
+	writeJSON(w, http.StatusOK, uploader)
+}
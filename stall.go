@@ -0,0 +1,133 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// defaultUploadRateWindow is how long min_upload_rate is averaged over when
+// upload_rate_window is unset.
+const defaultUploadRateWindow = 30 * time.Second
+
+// stallError aborts an upload that was too slow or took too long.
+type stallError string
+
+func (e stallError) Error() string {
+	return string(e)
+}
+
+// stallReader counts the bytes of a request body so a watcher can abort it
+// when it falls below min_upload_rate or outlives upload_timeout.
+type stallReader struct {
+	body io.ReadCloser
+	done chan struct{}
+
+	mu       sync.Mutex
+	received int64
+	err      error
+	finished bool
+}
+
+// watchUpload wraps r.Body in a stallReader when min_upload_rate or
+// upload_timeout is set. An abort sets the read deadline to now, so a Read
+// blocked on a silent client returns and the handler sees a stallError.
+func watchUpload(w http.ResponseWriter, r *http.Request, cfg *config) {
+	if cfg.MinUploadRate <= 0 && cfg.UploadTimeout <= 0 {
+		return
+	}
+	s := &stallReader{body: r.Body, done: make(chan struct{})}
+	r.Body = s
+	ip := clientIP(r, cfg).String()
+	controller := http.NewResponseController(w)
+	go s.watch(r, int64(cfg.MinUploadRate), time.Duration(cfg.UploadRateWindow), time.Duration(cfg.UploadTimeout), func(err error) {
+		slog.WarnContext(r.Context(), "aborting upload", "ip", ip, "bytes", s.bytes(), "err", err)
+		controller.SetReadDeadline(time.Now())
+	})
+}
+
+// watch checks the rate over a sliding window, sampled four times per
+// window, until the body is done or the request ends. The first full window
+// is always allowed, so slow starts aren't punished.
+func (s *stallReader) watch(r *http.Request, rate int64, window, timeout time.Duration, abort func(error)) {
+	var deadline <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		deadline = timer.C
+	}
+	var tick <-chan time.Time
+	if rate > 0 {
+		ticker := time.NewTicker(window / 4)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	var samples []int64
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-r.Context().Done():
+			return
+		case <-deadline:
+			s.abort(stallError("the upload took longer than upload_timeout"), abort)
+			return
+		case <-tick:
+			samples = append(samples, s.bytes())
+			if len(samples) < 5 {
+				continue
+			}
+			samples = samples[len(samples)-5:]
+			if samples[4]-samples[0] < int64(float64(rate)*window.Seconds()) {
+				s.abort(stallError("the upload is slower than min_upload_rate"), abort)
+				return
+			}
+		}
+	}
+}
+func (s *stallReader) abort(err error, abort func(error)) {
+	s.mu.Lock()
+	if s.finished {
+		s.mu.Unlock()
+		return
+	}
+	s.err = err
+	s.mu.Unlock()
+	abort(err)
+}
+func (s *stallReader) bytes() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.received
+}
+
+// finish stops the watcher, the body is fully read or no longer needed.
+func (s *stallReader) finish() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.finished {
+		s.finished = true
+		close(s.done)
+	}
+}
+func (s *stallReader) Read(p []byte) (int, error) {
+	n, err := s.body.Read(p)
+	s.mu.Lock()
+	s.received += int64(n)
+	abortErr := s.err
+	s.mu.Unlock()
+	if abortErr != nil {
+		return n, abortErr
+	}
+	if errors.Is(err, io.EOF) {
+		s.finish()
+	}
+	return n, err
+}
+func (s *stallReader) Close() error {
+	s.finish()
+	return s.body.Close()
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// slowReader sends its content in chunks with a pause before each, a client
+// on a slow link.
+type slowReader struct {
+	content []byte
+	chunk   int
+	pause   time.Duration
+}
+
+func (s *slowReader) Read(p []byte) (int, error) {
+	if len(s.content) == 0 {
+		return 0, io.EOF
+	}
+	time.Sleep(s.pause)
+	n := copy(p[:min(len(p), s.chunk)], s.content)
+	s.content = s.content[n:]
+	return n, nil
+}
+
+// slowUpload posts a multipart upload of content through a slowReader.
+func slowUpload(handler http.Handler, content string, chunk int, pause time.Duration) *httptest.ResponseRecorder {
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	part, _ := form.CreateFormFile("file", "slow.bin")
+	io.WriteString(part, content)
+	form.Close()
+	req := httptest.NewRequest(http.MethodPost, "/upload", &slowReader{content: body.Bytes(), chunk: chunk, pause: pause})
+	req.ContentLength = int64(body.Len())
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	req.SetBasicAuth("u", "p")
+	res := httptest.NewRecorder()
+	handler.ServeHTTP(res, req)
+	return res
+}
+
+func TestStalledUpload(t *testing.T) {
+	for _, test := range []struct {
+		name, config string
+		// steadyChunk bytes a millisecond are fast enough
+		steadyChunk int
+	}{
+		{"timeout", "upload_timeout: 100ms\n", 1000},
+		// about 300ms, more than a window
+		{"rate", "min_upload_rate: 10KB\nupload_rate_window: 200ms\n", 100},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			cfg := testConfig(t, test.config)
+			routes := testServer(t, cfg).Routes()
+			start := time.Now()
+			res := slowUpload(routes, strings.Repeat("a", 1000), 10, 10*time.Millisecond)
+			if res.Code != http.StatusRequestTimeout {
+				t.Errorf("stalled upload: status %d: %s", res.Code, res.Body)
+			}
+			if elapsed := time.Since(start); elapsed > time.Second {
+				t.Errorf("aborted after %v", elapsed)
+			}
+			if files := storedFiles(t, cfg); files != 0 {
+				t.Errorf("%d partial files left", files)
+			}
+			// slow but steady, it must not be killed
+			if res := slowUpload(routes, strings.Repeat("b", 30000), test.steadyChunk, time.Millisecond); res.Code != http.StatusCreated {
+				t.Errorf("steady upload: status %d: %s", res.Code, res.Body)
+			}
+		})
+	}
+}
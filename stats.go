@@ -0,0 +1,244 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultStatsInterval = time.Hour
+	defaultStatsDays     = 30
+	statsMaxDays         = 366
+	defaultStatsLargest  = 10
+	// statsLargest is how many of the largest files are tracked.
+	statsLargest = 100
+)
+
+// storageCounters keeps the totals of /api/stats up to date as files are
+// stored and deleted, so requests never walk the tree. A periodic scan
+// replaces them, fixing whatever drifted, like changes made while the
+// previous scan ran or files removed by hand.
+type storageCounters struct {
+	mu        sync.Mutex
+	files     int
+	bytes     int64
+	diskBytes int64
+	days      map[string]*dayStats
+	// largest is sorted by size, largest first. Deleting one of them leaves
+	// a gap only the next scan fills.
+	largest    []largeFile
+	computedAt time.Time
+}
+
+type largeFile struct {
+	Path string `json:"path"`
+	Size int64  `json:"size"`
+}
+
+// relDay is the YYYY-MM-DD of a stored path, namespaced or not, "" for one
+// in a custom dir replacing the date path.
+func relDay(rel string) string {
+	parts := strings.Split(rel, "/")
+	for i := 0; i <= 1 && i+3 < len(parts); i++ {
+		if isDigits(parts[i], 4) && isDigits(parts[i+1], 2) && isDigits(parts[i+2], 2) {
+			return strings.Join(parts[i:i+3], "-")
+		}
+	}
+	return ""
+}
+
+// added counts a stored file.
+func (c *storageCounters) added(rel string, size, diskSize int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.addLocked(rel, size, diskSize)
+}
+func (c *storageCounters) addLocked(rel string, size, diskSize int64) {
+	c.files++
+	c.bytes += size
+	c.diskBytes += diskSize
+	day := relDay(rel)
+	entry, ok := c.days[day]
+	if !ok {
+		entry = &dayStats{Day: day}
+		c.days[day] = entry
+	}
+	entry.Files++
+	entry.Bytes += size
+	entry.DiskBytes += diskSize
+	i := sort.Search(len(c.largest), func(i int) bool { return c.largest[i].Size < size })
+	if i < statsLargest {
+		c.largest = append(c.largest, largeFile{})
+		copy(c.largest[i+1:], c.largest[i:])
+		c.largest[i] = largeFile{rel, size}
+		c.largest = c.largest[:min(len(c.largest), statsLargest)]
+	}
+}
+
+// removed uncounts a deleted file.
+func (c *storageCounters) removed(rel string, size, diskSize int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.files = max(c.files-1, 0)
+	c.bytes = max(c.bytes-size, 0)
+	c.diskBytes = max(c.diskBytes-diskSize, 0)
+	if entry, ok := c.days[relDay(rel)]; ok {
+		entry.Files--
+		entry.Bytes -= size
+		entry.DiskBytes -= diskSize
+		if entry.Files <= 0 {
+			delete(c.days, entry.Day)
+		}
+	}
+	for i, file := range c.largest {
+		if file.Path == rel {
+			c.largest = append(c.largest[:i], c.largest[i+1:]...)
+			break
+		}
+	}
+}
+
+// scan recounts everything by walking the upload tree.
+func (c *storageCounters) scan(cfg *config) error {
+	started := time.Now()
+	fresh := &storageCounters{days: map[string]*dayStats{}}
+	err := walkStored(cfg, func(entry storedEntry) error {
+		fresh.addLocked(entry.Rel, logicalSize(cfg, filepath.Dir(entry.Path), entry.Info), entry.Info.Size())
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.files, c.bytes, c.diskBytes = fresh.files, fresh.bytes, fresh.diskBytes
+	c.days, c.largest = fresh.days, fresh.largest
+	c.computedAt = started
+	return nil
+}
+
+// run scans at the start and then every interval, forever.
+func (c *storageCounters) run(cfg *config, interval time.Duration) {
+	for {
+		err := c.scan(cfg)
+		if err != nil {
+			slog.Error("fail to scan the upload tree for stats", "err", err)
+		}
+		time.Sleep(interval)
+	}
+}
+
+// logicalSize is the original size of a file listed in dir, which differs
+// from its size on disk when it is compressed or encrypted.
+func logicalSize(cfg *config, dir string, file os.FileInfo) int64 {
+	name, _ := storedName(file.Name())
+	if name == file.Name() {
+		return file.Size()
+	}
+	info, err := statStored(cfg, filepath.Join(dir, name))
+	if err != nil {
+		return file.Size()
+	}
+	return info.Size()
+}
+
+type volumeStats struct {
+	Dir  string `json:"dir"`
+	Free uint64 `json:"free"`
+}
+
+// statsHandler reports the counters: totals, the last days (default 30,
+// ?days= up to 366) and the largest files (?largest=, default 10).
+func (s *Server) statsHandler(w http.ResponseWriter, r *http.Request) {
+	err := s.basicAuth(r)
+	if err != nil {
+		s.writeAuthError(w, r, err)
+		return
+	}
+	query := r.URL.Query()
+	dayCount, ok := statsParam(query.Get("days"), defaultStatsDays, statsMaxDays)
+	if !ok {
+		writeError(w, r, http.StatusBadRequest, "days must be between 1 and "+strconv.Itoa(statsMaxDays))
+		return
+	}
+	largestCount, ok := statsParam(query.Get("largest"), defaultStatsLargest, statsLargest)
+	if !ok {
+		writeError(w, r, http.StatusBadRequest, "largest must be between 1 and "+strconv.Itoa(statsLargest))
+		return
+	}
+	type largeFileURL struct {
+		largeFile
+		URL string `json:"url"`
+	}
+	stats := struct {
+		Files      int            `json:"files"`
+		Bytes      int64          `json:"bytes"`
+		DiskBytes  int64          `json:"disk_bytes"`
+		Days       []dayStats     `json:"days"`
+		Largest    []largeFileURL `json:"largest"`
+		Volumes    []volumeStats  `json:"volumes"`
+		ComputedAt *time.Time     `json:"computed_at"`
+		Cache      *hotCacheStats `json:"cache,omitempty"`
+		Egress     egressStats    `json:"egress"`
+		Trash      *trashTotals   `json:"trash,omitempty"`
+	}{Days: []dayStats{}, Largest: []largeFileURL{}, Volumes: []volumeStats{}, Cache: s.hotFiles.stats(), Egress: s.egress.stats(s.cfg)}
+	s.storageStats.mu.Lock()
+	stats.Files, stats.Bytes, stats.DiskBytes = s.storageStats.files, s.storageStats.bytes, s.storageStats.diskBytes
+	// every day of the window, oldest first, days without uploads included
+	today := s.cfg.today()
+	for i := dayCount - 1; i >= 0; i-- {
+		day := today.AddDate(0, 0, -i).Format(dayLayout)
+		entry := dayStats{Day: day}
+		if counted, ok := s.storageStats.days[day]; ok {
+			entry = *counted
+		}
+		stats.Days = append(stats.Days, entry)
+	}
+	for _, file := range s.storageStats.largest[:min(largestCount, len(s.storageStats.largest))] {
+		stats.Largest = append(stats.Largest, largeFileURL{file, publicURL(r, s.cfg, file.Path)})
+	}
+	if !s.storageStats.computedAt.IsZero() {
+		computedAt := s.storageStats.computedAt.UTC()
+		stats.ComputedAt = &computedAt
+	}
+	s.storageStats.mu.Unlock()
+	dirs := []string{s.cfg.UploadDir}
+	for _, replica := range s.cfg.Replicas {
+		dirs = append(dirs, replica.Dir)
+	}
+	for _, dir := range dirs {
+		free, err := freeSpace(dir)
+		if err != nil {
+			slog.ErrorContext(r.Context(), "fail to check free space", "dir", dir, "err", err)
+			continue
+		}
+		stats.Volumes = append(stats.Volumes, volumeStats{dir, free})
+	}
+	// the trash is walked, only when asked for
+	if query.Get("include_trashed") == "1" && s.cfg.TrashRetention > 0 {
+		totals, err := countTrash(s.cfg)
+		if err != nil {
+			slog.ErrorContext(r.Context(), "fail to count the trash", "err", err)
+			writeError(w, r, http.StatusInternalServerError, "")
+			return
+		}
+		stats.Trash = &totals
+	}
+	writeJSON(w, http.StatusOK, stats)
+}
+
+// statsParam parses an optional count between 1 and limit.
+func statsParam(value string, fallback, limit int) (int, bool) {
+	if len(value) == 0 {
+		return fallback, true
+	}
+	n, err := strconv.Atoi(value)
+	return n, err == nil && n >= 1 && n <= limit
+}
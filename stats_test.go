@@ -0,0 +1,71 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestStats(t *testing.T) {
+	cfg := testConfig(t, "trash_retention: 30d\n")
+	server := testServer(t, cfg)
+	routes := server.Routes()
+	files := writeFixtureTree(t, server)
+	var bytes int64
+	for _, content := range files {
+		bytes += int64(len(content))
+	}
+	type statsResponse struct {
+		Files   int          `json:"files"`
+		Bytes   int64        `json:"bytes"`
+		Days    []dayStats   `json:"days"`
+		Largest []largeFile  `json:"largest"`
+		Trash   *trashTotals `json:"trash"`
+	}
+	stats := func() statsResponse {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodGet, "/api/stats?days=2&include_trashed=1", nil)
+		req.SetBasicAuth("u", "p")
+		res := httptest.NewRecorder()
+		routes.ServeHTTP(res, req)
+		var stats statsResponse
+		err := json.Unmarshal(res.Body.Bytes(), &stats)
+		if err != nil {
+			t.Fatalf("status %d: %v", res.Code, err)
+		}
+		return stats
+	}
+
+	err := server.storageStats.scan(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := stats()
+	if got.Files != len(files) || got.Bytes != bytes {
+		t.Errorf("%d files of %d bytes, want %d of %d", got.Files, got.Bytes, len(files), bytes)
+	}
+	if len(got.Days) != 2 || got.Days[0].Files != 1 || got.Days[1].Files != 2 || got.Days[1].Bytes != int64(len("stored today")+len("stored today by alice")) {
+		t.Errorf("days %+v", got.Days)
+	}
+	if len(got.Largest) != len(files) || !strings.HasPrefix(got.Largest[0].Path, "alice/") {
+		t.Errorf("largest %+v", got.Largest)
+	}
+	if got.Trash == nil || got.Trash.Files != 1 || got.Trash.Bytes != int64(len("deleted today")) {
+		t.Errorf("trash %+v", got.Trash)
+	}
+
+	// uploads and deletes are counted as they happen
+	rel := strings.TrimPrefix(downloadPath(t, testUpload(t, routes, "notes.txt", "hello", nil)), "/i/")
+	if got := stats(); got.Files != len(files)+1 || got.Bytes != bytes+5 || got.Days[1].Files != 3 {
+		t.Errorf("after an upload %d files of %d bytes, today %+v", got.Files, got.Bytes, got.Days[1])
+	}
+	req := httptest.NewRequest(http.MethodDelete, "/api/files/"+rel, nil)
+	req.SetBasicAuth("u", "p")
+	res := httptest.NewRecorder()
+	routes.ServeHTTP(res, req)
+	if got := stats(); res.Code != http.StatusOK || got.Files != len(files) || got.Bytes != bytes || got.Trash.Files != 2 {
+		t.Errorf("after a delete (%d) %d files of %d bytes, trash %+v", res.Code, got.Files, got.Bytes, got.Trash)
+	}
+}
@@ -0,0 +1,604 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// digestMismatchError reports stored bytes that didn't match the digest the
+// client announced; the stored file is already removed when it's returned.
+type digestMismatchError string
+
+func (e digestMismatchError) Error() string {
+	return string(e)
+}
+
+// storedFile describes a successfully stored upload.
+type storedFile struct {
+	// Rel is the slash separated path relative to UploadDir.
+	Rel  string
+	Size int64
+	// DiskSize is what the file takes on disk, compressed or encrypted.
+	DiskSize     int64
+	SHA256       string
+	OriginalName string
+	ContentType  string
+	StoredAt     time.Time
+	Tags         []string
+	Private      bool
+	Paste        bool
+}
+
+// uploadPreflight runs the checks shared by every upload path before any
+// bytes are read: auth, digest headers, quota and free space. It writes the error
+// response itself and returns false when the upload must not proceed. The
+// caller releases the quota reservation when done.
+func (s *Server) uploadPreflight(w http.ResponseWriter, r *http.Request) ([]*digestCheck, *quotaReader, bool) {
+	digests, ok := s.uploadAuth(w, r)
+	if !ok {
+		return nil, nil, false
+	}
+	reservation, ok := s.admitUpload(w, r, 0)
+	return digests, reservation, ok
+}
+
+// uploadAuth is the first half of uploadPreflight, auth and digest headers.
+func (s *Server) uploadAuth(w http.ResponseWriter, r *http.Request) ([]*digestCheck, bool) {
+	err := s.basicAuth(r)
+	if err != nil {
+		s.writeAuthError(w, r, err)
+		return nil, false
+	}
+	digests, err := parseDigestHeaders(r.Header)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, err.Error())
+		return nil, false
+	}
+	return digests, true
+}
+
+// admitUpload is the second half of uploadPreflight, quota and free space,
+// with credit bytes of the body not charged to the quota.
+func (s *Server) admitUpload(w http.ResponseWriter, r *http.Request, credit int64) (*quotaReader, bool) {
+	var reservation *quotaReader
+	if s.quotas != nil {
+		var err error
+		reservation, err = s.checkQuota(r, credit)
+		if err != nil {
+			s.writeStoreError(w, r, err)
+			return nil, false
+		}
+	}
+	free, ok, err := hasFreeSpace(s.cfg, r.ContentLength)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "fail to check free space", "dir", s.cfg.UploadDir, "err", err)
+	}
+	if !ok {
+		reservation.release()
+		writeError(w, r, http.StatusInsufficientStorage, fmt.Sprintf("%d bytes free", free))
+		return nil, false
+	}
+	watchUpload(w, r, s.cfg)
+	watchProgress(r, s.cfg)
+	return reservation, true
+}
+
+// defaultMultipartMemory is how much of a multipart upload is kept in
+// memory before it spills to temp files, net/http's own default.
+const defaultMultipartMemory = 32 << 20
+
+// newName generates stored file names, replaceable so collisions can be
+// forced.
+var newName = func(ext string) string {
+	return uuid.New().String() + ext
+}
+
+// createAttempts bounds how often createUnique draws a new name.
+const createAttempts = 5
+
+// createUnique creates a new file in dir named by newName, never replacing an
+// existing one: a name that is taken is drawn again. The mode is set
+// explicitly since the umask applies to OpenFile.
+func createUnique(dir, ext string, mode os.FileMode) (*os.File, string, error) {
+	for range createAttempts {
+		filename := newName(ext)
+		dst, err := os.OpenFile(filepath.Join(dir, filename), os.O_CREATE|os.O_EXCL|os.O_WRONLY, mode)
+		if errors.Is(err, fs.ErrExist) {
+			slog.Warn("name collision, retrying", "name", filename)
+			continue
+		}
+		if err == nil {
+			err = dst.Chmod(mode)
+			if err != nil {
+				dst.Close()
+				os.Remove(dst.Name())
+			}
+		}
+		return dst, filename, err
+	}
+	return nil, "", fmt.Errorf("no free name after %d attempts", createAttempts)
+}
+
+// mkdirAllMode creates the slash separated rel below root like os.MkdirAll,
+// but chmods every directory it creates there so the umask can't change
+// mode. A missing root is created with plain os.MkdirAll.
+func mkdirAllMode(root, rel string, mode os.FileMode) error {
+	err := os.MkdirAll(root, mode)
+	if err != nil {
+		return err
+	}
+	dir := root
+	for _, segment := range strings.Split(rel, "/") {
+		dir = filepath.Join(dir, segment)
+		err := os.Mkdir(dir, mode)
+		if errors.Is(err, fs.ErrExist) {
+			continue
+		}
+		if err == nil {
+			err = os.Chmod(dir, mode)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// maxCompressedSize is the largest file stored compressed, gzip only keeps
+// the size modulo 4GB.
+const maxCompressedSize = 1<<32 - 1
+
+// storeUpload writes src to a new [{namespace}/]{year}/{month}/{day}/{uuid}{ext}
+// file under UploadDir, keeping the extension of originalName. A customDir
+// replaces the date path or goes below it, per custom_dir_layout. Nothing
+// is left behind when it fails. sizeHint is the most src can hold, -1 when
+// it isn't known, and decides whether a compressible type is compressed.
+func (s *Server) storeUpload(ctx context.Context, namespace, customDir string, src io.Reader, originalName string, sizeHint int64, digests []*digestCheck) (storedFile, error) {
+	cfg := s.cfg
+	now := cfg.now()
+	timePath := fmt.Sprintf("%d/%02d/%02d", now.Year(), now.Month(), now.Day())
+	switch {
+	case len(customDir) == 0:
+	case cfg.CustomDirLayout == customDirNested:
+		timePath += "/" + customDir
+	default:
+		timePath = customDir
+	}
+	if len(namespace) != 0 {
+		timePath = namespace + "/" + timePath
+	}
+	dirPath := filepath.Join(cfg.UploadDir, timePath)
+	err := mkdirAllMode(cfg.UploadDir, timePath, os.FileMode(cfg.DirMode))
+	if err != nil {
+		return storedFile{}, fmt.Errorf("fail to create upload dir\n%w", err)
+	}
+	ext := filepath.Ext(originalName)
+	compress := sizeHint >= 0 && sizeHint <= maxCompressedSize && cfg.Compression.compresses("upload"+ext)
+	if compress {
+		ext += compressedSuffix
+	}
+	if cfg.keys != nil {
+		// names have no dot but the extension's
+		ext = encryptedName(ext)
+	}
+	dst, filename, err := createUnique(dirPath, ext, os.FileMode(cfg.FileMode))
+	if err != nil {
+		return storedFile{}, fmt.Errorf("fail to create upload file\n%w", err)
+	}
+	filename, _ = storedName(filename)
+	timeNameString := fmt.Sprintf("%s/%s", timePath, filename)
+	filePath := dst.Name()
+	size, info, sha, err := s.writeContent(ctx, dst, filename, compress, src, digests)
+	if err != nil {
+		os.Remove(filePath)
+		return storedFile{}, err
+	}
+	return storedFile{
+		Rel:          timeNameString,
+		Size:         size,
+		DiskSize:     info.Size(),
+		SHA256:       sha,
+		OriginalName: originalName,
+		ContentType:  contentTypeOf(filename),
+		StoredAt:     now,
+	}, nil
+}
+
+// writeContent writes src to dst the way files are stored: gzipped when
+// compress, then encrypted with the keys. It closes dst and returns the
+// original size and sha256, checked against digests and the blocklist. The
+// caller removes dst when it fails.
+func (s *Server) writeContent(ctx context.Context, dst *os.File, filename string, compress bool, src io.Reader, digests []*digestCheck) (int64, os.FileInfo, string, error) {
+	cfg := s.cfg
+	sum := sha256.New()
+	// gzip, then encrypt, then write; digests and sha256 see the original
+	var out io.Writer = dst
+	var sealer *encryptWriter
+	var err error
+	if cfg.keys != nil {
+		sealer, err = newEncryptWriter(dst, cfg.keys)
+		out = sealer
+	}
+	var packer *gzip.Writer
+	if compress {
+		packer = gzip.NewWriter(out)
+		out = packer
+	}
+	_, write := startPhase(ctx, "upload.write")
+	write.setString("file.content_type", contentTypeOf(filename))
+	write.setBool("file.compressed", compress)
+	write.setBool("file.encrypted", sealer != nil)
+	var size int64
+	if err == nil {
+		size, err = s.copyBuffers.copy(io.MultiWriter(digestWriter(out, digests), sum), src)
+	}
+	if err == nil && packer != nil {
+		err = packer.Close()
+	}
+	if err == nil && sealer != nil {
+		err = sealer.Close()
+	}
+	var info os.FileInfo
+	if err == nil {
+		info, err = dst.Stat()
+	}
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+	write.setInt("file.size", size)
+	if info != nil {
+		write.setInt("file.disk_size", info.Size())
+	}
+	write.end(err)
+	if err != nil {
+		return 0, nil, "", fmt.Errorf("fail to write upload file\n%w", err)
+	}
+	// the hashes are fed while writing, this only finishes and checks them
+	_, hash := startPhase(ctx, "upload.hash")
+	hash.setInt("digest.count", int64(len(digests)))
+	mismatch, ok := verifyDigests(digests)
+	if !ok {
+		err = digestMismatchError(mismatch)
+		hash.end(err)
+		return 0, nil, "", err
+	}
+	sha := hex.EncodeToString(sum.Sum(nil))
+	if s.blocklist.blocked(sha) {
+		err = blockedError(sha)
+		hash.end(err)
+		return 0, nil, "", err
+	}
+	hash.end(nil)
+	return size, info, sha, nil
+}
+
+// afterStore does the bookkeeping every successful upload needs.
+func (s *Server) afterStore(r *http.Request, stored storedFile) {
+	cfg := s.cfg
+	logStored(r, cfg, stored)
+	if s.quotas != nil {
+		size := stored.Size
+		if cfg.QuotaCounts == quotaCountsDisk {
+			size = stored.DiskSize
+		}
+		s.quotas.add(clientIP(r, cfg).String(), size, time.Now())
+	}
+	uploader := requestUsername(r, cfg)
+	s.indexStored(fileRecord{
+		Path:         stored.Rel,
+		OriginalName: stored.OriginalName,
+		Size:         stored.Size,
+		DiskSize:     stored.DiskSize,
+		ContentType:  stored.ContentType,
+		SHA256:       stored.SHA256,
+		Uploader:     uploader,
+		UploadedAt:   stored.StoredAt,
+		Tags:         stored.Tags,
+		Private:      stored.Private,
+		Paste:        stored.Paste,
+	})
+	s.replicateStored(stored.Rel)
+	s.storageStats.added(stored.Rel, stored.Size, stored.DiskSize)
+	s.auditLog.uploaded(r, stored)
+}
+
+// writeUploadResponse answers a successful upload with 201, its url in
+// Location and the body of uploadResponse.
+func writeUploadResponse(w http.ResponseWriter, r *http.Request, cfg *config, stored storedFile) {
+	contentType, body := uploadResponse(r, cfg, stored)
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Location", publicURL(r, cfg, stored.Rel))
+	w.WriteHeader(http.StatusCreated)
+	w.Write(body)
+}
+
+// uploadTemplateData are the fields of response_template.
+type uploadTemplateData struct {
+	URL          string
+	Path         string
+	Filename     string
+	OriginalName string
+	Size         int64
+	ContentType  string
+	SHA256       string
+}
+
+// parseResponseTemplate parses response_template and fills it in once, so
+// unknown fields fail at load rather than on uploads.
+func parseResponseTemplate(text string) (*template.Template, error) {
+	tmpl, err := template.New("response_template").Parse(text)
+	if err != nil {
+		return nil, err
+	}
+	err = tmpl.Execute(io.Discard, uploadTemplateData{})
+	if err != nil {
+		return nil, err
+	}
+	return tmpl, nil
+}
+
+// plainUploadBody is the url of stored, or response_template filled in.
+func plainUploadBody(r *http.Request, cfg *config, stored storedFile) (string, error) {
+	url := publicURL(r, cfg, stored.Rel)
+	if cfg.responseTemplate == nil {
+		return url, nil
+	}
+	var body strings.Builder
+	err := cfg.responseTemplate.Execute(&body, uploadTemplateData{
+		URL:          url,
+		Path:         stored.Rel,
+		Filename:     path.Base(stored.Rel),
+		OriginalName: stored.OriginalName,
+		Size:         stored.Size,
+		ContentType:  stored.ContentType,
+		SHA256:       stored.SHA256,
+	})
+	return body.String(), err
+}
+
+// uploadResponse renders the body writeUploadResponse sends.
+func uploadResponse(r *http.Request, cfg *config, stored storedFile) (string, []byte) {
+	url := publicURL(r, cfg, stored.Rel)
+	if responseFormat(r, cfg) == formatShareX {
+		body, _ := json.Marshal(shareXResponse(url))
+		return "application/json", append(body, '\n')
+	}
+	if !prefersJSON(r) {
+		body, err := plainUploadBody(r, cfg, stored)
+		if err != nil {
+			// checked against a sample at load, this is a bug of the template
+			slog.ErrorContext(r.Context(), "fail to render response_template", "path", stored.Rel, "err", err)
+			body = url
+		}
+		return "text/plain; charset=utf-8", []byte(body)
+	}
+	body, _ := json.Marshal(map[string]any{
+		"url":       url,
+		"path":      stored.Rel,
+		"size":      stored.Size,
+		"disk_size": stored.DiskSize,
+		"sha256":    stored.SHA256,
+		"tags":      append([]string{}, stored.Tags...),
+		"private":   stored.Private,
+	})
+	return "application/json", append(body, '\n')
+}
+
+// bodyAborted reports whether err is a request body cut short by
+// max_upload_size, min_upload_rate, upload_timeout or the quota, which
+// writeStoreError answers.
+func bodyAborted(err error) bool {
+	var tooLarge *http.MaxBytesError
+	var stalled stallError
+	var overQuota quotaError
+	return errors.As(err, &tooLarge) || errors.As(err, &stalled) || errors.As(err, &overQuota)
+}
+
+// writeStoreError answers a failed storeUpload.
+func (s *Server) writeStoreError(w http.ResponseWriter, r *http.Request, err error) {
+	var mismatch digestMismatchError
+	if errors.As(err, &mismatch) {
+		writeError(w, r, http.StatusUnprocessableEntity, string(mismatch))
+		return
+	}
+	var blocked blockedError
+	if errors.As(err, &blocked) {
+		slog.WarnContext(r.Context(), "blocked upload", "sha256", string(blocked), "remote_addr", r.RemoteAddr)
+		s.auditLog.blocked(r, string(blocked))
+		writeError(w, r, http.StatusUnavailableForLegalReasons, "The content is not allowed")
+		return
+	}
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		writeError(w, r, http.StatusRequestEntityTooLarge, fmt.Sprintf("At most %d bytes", tooLarge.Limit))
+		return
+	}
+	var stalled stallError
+	if errors.As(err, &stalled) {
+		w.Header().Set("Connection", "close")
+		writeError(w, r, http.StatusRequestTimeout, string(stalled))
+		return
+	}
+	var overQuota quotaError
+	if errors.As(err, &overQuota) {
+		w.Header().Set("Retry-After", strconv.Itoa(int(time.Until(overQuota.reset).Seconds())+1))
+		writeError(w, r, http.StatusTooManyRequests, overQuota.Error())
+		return
+	}
+	slog.ErrorContext(r.Context(), "fail to store upload", "err", err)
+	writeError(w, r, http.StatusInternalServerError, "")
+}
+
+// storedContent is a stored file opened for reading its plain content.
+type storedContent interface {
+	io.ReadSeekCloser
+	Size() int64
+}
+
+// plainContent is a stored file that isn't encrypted.
+type plainContent struct {
+	*os.File
+	size int64
+}
+
+func (p plainContent) Size() int64 {
+	return p.size
+}
+
+// diskNames are the names a stored file served as name can have on disk:
+// itself, encrypted, compressed, or compressed and encrypted.
+func diskNames(name string) []string {
+	names := []string{name, encryptedName(name)}
+	if _, compressed := storedName(name + compressedSuffix); compressed {
+		names = append(names, name+compressedSuffix, encryptedName(name+compressedSuffix))
+	}
+	return names
+}
+
+// findStored returns the file on disk holding the stored path, the first of
+// its diskNames that exists, and whether it is compressed.
+func findStored(path string) (string, bool, error) {
+	dir, name := filepath.Split(path)
+	for _, diskName := range diskNames(name) {
+		info, err := os.Stat(dir + diskName)
+		if err == nil && info.Mode().IsRegular() {
+			return dir + diskName, strings.HasPrefix(diskSuffix(diskName, name), compressedSuffix), nil
+		}
+		if err != nil && !os.IsNotExist(err) {
+			return "", false, err
+		}
+	}
+	return "", false, os.ErrNotExist
+}
+
+// diskSuffix is what the name on disk diskPath adds to the stored path, so
+// a move of the file keeps it compressed and encrypted.
+func diskSuffix(diskPath, path string) string {
+	return strings.TrimPrefix(filepath.Base(diskPath), filepath.Base(path))
+}
+
+// removeDiskNames removes path under every one of its diskNames but keep.
+func removeDiskNames(path, keep string) error {
+	dir, name := filepath.Split(path)
+	for _, diskName := range diskNames(name) {
+		if dir+diskName == keep {
+			continue
+		}
+		err := os.Remove(dir + diskName)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// openStored opens a stored file for reading its original content: path,
+// or the file findStored finds for it, decrypted when its name says it is
+// encrypted and unpacked when it is compressed.
+func openStored(cfg *config, path string) (storedContent, os.FileInfo, error) {
+	diskPath, compressed, err := findStored(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	raw, rawInfo, err := openStoredFile(cfg, diskPath)
+	if err != nil || !compressed {
+		return raw, rawInfo, err
+	}
+	gunzip, err := newGunzipContent(raw)
+	if err != nil {
+		raw.Close()
+		return nil, nil, fmt.Errorf("%s: %w", diskPath, err)
+	}
+	return gunzip, plainInfo{rawInfo, filepath.Base(path), gunzip.Size()}, nil
+}
+
+// openStoredFile opens path itself, decrypting it when decryptedName says
+// it is encrypted. The content never decides it, an upload could start
+// like an encrypted file.
+func openStoredFile(cfg *config, path string) (storedContent, os.FileInfo, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	info, err := file.Stat()
+	if err == nil && !info.Mode().IsRegular() {
+		err = os.ErrNotExist
+	}
+	if err != nil {
+		file.Close()
+		return nil, nil, err
+	}
+	name, encrypted := decryptedName(info.Name())
+	if !encrypted {
+		return plainContent{file, info.Size()}, info, nil
+	}
+	header := make([]byte, encryptHeaderSize)
+	_, err = io.ReadFull(file, header)
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) || (err == nil && !bytes.Equal(header[:8], []byte(encryptMagic))) {
+		err = errCorruptEncrypted
+	}
+	var content *decryptReader
+	if err == nil {
+		content, err = newDecryptReader(cfg.keys, file, header, info.Size())
+	}
+	if err != nil {
+		file.Close()
+		return nil, nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return content, plainInfo{info, name, content.Size()}, nil
+}
+
+// readStored reads the whole original content of a stored file.
+func readStored(cfg *config, path string) ([]byte, error) {
+	content, _, err := openStored(cfg, path)
+	if err != nil {
+		return nil, err
+	}
+	defer content.Close()
+	return io.ReadAll(content)
+}
+
+// statStored is os.Stat with the original size of encrypted and compressed
+// files.
+func statStored(cfg *config, path string) (os.FileInfo, error) {
+	content, info, err := openStored(cfg, path)
+	if err != nil {
+		return nil, err
+	}
+	content.Close()
+	return info, nil
+}
+
+// plainInfo reports the name and size of the original content of an
+// encrypted or compressed file.
+type plainInfo struct {
+	os.FileInfo
+	name string
+	size int64
+}
+
+func (i plainInfo) Name() string {
+	return i.name
+}
+func (i plainInfo) Size() int64 {
+	return i.size
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+const (
+	maxTags      = 16
+	maxTagLength = 64
+)
+
+// parseTags reads the repeated "tag" form field and the comma separated
+// "tags" field. Tags are labels only and never reach the storage path.
+func parseTags(r *http.Request) ([]string, error) {
+	var values []string
+	if r.MultipartForm != nil {
+		values = append(values, r.MultipartForm.Value["tag"]...)
+		for _, list := range r.MultipartForm.Value["tags"] {
+			values = append(values, strings.Split(list, ",")...)
+		}
+	}
+	var tags []string
+	seen := map[string]bool{}
+	for _, tag := range values {
+		tag = strings.TrimSpace(tag)
+		if len(tag) == 0 || seen[tag] {
+			continue
+		}
+		if !validTag(tag) {
+			return nil, fmt.Errorf("invalid tag %q, tags are at most %d of A-Z a-z 0-9 and . _ - = :", tag, maxTagLength)
+		}
+		seen[tag] = true
+		tags = append(tags, tag)
+	}
+	if len(tags) > maxTags {
+		return nil, fmt.Errorf("at most %d tags per file", maxTags)
+	}
+	return tags, nil
+}
+func validTag(tag string) bool {
+	if len(tag) == 0 || len(tag) > maxTagLength {
+		return false
+	}
+	for _, c := range tag {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case strings.ContainsRune("._-=:", c):
+		default:
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestTags(t *testing.T) {
+	cfg := testConfig(t, "database: "+filepath.Join(t.TempDir(), "files.db")+"\nadmin_username: admin\nadmin_password: secret\n")
+	routes := testServer(t, cfg).Routes()
+	shot := downloadPath(t, testUpload(t, routes, "shot.png", "png", map[string]string{"tags": "project=alpha, kind=screenshot,project=alpha"}))
+	notes := downloadPath(t, testUpload(t, routes, "notes.txt", "notes", map[string]string{"tag": "project=alpha"}))
+	if strings.Contains(shot, "alpha") || strings.Contains(shot, "screenshot") {
+		t.Errorf("a tag reached the url %s", shot)
+	}
+	if res := testUpload(t, routes, "bad.txt", "bad", map[string]string{"tag": "a b"}); res.Code != http.StatusBadRequest {
+		t.Errorf("invalid tag: status %d", res.Code)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/api/search?tag=kind=screenshot", nil)
+	req.SetBasicAuth("u", "p")
+	res := httptest.NewRecorder()
+	routes.ServeHTTP(res, req)
+	var found struct {
+		Results []searchResult `json:"results"`
+	}
+	json.Unmarshal(res.Body.Bytes(), &found)
+	if len(found.Results) != 1 || !slices.Equal(found.Results[0].Tags, []string{"kind=screenshot", "project=alpha"}) {
+		t.Errorf("search by tag: %s", res.Body)
+	}
+	for query, want := range map[string]int{
+		"tag=project=alpha":                     2,
+		"tag=project=alpha&tag=kind=screenshot": 1,
+		"tag=project=beta":                      0,
+	} {
+		if _, total := searchPaths(t, routes, query); total != want {
+			t.Errorf("%s: %d found, want %d", query, total, want)
+		}
+	}
+
+	req = httptest.NewRequest(http.MethodPost, "/admin/delete?tag=kind=screenshot", nil)
+	req.SetBasicAuth("admin", "secret")
+	res = httptest.NewRecorder()
+	routes.ServeHTTP(res, req)
+	if res.Code != http.StatusOK {
+		t.Fatalf("delete by tag: status %d: %s", res.Code, res.Body)
+	}
+	for path, want := range map[string]int{shot: http.StatusNotFound, notes: http.StatusOK} {
+		res := httptest.NewRecorder()
+		routes.ServeHTTP(res, httptest.NewRequest(http.MethodGet, path, nil))
+		if res.Code != want {
+			t.Errorf("%s after the delete: status %d, want %d", path, res.Code, want)
+		}
+	}
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// throttleChunk is how much of a download is written per wait, small enough
+// for a steady rate and for never holding more of a file than that.
+const throttleChunk = 32 << 10
+
+// egressWindow is the seconds the egress rate is averaged over.
+const egressWindow = 5
+
+// rateLimiter spaces writes to rate bytes per second. Each write reserves
+// its slot right away and waits for it, so concurrent writers queue up
+// instead of bursting. Time left unused is not saved up.
+type rateLimiter struct {
+	mu   sync.Mutex
+	rate int64
+	// next is when the bytes reserved so far have been sent.
+	next time.Time
+}
+
+func newRateLimiter(rate int64) *rateLimiter {
+	return &rateLimiter{rate: rate}
+}
+
+// reserve books n bytes and returns how long to wait before sending them.
+func (l *rateLimiter) reserve(n int) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	if l.next.Before(now) {
+		l.next = now
+	}
+	l.next = l.next.Add(time.Duration(int64(n) * int64(time.Second) / l.rate))
+	return l.next.Sub(now)
+}
+
+// throttledWriter sends a download at most as fast as each of its limiters
+// allows, and counts it in egress.
+type throttledWriter struct {
+	http.ResponseWriter
+	ctx      context.Context
+	limiters []*rateLimiter
+	egress   *egressMeter
+}
+
+// throttle wraps w with the configured limits, without any it only counts.
+// The download is active in egress until egress.finished.
+func (s *Server) throttle(w http.ResponseWriter, r *http.Request) *throttledWriter {
+	s.egress.active.Add(1)
+	t := &throttledWriter{ResponseWriter: w, ctx: r.Context(), egress: s.egress}
+	if s.cfg.RequestDownloadRate > 0 {
+		t.limiters = append(t.limiters, newRateLimiter(int64(s.cfg.RequestDownloadRate)))
+	}
+	if s.downloadLimit != nil {
+		t.limiters = append(t.limiters, s.downloadLimit)
+	}
+	return t
+}
+
+func (t *throttledWriter) Write(p []byte) (int, error) {
+	if len(t.limiters) == 0 {
+		n, err := t.ResponseWriter.Write(p)
+		t.egress.add(n)
+		return n, err
+	}
+	written := 0
+	for len(p) > 0 {
+		chunk := p[:min(len(p), throttleChunk)]
+		// the own limit first, a slow client doesn't hold shared slots
+		for _, limiter := range t.limiters {
+			err := sleepContext(t.ctx, limiter.reserve(len(chunk)))
+			if err != nil {
+				return written, err
+			}
+		}
+		n, err := t.ResponseWriter.Write(chunk)
+		written += n
+		t.egress.add(n)
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
+
+func (t *throttledWriter) Flush() {
+	if flusher, ok := t.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (t *throttledWriter) Unwrap() http.ResponseWriter {
+	return t.ResponseWriter
+}
+
+// sleepContext waits for d or until ctx is done.
+func sleepContext(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// egressMeter keeps the bytes sent in each of the last seconds.
+type egressMeter struct {
+	mu      sync.Mutex
+	bytes   [egressWindow + 1]int64
+	seconds [egressWindow + 1]int64
+	active  atomic.Int64
+}
+
+func (m *egressMeter) add(n int) {
+	now := time.Now().Unix()
+	i := now % int64(len(m.bytes))
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.seconds[i] != now {
+		m.seconds[i], m.bytes[i] = now, 0
+	}
+	m.bytes[i] += int64(n)
+}
+
+func (m *egressMeter) finished() {
+	m.active.Add(-1)
+}
+
+// rate is the bytes per second of the last full seconds.
+func (m *egressMeter) rate() int64 {
+	now := time.Now().Unix()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var sum int64
+	for i, second := range m.seconds {
+		if second < now && second >= now-egressWindow {
+			sum += m.bytes[i]
+		}
+	}
+	return sum / egressWindow
+}
+
+type egressStats struct {
+	BytesPerSecond int64 `json:"bytes_per_second"`
+	// Active is the downloads being served.
+	Active                 int64 `json:"active"`
+	MaxDownloadRate        int64 `json:"max_download_rate"`
+	PerRequestDownloadRate int64 `json:"per_request_download_rate"`
+}
+
+func (m *egressMeter) stats(cfg *config) egressStats {
+	return egressStats{
+		BytesPerSecond:         m.rate(),
+		Active:                 m.active.Load(),
+		MaxDownloadRate:        int64(cfg.MaxDownloadRate),
+		PerRequestDownloadRate: int64(cfg.RequestDownloadRate),
+	}
+}
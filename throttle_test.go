@@ -0,0 +1,81 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	limiter := newRateLimiter(1 << 20)
+	var wait time.Duration
+	for range 32 {
+		wait = limiter.reserve(throttleChunk)
+	}
+	// 32 chunks of 32KB are a second at 1MB/s, the first one waits too
+	if wait < 900*time.Millisecond || wait > time.Second {
+		t.Errorf("the last of 1MB waits %v at 1MB/s", wait)
+	}
+}
+
+func TestThrottledDownload(t *testing.T) {
+	cfg := testConfig(t, "per_request_download_rate: 1MB/s\nmax_download_rate: 2MB/s\n")
+	server := testServer(t, cfg)
+	routes := server.Routes()
+	content := strings.Repeat("x", 256<<10)
+	writeDayFile(t, cfg, "large.bin", content)
+	get := func(header ...string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/i/2026/10/14/large.bin", nil)
+		for i := 0; i+1 < len(header); i += 2 {
+			req.Header.Set(header[i], header[i+1])
+		}
+		res := httptest.NewRecorder()
+		routes.ServeHTTP(res, req)
+		return res
+	}
+
+	start := time.Now()
+	if res := get(); res.Code != http.StatusOK || res.Body.String() != content {
+		t.Fatalf("throttled download: status %d, %d bytes", res.Code, res.Body.Len())
+	}
+	if elapsed := time.Since(start); elapsed < 200*time.Millisecond {
+		t.Errorf("256KB at 1MB/s took %v", elapsed)
+	}
+	if res := get("Range", "bytes=10-19"); res.Code != http.StatusPartialContent || res.Body.String() != content[10:20] {
+		t.Errorf("throttled range: status %d: %q", res.Code, res.Body)
+	}
+
+	// three downloads share the 2MB/s
+	start = time.Now()
+	var wg sync.WaitGroup
+	for range 3 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			get()
+		}()
+	}
+	wg.Wait()
+	if elapsed := time.Since(start); elapsed < 300*time.Millisecond {
+		t.Errorf("768KB at 2MB/s took %v", elapsed)
+	}
+	if active := server.egress.stats(cfg).Active; active != 0 {
+		t.Errorf("%d downloads still active", active)
+	}
+}
+
+func TestEgressRate(t *testing.T) {
+	var meter egressMeter
+	now := time.Now().Unix()
+	for second := now - egressWindow - 1; second <= now; second++ {
+		i := second % int64(len(meter.bytes))
+		meter.seconds[i], meter.bytes[i] = second, 1000
+	}
+	// the window's full seconds, not the one going on nor the one before
+	if rate := meter.rate(); rate != 1000 {
+		t.Errorf("rate %d, want 1000", rate)
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const tracerName = "file"
+
+// tracer is nil unless otel_enabled is set, every span helper checks that
+// first and does nothing else when tracing is off.
+var tracer trace.Tracer
+
+// tracePropagator reads incoming W3C traceparent and tracestate headers.
+var tracePropagator = propagation.TraceContext{}
+
+// setupTracing exports spans over OTLP/HTTP, configured by the standard
+// OTEL_EXPORTER_OTLP_*, OTEL_SERVICE_NAME, OTEL_RESOURCE_ATTRIBUTES and
+// OTEL_TRACES_SAMPLER variables. The returned function flushes pending
+// spans.
+func setupTracing(ctx context.Context) (func(context.Context) error, error) {
+	exporter, err := otlptracehttp.New(ctx)
+	if err != nil {
+		return nil, err
+	}
+	// the environment overrides the default service name
+	res, err := resource.New(ctx,
+		resource.WithAttributes(attribute.String("service.name", "file"), attribute.String("service.version", version)),
+		resource.WithFromEnv(),
+		resource.WithTelemetrySDK(),
+	)
+	if err != nil {
+		return nil, err
+	}
+	provider := sdktrace.NewTracerProvider(sdktrace.WithBatcher(exporter), sdktrace.WithResource(res))
+	otel.SetTracerProvider(provider)
+	tracer = provider.Tracer(tracerName)
+	return provider.Shutdown, nil
+}
+
+// tracing starts a server span for every routed request, as a child of the
+// caller's span when the request carries one.
+func tracing(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if tracer == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		name := r.Method
+		if route := mux.CurrentRoute(r); route != nil {
+			if template, err := route.GetPathTemplate(); err == nil {
+				name += " " + template
+			}
+		}
+		ctx := tracePropagator.Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		ctx, span := tracer.Start(ctx, name, trace.WithSpanKind(trace.SpanKindServer), trace.WithAttributes(
+			attribute.String("http.request.method", r.Method),
+			attribute.String("url.path", r.URL.Path),
+			attribute.String("client.address", r.RemoteAddr),
+			attribute.String("request.id", requestInfoOf(r).ID),
+		))
+		defer span.End()
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(recorder, r.WithContext(ctx))
+		span.SetAttributes(attribute.Int("http.response.status_code", recorder.status), attribute.Int64("http.response.body.size", recorder.written))
+		if recorder.status >= http.StatusInternalServerError {
+			span.SetStatus(codes.Error, http.StatusText(recorder.status))
+		}
+	})
+}
+
+// statusRecorder remembers the status and body size of a response.
+type statusRecorder struct {
+	http.ResponseWriter
+	status      int
+	written     int64
+	wroteHeader bool
+}
+
+func (s *statusRecorder) WriteHeader(code int) {
+	if !s.wroteHeader {
+		s.status = code
+		s.wroteHeader = code >= 200
+	}
+	s.ResponseWriter.WriteHeader(code)
+}
+func (s *statusRecorder) Write(p []byte) (int, error) {
+	s.wroteHeader = true
+	n, err := s.ResponseWriter.Write(p)
+	s.written += int64(n)
+	return n, err
+}
+
+// Unwrap lets http.ResponseController reach the connection.
+func (s *statusRecorder) Unwrap() http.ResponseWriter {
+	return s.ResponseWriter
+}
+
+// phase is a span around one phase of a request, nil when tracing is off.
+type phase struct {
+	span trace.Span
+}
+
+// startPhase starts a child span of the request's span.
+func startPhase(ctx context.Context, name string) (context.Context, *phase) {
+	if tracer == nil {
+		return ctx, nil
+	}
+	ctx, span := tracer.Start(ctx, name)
+	return ctx, &phase{span}
+}
+func (p *phase) setInt(key string, value int64) {
+	if p != nil {
+		p.span.SetAttributes(attribute.Int64(key, value))
+	}
+}
+func (p *phase) setString(key, value string) {
+	if p != nil {
+		p.span.SetAttributes(attribute.String(key, value))
+	}
+}
+func (p *phase) setBool(key string, value bool) {
+	if p != nil {
+		p.span.SetAttributes(attribute.Bool(key, value))
+	}
+}
+
+// end finishes the span, marking it failed when err isn't nil.
+func (p *phase) end(err error) {
+	if p == nil {
+		return
+	}
+	if err != nil {
+		p.span.RecordError(err)
+		p.span.SetStatus(codes.Error, err.Error())
+	}
+	p.span.End()
+}
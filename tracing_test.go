@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestTracingSpans(t *testing.T) {
+	cfg := testConfig(t, "")
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	tracer = provider.Tracer(tracerName)
+	t.Cleanup(func() { tracer = nil })
+	r := testServer(t, cfg).Routes()
+
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	part, _ := form.CreateFormFile("file", "notes.txt")
+	io.WriteString(part, "hello tracing")
+	form.Close()
+	req := httptest.NewRequest(http.MethodPost, "/upload", &body)
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	req.SetBasicAuth("u", "p")
+	res := httptest.NewRecorder()
+	r.ServeHTTP(res, req)
+	if res.Code != http.StatusCreated {
+		t.Fatalf("upload status %d: %s", res.Code, res.Body)
+	}
+	url := res.Body.String()
+	res = httptest.NewRecorder()
+	r.ServeHTTP(res, httptest.NewRequest(http.MethodGet, url[strings.Index(url, "/i/"):], nil))
+	if res.Code != http.StatusOK || res.Body.String() != "hello tracing" {
+		t.Fatalf("download status %d: %s", res.Code, res.Body)
+	}
+
+	spans := map[string]sdktrace.ReadOnlySpan{}
+	for _, span := range recorder.Ended() {
+		spans[span.Name()] = span
+	}
+	for _, name := range []string{"POST /upload", "upload.auth", "upload.parse", "upload.write", "upload.hash", "GET /i/" + storedFileRoute, "download.stat", "download.serve"} {
+		if _, ok := spans[name]; !ok {
+			t.Errorf("no %q span, got %v", name, recorder.Ended())
+		}
+	}
+	upload := spans["POST /upload"]
+	if upload == nil {
+		t.FailNow()
+	}
+	if got := upload.Parent().TraceID().String(); got != "4bf92f3577b34da6a3ce929d0e0e4736" {
+		t.Errorf("upload span has trace %s, want the traceparent one", got)
+	}
+	if got := spanAttribute(upload, "http.response.status_code"); got.AsInt64() != http.StatusCreated {
+		t.Errorf("upload status_code %v", got)
+	}
+	write := spans["upload.write"]
+	if write.Parent().SpanID() != upload.SpanContext().SpanID() {
+		t.Errorf("upload.write isn't a child of the request span")
+	}
+	if got := spanAttribute(write, "file.size"); got.AsInt64() != int64(len("hello tracing")) {
+		t.Errorf("upload.write file.size %v", got)
+	}
+	if got := spanAttribute(write, "file.content_type"); got.AsString() != "text/plain; charset=utf-8" {
+		t.Errorf("upload.write file.content_type %v", got)
+	}
+	serve := spans["download.serve"]
+	if got := spanAttribute(serve, "file.size"); got.AsInt64() != int64(len("hello tracing")) {
+		t.Errorf("download.serve file.size %v", got)
+	}
+}
+
+func spanAttribute(span sdktrace.ReadOnlySpan, key string) attribute.Value {
+	for _, attr := range span.Attributes() {
+		if string(attr.Key) == key {
+			return attr.Value
+		}
+	}
+	return attribute.Value{}
+}
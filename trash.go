@@ -0,0 +1,284 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// trashDir keeps the files deleted with trash_retention, below UploadDir
+// at their own path. As a dot directory no listing, walk or WebDAV client
+// sees it.
+const trashDir = ".trash"
+
+// trashInfoSuffix names the sidecar of a trashed file, uuid.ext.trashinfo.
+const trashInfoSuffix = ".trashinfo"
+
+// trashEntry is the sidecar of a trashed file: when it was deleted and,
+// with the database, its record for restoring.
+type trashEntry struct {
+	TrashedAt time.Time   `json:"trashed_at"`
+	Record    *fileRecord `json:"record,omitempty"`
+}
+
+func trashPath(cfg *config, rel string) string {
+	return filepath.Join(cfg.UploadDir, trashDir, filepath.FromSlash(rel))
+}
+
+// removeStored deletes diskPath, the file of rel, or moves it to the trash
+// with its sidecar when trash_retention is set.
+func (s *Server) removeStored(rel, diskPath string) error {
+	cfg := s.cfg
+	if cfg.TrashRetention <= 0 {
+		return os.Remove(diskPath)
+	}
+	entry := trashEntry{TrashedAt: time.Now().UTC()}
+	if s.metaIndex != nil {
+		record, found, err := s.metaIndex.lookupPath(rel)
+		if err != nil {
+			return err
+		}
+		if found {
+			entry.Record = &record
+		}
+	}
+	err := mkdirAllMode(cfg.UploadDir, path.Join(trashDir, path.Dir(rel)), os.FileMode(cfg.DirMode))
+	if err != nil {
+		return err
+	}
+	target := trashPath(cfg, rel)
+	data, _ := json.Marshal(entry)
+	err = os.WriteFile(target+trashInfoSuffix, data, os.FileMode(cfg.FileMode))
+	if err != nil {
+		return err
+	}
+	target += diskSuffix(diskPath, target)
+	err = os.Rename(diskPath, target)
+	if err != nil {
+		os.Remove(trashPath(cfg, rel) + trashInfoSuffix)
+	}
+	return err
+}
+
+// readTrashEntry reads the sidecar of a trashed rel.
+func readTrashEntry(cfg *config, rel string) (trashEntry, error) {
+	var entry trashEntry
+	data, err := os.ReadFile(trashPath(cfg, rel) + trashInfoSuffix)
+	if err != nil {
+		return entry, err
+	}
+	err = json.Unmarshal(data, &entry)
+	return entry, err
+}
+
+// trashed reports whether rel is in the trash, for answering 410.
+func trashed(cfg *config, rel string) bool {
+	if cfg.TrashRetention <= 0 {
+		return false
+	}
+	_, err := os.Stat(trashPath(cfg, rel) + trashInfoSuffix)
+	return err == nil
+}
+
+// trashedFile is a file of the trash, found by its sidecar.
+type trashedFile struct {
+	rel      string
+	diskPath string
+	info     os.FileInfo
+	entry    trashEntry
+}
+
+// walkTrash calls fn for every trashed file below the slash separated dir
+// of the trash, "" for all of it. Sidecars that can't be read are skipped.
+func walkTrash(cfg *config, dir string, fn func(trashedFile) error) error {
+	root := filepath.Join(cfg.UploadDir, trashDir)
+	err := filepath.WalkDir(filepath.Join(root, filepath.FromSlash(dir)), func(name string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() || !strings.HasSuffix(name, trashInfoSuffix) {
+			return err
+		}
+		relPath, err := filepath.Rel(root, strings.TrimSuffix(name, trashInfoSuffix))
+		if err != nil {
+			return err
+		}
+		rel := filepath.ToSlash(relPath)
+		entry, err := readTrashEntry(cfg, rel)
+		if err != nil {
+			slog.Warn("skip unreadable trash entry", "path", rel, "err", err)
+			return nil
+		}
+		diskPath, _, err := findStored(trashPath(cfg, rel))
+		var info os.FileInfo
+		if err == nil {
+			info, err = os.Stat(diskPath)
+		}
+		if err != nil {
+			// the sidecar of a file purged halfway
+			os.Remove(name)
+			return nil
+		}
+		return fn(trashedFile{rel: rel, diskPath: diskPath, info: info, entry: entry})
+	})
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// purgeTrash deletes the trashed files older than trash_retention for good.
+func purgeTrash(cfg *config) (int, error) {
+	cutoff := time.Now().Add(-time.Duration(cfg.TrashRetention))
+	purged := 0
+	err := walkTrash(cfg, "", func(file trashedFile) error {
+		if file.entry.TrashedAt.After(cutoff) {
+			return nil
+		}
+		err := os.Remove(file.diskPath)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		os.Remove(trashPath(cfg, file.rel) + trashInfoSuffix)
+		os.Remove(filepath.Dir(file.diskPath))
+		purged++
+		return nil
+	})
+	return purged, err
+}
+
+// runTrashJanitor purges the trash at the start and then hourly, or every
+// trash_retention when it is shorter, forever.
+func runTrashJanitor(cfg *config) {
+	interval := min(time.Duration(cfg.TrashRetention), time.Hour)
+	for {
+		purged, err := purgeTrash(cfg)
+		if err != nil {
+			slog.Error("fail to purge the trash", "err", err)
+		} else if purged != 0 {
+			slog.Info("trash purged", "files", purged)
+		}
+		time.Sleep(interval)
+	}
+}
+
+// trashTotals counts what the trash holds, for /api/stats.
+type trashTotals struct {
+	Files     int   `json:"files"`
+	Bytes     int64 `json:"bytes"`
+	DiskBytes int64 `json:"disk_bytes"`
+}
+
+func countTrash(cfg *config) (trashTotals, error) {
+	var totals trashTotals
+	err := walkTrash(cfg, "", func(file trashedFile) error {
+		totals.Files++
+		totals.Bytes += logicalSize(cfg, filepath.Dir(file.diskPath), file.info)
+		totals.DiskBytes += file.info.Size()
+		return nil
+	})
+	return totals, err
+}
+
+// deleteFileHandler deletes one file of the client's namespace, into the
+// trash with trash_retention.
+func (s *Server) deleteFileHandler(w http.ResponseWriter, r *http.Request) {
+	err := s.basicAuth(r)
+	if err != nil {
+		s.writeAuthError(w, r, err)
+		return
+	}
+	rel := routeRel(mux.Vars(r))
+	if !inNamespace(s.cfg, requestNamespace(r, s.cfg), rel) {
+		notFoundHandler(w, r)
+		return
+	}
+	result, err := s.deleteFiles([]string{rel})
+	s.auditLog.deleted(r, result.removed)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "fail to delete", "path", rel, "err", err)
+		writeError(w, r, http.StatusInternalServerError, "")
+		return
+	}
+	if result.Files == 0 {
+		notFoundHandler(w, r)
+		return
+	}
+	writeJSON(w, http.StatusOK, result)
+}
+
+// restoreHandler moves a trashed file back to its path, with its record
+// when it had one, so its url works again.
+func (s *Server) restoreHandler(w http.ResponseWriter, r *http.Request) {
+	err := s.basicAuth(r)
+	if err != nil {
+		s.writeAuthError(w, r, err)
+		return
+	}
+	cfg := s.cfg
+	rel := routeRel(mux.Vars(r))
+	filePath, ok := storedRelPath(cfg, rel)
+	if !ok || cfg.TrashRetention <= 0 || !inNamespace(cfg, requestNamespace(r, cfg), rel) {
+		notFoundHandler(w, r)
+		return
+	}
+	entry, err := readTrashEntry(cfg, rel)
+	var trashedPath string
+	if err == nil {
+		trashedPath, _, err = findStored(trashPath(cfg, rel))
+	}
+	if os.IsNotExist(err) {
+		writeError(w, r, http.StatusNotFound, "The file is not in the trash")
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "fail to read the trash", "path", rel, "err", err)
+		writeError(w, r, http.StatusInternalServerError, "")
+		return
+	}
+	if _, _, err := findStored(filePath); err == nil {
+		writeError(w, r, http.StatusConflict, "The file exists again")
+		return
+	}
+	target := filePath + diskSuffix(trashedPath, filePath)
+	err = mkdirAllMode(cfg.UploadDir, path.Dir(rel), os.FileMode(cfg.DirMode))
+	if err == nil {
+		err = os.Rename(trashedPath, target)
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "fail to restore", "path", rel, "err", err)
+		writeError(w, r, http.StatusInternalServerError, "")
+		return
+	}
+	os.Remove(trashPath(cfg, rel) + trashInfoSuffix)
+	os.Remove(filepath.Dir(trashedPath))
+	info, err := statStored(cfg, filePath)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "fail to stat the restored file", "path", rel, "err", err)
+		writeError(w, r, http.StatusInternalServerError, "")
+		return
+	}
+	record := fileRecord{
+		Path:         rel,
+		OriginalName: info.Name(),
+		Size:         info.Size(),
+		ContentType:  contentTypeOf(info.Name()),
+		UploadedAt:   info.ModTime().UTC(),
+	}
+	if entry.Record != nil {
+		record = *entry.Record
+		s.indexStored(record)
+	}
+	if raw, err := os.Stat(target); err == nil {
+		s.storageStats.added(rel, info.Size(), raw.Size())
+	}
+	s.replicateStored(rel)
+	s.auditLog.restored(r, rel)
+	writeJSON(w, http.StatusOK, resultOf(r, cfg, record))
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTrash(t *testing.T) {
+	dir := t.TempDir()
+	cfg := testConfig(t, "trash_retention: 1h\nbrowse_enabled: true\ndatabase: "+filepath.Join(dir, "index.db")+"\n")
+	server := testServer(t, cfg)
+	routes := server.Routes()
+	path := downloadPath(t, testUpload(t, routes, "notes.txt", "hello", nil))
+	rel := strings.TrimPrefix(path, "/i/")
+	send := func(method, target string, auth bool) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, nil)
+		req.Header.Set("Accept", "application/json")
+		if auth {
+			req.SetBasicAuth("u", "p")
+		}
+		res := httptest.NewRecorder()
+		routes.ServeHTTP(res, req)
+		return res
+	}
+
+	if res := send(http.MethodDelete, "/api/files/"+rel, false); res.Code != http.StatusUnauthorized {
+		t.Errorf("delete without credentials: status %d", res.Code)
+	}
+	if res := send(http.MethodDelete, "/api/files/"+rel, true); res.Code != http.StatusOK {
+		t.Fatalf("delete status %d: %s", res.Code, res.Body)
+	}
+	if res := send(http.MethodGet, path, false); res.Code != http.StatusGone {
+		t.Errorf("trashed download: status %d", res.Code)
+	}
+	if content, err := os.ReadFile(trashPath(cfg, rel)); err != nil || string(content) != "hello" {
+		t.Errorf("trash holds %q, %v", content, err)
+	}
+	if _, found, _ := server.metaIndex.lookupPath(rel); found {
+		t.Error("a trashed file is still indexed")
+	}
+
+	day := "/browse/" + filepath.ToSlash(filepath.Dir(rel))
+	var listing browseListing
+	json.Unmarshal(send(http.MethodGet, day, true).Body.Bytes(), &listing)
+	if listing.Total != 0 {
+		t.Errorf("listing without the trash has %d files", listing.Total)
+	}
+	json.Unmarshal(send(http.MethodGet, day+"?include_trashed=1", true).Body.Bytes(), &listing)
+	if listing.Total != 1 || !listing.Files[0].Trashed {
+		t.Errorf("listing with the trash: %+v", listing)
+	}
+	var stats struct {
+		Trash *trashTotals `json:"trash"`
+	}
+	json.Unmarshal(send(http.MethodGet, "/api/stats?include_trashed=1", true).Body.Bytes(), &stats)
+	if stats.Trash == nil || stats.Trash.Files != 1 || stats.Trash.Bytes != 5 {
+		t.Errorf("stats with the trash: %+v", stats)
+	}
+
+	if res := send(http.MethodPost, "/api/restore/"+rel, true); res.Code != http.StatusOK {
+		t.Fatalf("restore status %d: %s", res.Code, res.Body)
+	}
+	if res := send(http.MethodGet, path, false); res.Code != http.StatusOK || res.Body.String() != "hello" {
+		t.Errorf("restored download: status %d: %s", res.Code, res.Body)
+	}
+	if record, found, _ := server.metaIndex.lookupPath(rel); !found || record.OriginalName != "notes.txt" {
+		t.Errorf("restored record %+v, found %v", record, found)
+	}
+	if res := send(http.MethodPost, "/api/restore/"+rel, true); res.Code != http.StatusNotFound {
+		t.Errorf("restoring again: status %d", res.Code)
+	}
+}
+
+func TestTrashPurge(t *testing.T) {
+	cfg := testConfig(t, "trash_retention: 1h\n")
+	server := testServer(t, cfg)
+	routes := server.Routes()
+	var rels []string
+	for range 2 {
+		rels = append(rels, strings.TrimPrefix(downloadPath(t, testUpload(t, routes, "notes.txt", "hello", nil)), "/i/"))
+	}
+	if _, err := server.deleteFiles(rels); err != nil {
+		t.Fatal(err)
+	}
+	// the first one was deleted two hours ago
+	data, _ := json.Marshal(trashEntry{TrashedAt: time.Now().Add(-2 * time.Hour)})
+	os.WriteFile(trashPath(cfg, rels[0])+trashInfoSuffix, data, 0o644)
+	purged, err := purgeTrash(cfg)
+	if err != nil || purged != 1 {
+		t.Fatalf("purged %d, %v", purged, err)
+	}
+	if _, err := os.Stat(trashPath(cfg, rels[0])); !os.IsNotExist(err) {
+		t.Errorf("the expired file is still in the trash: %v", err)
+	}
+	if !trashed(cfg, rels[1]) {
+		t.Error("the recent file left the trash")
+	}
+}
+
+func TestDeleteWithoutTrash(t *testing.T) {
+	cfg := testConfig(t, "")
+	routes := testServer(t, cfg).Routes()
+	path := downloadPath(t, testUpload(t, routes, "notes.txt", "hello", nil))
+	req := httptest.NewRequest(http.MethodDelete, "/api/files/"+strings.TrimPrefix(path, "/i/"), nil)
+	req.SetBasicAuth("u", "p")
+	res := httptest.NewRecorder()
+	routes.ServeHTTP(res, req)
+	if res.Code != http.StatusOK {
+		t.Fatalf("delete status %d: %s", res.Code, res.Body)
+	}
+	res = httptest.NewRecorder()
+	routes.ServeHTTP(res, httptest.NewRequest(http.MethodGet, path, nil))
+	if res.Code != http.StatusNotFound || storedFiles(t, cfg) != 0 {
+		t.Errorf("deleted download: status %d, %d files left", res.Code, storedFiles(t, cfg))
+	}
+}
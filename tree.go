@@ -0,0 +1,121 @@
+package main
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const dayLayout = "2006-01-02"
+
+// storedEntry is one stored file found by walkStored.
+type storedEntry struct {
+	// Rel is the slash separated path relative to UploadDir, without the
+	// compressed and encrypted suffixes.
+	Rel string
+	// Path is the file on disk, with its suffixes.
+	Path string
+	Info os.FileInfo
+	// Day is the date of the path, or the day the file was last written
+	// for a custom dir replacing the date path.
+	Day time.Time
+	// Namespace is empty for files outside of any user's namespace.
+	Namespace string
+}
+
+// walkStored calls fn for every stored file below UploadDir in lexical
+// order, the dated ones and those of custom dirs, even when custom dirs
+// have been turned off since. The trash, temp files and anything else that
+// doesn't have the path of a stored file are skipped. It is how everything
+// going through the whole tree finds the files.
+func walkStored(cfg *config, fn func(storedEntry) error) error {
+	root := filepath.Clean(cfg.UploadDir)
+	err := filepath.WalkDir(root, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if strings.HasPrefix(entry.Name(), ".") && path != root {
+			if entry.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !entry.Type().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		name, _ := storedName(entry.Name())
+		rel = filepath.ToSlash(filepath.Join(filepath.Dir(rel), name))
+		parts := strings.Split(rel, "/")
+		dated := datedRel(rel)
+		if !dated && !customRel(cfg, parts) {
+			return nil
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return nil
+		}
+		stored := storedEntry{Rel: rel, Path: path, Info: info}
+		if (dated && len(parts) == 5) || (!dated && cfg.NamespacePerUser && validNamespace(parts[0])) {
+			stored.Namespace = parts[0]
+		}
+		stored.Day, err = time.Parse(dayLayout, relDay(rel))
+		if err != nil {
+			modTime := info.ModTime().UTC()
+			stored.Day = time.Date(modTime.Year(), modTime.Month(), modTime.Day(), 0, 0, 0, 0, time.UTC)
+		}
+		return fn(stored)
+	})
+	return err
+}
+
+// dayFiles lists the regular files of one day directory.
+func dayFiles(dir string) ([]os.FileInfo, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var files []os.FileInfo
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		files = append(files, info)
+	}
+	return files, nil
+}
+
+// parseDayRange parses optional from/to dates (inclusive). Missing bounds
+// are left zero.
+func parseDayRange(from, to string) (time.Time, time.Time, error) {
+	var fromDate, toDate time.Time
+	var err error
+	if len(from) != 0 {
+		fromDate, err = time.Parse(dayLayout, from)
+		if err != nil {
+			return fromDate, toDate, err
+		}
+	}
+	if len(to) != 0 {
+		toDate, err = time.Parse(dayLayout, to)
+		if err != nil {
+			return fromDate, toDate, err
+		}
+	}
+	return fromDate, toDate, nil
+}
+func dayInRange(date, from, to time.Time) bool {
+	return (from.IsZero() || !date.Before(from)) && (to.IsZero() || !date.After(to))
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// parseDuration extends time.ParseDuration with the d (day), w (week) and
+// y (365 days) units commonly used for cache lifetimes, e.g. "1y" or "30d".
+func parseDuration(s string) (time.Duration, error) {
+	s = strings.TrimSpace(s)
+	if len(s) < 2 {
+		return time.ParseDuration(s)
+	}
+	var unit time.Duration
+	switch s[len(s)-1] {
+	case 'd':
+		unit = 24 * time.Hour
+	case 'w':
+		unit = 7 * 24 * time.Hour
+	case 'y':
+		unit = 365 * 24 * time.Hour
+	default:
+		return time.ParseDuration(s)
+	}
+	n, err := strconv.ParseInt(s[:len(s)-1], 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid duration %q", s)
+	}
+	return time.Duration(n) * unit, nil
+}
+
+// byteSize is a size in bytes that may be written in config files either as
+// a plain number or with a binary suffix, e.g. "512MB" or "1.5G".
+type byteSize int64
+
+func (b *byteSize) UnmarshalText(text []byte) error {
+	n, err := parseSize(string(text))
+	if err != nil {
+		return err
+	}
+	*b = byteSize(n)
+	return nil
+}
+func parseSize(s string) (int64, error) {
+	s = strings.ToUpper(strings.TrimSpace(s))
+	number := strings.TrimRight(s, "KMGTIB ")
+	var unit int64 = 1
+	switch strings.TrimSuffix(strings.TrimSuffix(strings.TrimSpace(s[len(number):]), "B"), "I") {
+	case "":
+	case "K":
+		unit = 1 << 10
+	case "M":
+		unit = 1 << 20
+	case "G":
+		unit = 1 << 30
+	case "T":
+		unit = 1 << 40
+	default:
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	n, err := strconv.ParseFloat(number, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return int64(n * float64(unit)), nil
+}
+
+// UnmarshalJSON accepts both a JSON number and a suffixed string.
+func (b *byteSize) UnmarshalJSON(data []byte) error {
+	var n int64
+	if json.Unmarshal(data, &n) == nil {
+		*b = byteSize(n)
+		return nil
+	}
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("size must be a number or a string like \"10MB\"")
+	}
+	return b.UnmarshalText([]byte(s))
+}
+
+// UnmarshalYAML adds the line number yaml.v3 leaves out of
+// TextUnmarshaler errors.
+func (b *byteSize) UnmarshalYAML(node *yaml.Node) error {
+	err := b.UnmarshalText([]byte(node.Value))
+	if err != nil {
+		return fmt.Errorf("line %d: %w", node.Line, err)
+	}
+	return nil
+}
+
+// duration is a time.Duration written in config files as a string like
+// "30m" or "1d".
+type duration time.Duration
+
+func (d *duration) UnmarshalText(text []byte) error {
+	n, err := parseDuration(string(text))
+	if err != nil {
+		return err
+	}
+	*d = duration(n)
+	return nil
+}
+
+// UnmarshalYAML adds the line number like byteSize.UnmarshalYAML.
+func (d *duration) UnmarshalYAML(node *yaml.Node) error {
+	err := d.UnmarshalText([]byte(node.Value))
+	if err != nil {
+		return fmt.Errorf("line %d: %w", node.Line, err)
+	}
+	return nil
+}
+
+// fileMode is a permission mode written in config files as an octal
+// string like "0750".
+type fileMode os.FileMode
+
+func (m *fileMode) UnmarshalText(text []byte) error {
+	n, err := strconv.ParseUint(strings.TrimSpace(string(text)), 8, 32)
+	if err != nil || n > 0o777 {
+		return fmt.Errorf("invalid mode %q, want octal permissions like \"0750\"", text)
+	}
+	*m = fileMode(n)
+	return nil
+}
+
+// UnmarshalYAML reads the scalar as written, so an unquoted 0750 stays
+// octal, and adds the line number like byteSize.UnmarshalYAML.
+func (m *fileMode) UnmarshalYAML(node *yaml.Node) error {
+	err := m.UnmarshalText([]byte(node.Value))
+	if err != nil {
+		return fmt.Errorf("line %d: %w", node.Line, err)
+	}
+	return nil
+}
+
+// byteRate is a transfer rate in bytes per second, written like byteSize
+// with an optional "/s", e.g. "10KB/s".
+type byteRate int64
+
+func (b *byteRate) UnmarshalText(text []byte) error {
+	s := strings.TrimSpace(string(text))
+	if strings.HasSuffix(strings.ToLower(s), "/s") {
+		s = s[:len(s)-2]
+	}
+	n, err := parseSize(s)
+	if err != nil {
+		return fmt.Errorf("invalid rate %q", text)
+	}
+	*b = byteRate(n)
+	return nil
+}
+
+// UnmarshalJSON accepts both a JSON number and a suffixed string.
+func (b *byteRate) UnmarshalJSON(data []byte) error {
+	var n int64
+	if json.Unmarshal(data, &n) == nil {
+		*b = byteRate(n)
+		return nil
+	}
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("rate must be a number or a string like \"10KB/s\"")
+	}
+	return b.UnmarshalText([]byte(s))
+}
+
+// UnmarshalYAML adds the line number like byteSize.UnmarshalYAML.
+func (b *byteRate) UnmarshalYAML(node *yaml.Node) error {
+	err := b.UnmarshalText([]byte(node.Value))
+	if err != nil {
+		return fmt.Errorf("line %d: %w", node.Line, err)
+	}
+	return nil
+}
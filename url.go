@@ -0,0 +1,55 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+// requestBaseURL derives scheme://host from the request itself. The
+// X-Forwarded-Proto of reverse proxies terminating TLS is only believed
+// from trusted_proxies, like X-Forwarded-For, and only as http or https.
+func requestBaseURL(r *http.Request, cfg *config) string {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	remote, _ := parseAddr(r.RemoteAddr)
+	if proto := r.Header.Get("X-Forwarded-Proto"); len(proto) != 0 && containsAddr(cfg.trustedProxies, remote) {
+		proto, _, _ = strings.Cut(proto, ",")
+		switch proto = strings.ToLower(strings.TrimSpace(proto)); proto {
+		case "http", "https":
+			scheme = proto
+		}
+	}
+	return scheme + "://" + r.Host
+}
+
+// publicURL returns the absolute url of a stored file given its path relative
+// to UploadDir, based on base_url or, when unset, the request itself, and
+// route_prefix.
+func publicURL(r *http.Request, cfg *config, rel string) string {
+	return routeURL(r, cfg, joinURL(cfg.AccessPrefix, rel))
+}
+
+// routeURL is the absolute url of a route below route_prefix.
+func routeURL(r *http.Request, cfg *config, route string) string {
+	base := cfg.BaseURL
+	if len(base) == 0 {
+		base = requestBaseURL(r, cfg)
+	}
+	return joinURL(base, cfg.RoutePrefix, route)
+}
+
+// joinURL joins base with path segments so that exactly one slash separates
+// each non-empty part, whatever slashes the parts carry themselves.
+func joinURL(base string, segments ...string) string {
+	url := strings.TrimRight(base, "/")
+	for _, segment := range segments {
+		segment = strings.Trim(segment, "/")
+		if len(segment) == 0 {
+			continue
+		}
+		url += "/" + segment
+	}
+	return url
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+)
+
+func TestPublicURL(t *testing.T) {
+	const rel = "2026/10/14/a.png"
+	for _, test := range []struct {
+		baseURL, accessPrefix, want string
+	}{
+		{"", "", "http://files.local/2026/10/14/a.png"},
+		{"", "i", "http://files.local/i/2026/10/14/a.png"},
+		{"", "/i/", "http://files.local/i/2026/10/14/a.png"},
+		{"https://example.com", "", "https://example.com/2026/10/14/a.png"},
+		{"https://example.com/", "", "https://example.com/2026/10/14/a.png"},
+		{"https://example.com", "i", "https://example.com/i/2026/10/14/a.png"},
+		{"https://example.com/", "/i/", "https://example.com/i/2026/10/14/a.png"},
+		{"https://example.com/files/", "i/", "https://example.com/files/i/2026/10/14/a.png"},
+	} {
+		cfg := &config{BaseURL: test.baseURL, AccessPrefix: test.accessPrefix}
+		req := httptest.NewRequest(http.MethodPost, "/upload", nil)
+		req.Host = "files.local"
+		if got := publicURL(req, cfg, rel); got != test.want {
+			t.Errorf("base_url %q, access_prefix %q: %q, want %q", test.baseURL, test.accessPrefix, got, test.want)
+		}
+	}
+}
+
+func TestForwardedProto(t *testing.T) {
+	cfg := &config{trustedProxies: []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")}}
+	for _, test := range []struct {
+		remote, proto, want string
+	}{
+		{"10.0.0.1:1234", "https", "https://files.local"},
+		{"10.0.0.1:1234", "HTTPS, http", "https://files.local"},
+		{"10.0.0.1:1234", "javascript", "http://files.local"},
+		{"192.0.2.1:1234", "https", "http://files.local"},
+		{"10.0.0.1:1234", "", "http://files.local"},
+	} {
+		req := httptest.NewRequest(http.MethodPost, "/upload", nil)
+		req.Host = "files.local"
+		req.RemoteAddr = test.remote
+		req.Header.Set("X-Forwarded-Proto", test.proto)
+		if got := requestBaseURL(req, cfg); got != test.want {
+			t.Errorf("X-Forwarded-Proto %q from %s: %q, want %q", test.proto, test.remote, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// userConfig is one extra upload account of the users list.
+type userConfig struct {
+	Username string `yaml:"username" json:"username" toml:"username"`
+	Password string `yaml:"password" json:"password" toml:"password"`
+	// Namespace pins the directory of the user's files; it defaults to the
+	// sanitized username, so set it before renaming a user.
+	Namespace string `yaml:"namespace" json:"namespace" toml:"namespace"`
+	// Token is sent as "Authorization: Bearer <token>" instead of the
+	// username and password.
+	Token string `yaml:"token" json:"token" toml:"token"`
+}
+
+// reservedNamespaces would shadow other routes when access_prefix is empty.
+var reservedNamespaces = []string{"admin", "api", "browse", "dav", "paste", "qr", "upload"}
+
+// sanitizeNamespace turns a username into a directory name: lower case
+// letters, digits, "-" and "_", at most 64 long.
+func sanitizeNamespace(username string) string {
+	name := strings.Map(func(c rune) rune {
+		switch {
+		case c >= 'a' && c <= 'z', c >= '0' && c <= '9', c == '-', c == '_':
+			return c
+		case c >= 'A' && c <= 'Z':
+			return c + 'a' - 'A'
+		}
+		return '-'
+	}, username)
+	name = strings.Trim(name, "-_")
+	if len(name) > 64 {
+		name = name[:64]
+	}
+	return name
+}
+
+// validNamespace rejects names that can't be told apart from a year
+// directory or a route.
+func validNamespace(name string) bool {
+	return len(name) != 0 && name == sanitizeNamespace(name) && !isDigits(name, 4) && !slices.Contains(reservedNamespaces, name)
+}
+
+// compileUsers builds cfg.accounts from username/password and the users
+// list, checking names and namespaces are unique.
+func (c *config) compileUsers() []error {
+	var problems []error
+	c.accounts = []userConfig{{Username: c.Username, Password: c.Password, Namespace: c.Namespace, Token: c.Token}}
+	c.accounts = append(c.accounts, c.Users...)
+	usernames := map[string]bool{}
+	tokens := map[string]bool{}
+	namespaces := map[string]string{}
+	for i := range c.accounts {
+		account := &c.accounts[i]
+		if i > 0 && (len(account.Username) == 0 || len(account.Password) == 0) {
+			problems = append(problems, fmt.Errorf("users[%d] needs a username and a password", i-1))
+			continue
+		}
+		if usernames[account.Username] {
+			problems = append(problems, fmt.Errorf("username %q is used twice", account.Username))
+		}
+		usernames[account.Username] = true
+		if len(account.Token) != 0 {
+			if tokens[account.Token] {
+				problems = append(problems, fmt.Errorf("the token of %q is used twice", account.Username))
+			}
+			tokens[account.Token] = true
+		}
+		if len(c.AdminUsername) != 0 && account.Username == c.AdminUsername {
+			problems = append(problems, errors.New("admin_username must differ from every username"))
+		}
+		if !c.NamespacePerUser {
+			continue
+		}
+		if len(account.Namespace) == 0 {
+			account.Namespace = sanitizeNamespace(account.Username)
+		}
+		if !validNamespace(account.Namespace) {
+			problems = append(problems, fmt.Errorf("namespace %q of %q must be lower case letters, digits, - and _, not 4 digits or one of %s, set namespace explicitly", account.Namespace, account.Username, strings.Join(reservedNamespaces, ", ")))
+			continue
+		}
+		if other, ok := namespaces[account.Namespace]; ok {
+			problems = append(problems, fmt.Errorf("%q and %q share the namespace %q", other, account.Username, account.Namespace))
+		}
+		namespaces[account.Namespace] = account.Username
+	}
+	return problems
+}
+
+// authenticate finds the account the request's credentials belong to.
+func (s *Server) authenticate(r *http.Request) (*userConfig, error) {
+	cfg := s.cfg
+	if isBearer(r) {
+		account, ok := bearerAccount(r, cfg)
+		if !ok {
+			return nil, errors.New("invalid token")
+		}
+		return account, nil
+	}
+	username := requestUsername(r, cfg)
+	for i := range cfg.accounts {
+		if cfg.accounts[i].Username == username {
+			account := &cfg.accounts[i]
+			return account, s.checkCredentials(r, account.Username, account.Password)
+		}
+	}
+	return nil, s.checkCredentials(r, cfg.Username, cfg.Password)
+}
+
+// matchesAccount reports whether the request carries valid credentials of
+// any upload account, without using up a Digest nonce.
+func (s *Server) matchesAccount(r *http.Request) bool {
+	cfg := s.cfg
+	if _, ok := bearerAccount(r, cfg); ok {
+		return true
+	}
+	username := requestUsername(r, cfg)
+	for _, account := range cfg.accounts {
+		if account.Username == username {
+			return s.matchesCredentials(r, account.Username, account.Password)
+		}
+	}
+	return false
+}
+
+// requestNamespace is the namespace of an authenticated request, empty
+// unless namespace_per_user is on.
+func requestNamespace(r *http.Request, cfg *config) string {
+	if !cfg.NamespacePerUser {
+		return ""
+	}
+	username := requestUsername(r, cfg)
+	for _, account := range cfg.accounts {
+		if account.Username == username {
+			return account.Namespace
+		}
+	}
+	return ""
+}
+
+// namespaceOf is the namespace segment of a stored path, empty for files
+// stored without namespaces.
+func namespaceOf(rel string) string {
+	first, _, _ := strings.Cut(rel, "/")
+	if isDigits(first, 4) {
+		return ""
+	}
+	return first
+}
+
+// inNamespace reports whether a user of namespace may see rel. With
+// namespace_per_user users only see their own files.
+func inNamespace(cfg *config, namespace, rel string) bool {
+	return !cfg.NamespacePerUser || namespaceOf(rel) == namespace
+}
+
+// isBearer reports whether the request authenticates with a token.
+func isBearer(r *http.Request) bool {
+	return strings.HasPrefix(r.Header.Get("Authorization"), "Bearer ")
+}
+
+// bearerAccount is the account whose token the request carries as
+// "Authorization: Bearer <token>".
+func bearerAccount(r *http.Request, cfg *config) (*userConfig, bool) {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || len(token) == 0 {
+		return nil, false
+	}
+	for i := range cfg.accounts {
+		account := &cfg.accounts[i]
+		if len(account.Token) != 0 && subtle.ConstantTimeCompare([]byte(account.Token), []byte(token)) == 1 {
+			return account, true
+		}
+	}
+	return nil, false
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestNamespaces(t *testing.T) {
+	cfg := testConfig(t, "namespace_per_user: true\nbrowse_enabled: true\nusers:\n  - username: Alice\n    password: a\n  - username: bob\n    password: b\n")
+	routes := testServer(t, cfg).Routes()
+	as := func(username, password, method, target, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		req.SetBasicAuth(username, password)
+		res := httptest.NewRecorder()
+		routes.ServeHTTP(res, req)
+		return res
+	}
+	pasted := as("Alice", "a", http.MethodPost, "/paste", "alice's notes")
+	path := downloadPath(t, pasted)
+	rel := path[len("/i/"):]
+	if !strings.HasPrefix(rel, "alice/") {
+		t.Fatalf("stored at %s, want the namespace alice", rel)
+	}
+	// the download url itself stays public
+	if res := as("bob", "b", http.MethodGet, path, ""); res.Code != http.StatusOK {
+		t.Errorf("download: status %d", res.Code)
+	}
+	for _, test := range []struct {
+		method, target, body string
+	}{
+		{http.MethodGet, "/api/files/" + rel, ""},
+		{http.MethodPatch, "/api/files/" + rel, `{"visibility": "public"}`},
+		{http.MethodDelete, "/api/files/" + rel, ""},
+		{http.MethodPut, path, "bob's notes"},
+	} {
+		if res := as("bob", "b", test.method, test.target, test.body); res.Code != http.StatusNotFound {
+			t.Errorf("bob %s %s: status %d", test.method, test.target, res.Code)
+		}
+	}
+	day := strings.Join(strings.Split(rel, "/")[1:4], "/")
+	for username, password := range map[string]string{"Alice": "a", "bob": "b"} {
+		search := as(username, password, http.MethodGet, "/api/search", "")
+		browse := as(username, password, http.MethodGet, "/browse/"+day, "")
+		mine := username == "Alice"
+		name := rel[strings.LastIndex(rel, "/")+1:]
+		inSearch, inBrowse := strings.Contains(search.Body.String(), rel), strings.Contains(browse.Body.String(), name)
+		if inSearch != mine || inBrowse != mine {
+			t.Errorf("%s sees alice's file in search %v, browse %v", username, inSearch, inBrowse)
+		}
+	}
+	if res := as("Alice", "a", http.MethodGet, path, ""); res.Body.String() != "alice's notes" {
+		t.Errorf("alice's file changed to %q", res.Body)
+	}
+}
+
+func TestReservedNamespaces(t *testing.T) {
+	for _, name := range reservedNamespaces {
+		for _, user := range []string{
+			"username: " + strings.ToUpper(name[:1]) + name[1:] + "\n    password: x\n",
+			"username: someone\n    password: x\n    namespace: " + name + "\n",
+		} {
+			_, err := loadConfigFrom(strings.NewReader("upload_dir: /srv/upload\nusername: u\npassword: p\nport: 8080\nnamespace_per_user: true\nusers:\n  - "+user), ".yaml")
+			if err == nil || !strings.Contains(err.Error(), "namespace") {
+				t.Errorf("%q: %v", user, err)
+			}
+		}
+	}
+	if !slices.Equal(reservedNamespaces, []string{"admin", "api", "browse", "dav", "paste", "qr", "upload"}) {
+		t.Errorf("reserved %v", reservedNamespaces)
+	}
+	if validNamespace("2026") || !validNamespace("alice") {
+		t.Error("a year is a namespace or alice is not")
+	}
+}
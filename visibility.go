@@ -0,0 +1,98 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+
+	"github.com/gorilla/mux"
+)
+
+// parseVisibility reads the visibility field: empty or "public", or
+// "private" for files that need the upload credentials to download.
+// Private files need the database to remember it.
+func (s *Server) parseVisibility(value string) (bool, error) {
+	switch value {
+	case "", "public":
+		return false, nil
+	case "private":
+		if s.metaIndex == nil {
+			return false, fmt.Errorf("private files need the database")
+		}
+		return true, nil
+	}
+	return false, fmt.Errorf("visibility must be public or private")
+}
+
+// fileInfoHandler describes a stored file on GET and changes its
+// visibility on PATCH with a {"visibility": "private"} body.
+func (s *Server) fileInfoHandler(w http.ResponseWriter, r *http.Request) {
+	err := s.basicAuth(r)
+	if err != nil {
+		s.writeAuthError(w, r, err)
+		return
+	}
+	vars := mux.Vars(r)
+	rel := routeRel(vars)
+	filePath, ok := storedRelPath(s.cfg, rel)
+	if !ok || !inNamespace(s.cfg, requestNamespace(r, s.cfg), rel) {
+		notFoundHandler(w, r)
+		return
+	}
+	info, err := statStored(s.cfg, filePath)
+	if err != nil {
+		notFoundHandler(w, r)
+		return
+	}
+	record := fileRecord{
+		Path:         rel,
+		OriginalName: info.Name(),
+		Size:         info.Size(),
+		ContentType:  contentTypeOf(info.Name()),
+		UploadedAt:   info.ModTime().UTC(),
+	}
+	if s.metaIndex != nil {
+		indexed, found, err := s.metaIndex.lookupPath(rel)
+		if err != nil {
+			slog.ErrorContext(r.Context(), "fail to look up", "path", rel, "err", err)
+			writeError(w, r, http.StatusInternalServerError, "")
+			return
+		}
+		if found {
+			record = indexed
+		}
+	}
+	if r.Method == http.MethodPatch {
+		if s.metaIndex == nil {
+			writeError(w, r, http.StatusBadRequest, "Visibility needs the database")
+			return
+		}
+		var change struct {
+			Visibility string `json:"visibility"`
+		}
+		err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<10)).Decode(&change)
+		if err != nil || len(change.Visibility) == 0 {
+			writeError(w, r, http.StatusBadRequest, `Body must be {"visibility": "public" or "private"}`)
+			return
+		}
+		private, err := s.parseVisibility(change.Visibility)
+		if err != nil {
+			writeError(w, r, http.StatusBadRequest, err.Error())
+			return
+		}
+		found, err := s.metaIndex.setPrivate(rel, private)
+		if err != nil {
+			slog.ErrorContext(r.Context(), "fail to change the visibility", "path", rel, "err", err)
+			writeError(w, r, http.StatusInternalServerError, "")
+			return
+		}
+		if !found {
+			writeError(w, r, http.StatusBadRequest, "The file is not in the database, run file reindex")
+			return
+		}
+		record.Private = private
+		s.hotFiles.remove(rel)
+	}
+	writeJSON(w, http.StatusOK, resultOf(r, s.cfg, record))
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"golang.org/x/net/webdav"
+)
+
+const davPrefix = "/dav"
+
+// readOnlyFS serves the upload tree over WebDAV without letting clients
+// change it, so the year/month/day layout stays intact. Encrypted files
+// are served decrypted.
+type readOnlyFS struct {
+	cfg *config
+	dir webdav.Dir
+}
+
+// emptyRoot reports whether name is the root and it doesn't exist yet, a
+// user without uploads, whose share is empty rather than missing.
+func (fs readOnlyFS) emptyRoot(name string) bool {
+	if path.Clean("/"+name) != "/" {
+		return false
+	}
+	_, err := os.Stat(string(fs.dir))
+	return os.IsNotExist(err)
+}
+
+// realPath is the file of a name webdav.Dir accepted.
+func (fs readOnlyFS) realPath(name string) string {
+	return filepath.Join(string(fs.dir), filepath.FromSlash(path.Clean("/"+name)))
+}
+
+// hiddenName refuses dot files at any level, like storedRelPath.
+func hiddenName(name string) bool {
+	for _, segment := range strings.Split(name, "/") {
+		if strings.HasPrefix(segment, ".") {
+			return true
+		}
+	}
+	return false
+}
+func (fs readOnlyFS) Mkdir(ctx context.Context, name string, perm os.FileMode) error {
+	return os.ErrPermission
+}
+func (fs readOnlyFS) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	if flag&(os.O_WRONLY|os.O_RDWR|os.O_APPEND|os.O_CREATE|os.O_TRUNC) != 0 {
+		return nil, os.ErrPermission
+	}
+	if hiddenName(name) {
+		return nil, os.ErrNotExist
+	}
+	if fs.emptyRoot(name) {
+		return emptyDAVDir{}, nil
+	}
+	file, err := fs.dir.OpenFile(ctx, name, os.O_RDONLY, 0)
+	if err == nil {
+		info, err := file.Stat()
+		if err != nil || info.IsDir() {
+			return readOnlyFile{file, fs.cfg, fs.realPath(name)}, err
+		}
+		file.Close()
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+	// a missing name may be stored compressed
+	content, info, err := openStored(fs.cfg, fs.realPath(name))
+	if err != nil {
+		return nil, err
+	}
+	return storedDAVFile{content, info}, nil
+}
+func (fs readOnlyFS) RemoveAll(ctx context.Context, name string) error {
+	return os.ErrPermission
+}
+func (fs readOnlyFS) Rename(ctx context.Context, oldName, newName string) error {
+	return os.ErrPermission
+}
+func (fs readOnlyFS) Stat(ctx context.Context, name string) (os.FileInfo, error) {
+	if hiddenName(name) {
+		return nil, os.ErrNotExist
+	}
+	if fs.emptyRoot(name) {
+		return emptyDirInfo{}, nil
+	}
+	info, err := fs.dir.Stat(ctx, name)
+	if err == nil && !info.Mode().IsRegular() {
+		return info, nil
+	}
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	return statStored(fs.cfg, fs.realPath(name))
+}
+
+// readOnlyFile is a directory. Its listings leave dot files out and show
+// compressed files by their original name and size.
+type readOnlyFile struct {
+	webdav.File
+	cfg *config
+	dir string
+}
+
+func (f readOnlyFile) Readdir(count int) ([]os.FileInfo, error) {
+	infos, err := f.File.Readdir(count)
+	visible := infos[:0]
+	for _, info := range infos {
+		if strings.HasPrefix(info.Name(), ".") {
+			continue
+		}
+		if name, _ := storedName(info.Name()); name != info.Name() && info.Mode().IsRegular() {
+			plain, statErr := statStored(f.cfg, filepath.Join(f.dir, name))
+			if statErr != nil {
+				continue
+			}
+			info = plain
+		}
+		visible = append(visible, info)
+	}
+	return visible, err
+}
+func (f readOnlyFile) Write(p []byte) (int, error) {
+	return 0, os.ErrPermission
+}
+
+// storedDAVFile is a stored file opened for reading over WebDAV.
+type storedDAVFile struct {
+	storedContent
+	info os.FileInfo
+}
+
+func (f storedDAVFile) Readdir(count int) ([]os.FileInfo, error) {
+	return nil, os.ErrInvalid
+}
+func (f storedDAVFile) Stat() (os.FileInfo, error) {
+	return f.info, nil
+}
+func (f storedDAVFile) Write(p []byte) (int, error) {
+	return 0, os.ErrPermission
+}
+
+// emptyDAVDir is the root of a share without any files yet.
+type emptyDAVDir struct{}
+
+func (emptyDAVDir) Close() error {
+	return nil
+}
+func (emptyDAVDir) Read(p []byte) (int, error) {
+	return 0, os.ErrInvalid
+}
+func (emptyDAVDir) Seek(int64, int) (int64, error) {
+	return 0, os.ErrInvalid
+}
+func (emptyDAVDir) Readdir(int) ([]os.FileInfo, error) {
+	return nil, nil
+}
+func (emptyDAVDir) Stat() (os.FileInfo, error) {
+	return emptyDirInfo{}, nil
+}
+func (emptyDAVDir) Write(p []byte) (int, error) {
+	return 0, os.ErrPermission
+}
+
+type emptyDirInfo struct{}
+
+func (emptyDirInfo) Name() string {
+	return "/"
+}
+func (emptyDirInfo) Size() int64 {
+	return 0
+}
+func (emptyDirInfo) Mode() os.FileMode {
+	return os.ModeDir | 0o555
+}
+func (emptyDirInfo) ModTime() time.Time {
+	return time.Time{}
+}
+func (emptyDirInfo) IsDir() bool {
+	return true
+}
+func (emptyDirInfo) Sys() any {
+	return nil
+}
+
+// davMethods are the read-only WebDAV methods, anything that would change
+// the tree gets 403.
+var davMethods = map[string]bool{
+	http.MethodGet:     true,
+	http.MethodHead:    true,
+	http.MethodOptions: true,
+	"PROPFIND":         true,
+}
+
+// registerWebDAV serves the upload tree read-only at /dav/, below
+// route_prefix, when webdav_enabled is set.
+func (s *Server) registerWebDAV(r *mux.Router) {
+	cfg := s.cfg
+	if !cfg.WebDAVEnabled {
+		return
+	}
+	locks := webdav.NewMemLS()
+	prefix := cfg.route(davPrefix)
+	r.Handle(prefix, http.RedirectHandler(prefix+"/", http.StatusMovedPermanently))
+	r.PathPrefix(prefix + "/").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		err := s.basicAuth(r)
+		if err != nil {
+			s.writeAuthError(w, r, err)
+			return
+		}
+		if !davMethods[r.Method] {
+			writeError(w, r, http.StatusForbidden, "The WebDAV share is read-only")
+			return
+		}
+		// with namespace_per_user every user only sees their own tree, an
+		// empty one until the first upload
+		root := cfg.UploadDir
+		if namespace := requestNamespace(r, cfg); len(namespace) != 0 {
+			root = filepath.Join(root, namespace)
+		}
+		handler := &webdav.Handler{
+			Prefix:     prefix,
+			FileSystem: readOnlyFS{cfg, webdav.Dir(root)},
+			LockSystem: locks,
+			Logger: func(r *http.Request, err error) {
+				if err != nil && !errors.Is(err, os.ErrNotExist) {
+					slog.ErrorContext(r.Context(), "webdav request failed", "method", r.Method, "url_path", r.URL.Path, "err", err)
+				}
+			},
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestWebDAV(t *testing.T) {
+	cfg := testConfig(t, "webdav_enabled: true\nnamespace_per_user: true\nusers:\n  - username: alice\n    password: a\n  - username: bob\n    password: b\n")
+	routes := testServer(t, cfg).Routes()
+	dav := func(username, password, method, target, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		req.SetBasicAuth(username, password)
+		if method == "PROPFIND" {
+			req.Header.Set("Depth", "infinity")
+		}
+		res := httptest.NewRecorder()
+		routes.ServeHTTP(res, req)
+		return res
+	}
+	pasted := httptest.NewRequest(http.MethodPost, "/paste", strings.NewReader("alice's notes"))
+	pasted.SetBasicAuth("alice", "a")
+	res := httptest.NewRecorder()
+	routes.ServeHTTP(res, pasted)
+	rel := downloadPath(t, res)[len("/i/alice/"):]
+	os.MkdirAll(filepath.Join(cfg.UploadDir, "alice", ".trash"), 0o755)
+
+	listing := dav("alice", "a", "PROPFIND", "/dav/", "")
+	if listing.Code != http.StatusMultiStatus || !strings.Contains(listing.Body.String(), "/dav/"+rel) || strings.Contains(listing.Body.String(), ".trash") {
+		t.Errorf("alice's listing: status %d: %s", listing.Code, listing.Body)
+	}
+	if res := dav("alice", "a", http.MethodGet, "/dav/"+rel, ""); res.Code != http.StatusOK || res.Body.String() != "alice's notes" {
+		t.Errorf("alice's GET: status %d: %q", res.Code, res.Body)
+	}
+	for _, method := range []string{http.MethodPut, http.MethodDelete, "MKCOL", "MOVE"} {
+		if res := dav("alice", "a", method, "/dav/"+rel, "changed"); res.Code != http.StatusForbidden {
+			t.Errorf("%s: status %d", method, res.Code)
+		}
+	}
+	if res := dav("alice", "a", http.MethodGet, "/dav/"+rel, ""); res.Body.String() != "alice's notes" {
+		t.Errorf("the file changed to %q", res.Body)
+	}
+
+	// bob has no uploads, his share is empty and doesn't reach alice's
+	listing = dav("bob", "b", "PROPFIND", "/dav/", "")
+	if listing.Code != http.StatusMultiStatus || strings.Contains(listing.Body.String(), rel) {
+		t.Errorf("bob's listing: status %d: %s", listing.Code, listing.Body)
+	}
+	for _, target := range []string{"/dav/" + rel, "/dav/../alice/" + rel, "/dav/%2e%2e/alice/" + rel} {
+		if res := dav("bob", "b", http.MethodGet, target, ""); res.Code == http.StatusOK || strings.Contains(res.Body.String(), "alice's notes") {
+			t.Errorf("bob's GET %s: status %d", target, res.Code)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(cfg.UploadDir, "bob")); !os.IsNotExist(err) {
+		t.Errorf("bob's share created a directory: %v", err)
+	}
+	if res := dav("", "", "PROPFIND", "/dav/", ""); res.Code != http.StatusUnauthorized {
+		t.Errorf("anonymous PROPFIND: status %d", res.Code)
+	}
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"path"
+	"strings"
+)
+
+const (
+	defaultZipMaxFiles = 100
+	defaultZipMaxBytes = 1 << 30
+)
+
+type zipRequest struct {
+	Files  []string `json:"files"`
+	Strict bool     `json:"strict"`
+}
+
+// parseZipRequest accepts either ?files=a,b&strict=1 or a JSON body that is
+// a plain array of paths or {"files": [...], "strict": true}.
+func parseZipRequest(r *http.Request) (*zipRequest, error) {
+	query := r.URL.Query()
+	strict := query.Get("strict") == "1" || query.Get("strict") == "true"
+	var req zipRequest
+	if r.Method == http.MethodGet {
+		for _, file := range strings.Split(query.Get("files"), ",") {
+			if file = strings.TrimSpace(file); len(file) != 0 {
+				req.Files = append(req.Files, file)
+			}
+		}
+		req.Strict = strict
+		return &req, nil
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, 1<<20))
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(body, &req.Files); err != nil {
+		err = json.Unmarshal(body, &req)
+		if err != nil {
+			return nil, fmt.Errorf("body must be a JSON array of paths or {\"files\": [...]}")
+		}
+	}
+	req.Strict = req.Strict || strict
+	return &req, nil
+}
+
+// zipHandler streams a zip archive of several stored files straight to the
+// response, so nothing is buffered in memory or on disk.
+func (s *Server) zipHandler(w http.ResponseWriter, r *http.Request) {
+	err := s.basicAuth(r)
+	if err != nil {
+		s.writeAuthError(w, r, err)
+		return
+	}
+	req, err := parseZipRequest(r)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	if len(req.Files) == 0 {
+		writeError(w, r, http.StatusBadRequest, "No files requested")
+		return
+	}
+	maxFiles := s.cfg.ZipMaxFiles
+	if maxFiles <= 0 {
+		maxFiles = defaultZipMaxFiles
+	}
+	maxBytes := int64(s.cfg.ZipMaxBytes)
+	if maxBytes <= 0 {
+		maxBytes = defaultZipMaxBytes
+	}
+	if len(req.Files) > maxFiles {
+		writeError(w, r, http.StatusRequestEntityTooLarge, fmt.Sprintf("At most %d files per archive", maxFiles))
+		return
+	}
+	namespace := requestNamespace(r, s.cfg)
+	var found, missing []string
+	var total int64
+	for _, name := range req.Files {
+		filePath, ok := storedRelPath(s.cfg, name)
+		if !ok {
+			writeError(w, r, http.StatusBadRequest, fmt.Sprintf("Invalid path %q", name))
+			return
+		}
+		// other users' files look missing, not forbidden
+		info, err := statStored(s.cfg, filePath)
+		if err != nil || !inNamespace(s.cfg, namespace, name) {
+			if req.Strict {
+				writeError(w, r, http.StatusNotFound, name)
+				return
+			}
+			missing = append(missing, name)
+			continue
+		}
+		total += info.Size()
+		if total > maxBytes {
+			writeError(w, r, http.StatusRequestEntityTooLarge, fmt.Sprintf("At most %d bytes per archive", maxBytes))
+			return
+		}
+		found = append(found, name)
+	}
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", contentDisposition("attachment", "files.zip"))
+	w.WriteHeader(http.StatusOK)
+	zw := zip.NewWriter(w)
+	// MISSING.txt is kept for the manifest
+	used := map[string]bool{"MISSING.txt": true}
+	for _, name := range found {
+		err := s.addZipEntry(zw, name, s.zipEntryName(r, name, used))
+		if err != nil {
+			// the status line is already sent, so the best we can do is
+			// note the failure in the manifest
+			slog.ErrorContext(r.Context(), "fail to add to zip", "path", name, "err", err)
+			missing = append(missing, name)
+		}
+	}
+	if len(missing) != 0 {
+		entry, err := zw.Create("MISSING.txt")
+		if err == nil {
+			io.WriteString(entry, strings.Join(missing, "\n")+"\n")
+		}
+	}
+	err = zw.Close()
+	if err != nil {
+		slog.ErrorContext(r.Context(), "fail to finish zip", "err", err)
+	}
+}
+
+// zipEntryName names the entry of rel by its original filename when the
+// index has one, else by its path. A name already in used gets a " (2)",
+// " (3)"... before its extension.
+func (s *Server) zipEntryName(r *http.Request, rel string, used map[string]bool) string {
+	name := rel
+	if s.metaIndex != nil {
+		record, found, err := s.metaIndex.lookupPath(rel)
+		if err != nil {
+			slog.WarnContext(r.Context(), "fail to look up the original name", "path", rel, "err", err)
+		}
+		if found && len(record.OriginalName) != 0 {
+			name = sanitizeFilename(record.OriginalName)
+		}
+	}
+	ext := path.Ext(name)
+	base := strings.TrimSuffix(name, ext)
+	for i := 2; used[name]; i++ {
+		name = fmt.Sprintf("%s (%d)%s", base, i, ext)
+	}
+	used[name] = true
+	return name
+}
+
+// addZipEntry stores the file of rel as entry name.
+func (s *Server) addZipEntry(zw *zip.Writer, rel, name string) error {
+	cfg := s.cfg
+	filePath, _ := storedRelPath(cfg, rel)
+	file, info, err := openStored(cfg, filePath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	header, err := zip.FileInfoHeader(info)
+	if err != nil {
+		return err
+	}
+	header.Name = name
+	// uploads are mostly already-compressed media, storing is cheaper
+	header.Method = zip.Store
+	entry, err := zw.CreateHeader(header)
+	if err != nil {
+		return err
+	}
+	_, err = s.copyBuffers.copy(entry, file)
+	return err
+}
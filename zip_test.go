@@ -0,0 +1,48 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestZipOriginalNames(t *testing.T) {
+	cfg := testConfig(t, "database: "+filepath.Join(t.TempDir(), "files.db")+"\n")
+	routes := testServer(t, cfg).Routes()
+	var files []string
+	for _, content := range []string{"one", "two"} {
+		files = append(files, strings.TrimPrefix(downloadPath(t, testUpload(t, routes, "photo.jpg", content, nil)), "/i/"))
+	}
+	files = append(files, strings.TrimPrefix(downloadPath(t, testUpload(t, routes, "MISSING.txt", "three", nil)), "/i/"))
+	req := httptest.NewRequest(http.MethodGet, "/api/zip?files="+strings.Join(files, ",")+",2026/01/01/gone.txt", nil)
+	req.SetBasicAuth("u", "p")
+	res := httptest.NewRecorder()
+	routes.ServeHTTP(res, req)
+	if res.Code != http.StatusOK {
+		t.Fatalf("zip status %d: %s", res.Code, res.Body)
+	}
+	archive, err := zip.NewReader(bytes.NewReader(res.Body.Bytes()), int64(res.Body.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names, contents []string
+	for _, entry := range archive.File {
+		names = append(names, entry.Name)
+		content, _ := entry.Open()
+		data, _ := io.ReadAll(content)
+		contents = append(contents, string(data))
+	}
+	want := []string{"photo.jpg", "photo (2).jpg", "MISSING (2).txt", "MISSING.txt"}
+	if !slices.Equal(names, want) {
+		t.Errorf("entries %q, want %q", names, want)
+	}
+	if len(contents) == 4 && (contents[0] != "one" || contents[1] != "two" || contents[3] != "2026/01/01/gone.txt\n") {
+		t.Errorf("contents %q", contents)
+	}
+}